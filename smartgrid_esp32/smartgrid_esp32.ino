@@ -2,6 +2,10 @@
 #include <WiFiManager.h>
 #include <ArduinoWebsockets.h>
 #include <ArduinoJson.h>
+#include <Preferences.h>
+#include <HTTPClient.h>
+#include <Update.h>
+#include <mbedtls/sha256.h>
 
 using namespace websockets;
 
@@ -9,6 +13,23 @@ using namespace websockets;
 constexpr char WS_SERVER[] = "ws://smartgrid-app.xyz:8080/ws"; 
 WebsocketsClient client;
 
+// Firmware Identity
+// Reported in the hello so the server knows which images fit this panel;
+// bump FIRMWARE_VERSION with every release uploaded to the server.
+constexpr char HARDWARE_MODEL[] = "esp32";
+constexpr char FIRMWARE_VERSION[] = "1.0.0";
+
+// OTA updates report progress at least this often so the server keeps the socket
+constexpr unsigned long OTA_PROGRESS_INTERVAL = 2000;
+constexpr unsigned long OTA_READ_TIMEOUT = 15000;
+
+// Device Credential
+// The server hands out a token the first time the device redeems a claim code;
+// both live in NVS so they survive a reboot.
+Preferences prefs;
+String deviceToken;
+String claimCode;
+
 // Frequency Sensing Pin Definitions
 constexpr int SIGNAL_IN_PIN = 12;
 
@@ -25,20 +46,36 @@ const int enPinX = 19;
 const uint8_t limitPinY = 27;
 const uint8_t limitPinX = 26;
 
-// Frequency & LED Control
-constexpr float LOWER_FREQ_BOUND = 59.0f;
-constexpr float UPPER_FREQ_BOUND = 61.0f;
-constexpr unsigned long BLINK_INTERVAL = 100;
+// Device Settings
+// The server pushes these with setConfig. They live in NVS with their version,
+// which the hello reports; the defaults match the server's.
+struct DeviceSettings {
+    int telemetryIntervalS = 60;
+    int samplingIntervalMs = 2000;
+    unsigned long minEdgeUs = 100;
+    unsigned long maxEdgeUs = 500000;
+    int blinkIntervalMs = 100;
+    float lowHz = 59.0f;
+    float highHz = 61.0f;
+    int flashCount = 3;
+};
+DeviceSettings settings;
+int configVersion = -1; // -1 until the server has sent settings
+
+// Status LED, blinked while the frequency is out of range
+constexpr int LED_PIN = 2;
 
 // Timing Variables
 unsigned long lastReconnectAttempt = 0;
 volatile unsigned long lastEdgeTime = 0;
 volatile float measuredFrequency = 0.0f;
-int FreqqyPacketFlag;
+unsigned long lastTelemetryTime = 0;
 
 // LED Blinking State
 bool freqBreakerState = true;
 unsigned long lastPrintTime = 0;
+unsigned long lastBlinkTime = 0;
+bool ledOn = false;
 
 // ** ADJUST THESE AS NEEDED **
 const bool HOME_DIR_Y = LOW; // e.g., LOW moves towards Y limit
@@ -56,6 +93,7 @@ volatile bool limitY_hit = false;
 volatile bool limitX_hit = false;
 
 WiFiManager wifiManager;
+WiFiManagerParameter claimCodeParam("claim_code", "Claim code", "", 10);
 
 // Interrupt Service Routines (ISRs) for Motor Control 
 void IRAM_ATTR isrY() {
@@ -72,7 +110,7 @@ void IRAM_ATTR onEdge() {
     unsigned long currentEdgeTime = micros();
     unsigned long interval = currentEdgeTime - lastEdgeTime;
 
-    if (interval > 100 && interval < 500000) { 
+    if (interval > settings.minEdgeUs && interval < settings.maxEdgeUs) { 
         lastEdgeTime = currentEdgeTime;
         measuredFrequency = 1'000'000.0f / interval;
     } else {
@@ -345,15 +383,20 @@ void flipSwitch(int switchnumb, char onoff ){
   }
 
 // Function to Send WebSocket Message
-void sendWebSocketMessage(const char* command, int breakerId = -1, bool breakerState = -1) {
-    StaticJsonDocument<128> doc;
+// Replies to a server command pass its requestId and a status of "ok" or
+// "error" so the server can match the reply to the command
+void sendWebSocketMessage(const char* command, const char* requestId = nullptr, int breakerId = -1, int breakerState = -1, const char* status = nullptr, const char* error = nullptr) {
+    StaticJsonDocument<256> doc;
     doc["command"] = command;
     doc["mac_addr"] = WiFi.macAddress();
 
+    if (requestId != nullptr) doc["requestId"] = requestId;
+    if (status != nullptr) doc["status"] = status;
+    if (error != nullptr) doc["error"] = error;
     if (breakerId != -1) doc["breakerId"] = breakerId;
-    if (breakerState != -1) doc["breakerState"] = breakerState;
+    if (breakerState != -1) doc["breakerState"] = (bool)breakerState;
 
-    char messageBuffer[128];
+    char messageBuffer[256];
     serializeJson(doc, messageBuffer);
 
     Serial.print("Sending Back: ");
@@ -362,26 +405,270 @@ void sendWebSocketMessage(const char* command, int breakerId = -1, bool breakerS
     client.send(messageBuffer);
 }
 
+// Store the device token, dropping the claim code it replaces
+void saveDeviceToken(const char* token) {
+    deviceToken = token;
+    prefs.putString("token", deviceToken);
+    if (claimCode.length() > 0) {
+        claimCode = "";
+        prefs.remove("claim_code");
+    }
+    Serial.println("Device token saved.");
+}
+
+// Store a claim code entered in the configuration portal
+void saveClaimCode() {
+    String code = claimCodeParam.getValue();
+    code.trim();
+    if (code.length() > 0) {
+        claimCode = code;
+        prefs.putString("claim_code", claimCode);
+        Serial.println("Claim code saved.");
+    }
+}
+
+// Send the hello frame that identifies the device to the server
+void sendHello() {
+    StaticJsonDocument<256> doc;
+    doc["mac_addr"] = WiFi.macAddress();
+    if (deviceToken.length() > 0) doc["token"] = deviceToken;
+    else if (claimCode.length() > 0) doc["claim_code"] = claimCode;
+    doc["model"] = HARDWARE_MODEL;
+    doc["firmware"] = FIRMWARE_VERSION;
+    if (configVersion >= 0) doc["config_version"] = configVersion;
+
+    char messageBuffer[256];
+    serializeJson(doc, messageBuffer);
+    client.send(messageBuffer);
+}
+
 // Function to Send Frequency Data to Server
 void sendFrequencyUpdate() {
-    if (millis() - lastPrintTime >= 2000) { // Every 2 seconds
+    if (millis() - lastPrintTime >= (unsigned long)settings.samplingIntervalMs) {
         lastPrintTime = millis();
-        
-        if (FreqqyPacketFlag == 30){
-            FreqqyPacketFlag = 0;
-            StaticJsonDocument<128> doc;
-            doc["mac_addr"] = WiFi.macAddress();
-            doc["command"] = "frequencyUpdate";
-            doc["frequency"] = measuredFrequency;
-
-            char messageBuffer[128];
-            serializeJson(doc, messageBuffer);
-            client.send(messageBuffer);
+        Serial.printf("Measured Frequency: %.3f Hz\n", measuredFrequency);
+    }
+
+    if (millis() - lastTelemetryTime >= (unsigned long)settings.telemetryIntervalS * 1000) {
+        lastTelemetryTime = millis();
+        StaticJsonDocument<128> doc;
+        doc["mac_addr"] = WiFi.macAddress();
+        doc["command"] = "frequencyUpdate";
+        doc["frequency"] = measuredFrequency;
+
+        char messageBuffer[128];
+        serializeJson(doc, messageBuffer);
+        client.send(messageBuffer);
+    }
+}
+
+// Blink the LED settings.flashCount times
+void flashLED(int count) {
+    for (int i = 0; i < count; i++) {
+        digitalWrite(LED_PIN, HIGH);
+        delay(200);
+        digitalWrite(LED_PIN, LOW);
+        delay(200);
+    }
+    ledOn = false;
+}
+
+// Blink the LED while the frequency is outside settings.lowHz..highHz
+void updateStatusLED() {
+    if (measuredFrequency >= settings.lowHz && measuredFrequency <= settings.highHz) {
+        if (ledOn) {
+            ledOn = false;
+            digitalWrite(LED_PIN, LOW);
         }
+        return;
+    }
+    if (millis() - lastBlinkTime >= (unsigned long)settings.blinkIntervalMs) {
+        lastBlinkTime = millis();
+        ledOn = !ledOn;
+        digitalWrite(LED_PIN, ledOn ? HIGH : LOW);
+    }
+}
 
-        FreqqyPacketFlag++;
-        Serial.printf("Sent Frequency: %.3f Hz\n", measuredFrequency);
+// Read a setConfig document into out, keeping the current value of any field
+// left out. Returns nullptr if the settings can be run, or why not.
+const char* parseSettings(JsonObjectConst config, DeviceSettings& out) {
+    out = settings;
+    out.telemetryIntervalS = config["telemetry"]["interval_s"] | out.telemetryIntervalS;
+    out.samplingIntervalMs = config["sampling"]["interval_ms"] | out.samplingIntervalMs;
+    out.minEdgeUs = config["sampling"]["min_edge_us"] | out.minEdgeUs;
+    out.maxEdgeUs = config["sampling"]["max_edge_us"] | out.maxEdgeUs;
+    out.blinkIntervalMs = config["led"]["blink_interval_ms"] | out.blinkIntervalMs;
+    out.lowHz = config["led"]["low_hz"] | out.lowHz;
+    out.highHz = config["led"]["high_hz"] | out.highHz;
+    out.flashCount = config["led"]["flash_count"] | out.flashCount;
+
+    if (out.telemetryIntervalS < 1 || out.samplingIntervalMs < 100) return "intervals too short";
+    if (out.minEdgeUs < 1 || out.maxEdgeUs <= out.minEdgeUs) return "bad edge bounds";
+    if (out.blinkIntervalMs < 10 || out.lowHz <= 0 || out.highHz <= out.lowHz) return "bad led settings";
+    if (out.flashCount < 0 || out.flashCount > 20) return "bad flash count";
+    return nullptr;
+}
+
+// Load the settings the server last sent, if any
+void loadSettings() {
+    configVersion = prefs.getInt("config_version", -1);
+    String saved = prefs.getString("config", "");
+    if (configVersion < 0 || saved.length() == 0) return;
+
+    StaticJsonDocument<512> doc;
+    DeviceSettings loaded;
+    if (deserializeJson(doc, saved) || parseSettings(doc.as<JsonObjectConst>(), loaded) != nullptr) {
+        Serial.println("Saved settings are invalid, using defaults.");
+        configVersion = -1;
+        return;
     }
+    settings = loaded;
+}
+
+// Answer setConfig with the version it carried
+void sendConfigResult(const char* requestId, int version, const char* error) {
+    StaticJsonDocument<256> doc;
+    doc["command"] = "setConfig";
+    if (requestId != nullptr) doc["requestId"] = requestId;
+    doc["configVersion"] = version;
+    doc["status"] = error == nullptr ? "ok" : "error";
+    if (error != nullptr) doc["error"] = error;
+
+    char messageBuffer[256];
+    serializeJson(doc, messageBuffer);
+    client.send(messageBuffer);
+}
+
+// Apply and store the settings in a setConfig command
+void handleSetConfig(JsonDocument& doc, const char* requestId) {
+    int version = doc["configVersion"] | -1;
+    JsonObjectConst config = doc["config"].as<JsonObjectConst>();
+    if (version < 0 || config.isNull()) {
+        sendWebSocketMessage("setConfig", requestId, -1, -1, "error", "missing config or configVersion");
+        return;
+    }
+
+    DeviceSettings next;
+    const char* failure = parseSettings(config, next);
+    if (failure != nullptr) {
+        sendConfigResult(requestId, version, failure);
+        return;
+    }
+    settings = next;
+    configVersion = version;
+
+    String saved;
+    serializeJson(config, saved);
+    prefs.putString("config", saved);
+    prefs.putInt("config_version", configVersion);
+    Serial.printf("Applied settings version %d\n", configVersion);
+    sendConfigResult(requestId, version, nullptr);
+}
+
+// Report how far an OTA download has got, as a percentage
+void sendOTAProgress(const char* requestId, int progress) {
+    StaticJsonDocument<128> doc;
+    doc["command"] = "otaProgress";
+    doc["requestId"] = requestId;
+    doc["progress"] = progress;
+
+    char messageBuffer[128];
+    serializeJson(doc, messageBuffer);
+    client.send(messageBuffer);
+}
+
+// Download the image at url, check it against sha256 and write it to the
+// spare OTA partition. Returns nullptr on success or why it failed.
+const char* downloadFirmware(const char* url, const char* sha256, long size, const char* requestId) {
+    if (url == nullptr || sha256 == nullptr || size <= 0) return "missing url, sha256 or size";
+
+    HTTPClient http;
+    http.begin(url);
+    int code = http.GET();
+    if (code != HTTP_CODE_OK) {
+        http.end();
+        return "download failed";
+    }
+    if (http.getSize() != size) {
+        http.end();
+        return "size mismatch";
+    }
+    if (!Update.begin(size)) {
+        http.end();
+        return "not enough space";
+    }
+
+    mbedtls_sha256_context sha;
+    mbedtls_sha256_init(&sha);
+    mbedtls_sha256_starts(&sha, 0);
+
+    WiFiClient* stream = http.getStreamPtr();
+    uint8_t buffer[1024];
+    long written = 0;
+    unsigned long lastData = millis();
+    unsigned long lastProgress = 0;
+    const char* failure = nullptr;
+    while (written < size) {
+        size_t available = stream->available();
+        if (available == 0) {
+            if (millis() - lastData > OTA_READ_TIMEOUT) {
+                failure = "download timed out";
+                break;
+            }
+            delay(1);
+            continue;
+        }
+        int n = stream->readBytes(buffer, min(available, sizeof(buffer)));
+        mbedtls_sha256_update(&sha, buffer, n);
+        if (Update.write(buffer, n) != (size_t)n) {
+            failure = "flash write failed";
+            break;
+        }
+        written += n;
+        lastData = millis();
+        if (millis() - lastProgress >= OTA_PROGRESS_INTERVAL) {
+            lastProgress = millis();
+            sendOTAProgress(requestId, (int)(written * 100 / size));
+        }
+    }
+    http.end();
+
+    uint8_t digest[32];
+    mbedtls_sha256_finish(&sha, digest);
+    mbedtls_sha256_free(&sha);
+    if (failure == nullptr) {
+        char hex[65];
+        for (int i = 0; i < 32; i++) sprintf(hex + i * 2, "%02x", digest[i]);
+        if (strcasecmp(hex, sha256) != 0) failure = "checksum mismatch";
+    }
+    if (failure != nullptr) {
+        Update.abort();
+        return failure;
+    }
+    if (!Update.end(true)) return "could not finish update";
+    return nullptr;
+}
+
+// Install the image named in an otaUpdate command and reboot into it. The
+// server sees the new version in the next hello.
+void handleOTAUpdate(JsonDocument& doc, const char* requestId) {
+    Serial.print("Updating firmware to ");
+    Serial.println((const char*)(doc["version"] | "?"));
+
+    sendOTAProgress(requestId, 0);
+    const char* failure = downloadFirmware(doc["url"], doc["sha256"], doc["size"] | 0L, requestId);
+    if (failure != nullptr) {
+        Serial.print("Firmware update failed: ");
+        Serial.println(failure);
+        sendWebSocketMessage("otaUpdate", requestId, -1, -1, "error", failure);
+        return;
+    }
+
+    sendWebSocketMessage("otaUpdate", requestId, -1, -1, "ok");
+    Serial.println("Firmware written, rebooting...");
+    client.close();
+    delay(500);
+    ESP.restart();
 }
 
 // Handle LED Blinking Based on Frequency
@@ -389,12 +676,12 @@ void handleLEDBlinking() {
     if (measuredFrequency < 50 || measuredFrequency > 500 || measuredFrequency == 0.0f) {
         if (freqBreakerState) {
             flipSwitch(1, 'F');
-            sendWebSocketMessage("toggleBreaker", 1, false);
+            sendWebSocketMessage("toggleBreaker", nullptr, 1, false);
             freqBreakerState = !freqBreakerState;
             Serial.println("Frequency out of range, turning off breaker.");
         } else if (!freqBreakerState) {
             flipSwitch(1, 'N'); // Turn on the breaker
-            sendWebSocketMessage("toggleBreaker", 1, true);
+            sendWebSocketMessage("toggleBreaker", nullptr, 1, true);
             freqBreakerState = !freqBreakerState;
             Serial.println("Frequency out of range, turning on breaker.");
         }
@@ -406,32 +693,52 @@ void onMessageCallback(WebsocketsMessage message) {
     Serial.print("Received: ");
     Serial.println(message.data());
 
-    StaticJsonDocument<128> doc;
+    // otaUpdate carries a signed download link, the largest frame the server sends
+    StaticJsonDocument<1024> doc;
     if (deserializeJson(doc, message.data())) {
         Serial.println("JSON Parse Error!");
         return;
     }
 
     const char* command = doc["command"];
+    const char* requestId = doc["requestId"];
     int breakerId = doc["breakerId"] | -1;
     bool breakerState = doc["breakerState"] | false;
     char switchParam;
 
-    if (strcmp(command, "pingDevice") == 0) {
-        sendWebSocketMessage("ACK");
+    if (command == nullptr) {
+        Serial.println("Missing Command.");
+    }
+    else if (strcmp(command, "provisioned") == 0 || strcmp(command, "setCredential") == 0) {
+        const char* token = doc["token"];
+        if (token != nullptr) saveDeviceToken(token);
+    }
+    else if (strcmp(command, "pingDevice") == 0) {
+        sendWebSocketMessage("ACK", requestId, -1, -1, "ok");
     } 
     else if (strcmp(command, "flashLED") == 0) {
-        flashLED(3);
-        sendWebSocketMessage("ACK");
+        flashLED(settings.flashCount);
+        sendWebSocketMessage("ACK", requestId, -1, -1, "ok");
     } 
-    else if (strcmp(command, "toggleBreaker") == 0 && breakerId != -1) {
-        if (breakerState == false) switchParam = 'F';
-        else if (breakerState == true) switchParam = 'N';
+    else if (strcmp(command, "toggleBreaker") == 0) {
+        if (breakerId == -1) {
+            sendWebSocketMessage(command, requestId, -1, -1, "error", "missing breakerId");
+            return;
+        }
+        switchParam = breakerState ? 'N' : 'F';
         flipSwitch(breakerId, switchParam);
-        sendWebSocketMessage(command, breakerId, !breakerState);
+        // Report the state the breaker was switched to
+        sendWebSocketMessage(command, requestId, breakerId, breakerState, "ok");
     } 
+    else if (strcmp(command, "otaUpdate") == 0) {
+        handleOTAUpdate(doc, requestId);
+    }
+    else if (strcmp(command, "setConfig") == 0) {
+        handleSetConfig(doc, requestId);
+    }
     else {
         Serial.println("Unknown Command Received.");
+        if (requestId != nullptr) sendWebSocketMessage(command, requestId, -1, -1, "error", "unknown command");
     }
 }
 
@@ -440,7 +747,7 @@ void connectWebSocket() {
     Serial.println("Connecting to WebSocket...");
     if (client.connect(WS_SERVER)) {
         Serial.println("Connected to WebSocket server");
-        client.send(WiFi.macAddress());
+        sendHello();
     } else {
         Serial.println("WebSocket connection failed!");
     }
@@ -475,6 +782,7 @@ void setup() {
     digitalWrite(enPinX, LOW);
 
     pinMode(SIGNAL_IN_PIN, INPUT_PULLDOWN);
+    pinMode(LED_PIN, OUTPUT);
 
     Serial.println("Attaching interrupts...");
     attachInterrupt(digitalPinToInterrupt(limitPinY), isrY, RISING);
@@ -483,10 +791,26 @@ void setup() {
     attachInterrupt(digitalPinToInterrupt(SIGNAL_IN_PIN), onEdge, RISING);
     Serial.println("Setup complete. Ready to detect frequency...");
 
+    // Load the device credential, or the claim code used to obtain one
+    prefs.begin("smartgrid", false);
+    deviceToken = prefs.getString("token", "");
+    claimCode = prefs.getString("claim_code", "");
+    loadSettings();
+
     // Uncomment this to reset saved Wi-Fi credentials
     // wifiManager.resetSettings(); 
 
-    if (!wifiManager.autoConnect("ESP32-Config", "password")) {
+    wifiManager.addParameter(&claimCodeParam);
+    wifiManager.setSaveParamsCallback(saveClaimCode);
+
+    // An unclaimed device opens the portal so a claim code can be entered
+    bool connected;
+    if (deviceToken.length() == 0 && claimCode.length() == 0) {
+        connected = wifiManager.startConfigPortal("ESP32-Config", "password");
+    } else {
+        connected = wifiManager.autoConnect("ESP32-Config", "password");
+    }
+    if (!connected) {
         Serial.println("Wi-Fi connection failed. Restarting...");
         ESP.restart();
     }
@@ -527,5 +851,6 @@ void setup() {
 void loop() {
     handleWebSocket();
     handleLEDBlinking();
+    updateStatusLED();
     sendFrequencyUpdate();
 }
\ No newline at end of file
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxAlertList caps fetchAlerts
+const maxAlertList = 500
+
+// alertRuleCacheTTL bounds how long a device's rules are reused before they
+// are read again, covering changes the engine is not told about
+const alertRuleCacheTTL = time.Minute
+
+// EventAlert is pushed to app clients when an alert opens or resolves
+const EventAlert = "alert"
+
+var alertRuleKinds = map[string]bool{
+	RuleFrequencyBelow: true,
+	RuleFrequencyAbove: true,
+	RuleDeviceOffline:  true,
+	RuleBreakerChanged: true,
+}
+
+type alertKey struct {
+	ruleID   int
+	deviceID int
+}
+
+// alertEngine holds the in-flight state of duration-based rules: when a
+// frequency condition started holding, and the timers waiting out offline ones.
+// It also caches each device's rules and whether each rule has an active alert
+// on it, so telemetry frames do not have to query for them.
+type alertEngine struct {
+	mu      sync.Mutex
+	pending map[alertKey]time.Time
+	offline map[alertKey]*time.Timer
+	rules   map[int]cachedAlertRules
+	active  map[alertKey]bool
+}
+
+// cachedAlertRules is one device's enabled rules as of loadedAt
+type cachedAlertRules struct {
+	rules    []AlertRule
+	loadedAt time.Time
+}
+
+func newAlertEngine() *alertEngine {
+	return &alertEngine{
+		pending: make(map[alertKey]time.Time),
+		offline: make(map[alertKey]*time.Timer),
+		rules:   make(map[int]cachedAlertRules),
+		active:  make(map[alertKey]bool),
+	}
+}
+
+// deviceAlertRules returns the enabled rules that apply to device, from the
+// cache while it is fresh
+func (s *Server) deviceAlertRules(device Device) ([]AlertRule, error) {
+	e := s.alerts
+	e.mu.Lock()
+	cached, ok := e.rules[device.ID]
+	e.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < alertRuleCacheTTL {
+		return cached.rules, nil
+	}
+
+	rules, err := s.store.ListDeviceAlertRules(device)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.rules[device.ID] = cachedAlertRules{rules: rules, loadedAt: time.Now()}
+	e.mu.Unlock()
+	return rules, nil
+}
+
+// forgetDeviceAlertRules drops the cached rules of a device whose members changed
+func (s *Server) forgetDeviceAlertRules(deviceID int) {
+	s.alerts.mu.Lock()
+	delete(s.alerts.rules, deviceID)
+	s.alerts.mu.Unlock()
+}
+
+// alertActive reports whether rule has an open or acknowledged alert on
+// device, asking the store only the first time
+func (s *Server) alertActive(key alertKey) (bool, error) {
+	e := s.alerts
+	e.mu.Lock()
+	active, known := e.active[key]
+	e.mu.Unlock()
+	if known {
+		return active, nil
+	}
+
+	_, err := s.store.ActiveAlert(key.ruleID, key.deviceID)
+	if errors.Is(err, ErrNotFound) {
+		active = false
+	} else if err != nil {
+		return false, err
+	} else {
+		active = true
+	}
+	s.setAlertActive(key, active)
+	return active, nil
+}
+
+// setAlertActive records that rule's alert on device was opened or resolved
+func (s *Server) setAlertActive(key alertKey, active bool) {
+	s.alerts.mu.Lock()
+	s.alerts.active[key] = active
+	s.alerts.mu.Unlock()
+}
+
+// frequencyBreached reports whether a reading violates a frequency rule
+func frequencyBreached(rule AlertRule, frequency float64) bool {
+	if rule.Threshold == nil {
+		return false
+	}
+	switch rule.Kind {
+	case RuleFrequencyBelow:
+		return frequency < *rule.Threshold
+	case RuleFrequencyAbove:
+		return frequency > *rule.Threshold
+	}
+	return false
+}
+
+// evaluateFrequencyRules checks a reading against the device's frequency
+// rules, opening alerts once a breach has lasted the rule's duration and
+// resolving them when the reading is back within bounds
+func (s *Server) evaluateFrequencyRules(device Device, entry FrequencyLog) {
+	rules, err := s.deviceAlertRules(device)
+	if err != nil {
+		log.Println("Failed to load alert rules:", err)
+		return
+	}
+
+	e := s.alerts
+	for _, rule := range rules {
+		if rule.Kind != RuleFrequencyBelow && rule.Kind != RuleFrequencyAbove {
+			continue
+		}
+		key := alertKey{rule.ID, device.ID}
+
+		if !frequencyBreached(rule, entry.Frequency) {
+			e.mu.Lock()
+			delete(e.pending, key)
+			e.mu.Unlock()
+			s.clearAlert(rule, device, entry.Timestamp)
+			continue
+		}
+
+		e.mu.Lock()
+		since, ok := e.pending[key]
+		if !ok {
+			since = entry.Timestamp
+			e.pending[key] = since
+		}
+		e.mu.Unlock()
+
+		if entry.Timestamp.Sub(since) >= rule.Duration() {
+			direction := "below"
+			if rule.Kind == RuleFrequencyAbove {
+				direction = "above"
+			}
+			value := entry.Frequency
+			msg := fmt.Sprintf("%s: frequency %.3f Hz %s %.3f Hz", rule.Name, value, direction, *rule.Threshold)
+			s.openAlert(rule, device, msg, &value, entry.Timestamp)
+		}
+	}
+}
+
+// evaluateBreakerRules records an alert for a breaker that has changed state.
+// Each change is its own alert, resolved as it is raised, since there is no
+// later condition that would clear it.
+func (s *Server) evaluateBreakerRules(device Device, breaker Breaker) {
+	rules, err := s.deviceAlertRules(device)
+	if err != nil {
+		log.Println("Failed to load alert rules:", err)
+		return
+	}
+
+	state := "off"
+	if breaker.Status {
+		state = "on"
+	}
+	for _, rule := range rules {
+		if rule.Kind != RuleBreakerChanged || (rule.BreakerID != nil && *rule.BreakerID != breaker.ID) {
+			continue
+		}
+		now := time.Now()
+		alert := Alert{
+			RuleID: rule.ID, UserID: rule.UserID, DeviceID: device.ID, Status: AlertResolved,
+			Message: fmt.Sprintf("%s: breaker %s switched %s", rule.Name, breaker.Name, state), OpenedAt: now, ResolvedAt: &now,
+		}
+		if err := s.store.CreateAlert(&alert); err != nil {
+			log.Println("Failed to record alert:", err)
+			continue
+		}
+		s.publishTo([]int{rule.UserID}, EventAlert, device, alert)
+	}
+}
+
+// deviceOffline drops a disconnected device's pending frequency breaches and
+// starts its offline rules' timers; since is when it was last heard from
+func (s *Server) deviceOffline(device Device, since time.Time) {
+	s.alerts.mu.Lock()
+	for key := range s.alerts.pending {
+		if key.deviceID == device.ID {
+			delete(s.alerts.pending, key)
+		}
+	}
+	s.alerts.mu.Unlock()
+
+	rules, err := s.deviceAlertRules(device)
+	if err != nil {
+		log.Println("Failed to load alert rules:", err)
+		return
+	}
+	for _, rule := range rules {
+		if rule.Kind == RuleDeviceOffline {
+			s.armOfflineAlert(rule, device, since)
+		}
+	}
+}
+
+// armOfflineAlert fires rule for device once it has been offline for the
+// rule's duration, unless it reconnects or the rule changes first
+func (s *Server) armOfflineAlert(rule AlertRule, device Device, since time.Time) {
+	key := alertKey{rule.ID, device.ID}
+	fire := func() {
+		s.alerts.mu.Lock()
+		delete(s.alerts.offline, key)
+		s.alerts.mu.Unlock()
+
+		current, err := s.store.GetAlertRule(rule.ID)
+		if err != nil || !current.Enabled || current.Kind != RuleDeviceOffline {
+			return
+		}
+		if _, online := s.hub.Get(device.ID); online {
+			return
+		}
+		// The rule's owner may have lost access to the device meanwhile
+		if _, err := s.deviceRole(current.UserID, device.ID); err != nil {
+			return
+		}
+		msg := fmt.Sprintf("%s: device %s offline since %s", current.Name, device.Name, since.UTC().Format(time.RFC3339))
+		s.openAlert(current, device, msg, nil, time.Now())
+	}
+
+	s.alerts.mu.Lock()
+	defer s.alerts.mu.Unlock()
+	if timer := s.alerts.offline[key]; timer != nil {
+		timer.Stop()
+	}
+	s.alerts.offline[key] = time.AfterFunc(time.Until(since.Add(rule.Duration())), fire)
+}
+
+// armOfflineRule arms a device_offline rule for every device it covers that
+// is not connected, e.g. at startup or when the rule is created
+func (s *Server) armOfflineRule(rule AlertRule, since time.Time) {
+	var devices []Device
+	if rule.DeviceID != nil {
+		device, err := s.store.GetDevice(*rule.DeviceID)
+		if err != nil {
+			log.Println("Failed to load device for alert rule:", err)
+			return
+		}
+		devices = []Device{device}
+	} else {
+		var err error
+		if devices, err = s.accessibleDevices(rule.UserID); err != nil {
+			log.Println("Failed to load devices for alert rule:", err)
+			return
+		}
+	}
+
+	for _, device := range devices {
+		if _, online := s.hub.Get(device.ID); !online {
+			s.armOfflineAlert(rule, device, since)
+		}
+	}
+}
+
+// armOfflineRules arms every offline rule; nothing is connected at startup
+func (s *Server) armOfflineRules() {
+	rules, err := s.store.ListAlertRulesByKind(RuleDeviceOffline)
+	if err != nil {
+		log.Println("Failed to load offline alert rules:", err)
+		return
+	}
+	now := time.Now()
+	for _, rule := range rules {
+		s.armOfflineRule(rule, now)
+	}
+}
+
+// deviceOnline stops a reconnected device's offline timers and resolves any
+// offline alerts it had raised
+func (s *Server) deviceOnline(device Device) {
+	s.alerts.mu.Lock()
+	for key, timer := range s.alerts.offline {
+		if key.deviceID == device.ID {
+			timer.Stop()
+			delete(s.alerts.offline, key)
+		}
+	}
+	s.alerts.mu.Unlock()
+
+	rules, err := s.deviceAlertRules(device)
+	if err != nil {
+		log.Println("Failed to load alert rules:", err)
+		return
+	}
+	for _, rule := range rules {
+		if rule.Kind == RuleDeviceOffline {
+			s.clearAlert(rule, device, time.Now())
+		}
+	}
+}
+
+// forgetAlertRule drops the engine's state for a rule that was created,
+// changed or went away, including every device's cached rules
+func (s *Server) forgetAlertRule(ruleID int) {
+	s.alerts.mu.Lock()
+	defer s.alerts.mu.Unlock()
+
+	clear(s.alerts.rules)
+	for key := range s.alerts.active {
+		if key.ruleID == ruleID {
+			delete(s.alerts.active, key)
+		}
+	}
+	for key := range s.alerts.pending {
+		if key.ruleID == ruleID {
+			delete(s.alerts.pending, key)
+		}
+	}
+	for key, timer := range s.alerts.offline {
+		if key.ruleID == ruleID {
+			timer.Stop()
+			delete(s.alerts.offline, key)
+		}
+	}
+}
+
+// openAlert records an alert for rule on device unless one is already active
+func (s *Server) openAlert(rule AlertRule, device Device, msg string, value *float64, at time.Time) {
+	key := alertKey{rule.ID, device.ID}
+	if active, err := s.alertActive(key); err != nil {
+		log.Println("Failed to look up active alert:", err)
+		return
+	} else if active {
+		return
+	}
+
+	alert := Alert{RuleID: rule.ID, UserID: rule.UserID, DeviceID: device.ID, Status: AlertOpen, Message: msg, Value: value, OpenedAt: at}
+	if err := s.store.CreateAlert(&alert); err != nil {
+		log.Println("Failed to record alert:", err)
+		return
+	}
+	s.setAlertActive(key, true)
+	s.publishTo([]int{rule.UserID}, EventAlert, device, alert)
+}
+
+// clearAlert resolves rule's active alert on device, if there is one
+func (s *Server) clearAlert(rule AlertRule, device Device, at time.Time) {
+	key := alertKey{rule.ID, device.ID}
+	if active, err := s.alertActive(key); err != nil {
+		log.Println("Failed to look up active alert:", err)
+		return
+	} else if !active {
+		return
+	}
+
+	alert, err := s.store.ActiveAlert(rule.ID, device.ID)
+	if errors.Is(err, ErrNotFound) {
+		s.setAlertActive(key, false)
+		return
+	} else if err != nil {
+		log.Println("Failed to look up active alert:", err)
+		return
+	}
+	if err := s.store.SetAlertStatus(alert.ID, AlertResolved, at); err != nil {
+		log.Println("Failed to resolve alert:", err)
+		return
+	}
+	s.setAlertActive(key, false)
+	alert.Status, alert.ResolvedAt = AlertResolved, &at
+	s.publishTo([]int{rule.UserID}, EventAlert, device, alert)
+}
+
+// alertRuleInput is the body of createAlertRule and updateAlertRule
+type alertRuleInput struct {
+	DeviceID        *int     `json:"device_id"`
+	BreakerID       *int     `json:"breaker_id"`
+	Name            string   `json:"name" binding:"required"`
+	Kind            string   `json:"kind" binding:"required"`
+	Threshold       *float64 `json:"threshold"`
+	DurationSeconds int      `json:"duration_seconds"`
+	Enabled         *bool    `json:"enabled"`
+}
+
+// bindAlertRule validates the request body into rule, checking the caller
+// owns any device and breaker it names
+func (s *Server) bindAlertRule(c *gin.Context, rule *AlertRule) bool {
+	var input alertRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return false
+	}
+
+	var problem string
+	switch {
+	case !alertRuleKinds[input.Kind]:
+		problem = "kind must be frequency_below, frequency_above, device_offline or breaker_changed"
+	case (input.Kind == RuleFrequencyBelow || input.Kind == RuleFrequencyAbove) && input.Threshold == nil:
+		problem = "Frequency rules need a threshold"
+	case input.DurationSeconds < 0:
+		problem = "duration_seconds cannot be negative"
+	case input.BreakerID != nil && input.Kind != RuleBreakerChanged:
+		problem = "Only breaker_changed rules can name a breaker"
+	case input.BreakerID != nil && input.DeviceID == nil:
+		problem = "A rule naming a breaker must also name its device"
+	}
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return false
+	}
+
+	if input.DeviceID != nil && !s.authorizeDevice(c, *input.DeviceID, RoleViewer) {
+		return false
+	}
+	if input.BreakerID != nil {
+		breaker, err := s.store.GetBreaker(*input.BreakerID)
+		if err == nil && breaker.DeviceID != *input.DeviceID {
+			err = ErrNotFound
+		}
+		if err != nil {
+			abortAuthz(c, err, "Breaker")
+			return false
+		}
+	}
+
+	rule.DeviceID, rule.BreakerID = input.DeviceID, input.BreakerID
+	rule.Name, rule.Kind, rule.Threshold = input.Name, input.Kind, input.Threshold
+	rule.DurationSeconds = input.DurationSeconds
+	rule.Enabled = input.Enabled == nil || *input.Enabled
+	return true
+}
+
+// loadAlertRule resolves :id to one of the caller's rules
+func (s *Server) loadAlertRule(c *gin.Context) (AlertRule, bool) {
+	id, ok := paramID(c, "id", "alert rule")
+	if !ok {
+		return AlertRule{}, false
+	}
+	auditTarget(c, "alert_rule", int64(id))
+	rule, err := s.store.GetAlertRule(id)
+	if err := checkOwner(c, rule.UserID, err); err != nil {
+		abortAuthz(c, err, "Alert rule")
+		return AlertRule{}, false
+	}
+	return rule, true
+}
+
+// loadAlert resolves :id to one of the caller's alerts
+func (s *Server) loadAlert(c *gin.Context) (Alert, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert ID"})
+		return Alert{}, false
+	}
+	auditTarget(c, "alert", id)
+	alert, err := s.store.GetAlert(id)
+	if err := checkOwner(c, alert.UserID, err); err != nil {
+		abortAuthz(c, err, "Alert")
+		return Alert{}, false
+	}
+	return alert, true
+}
+
+func (s *Server) createAlertRule(c *gin.Context) {
+	rule := AlertRule{UserID: currentUserID(c)}
+	if !s.bindAlertRule(c, &rule) {
+		return
+	}
+
+	if err := s.store.CreateAlertRule(&rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create alert rule"})
+		return
+	}
+	s.forgetAlertRule(rule.ID)
+	if rule.Enabled && rule.Kind == RuleDeviceOffline {
+		s.armOfflineRule(rule, time.Now())
+	}
+	auditTarget(c, "alert_rule", int64(rule.ID))
+	auditChange(c, nil, rule)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule created successfully", "alertRuleID": rule.ID})
+}
+
+func (s *Server) fetchAlertRules(c *gin.Context) {
+	rules, err := s.store.ListAlertRules(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alert rules"})
+		return
+	}
+	if rules == nil {
+		rules = []AlertRule{}
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+func (s *Server) readAlertRule(c *gin.Context) {
+	rule, ok := s.loadAlertRule(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func (s *Server) updateAlertRule(c *gin.Context) {
+	rule, ok := s.loadAlertRule(c)
+	before := rule
+	if !ok || !s.bindAlertRule(c, &rule) {
+		return
+	}
+
+	if err := s.store.UpdateAlertRule(rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update alert rule"})
+		return
+	}
+	// Start the rule over under its new terms
+	s.forgetAlertRule(rule.ID)
+	if rule.Enabled && rule.Kind == RuleDeviceOffline {
+		s.armOfflineRule(rule, time.Now())
+	}
+	auditChange(c, before, rule)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule updated successfully"})
+}
+
+func (s *Server) deleteAlertRule(c *gin.Context) {
+	rule, ok := s.loadAlertRule(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteAlertRule(rule.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete alert rule"})
+		return
+	}
+	s.forgetAlertRule(rule.ID)
+	auditChange(c, rule, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted successfully"})
+}
+
+// fetchAlerts lists the caller's alerts, newest first, optionally narrowed by
+// ?status and ?device
+func (s *Server) fetchAlerts(c *gin.Context) {
+	filter := AlertFilter{Status: c.Query("status"), Limit: maxAlertList}
+	switch filter.Status {
+	case "", AlertOpen, AlertAcknowledged, AlertResolved:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be open, acknowledged or resolved"})
+		return
+	}
+	if raw := c.Query("device"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device ID"})
+			return
+		}
+		filter.DeviceID = id
+	}
+
+	alerts, err := s.store.ListAlerts(currentUserID(c), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alerts"})
+		return
+	}
+	if alerts == nil {
+		alerts = []Alert{}
+	}
+
+	c.JSON(http.StatusOK, alerts)
+}
+
+func (s *Server) acknowledgeAlert(c *gin.Context) {
+	s.setAlertStatus(c, AlertAcknowledged, "Alert has already been acknowledged or resolved")
+}
+
+func (s *Server) resolveAlert(c *gin.Context) {
+	s.setAlertStatus(c, AlertResolved, "Alert has already been resolved")
+}
+
+// setAlertStatus moves the caller's alert to status; conflict explains why it
+// could not be
+func (s *Server) setAlertStatus(c *gin.Context, status, conflict string) {
+	alert, ok := s.loadAlert(c)
+	if !ok {
+		return
+	}
+
+	err := s.store.SetAlertStatus(alert.ID, status, time.Now())
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": conflict})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update alert"})
+		return
+	}
+	if status == AlertResolved {
+		s.setAlertActive(alertKey{alert.RuleID, alert.DeviceID}, false)
+	}
+	auditChange(c, gin.H{"status": alert.Status}, gin.H{"status": status})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert " + status})
+}
+
+func (s *Server) deleteAlert(c *gin.Context) {
+	alert, ok := s.loadAlert(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteAlert(alert.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete alert"})
+		return
+	}
+	s.alerts.mu.Lock()
+	delete(s.alerts.active, alertKey{alert.RuleID, alert.DeviceID})
+	s.alerts.mu.Unlock()
+	auditChange(c, alert, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert deleted successfully"})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// countingRuleStore counts how often a device's alert rules are read
+type countingRuleStore struct {
+	Store
+	ruleReads int
+}
+
+func (c *countingRuleStore) ListDeviceAlertRules(device Device) ([]AlertRule, error) {
+	c.ruleReads++
+	return c.Store.ListDeviceAlertRules(device)
+}
+
+func newAlertServer(t *testing.T) (*Server, *countingRuleStore, User, Device) {
+	t.Helper()
+	store := &countingRuleStore{Store: NewMemoryStore()}
+	s := NewServer(store, DefaultConfig())
+	user, device := seedDevice(t, store, "alice")
+	return s, store, user, device
+}
+
+func createRule(t *testing.T, s *Server, rule AlertRule) AlertRule {
+	t.Helper()
+	rule.Enabled = true
+	if err := s.store.CreateAlertRule(&rule); err != nil {
+		t.Fatal(err)
+	}
+	s.forgetAlertRule(rule.ID)
+	return rule
+}
+
+func listAlerts(t *testing.T, s *Server, userID int) []Alert {
+	t.Helper()
+	alerts, err := s.store.ListAlerts(userID, AlertFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alerts
+}
+
+func TestBreakerChangeAlertsAreResolvedWhenRaised(t *testing.T) {
+	s, _, user, device := newAlertServer(t)
+	createRule(t, s, AlertRule{UserID: user.ID, Name: "Breakers", Kind: RuleBreakerChanged})
+
+	breaker := Breaker{ID: 1, DeviceID: device.ID, Name: "Kitchen"}
+	for _, on := range []bool{true, false, true} {
+		breaker.Status = on
+		s.evaluateBreakerRules(device, breaker)
+	}
+
+	alerts := listAlerts(t, s, user.ID)
+	if len(alerts) != 3 {
+		t.Fatalf("got %d alerts, want one per change", len(alerts))
+	}
+	for _, a := range alerts {
+		if a.Status != AlertResolved || a.ResolvedAt == nil {
+			t.Errorf("alert %+v was left active", a)
+		}
+	}
+}
+
+func TestFrequencyAlertOpensAndResolves(t *testing.T) {
+	s, _, user, device := newAlertServer(t)
+	threshold := 59.9
+	createRule(t, s, AlertRule{UserID: user.ID, Name: "Low", Kind: RuleFrequencyBelow, Threshold: &threshold, DurationSeconds: 2})
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, hz := range []float64{59.8, 59.8, 59.8, 59.8} {
+		s.evaluateFrequencyRules(device, FrequencyLog{DeviceID: device.ID, Frequency: hz, Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+	alerts := listAlerts(t, s, user.ID)
+	if len(alerts) != 1 || alerts[0].Status != AlertOpen {
+		t.Fatalf("got %+v, want one open alert", alerts)
+	}
+
+	s.evaluateFrequencyRules(device, FrequencyLog{DeviceID: device.ID, Frequency: 60, Timestamp: base.Add(5 * time.Second)})
+	alerts = listAlerts(t, s, user.ID)
+	if len(alerts) != 1 || alerts[0].Status != AlertResolved {
+		t.Fatalf("got %+v, want the alert resolved", alerts)
+	}
+}
+
+func TestAlertRulesAreCachedPerDevice(t *testing.T) {
+	s, store, user, device := newAlertServer(t)
+	threshold := 59.5
+	rule := createRule(t, s, AlertRule{UserID: user.ID, Name: "Low", Kind: RuleFrequencyBelow, Threshold: &threshold})
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 10; i++ {
+		s.evaluateFrequencyRules(device, FrequencyLog{DeviceID: device.ID, Frequency: 60, Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+	if store.ruleReads != 1 {
+		t.Errorf("rules read %d times for 10 frames, want 1", store.ruleReads)
+	}
+
+	// A changed rule takes effect on the next frame
+	threshold = 60.5
+	rule.Threshold = &threshold
+	if err := s.store.UpdateAlertRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	s.forgetAlertRule(rule.ID)
+	s.evaluateFrequencyRules(device, FrequencyLog{DeviceID: device.ID, Frequency: 60, Timestamp: base.Add(time.Minute)})
+	if alerts := listAlerts(t, s, user.ID); len(alerts) != 1 || alerts[0].Status != AlertOpen {
+		t.Fatalf("got %+v after raising the threshold, want one open alert", alerts)
+	}
+	if store.ruleReads != 2 {
+		t.Errorf("rules read %d times, want 2 after the update", store.ruleReads)
+	}
+}
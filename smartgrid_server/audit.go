@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// auditKey holds the request's *auditRecord in the gin context
+	auditKey = "audit"
+	// maxAuditList caps one page of fetchAuditLog
+	maxAuditList = 500
+)
+
+// unauditedRoutes change nothing; auditing /login would log every password attempt
+var unauditedRoutes = map[string]bool{"/login": true}
+
+// auditRecord collects what handlers know about the resource they touched
+type auditRecord struct {
+	targetType    string
+	targetID      *int64
+	before, after any
+}
+
+func auditOf(c *gin.Context) *auditRecord {
+	r, _ := c.Get(auditKey)
+	record, _ := r.(*auditRecord)
+	return record
+}
+
+// auditTarget names the resource a mutating call acts on
+func auditTarget(c *gin.Context, kind string, id int64) {
+	if r := auditOf(c); r != nil {
+		r.targetType, r.targetID = kind, &id
+	}
+}
+
+// auditChange attaches before and after summaries; either may be nil
+func auditChange(c *gin.Context, before, after any) {
+	if r := auditOf(c); r != nil {
+		r.before, r.after = before, after
+	}
+}
+
+// userSummary is what the audit log keeps of a user; never the password
+func userSummary(u User) gin.H {
+	return gin.H{"id": u.ID, "name": u.Name, "email": u.Email, "login": u.Login, "isverified": u.IsVerified}
+}
+
+// auditOutcome classifies a response status
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return AuditDenied
+	case status >= 500:
+		return AuditError
+	case status >= 400:
+		return AuditRejected
+	default:
+		return AuditSuccess
+	}
+}
+
+// AuditLog records every mutating request once the handler chain has run,
+// including ones rejected by authentication or authorization
+func (s *Server) AuditLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if unauditedRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		record := &auditRecord{}
+		c.Set(auditKey, record)
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		entry := AuditEntry{
+			Method:     c.Request.Method,
+			Route:      route,
+			Path:       c.Request.URL.Path,
+			TargetType: record.targetType,
+			TargetID:   record.targetID,
+			ClientIP:   c.ClientIP(),
+			Status:     c.Writer.Status(),
+		}
+		entry.Outcome = auditOutcome(entry.Status)
+		if id := currentUserID(c); id != 0 {
+			entry.ActorID = &id
+		}
+		for _, part := range []struct {
+			value any
+			dst   *json.RawMessage
+		}{{record.before, &entry.Before}, {record.after, &entry.After}} {
+			if part.value == nil {
+				continue
+			}
+			body, err := json.Marshal(part.value)
+			if err != nil {
+				log.Println("Failed to encode audit summary:", err)
+				continue
+			}
+			*part.dst = body
+		}
+		if err := s.store.CreateAuditEntry(&entry); err != nil {
+			log.Println("Failed to write audit entry:", err)
+		}
+	}
+}
+
+// fetchAuditLog lets admins search the audit log newest first. Filters are
+// ?actor, ?target_type, ?target_id, ?method, ?route, ?outcome, ?start and
+// ?end; ?before takes the last ID of the previous page.
+func (s *Server) fetchAuditLog(c *gin.Context) {
+	r, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	filter := AuditFilter{
+		TargetType: c.Query("target_type"),
+		Method:     c.Query("method"),
+		Route:      c.Query("route"),
+		Outcome:    c.Query("outcome"),
+		Start:      r.Start,
+		End:        r.End,
+		Limit:      maxAuditList,
+	}
+	switch filter.Outcome {
+	case "", AuditSuccess, AuditDenied, AuditRejected, AuditError:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid outcome"})
+		return
+	}
+	if raw := c.Query("actor"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid actor"})
+			return
+		}
+		filter.ActorID = &id
+	}
+	if raw := c.Query("before"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before"})
+			return
+		}
+		filter.BeforeID = id
+	}
+	if raw := c.Query("target_id"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target_id"})
+			return
+		}
+		filter.TargetID = &id
+	}
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		filter.Limit = min(n, maxAuditList)
+	}
+
+	entries, err := s.store.ListAuditEntries(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// runAdminCommand grants or revokes admin rights from the command line, which
+// is the only way to do either
+func runAdminCommand(args []string) error {
+	usage := fmt.Errorf("usage: server admin grant|revoke <login>")
+	if len(args) != 2 || (args[0] != "grant" && args[0] != "revoke") {
+		return usage
+	}
+
+	store, closeStore, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	user, err := store.GetUserByLogin(args[1])
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("no user with login %q", args[1])
+	} else if err != nil {
+		return err
+	}
+	grant := args[0] == "grant"
+	if err := store.SetUserAdmin(user.ID, grant); err != nil {
+		return err
+	}
+	if grant {
+		log.Printf("Granted admin to %s (user %d)\n", user.Login, user.ID)
+	} else {
+		log.Printf("Revoked admin from %s (user %d)\n", user.Login, user.ID)
+	}
+	return nil
+}
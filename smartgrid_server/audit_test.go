@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// auditFixture is an admin who owns one device with one breaker, and a
+// stranger with no access to it
+type auditFixture struct {
+	server   *Server
+	router   *gin.Engine
+	admin    User
+	stranger User
+	device   Device
+	breaker  Breaker
+}
+
+func newAuditFixture(t *testing.T, store Store) *auditFixture {
+	t.Helper()
+	f := &auditFixture{server: NewServer(store, DefaultConfig())}
+	f.admin, f.device = seedDevice(t, store, "alice")
+	if err := store.SetUserAdmin(f.admin.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	f.stranger, _ = seedDevice(t, store, "mallory")
+	f.breaker = Breaker{DeviceID: f.device.ID, Name: "main", Breaker_Number: "1"}
+	if err := store.CreateBreaker(&f.breaker); err != nil {
+		t.Fatal(err)
+	}
+	f.router = f.server.Router()
+	return f
+}
+
+// entries returns the audit log for route, newest first
+func (f *auditFixture) entries(t *testing.T, route string) []AuditEntry {
+	t.Helper()
+	entries, err := f.server.store.ListAuditEntries(AuditFilter{Route: route, Limit: maxAuditList})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAuditLogRecordsMutationsForAdmins(t *testing.T) {
+	f := newAuditFixture(t, NewMemoryStore())
+	path := fmt.Sprintf("/updateDevice/%d", f.device.ID)
+	if w := serve(t, f.router, f.stranger.ID, "PUT", path, `{"name":"stolen"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d, want 403: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.admin.ID, "PUT", path, `{"name":"renamed"}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	// Admin rights cannot be claimed over the API
+	if w := serve(t, f.router, f.stranger.ID, "PUT", fmt.Sprintf("/updateUser/%d", f.stranger.ID), `{"name":"mallory","login":"mallory","pass":"x","is_admin":true}`); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.stranger.ID, "GET", "/fetchAuditLog", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d, want 403: %s", w.Code, w.Body)
+	}
+
+	query := fmt.Sprintf("/fetchAuditLog?route=/updateDevice/:id&target_type=device&target_id=%d", f.device.ID)
+	w := serve(t, f.router, f.admin.ID, "GET", query, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var entries []AuditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2: %s", len(entries), w.Body)
+	}
+	ok, denied := entries[0], entries[1]
+	if ok.Outcome != AuditSuccess || *ok.ActorID != f.admin.ID ||
+		!bytes.Contains(ok.Before, []byte(`"alice panel"`)) || !bytes.Contains(ok.After, []byte(`"renamed"`)) {
+		t.Fatalf("unexpected entry for the update: %+v", ok)
+	}
+	if denied.Outcome != AuditDenied || *denied.ActorID != f.stranger.ID || denied.After != nil {
+		t.Fatalf("unexpected entry for the denied update: %+v", denied)
+	}
+
+	// Pages continue below the last ID seen
+	w = serve(t, f.router, f.admin.ID, "GET", fmt.Sprintf("%s&before=%d", query, ok.ID), "")
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].ID != denied.ID {
+		t.Fatalf("unexpected second page: %s", w.Body)
+	}
+}
+
+func TestAuditLogSkipsLogin(t *testing.T) {
+	store := NewMemoryStore()
+	hash, err := bcrypt.GenerateFromPassword([]byte("right"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{Name: "alice", Login: "alice", Email: "alice@example.com", Pass: string(hash)}
+	if err := store.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	router := NewServer(store, DefaultConfig()).Router()
+
+	for _, pass := range []string{"wrong", "right"} {
+		serve(t, router, 0, "POST", "/login", fmt.Sprintf(`{"login":"alice","pass":%q}`, pass))
+	}
+	entries, err := store.ListAuditEntries(AuditFilter{Limit: maxAuditList})
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("got %d entries for logins, want none (%v)", len(entries), err)
+	}
+}
+
+// failingDeleteStore fails every device delete after the device was read
+type failingDeleteStore struct {
+	Store
+}
+
+func (failingDeleteStore) DeleteDevice(int) error { return errors.New("disk full") }
+
+func TestAuditLogOnlySummarizesChangesThatHappened(t *testing.T) {
+	f := newAuditFixture(t, failingDeleteStore{NewMemoryStore()})
+	if w := serve(t, f.router, f.admin.ID, "DELETE", fmt.Sprintf("/deleteDevice/%d", f.device.ID), ""); w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want 500: %s", w.Code, w.Body)
+	}
+	entries := f.entries(t, "/deleteDevice/:id")
+	if len(entries) != 1 || entries[0].Outcome != AuditError || entries[0].Before != nil || entries[0].After != nil {
+		t.Fatalf("got %+v, want one error entry without summaries", entries)
+	}
+}
+
+func TestAuditLogSummarizesFeatureChanges(t *testing.T) {
+	f := newAuditFixture(t, NewMemoryStore())
+	rule := AlertRule{UserID: f.admin.ID, DeviceID: &f.device.ID, Name: "dip", Kind: RuleDeviceOffline, Enabled: true}
+	if err := f.server.store.CreateAlertRule(&rule); err != nil {
+		t.Fatal(err)
+	}
+	hook := Webhook{UserID: f.admin.ID, URL: "https://hooks.example.com/a", Secret: "s3cret", EventTypes: []string{}, Enabled: true}
+	if err := f.server.store.CreateWebhook(&hook); err != nil {
+		t.Fatal(err)
+	}
+	device := f.device.ID
+
+	cases := []struct {
+		method, path, route, body string
+		before, after             bool
+	}{
+		{"POST", "/createAlertRule", "/createAlertRule", fmt.Sprintf(`{"name":"gone","kind":"device_offline","device_id":%d}`, device), false, true},
+		{"PUT", fmt.Sprintf("/updateAlertRule/%d", rule.ID), "/updateAlertRule/:id", fmt.Sprintf(`{"name":"renamed","kind":"device_offline","device_id":%d}`, device), true, true},
+		{"PUT", fmt.Sprintf("/updateWebhook/%d", hook.ID), "/updateWebhook/:id", `{"url":"https://hooks.example.com/b"}`, true, true},
+		{"DELETE", fmt.Sprintf("/deleteWebhook/%d", hook.ID), "/deleteWebhook/:id", "", true, false},
+		{"POST", "/createBreakerSchedule", "/createBreakerSchedule", fmt.Sprintf(`{"breaker_id":%d,"name":"night","state":false,"cron":"0 22 * * *"}`, f.breaker.ID), false, true},
+		{"POST", fmt.Sprintf("/rotateDeviceCredential/%d", device), "/rotateDeviceCredential/:id", "", true, true},
+		{"POST", fmt.Sprintf("/revokeDeviceCredential/%d", device), "/revokeDeviceCredential/:id", "", true, true},
+		{"POST", fmt.Sprintf("/suspendLoadShedding/%d", device), "/suspendLoadShedding/:id", `{"duration":"1h"}`, true, true},
+		{"POST", fmt.Sprintf("/resumeLoadShedding/%d", device), "/resumeLoadShedding/:id", "", true, true},
+		{"POST", fmt.Sprintf("/sendPacket/%d", device), "/sendPacket/:id", `{"command":"pingDevice"}`, false, true},
+		{"POST", "/createCommandJob", "/createCommandJob", fmt.Sprintf(`{"device_ids":[%d],"command":"flashLED"}`, device), false, true},
+	}
+	for _, tc := range cases {
+		w := serve(t, f.router, f.admin.ID, tc.method, tc.path, tc.body)
+		if w.Code >= 300 {
+			t.Fatalf("%s %s: got %d: %s", tc.method, tc.path, w.Code, w.Body)
+		}
+		entries := f.entries(t, tc.route)
+		if len(entries) != 1 {
+			t.Fatalf("%s: got %d entries, want 1", tc.route, len(entries))
+		}
+		if e := entries[0]; (e.Before != nil) != tc.before || (e.After != nil) != tc.after {
+			t.Errorf("%s: before %s after %s; want before %v after %v", tc.route, e.Before, e.After, tc.before, tc.after)
+		}
+	}
+
+	// The rotated secret itself is never written to the log
+	for _, e := range f.entries(t, "/rotateDeviceCredential/:id") {
+		if bytes.Contains(e.After, []byte("token")) || bytes.Contains(e.After, []byte("secret")) {
+			t.Errorf("credential summary leaks the secret: %s", e.After)
+		}
+	}
+
+	// Cancelling the queued ping records the status change
+	cmds, err := f.server.store.ListCommands(device, CommandPending, 1)
+	if err != nil || len(cmds) != 1 {
+		t.Fatalf("got %v, %v; want the queued ping", cmds, err)
+	}
+	if w := serve(t, f.router, f.admin.ID, "POST", fmt.Sprintf("/cancelCommand/%d", cmds[0].ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("cancel: got %d: %s", w.Code, w.Body)
+	}
+	entries := f.entries(t, "/cancelCommand/:id")
+	if len(entries) != 1 || !bytes.Contains(entries[0].After, []byte(CommandCancelled)) {
+		t.Errorf("cancel entry %+v, want the cancelled status", entries)
+	}
+}
+
+func TestAuditLogIgnoresForwardedForFromUntrustedPeers(t *testing.T) {
+	f := newAuditFixture(t, NewMemoryStore())
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/updateDevice/%d", f.device.ID), bytes.NewBufferString(`{"name":"renamed"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	token, _ := newToken(f.admin.ID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	entries := f.entries(t, "/updateDevice/:id")
+	if len(entries) != 1 || entries[0].ClientIP != "192.0.2.1" {
+		t.Fatalf("audit IP should be the peer's, got %+v", entries)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every device, breaker and user route resolves its target back to the
+// users allowed to see it and compares them with the caller set by
+// AuthMiddleware. A device is reached by its owner (devices.user_id) and by
+// its members, each with a role; routes name the weakest role they accept.
+// A missing resource is a 404, someone else's resource is a 403.
+
+var errForbidden = errors.New("forbidden")
+
+// errRole means the caller can see the device but their role is too weak
+var errRole = errors.New("role too weak")
+
+// roleRank orders roles so a stronger one satisfies a weaker requirement
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleOwner: 3}
+
+// currentUserID returns the authenticated caller, or 0 outside AuthMiddleware
+func currentUserID(c *gin.Context) int {
+	return c.GetInt("userID")
+}
+
+// deviceRole returns userID's role on deviceID, or errForbidden if they have none
+func (s *Server) deviceRole(userID, deviceID int) (string, error) {
+	device, err := s.store.GetDevice(deviceID)
+	if err != nil {
+		return "", err
+	}
+	if device.UserID == userID {
+		return RoleOwner, nil
+	}
+	member, err := s.store.GetDeviceMember(deviceID, userID)
+	if errors.Is(err, ErrNotFound) {
+		return "", errForbidden
+	}
+	return member.Role, err
+}
+
+// deviceUserIDs lists everyone with access to device, owner first
+func (s *Server) deviceUserIDs(device Device) ([]int, error) {
+	members, err := s.store.ListDeviceMembers(device.ID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{device.UserID}
+	for _, m := range members {
+		ids = append(ids, m.UserID)
+	}
+	return ids, nil
+}
+
+// checkOwner compares the resolved owner with the caller
+func checkOwner(c *gin.Context, owner int, err error) error {
+	if err != nil {
+		return err
+	}
+	if owner != currentUserID(c) {
+		return errForbidden
+	}
+	return nil
+}
+
+// abortAuthz writes the response for a failed ownership check
+func abortAuthz(c *gin.Context, err error, label string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": label + " not found"})
+	case errors.Is(err, errForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this " + label})
+	case errors.Is(err, errRole):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your role does not allow this on this " + label})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify " + label})
+	}
+	c.Abort()
+}
+
+// checkDeviceRole checks the caller holds at least role need on deviceID and
+// keeps their role in the context as "deviceRole"
+func (s *Server) checkDeviceRole(c *gin.Context, deviceID int, need string) error {
+	role, err := s.deviceRole(currentUserID(c), deviceID)
+	if err != nil {
+		return err
+	}
+	if roleRank[role] < roleRank[need] {
+		return errRole
+	}
+	c.Set("deviceRole", role)
+	return nil
+}
+
+// authorizeDevice checks the caller's role on deviceID, aborting the request if too weak
+func (s *Server) authorizeDevice(c *gin.Context, deviceID int, need string) bool {
+	if err := s.checkDeviceRole(c, deviceID, need); err != nil {
+		abortAuthz(c, err, "Device")
+		return false
+	}
+	return true
+}
+
+// authorizeBreaker checks the caller's role on the device behind breakerID
+func (s *Server) authorizeBreaker(c *gin.Context, breakerID int, need string) bool {
+	breaker, err := s.store.GetBreaker(breakerID)
+	if err == nil {
+		err = s.checkDeviceRole(c, breaker.DeviceID, need)
+	}
+	if err != nil {
+		abortAuthz(c, err, "Breaker")
+		return false
+	}
+	return true
+}
+
+// RequireDeviceRole guards routes whose :param is a device ID
+func (s *Server) RequireDeviceRole(param, need string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device ID"})
+			c.Abort()
+			return
+		}
+		auditTarget(c, "device", int64(id))
+		if s.authorizeDevice(c, id, need) {
+			c.Next()
+		}
+	}
+}
+
+// RequireBreakerRole guards routes whose :param is a breaker ID
+func (s *Server) RequireBreakerRole(param, need string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid breaker ID"})
+			c.Abort()
+			return
+		}
+		auditTarget(c, "breaker", int64(id))
+		if s.authorizeBreaker(c, id, need) {
+			c.Next()
+		}
+	}
+}
+
+// RequireSelf guards user routes so callers can only act on their own account
+func RequireSelf(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			c.Abort()
+			return
+		}
+		auditTarget(c, "user", int64(id))
+		if id != currentUserID(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this user"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireAdmin guards routes only admins may use
+func (s *Server) RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := s.store.GetUser(currentUserID(c))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify user"})
+			c.Abort()
+			return
+		}
+		if !user.IsAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
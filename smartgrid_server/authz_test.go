@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	jwtSecret = []byte("test-secret")
+}
+
+// fixture seeds two tenants, each with one device and one breaker, plus a
+// viewer who shares bob's device and a pending invitation to it
+type fixture struct {
+	server    *Server
+	router    *gin.Engine
+	users     [2]User
+	devices   [2]Device
+	breaker   [2]Breaker
+	command   [2]DeviceCommand
+	alertRule [2]AlertRule
+	alert     [2]Alert
+	webhook   [2]Webhook
+	delivery  [2]WebhookDelivery
+	schedule  [2]BreakerSchedule
+	site      [2]Site
+	group     [2]DeviceGroup
+	job       [2]CommandJob
+	rollout   [2]FirmwareRollout
+
+	firmware   Firmware
+	member     User
+	invitation DeviceInvitation
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	store := NewMemoryStore()
+	f := &fixture{server: NewServer(store, DefaultConfig())}
+	f.firmware = Firmware{HardwareModel: "esp32", Version: "1.1.0", SHA256: "00", Size: 4}
+	if err := store.CreateFirmware(&f.firmware, []byte("v110")); err != nil {
+		t.Fatal(err)
+	}
+	for i, login := range []string{"alice", "bob"} {
+		f.users[i] = User{Name: login, Login: login, Email: login + "@example.com"}
+		if err := store.CreateUser(&f.users[i]); err != nil {
+			t.Fatal(err)
+		}
+		f.devices[i] = Device{Name: login + " panel", UserID: f.users[i].ID}
+		if err := store.CreateDevice(&f.devices[i]); err != nil {
+			t.Fatal(err)
+		}
+		f.breaker[i] = Breaker{DeviceID: f.devices[i].ID, Name: "main", Breaker_Number: "1"}
+		if err := store.CreateBreaker(&f.breaker[i]); err != nil {
+			t.Fatal(err)
+		}
+		f.command[i] = DeviceCommand{
+			DeviceID:  f.devices[i].ID,
+			RequestID: login + "-ping",
+			Command:   "pingDevice",
+			Payload:   DeviceResponse{Command: "pingDevice", RequestID: login + "-ping"},
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		if err := store.CreateCommand(&f.command[i]); err != nil {
+			t.Fatal(err)
+		}
+		f.alertRule[i] = AlertRule{UserID: f.users[i].ID, DeviceID: &f.devices[i].ID, Name: "dip", Kind: RuleDeviceOffline, Enabled: true}
+		if err := store.CreateAlertRule(&f.alertRule[i]); err != nil {
+			t.Fatal(err)
+		}
+		f.alert[i] = Alert{RuleID: f.alertRule[i].ID, UserID: f.users[i].ID, DeviceID: f.devices[i].ID, Status: AlertOpen, Message: "offline", OpenedAt: time.Now()}
+		if err := store.CreateAlert(&f.alert[i]); err != nil {
+			t.Fatal(err)
+		}
+		f.webhook[i] = Webhook{UserID: f.users[i].ID, URL: "http://127.0.0.1:9/" + login, Secret: "secret", EventTypes: []string{EventAlert}, Enabled: true}
+		if err := store.CreateWebhook(&f.webhook[i]); err != nil {
+			t.Fatal(err)
+		}
+		f.delivery[i] = WebhookDelivery{WebhookID: f.webhook[i].ID, EventType: EventPing, Payload: []byte(`{}`), Status: DeliveryFailed}
+		if err := store.EnqueueWebhookDelivery(&f.delivery[i]); err != nil {
+			t.Fatal(err)
+		}
+		cron, next := "0 18 * * *", time.Now().Add(time.Hour)
+		f.schedule[i] = BreakerSchedule{BreakerID: f.breaker[i].ID, Name: "evening", Cron: &cron, Timezone: "UTC", Enabled: true, NextRunAt: &next}
+		if err := store.CreateBreakerSchedule(&f.schedule[i]); err != nil {
+			t.Fatal(err)
+		}
+		f.site[i] = Site{UserID: f.users[i].ID, Name: login + " home", Timezone: "America/Chicago"}
+		if err := store.CreateSite(&f.site[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetDeviceSite(f.devices[i].ID, &f.site[i].ID); err != nil {
+			t.Fatal(err)
+		}
+		f.group[i] = DeviceGroup{UserID: f.users[i].ID, Name: "panels"}
+		if err := store.CreateDeviceGroup(&f.group[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddGroupDevice(f.group[i].ID, f.devices[i].ID); err != nil {
+			t.Fatal(err)
+		}
+		f.job[i] = CommandJob{UserID: f.users[i].ID, Command: "pingDevice", GroupID: &f.group[i].ID}
+		if err := store.CreateCommandJob(&f.job[i], []CommandJobTarget{{DeviceID: f.devices[i].ID}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetDeviceFirmware(f.devices[i].ID, "esp32", "1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+		f.rollout[i] = FirmwareRollout{UserID: f.users[i].ID, FirmwareID: f.firmware.ID, Percent: 0}
+		if err := store.CreateFirmwareRollout(&f.rollout[i], []int{f.devices[i].ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.member = User{Name: "carol", Login: "carol", Email: "carol@example.com"}
+	if err := store.CreateUser(&f.member); err != nil {
+		t.Fatal(err)
+	}
+	shared := DeviceInvitation{DeviceID: f.devices[1].ID, Email: f.member.Email, Role: RoleViewer, InvitedBy: &f.users[1].ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.CreateDeviceInvitation(&shared); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AcceptDeviceInvitation(shared.ID, f.member.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	f.invitation = DeviceInvitation{DeviceID: f.devices[1].ID, Email: "dave@example.com", Role: RoleOperator, InvitedBy: &f.users[1].ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.CreateDeviceInvitation(&f.invitation); err != nil {
+		t.Fatal(err)
+	}
+
+	f.router = f.server.Router()
+	return f
+}
+
+// do issues a request as the given user; userID 0 sends no token
+func (f *fixture) do(t *testing.T, userID int, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(t, f.router, userID, method, path, body)
+}
+
+// serve sends a JSON request through router as the given user; userID 0
+// sends no token
+func serve(t *testing.T, router *gin.Engine, userID int, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	if userID != 0 {
+		token, err := newToken(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// authzCase targets bob's resources; the owner column is what bob gets
+type authzCase struct {
+	method string
+	path   func(f *fixture) string
+	body   func(f *fixture) string
+	owner  int
+}
+
+func noBody(*fixture) string { return "" }
+
+func authzMatrix() []authzCase {
+	device := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.devices[1].ID) }
+	}
+	breaker := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.breaker[1].ID) }
+	}
+	command := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.command[1].ID) }
+	}
+	alertRule := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.alertRule[1].ID) }
+	}
+	alert := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.alert[1].ID) }
+	}
+	webhook := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.webhook[1].ID) }
+	}
+	delivery := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.delivery[1].ID) }
+	}
+	schedule := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.schedule[1].ID) }
+	}
+	site := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.site[1].ID) }
+	}
+	group := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.group[1].ID) }
+	}
+	rollout := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.rollout[1].ID) }
+	}
+	user := func(route string) func(f *fixture) string {
+		return func(f *fixture) string { return fmt.Sprintf("/%s/%d", route, f.users[1].ID) }
+	}
+	static := func(path string) func(*fixture) string {
+		return func(*fixture) string { return path }
+	}
+
+	return []authzCase{
+		{"PUT", user("updateUser"), func(*fixture) string {
+			return `{"name":"bob","email":"bob@example.com","login":"bob","pass":"secret"}`
+		}, http.StatusOK},
+		{"DELETE", user("deleteUser"), noBody, http.StatusOK},
+
+		{"POST", static("/createDevice"), func(f *fixture) string {
+			return fmt.Sprintf(`{"name":"garage","user_id":%d}`, f.users[1].ID)
+		}, http.StatusOK},
+		{"GET", device("readDevice"), noBody, http.StatusOK},
+		{"PUT", device("updateDevice"), func(*fixture) string { return `{"name":"renamed"}` }, http.StatusOK},
+		{"DELETE", device("deleteDevice"), noBody, http.StatusOK},
+
+		{"POST", static("/createBreaker"), func(f *fixture) string {
+			return fmt.Sprintf(`{"device_id":%d,"name":"oven","breaker_number":"2"}`, f.devices[1].ID)
+		}, http.StatusOK},
+		{"GET", breaker("readBreaker"), noBody, http.StatusOK},
+		{"PUT", breaker("updateBreaker"), func(*fixture) string {
+			return `{"name":"oven","breaker_number":"3","priority":2}`
+		}, http.StatusOK},
+		{"DELETE", breaker("deleteBreaker"), noBody, http.StatusOK},
+
+		{"GET", breaker("fetchBreakerSchedules"), noBody, http.StatusOK},
+		{"GET", breaker("fetchUpcomingRuns"), noBody, http.StatusOK},
+		{"GET", breaker("fetchBreakerTimeline"), noBody, http.StatusOK},
+		{"POST", static("/createBreakerSchedule"), func(f *fixture) string {
+			return fmt.Sprintf(`{"breaker_id":%d,"name":"night","state":false,"cron":"0 23 * * *","timezone":"America/Chicago"}`, f.breaker[1].ID)
+		}, http.StatusOK},
+		{"GET", schedule("readBreakerSchedule"), noBody, http.StatusOK},
+		{"PUT", schedule("updateBreakerSchedule"), func(*fixture) string {
+			return `{"name":"once","state":true,"run_at":"2099-01-01T06:30","timezone":"Europe/Paris"}`
+		}, http.StatusOK},
+		{"DELETE", schedule("deleteBreakerSchedule"), noBody, http.StatusOK},
+		{"POST", schedule("skipBreakerSchedule"), noBody, http.StatusOK},
+		{"GET", schedule("fetchScheduleRuns"), noBody, http.StatusOK},
+
+		{"GET", device("fetchBreakers"), noBody, http.StatusOK},
+		{"GET", device("fetchFrequencyData"), noBody, http.StatusOK},
+		{"GET", device("fetchDeviceSessions"), noBody, http.StatusOK},
+		{"GET", device("fetchExcursions"), noBody, http.StatusOK},
+		{"GET", device("readDeviceConfig"), noBody, http.StatusOK},
+		{"PUT", device("updateDeviceConfig"), func(*fixture) string { return `{"telemetry":{"interval_s":30}}` }, http.StatusOK},
+
+		{"GET", device("fetchLoadShedding"), noBody, http.StatusOK},
+		{"POST", device("suspendLoadShedding"), func(*fixture) string { return `{"duration":"30m","restore":true}` }, http.StatusOK},
+		// Nothing is suspended in the fixture, so the owner gets past authz to a conflict
+		{"POST", device("resumeLoadShedding"), noBody, http.StatusConflict},
+		{"GET", device("fetchLoadShedEvents"), noBody, http.StatusOK},
+
+		// The device is not connected in tests, so the command is queued
+		{"POST", device("sendPacket"), func(*fixture) string { return `{"command":"pingDevice"}` }, http.StatusAccepted},
+		{"GET", device("fetchCommands"), noBody, http.StatusOK},
+		{"POST", command("cancelCommand"), noBody, http.StatusOK},
+
+		{"POST", static("/createAlertRule"), func(f *fixture) string {
+			return fmt.Sprintf(`{"device_id":%d,"name":"low","kind":"frequency_below","threshold":59.9}`, f.devices[1].ID)
+		}, http.StatusOK},
+		{"GET", alertRule("readAlertRule"), noBody, http.StatusOK},
+		{"PUT", alertRule("updateAlertRule"), func(f *fixture) string {
+			return fmt.Sprintf(`{"device_id":%d,"name":"down","kind":"device_offline","duration_seconds":300}`, f.devices[1].ID)
+		}, http.StatusOK},
+		{"DELETE", alertRule("deleteAlertRule"), noBody, http.StatusOK},
+		{"POST", alert("acknowledgeAlert"), noBody, http.StatusOK},
+		{"POST", alert("resolveAlert"), noBody, http.StatusOK},
+		{"DELETE", alert("deleteAlert"), noBody, http.StatusOK},
+
+		{"GET", webhook("readWebhook"), noBody, http.StatusOK},
+		{"PUT", webhook("updateWebhook"), func(*fixture) string {
+			return `{"url":"https://example.com/hook","event_types":["breaker","presence"]}`
+		}, http.StatusOK},
+		{"DELETE", webhook("deleteWebhook"), noBody, http.StatusOK},
+		{"POST", webhook("testWebhook"), noBody, http.StatusAccepted},
+		{"GET", webhook("fetchWebhookDeliveries"), noBody, http.StatusOK},
+		{"POST", delivery("redeliverWebhookDelivery"), noBody, http.StatusAccepted},
+
+		{"POST", device("createClaimCode"), noBody, http.StatusOK},
+		{"GET", device("fetchDeviceCredentials"), noBody, http.StatusOK},
+		{"POST", device("rotateDeviceCredential"), noBody, http.StatusOK},
+		{"POST", device("revokeDeviceCredential"), noBody, http.StatusOK},
+
+		{"GET", device("fetchDeviceMembers"), noBody, http.StatusOK},
+		{"PUT", device("updateDeviceMember"), func(f *fixture) string {
+			return fmt.Sprintf(`{"user_id":%d,"role":"operator"}`, f.member.ID)
+		}, http.StatusOK},
+		{"POST", device("removeDeviceMember"), func(f *fixture) string {
+			return fmt.Sprintf(`{"user_id":%d}`, f.member.ID)
+		}, http.StatusOK},
+		// The owner can see the device but has no membership to leave
+		{"POST", device("leaveDevice"), noBody, http.StatusConflict},
+		{"POST", device("inviteDeviceMember"), func(*fixture) string {
+			return `{"email":"erin@example.com","role":"viewer"}`
+		}, http.StatusOK},
+		{"GET", device("fetchDeviceInvitations"), noBody, http.StatusOK},
+		{"POST", func(f *fixture) string {
+			return fmt.Sprintf("/revokeDeviceInvitation/%d", f.invitation.ID)
+		}, noBody, http.StatusOK},
+
+		{"GET", site("readSite"), noBody, http.StatusOK},
+		{"PUT", site("updateSite"), func(*fixture) string {
+			return `{"name":"cabin","address":"1 Lake Rd","timezone":"America/Denver"}`
+		}, http.StatusOK},
+		{"DELETE", site("deleteSite"), noBody, http.StatusOK},
+		{"PUT", device("assignDeviceSite"), func(f *fixture) string {
+			return fmt.Sprintf(`{"site_id":%d}`, f.site[1].ID)
+		}, http.StatusOK},
+		{"GET", group("readDeviceGroup"), noBody, http.StatusOK},
+		{"PUT", group("updateDeviceGroup"), func(*fixture) string { return `{"name":"garage"}` }, http.StatusOK},
+		{"DELETE", group("deleteDeviceGroup"), noBody, http.StatusOK},
+		{"POST", group("addGroupDevice"), func(f *fixture) string {
+			return fmt.Sprintf(`{"device_id":%d}`, f.devices[1].ID)
+		}, http.StatusOK},
+		{"POST", group("removeGroupDevice"), func(f *fixture) string {
+			return fmt.Sprintf(`{"device_id":%d}`, f.devices[1].ID)
+		}, http.StatusOK},
+		{"GET", func(f *fixture) string {
+			return fmt.Sprintf("/fetchFrequencySummary?site=%d", f.site[1].ID)
+		}, noBody, http.StatusOK},
+		{"POST", static("/createCommandJob"), func(f *fixture) string {
+			return fmt.Sprintf(`{"group_id":%d,"command":"pingDevice"}`, f.group[1].ID)
+		}, http.StatusAccepted},
+		{"POST", static("/createCommandJob"), func(f *fixture) string {
+			return fmt.Sprintf(`{"device_ids":[%d],"command":"toggleBreaker","breaker_state":false}`, f.devices[1].ID)
+		}, http.StatusAccepted},
+		{"POST", static("/sendTargetPacket"), func(f *fixture) string {
+			return fmt.Sprintf(`{"group_id":%d,"command":"pingDevice"}`, f.group[1].ID)
+		}, http.StatusAccepted},
+		{"GET", func(f *fixture) string {
+			return fmt.Sprintf("/readCommandJob/%d", f.job[1].ID)
+		}, noBody, http.StatusOK},
+
+		{"POST", static("/createFirmwareRollout"), func(f *fixture) string {
+			return fmt.Sprintf(`{"device_ids":[%d],"firmware_id":%d}`, f.devices[1].ID, f.firmware.ID)
+		}, http.StatusAccepted},
+		{"GET", rollout("readFirmwareRollout"), noBody, http.StatusOK},
+		{"POST", rollout("advanceFirmwareRollout"), func(*fixture) string { return `{"percent":100}` }, http.StatusOK},
+		{"POST", rollout("haltFirmwareRollout"), noBody, http.StatusOK},
+	}
+}
+
+func TestAuthorizationMatrix(t *testing.T) {
+	for _, tc := range authzMatrix() {
+		f := newFixture(t)
+		name := tc.method + " " + tc.path(f)
+
+		t.Run(name+" anonymous", func(t *testing.T) {
+			f := newFixture(t)
+			if w := f.do(t, 0, tc.method, tc.path(f), tc.body(f)); w.Code != http.StatusUnauthorized {
+				t.Fatalf("got %d, want 401: %s", w.Code, w.Body)
+			}
+		})
+		t.Run(name+" other tenant", func(t *testing.T) {
+			f := newFixture(t)
+			if w := f.do(t, f.users[0].ID, tc.method, tc.path(f), tc.body(f)); w.Code != http.StatusForbidden {
+				t.Fatalf("got %d, want 403: %s", w.Code, w.Body)
+			}
+		})
+		t.Run(name+" owner", func(t *testing.T) {
+			f := newFixture(t)
+			if w := f.do(t, f.users[1].ID, tc.method, tc.path(f), tc.body(f)); w.Code != tc.owner {
+				t.Fatalf("got %d, want %d: %s", w.Code, tc.owner, w.Body)
+			}
+		})
+	}
+}
+
+func TestSendPacketRejectsForeignBreaker(t *testing.T) {
+	f := newFixture(t)
+	body := fmt.Sprintf(`{"command":"toggleBreaker","breakerId":%d,"breakerState":false}`, f.breaker[0].ID)
+	path := fmt.Sprintf("/sendPacket/%d", f.devices[1].ID)
+	if w := f.do(t, f.users[1].ID, "POST", path, body); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d, want 403: %s", w.Code, w.Body)
+	}
+}
+
+func TestFetchDevicesOnlyListsOwnDevices(t *testing.T) {
+	f := newFixture(t)
+	w := f.do(t, f.users[0].ID, "GET", "/fetchDevices", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("bob panel")) {
+		t.Fatalf("alice can see bob's device: %s", w.Body)
+	}
+}
+
+func TestStreamEventsRejectsForeignDevice(t *testing.T) {
+	f := newFixture(t)
+	path := fmt.Sprintf("/streamEvents?device=%d", f.devices[1].ID)
+	if w := f.do(t, 0, "GET", path, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, want 401: %s", w.Code, w.Body)
+	}
+	if w := f.do(t, f.users[0].ID, "GET", path, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d, want 403: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBreakerEventList caps fetchBreakerTimeline
+const maxBreakerEventList = 500
+
+// recordBreakerRequest opens a toggle's entry in the breaker timeline; other
+// commands are ignored
+func (s *Server) recordBreakerRequest(cmd DeviceCommand, by Requester) {
+	p := cmd.Payload
+	if p.Command != "toggleBreaker" || p.BreakerID == nil || p.BreakerState == nil {
+		return
+	}
+	requestedAt := cmd.CreatedAt
+	e := BreakerEvent{
+		BreakerID:   *p.BreakerID,
+		DeviceID:    cmd.DeviceID,
+		Kind:        BreakerRequested,
+		State:       *p.BreakerState,
+		Requester:   by,
+		CommandID:   &cmd.ID,
+		RequestedAt: &requestedAt,
+	}
+	if err := s.store.CreateBreakerEvent(&e); err != nil {
+		log.Println("Failed to record breaker request:", err)
+	}
+}
+
+// recordBreakerAck closes the loop on a toggle. Replies that match no
+// recorded request are attributed to the device itself.
+func (s *Server) recordBreakerAck(device Device, breaker Breaker, response DeviceResponse) {
+	now := time.Now()
+	e := BreakerEvent{
+		BreakerID:      breaker.ID,
+		DeviceID:       device.ID,
+		Kind:           BreakerConfirmed,
+		State:          *response.BreakerState,
+		Requester:      Requester{Source: SourceDevice},
+		AcknowledgedAt: &now,
+	}
+	if response.Status == "error" {
+		e.Kind, e.Error = BreakerFailed, response.Error
+	}
+	if response.RequestID != "" {
+		req, err := s.store.FindBreakerRequest(device.ID, response.RequestID)
+		switch {
+		case err == nil:
+			e.Requester, e.CommandID, e.RequestedAt = req.Requester, req.CommandID, req.RequestedAt
+			if e.Kind == BreakerFailed {
+				// A failed reply echoes the state that was asked for, if any
+				e.State = req.State
+			}
+		case !errors.Is(err, ErrNotFound):
+			log.Println("Failed to look up breaker request:", err)
+		}
+	}
+	if err := s.store.CreateBreakerEvent(&e); err != nil {
+		log.Println("Failed to record breaker acknowledgement:", err)
+	}
+}
+
+// fetchBreakerTimeline lists a breaker's requested and confirmed changes
+// between ?start and ?end, newest first
+func (s *Server) fetchBreakerTimeline(c *gin.Context) {
+	breakerID, ok := paramID(c, "id", "breaker")
+	if !ok {
+		return
+	}
+
+	r, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	r.Limit = maxBreakerEventList
+
+	events, err := s.store.ListBreakerEvents(breakerID, r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch breaker timeline"})
+		return
+	}
+	if events == nil {
+		events = []BreakerEvent{}
+	}
+
+	c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// claimAlphabet leaves out 0/O and 1/I/L so codes survive being read aloud
+const claimAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+const claimCodeLength = 8
+
+// claimByteLimit is the largest multiple of the alphabet size that fits in a
+// byte; random bytes at or above it are dropped so every character is equally likely
+const claimByteLimit = 256 - 256%len(claimAlphabet)
+
+// errClaimThrottled rejects claims from an address with too many recent failures
+var errClaimThrottled = errors.New("too many failed claim attempts")
+
+// newClaimCode returns a random code formatted as XXXX-XXXX
+func newClaimCode() (string, error) {
+	var code strings.Builder
+	buf := make([]byte, claimCodeLength)
+	for n := 0; n < claimCodeLength; {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) >= claimByteLimit || n == claimCodeLength {
+				continue
+			}
+			if n == claimCodeLength/2 {
+				code.WriteByte('-')
+			}
+			code.WriteByte(claimAlphabet[int(b)%len(claimAlphabet)])
+			n++
+		}
+	}
+	return code.String(), nil
+}
+
+// claimLimiter counts failed claim attempts per remote IP so claim codes
+// cannot be guessed by hammering /ws
+type claimLimiter struct {
+	maxFailures int
+	window      time.Duration
+
+	mu       sync.Mutex
+	failures map[string]claimFailures
+}
+
+// claimFailures is one address's failures since since
+type claimFailures struct {
+	count int
+	since time.Time
+}
+
+func newClaimLimiter(cfg Config) *claimLimiter {
+	return &claimLimiter{
+		maxFailures: cfg.ClaimMaxFailures,
+		window:      cfg.ClaimFailureWindow,
+		failures:    make(map[string]claimFailures),
+	}
+}
+
+// allow reports whether ip may attempt another claim at now
+func (l *claimLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[ip]
+	if !ok {
+		return true
+	}
+	if now.Sub(f.since) >= l.window {
+		delete(l.failures, ip)
+		return true
+	}
+	return f.count < l.maxFailures
+}
+
+// fail records a failed claim attempt from ip, dropping windows that have passed
+func (l *claimLimiter) fail(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for addr, f := range l.failures {
+		if now.Sub(f.since) >= l.window {
+			delete(l.failures, addr)
+		}
+	}
+	f, ok := l.failures[ip]
+	if !ok {
+		f.since = now
+	}
+	f.count++
+	l.failures[ip] = f
+}
+
+// hashClaimCode normalises case and separators before hashing
+func hashClaimCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return hashDeviceSecret(code)
+}
+
+// issueClaimCode creates a fresh claim code for deviceID, voiding older ones
+func (s *Server) issueClaimCode(deviceID int) (string, time.Time, error) {
+	code, err := newClaimCode()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(s.cfg.ClaimCodeTTL)
+	if err := s.store.CreateDeviceClaim(deviceID, hashClaimCode(code), expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	return code, expiresAt, nil
+}
+
+// claimDevice binds the hello MAC to the device its claim code was issued for
+// and hands back a fresh credential. Addresses that keep presenting bad codes
+// are turned away without checking them.
+func (s *Server) claimDevice(hello deviceHello, remoteIP string) (Device, string, error) {
+	now := time.Now()
+	if !s.claims.allow(remoteIP, now) {
+		log.Printf("Claim throttled for MAC %s from %s\n", hello.MACAddr, remoteIP)
+		return Device{}, "", errClaimThrottled
+	}
+
+	device, err := s.store.RedeemDeviceClaim(hashClaimCode(hello.ClaimCode), hello.MACAddr, now)
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrClaimExpired),
+		errors.Is(err, ErrClaimUsed), errors.Is(err, ErrClaimConflict):
+		log.Printf("Claim rejected for MAC %s: %v\n", hello.MACAddr, err)
+		s.claims.fail(remoteIP, now)
+		return Device{}, "", errDeviceRejected
+	case err != nil:
+		return Device{}, "", err
+	}
+	log.Printf("Linked MAC %s to device %d\n", hello.MACAddr, device.ID)
+
+	secret, _, err := s.issueDeviceSecret(device.ID)
+	if err != nil {
+		return Device{}, "", err
+	}
+	return device, secret, nil
+}
+
+// createClaimCode issues a new claim code, e.g. after the first one expired or
+// to move the device row onto replacement hardware
+func (s *Server) createClaimCode(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	code, expiresAt, err := s.issueClaimCode(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create claim code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"claim_code": code, "claim_expires_at": expiresAt})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewClaimCodeFormat(t *testing.T) {
+	seen := make(map[rune]bool)
+	for i := 0; i < 200; i++ {
+		code, err := newClaimCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != claimCodeLength+1 || code[claimCodeLength/2] != '-' {
+			t.Fatalf("code %q is not formatted as XXXX-XXXX", code)
+		}
+		for _, r := range strings.ReplaceAll(code, "-", "") {
+			if !strings.ContainsRune(claimAlphabet, r) {
+				t.Fatalf("code %q has %q outside the claim alphabet", code, r)
+			}
+			seen[r] = true
+		}
+	}
+	if len(seen) != len(claimAlphabet) {
+		t.Errorf("1600 characters used %d of %d alphabet letters", len(seen), len(claimAlphabet))
+	}
+}
+
+func TestClaimDeviceThrottlesFailedAttempts(t *testing.T) {
+	store := NewMemoryStore()
+	cfg := DefaultConfig()
+	cfg.ClaimMaxFailures = 2
+	s := NewServer(store, cfg)
+
+	user := User{Name: "alice", Login: "alice"}
+	if err := store.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	device := Device{Name: "panel", UserID: user.ID}
+	if err := store.CreateDevice(&device); err != nil {
+		t.Fatal(err)
+	}
+	code, _, err := s.issueClaimCode(device.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guess := deviceHello{MACAddr: "AA:BB:CC:DD:EE:FF", ClaimCode: "AAAA-AAAA"}
+	for i := 0; i < cfg.ClaimMaxFailures; i++ {
+		if _, _, err := s.claimDevice(guess, "10.0.0.1"); !errors.Is(err, errDeviceRejected) {
+			t.Fatalf("guess %d: got %v, want rejection", i, err)
+		}
+	}
+
+	// The right code is no longer even checked for the guessing address
+	hello := deviceHello{MACAddr: "AA:BB:CC:DD:EE:FF", ClaimCode: code}
+	if _, _, err := s.claimDevice(hello, "10.0.0.1"); !errors.Is(err, errClaimThrottled) {
+		t.Fatalf("got %v after %d failures, want errClaimThrottled", err, cfg.ClaimMaxFailures)
+	}
+	if _, secret, err := s.claimDevice(hello, "10.0.0.2"); err != nil || secret == "" {
+		t.Fatalf("claim from another address: secret %q, err %v", secret, err)
+	}
+
+	// The block lifts once the window has passed
+	later := time.Now().Add(cfg.ClaimFailureWindow)
+	if !s.claims.allow("10.0.0.1", later) {
+		t.Error("address still blocked after the failure window")
+	}
+}
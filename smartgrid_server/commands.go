@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxAckTimeout caps the per-request wait a client may ask for
+	maxAckTimeout = 2 * time.Minute
+	// maxCommandTTL caps how long a client may keep a command queued
+	maxCommandTTL = 7 * 24 * time.Hour
+	// commandSweepInterval is how often stale commands are marked expired
+	commandSweepInterval = time.Minute
+	// maxCommandList caps fetchCommands
+	maxCommandList = 200
+)
+
+var errAckTimeout = errors.New("timed out waiting for device acknowledgement")
+
+// CommandOptions controls how dispatchCommand delivers a command
+type CommandOptions struct {
+	// Wait blocks until the device acks or Timeout passes; it has no effect
+	// when the device is offline and the command is only queued
+	Wait    bool
+	Timeout time.Duration
+	// TTL is how long the command may wait for the device to come online
+	TTL time.Duration
+	// RequestedBy is written to the breaker timeline for toggles
+	RequestedBy Requester
+}
+
+// newRequestID returns a random ID the device echoes back in its ack
+func newRequestID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// parseDurationParam resolves a client supplied duration against a default and a cap
+func parseDurationParam(requested string, def, limit time.Duration) (time.Duration, error) {
+	if requested == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(requested)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid duration")
+	}
+	return min(d, limit), nil
+}
+
+// dispatchCommand is the one path every device command takes. The command is
+// recorded first, so an offline device gets it on reconnect; an online device
+// gets the whole pending queue flushed in order. The returned command's Status
+// tells the caller which of the two happened.
+func (s *Server) dispatchCommand(deviceID int, payload DeviceResponse, opts CommandOptions) (DeviceCommand, error) {
+	requestID, err := newRequestID()
+	if err != nil {
+		return DeviceCommand{}, err
+	}
+	payload.RequestID = requestID
+	cmd := DeviceCommand{
+		DeviceID:  deviceID,
+		RequestID: payload.RequestID,
+		Command:   payload.Command,
+		Payload:   payload,
+		ExpiresAt: time.Now().Add(opts.TTL),
+	}
+	if err := s.store.CreateCommand(&cmd); err != nil {
+		return cmd, err
+	}
+	// Logged before sending so the ack always finds the request
+	s.recordBreakerRequest(cmd, opts.RequestedBy)
+
+	dc, online := s.hub.Get(deviceID)
+	if !online {
+		return cmd, nil
+	}
+
+	// Register before sending so a fast ack cannot slip past us
+	var ack <-chan DeviceResponse
+	if opts.Wait {
+		ack = s.hub.ExpectAck(deviceID, cmd.RequestID)
+		defer s.hub.CancelAck(cmd.RequestID)
+	}
+
+	if err := s.deliverPending(dc); err != nil {
+		// The connection dropped; the command stays queued for the next one
+		log.Printf("Queued command %d for device %d: %v\n", cmd.ID, deviceID, err)
+		return cmd, nil
+	}
+	cmd.Status = CommandSent
+
+	if !opts.Wait {
+		return cmd, nil
+	}
+
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-ack:
+		cmd.Status = ackStatus(response)
+		cmd.Result = &response
+		return cmd, nil
+	case <-dc.Done():
+		return cmd, errConnClosed
+	case <-timer.C:
+		return cmd, errAckTimeout
+	}
+}
+
+// deliverPending writes every queued command for dc's device, oldest first.
+// Each command is marked sent only once it is on the socket, and the next one
+// waits for that, so a long backlog cannot overflow the send buffer. It stops
+// at the first failed write and leaves the rest pending.
+func (s *Server) deliverPending(dc *DeviceConn) error {
+	dc.flushMu.Lock()
+	defer dc.flushMu.Unlock()
+
+	cmds, err := s.store.PendingCommands(dc.Device.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := dc.Deliver(cmd.Payload); err != nil {
+			return err
+		}
+		if err := s.store.MarkCommandSent(cmd.ID, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ackStatus maps a device reply onto the command lifecycle
+func ackStatus(response DeviceResponse) string {
+	if response.Status == "error" {
+		return CommandFailed
+	}
+	return CommandAcked
+}
+
+// completeCommand records the device's reply against the command it answers
+func (s *Server) completeCommand(device Device, response DeviceResponse) {
+	err := s.store.CompleteCommand(device.ID, response.RequestID, ackStatus(response), response, time.Now())
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Println("Failed to record command result:", err)
+	}
+}
+
+// Start runs background jobs until ctx is cancelled
+func (s *Server) Start(ctx context.Context) {
+	// Nothing is connected yet, so any open session was cut off by a restart
+	if err := s.store.CloseStaleDeviceSessions(time.Now()); err != nil {
+		log.Println("Failed to close stale device sessions:", err)
+	}
+	if err := s.store.CloseOpenExcursions(time.Now()); err != nil {
+		log.Println("Failed to close stale excursions:", err)
+	}
+	if err := s.store.AbortRunningCommandJobs(time.Now()); err != nil {
+		log.Println("Failed to abort interrupted command jobs:", err)
+	}
+	s.armOfflineRules()
+	go s.expireCommands(ctx)
+	go s.maintainFrequency(ctx)
+	go s.queueWebhookEvents(ctx)
+	go s.deliverWebhooks(ctx)
+	go s.runSchedules(ctx)
+}
+
+// expireCommands periodically retires commands whose TTL has passed
+func (s *Server) expireCommands(ctx context.Context) {
+	ticker := time.NewTicker(commandSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := s.store.ExpireCommands(now)
+			if err != nil {
+				log.Println("Failed to expire commands:", err)
+			} else if n > 0 {
+				log.Printf("Expired %d device commands\n", n)
+			}
+			s.expireRolloutTargets(now)
+		}
+	}
+}
+
+// fetchCommands lists a device's recent commands, optionally filtered by status
+func (s *Server) fetchCommands(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", CommandPending, CommandSent, CommandAcked, CommandFailed, CommandExpired, CommandCancelled:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+	limit := maxCommandList
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxCommandList)
+	}
+
+	cmds, err := s.store.ListCommands(deviceID, status, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch commands"})
+		return
+	}
+	if cmds == nil {
+		cmds = []DeviceCommand{}
+	}
+
+	c.JSON(http.StatusOK, cmds)
+}
+
+// cancelCommand drops a command that has not reached the device yet
+func (s *Server) cancelCommand(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command ID"})
+		return
+	}
+
+	auditTarget(c, "command", id)
+	cmd, err := s.store.GetCommand(id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Command not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch command"})
+		return
+	}
+	if !s.authorizeDevice(c, cmd.DeviceID, RoleOperator) {
+		return
+	}
+
+	err = s.store.CancelCommand(id, time.Now())
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Command not found"})
+		return
+	case errors.Is(err, ErrCommandNotPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "Command has already been sent"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not cancel command"})
+		return
+	}
+	auditChange(c, gin.H{"status": cmd.Status}, gin.H{"status": CommandCancelled})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Command cancelled successfully"})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeDevice is the panel's side of a live connection
+type fakeDevice struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+// next reads the next frame the server sent
+func (d *fakeDevice) next() DeviceResponse {
+	d.t.Helper()
+	var msg DeviceResponse
+	d.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := d.ws.ReadJSON(&msg); err != nil {
+		d.t.Errorf("device read: %v", err)
+	}
+	return msg
+}
+
+// reply sends msg to the server
+func (d *fakeDevice) reply(msg DeviceResponse) {
+	d.t.Helper()
+	if err := d.ws.WriteJSON(msg); err != nil {
+		d.t.Errorf("device write: %v", err)
+	}
+}
+
+// newCommandServer returns a server with one device owned by one user
+func newCommandServer(t *testing.T) (*Server, Device) {
+	t.Helper()
+	store := NewMemoryStore()
+	s := NewServer(store, DefaultConfig())
+	user := User{Name: "alice", Login: "alice"}
+	if err := store.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	device := Device{Name: "panel", UserID: user.ID}
+	if err := store.CreateDevice(&device); err != nil {
+		t.Fatal(err)
+	}
+	return s, device
+}
+
+// connectDevice connects a fake panel the way handleWebSocket does after the
+// handshake
+func connectDevice(t *testing.T, s *Server, device Device) (*DeviceConn, *fakeDevice) {
+	t.Helper()
+	dc, ws := dialHub(t, s.hub, device)
+	s.openSession(dc)
+	go s.receivePacket(dc)
+	if err := s.deliverPending(dc); err != nil {
+		t.Fatal(err)
+	}
+	return dc, &fakeDevice{t: t, ws: ws}
+}
+
+// waitForCommand polls until the command reaches status
+func waitForCommand(t *testing.T, s *Server, id int64, status string) DeviceCommand {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cmd, err := s.store.GetCommand(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd.Status == status {
+			return cmd
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("command %d is %s, want %s", id, cmd.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatchCommandWaitsForAck(t *testing.T) {
+	s, device := newCommandServer(t)
+	_, panel := connectDevice(t, s, device)
+
+	go func() {
+		ping := panel.next()
+		panel.reply(DeviceResponse{Command: "ACK", RequestID: ping.RequestID, Status: "ok"})
+		flash := panel.next()
+		panel.reply(DeviceResponse{Command: "ACK", RequestID: flash.RequestID, Status: "error", Error: "LED driver fault"})
+	}()
+
+	opts := CommandOptions{Wait: true, Timeout: 5 * time.Second, TTL: time.Hour}
+	cmd, err := s.dispatchCommand(device.ID, DeviceResponse{Command: "pingDevice"}, opts)
+	if err != nil || cmd.Status != CommandAcked {
+		t.Fatalf("ping: got %s, %v; want acked", cmd.Status, err)
+	}
+	waitForCommand(t, s, cmd.ID, CommandAcked)
+
+	cmd, err = s.dispatchCommand(device.ID, DeviceResponse{Command: "flashLED"}, opts)
+	if err != nil || cmd.Status != CommandFailed || cmd.Result == nil || cmd.Result.Error != "LED driver fault" {
+		t.Fatalf("flash: got %+v, %v; want failed with the device error", cmd, err)
+	}
+	waitForCommand(t, s, cmd.ID, CommandFailed)
+}
+
+func TestDispatchCommandTimesOutAndRecordsLateAck(t *testing.T) {
+	s, device := newCommandServer(t)
+	_, panel := connectDevice(t, s, device)
+
+	opts := CommandOptions{Wait: true, Timeout: 50 * time.Millisecond, TTL: time.Hour}
+	cmd, err := s.dispatchCommand(device.ID, DeviceResponse{Command: "pingDevice"}, opts)
+	if !errors.Is(err, errAckTimeout) || cmd.Status != CommandSent {
+		t.Fatalf("got %s, %v; want sent and errAckTimeout", cmd.Status, err)
+	}
+	s.hub.pendingMu.Lock()
+	waiters := len(s.hub.pending)
+	s.hub.pendingMu.Unlock()
+	if waiters != 0 {
+		t.Fatalf("%d ack waiters left behind after the timeout", waiters)
+	}
+
+	// The ack arriving after the caller gave up still closes out the command
+	ping := panel.next()
+	if ping.RequestID != cmd.RequestID {
+		t.Fatalf("device got request %q, want %q", ping.RequestID, cmd.RequestID)
+	}
+	panel.reply(DeviceResponse{Command: "ACK", RequestID: ping.RequestID, Status: "ok"})
+	late := waitForCommand(t, s, cmd.ID, CommandAcked)
+	if late.Result == nil || late.Result.RequestID != cmd.RequestID {
+		t.Fatalf("late ack recorded %+v", late.Result)
+	}
+}
+
+func TestPendingCommandsDeliveredOnReconnect(t *testing.T) {
+	s, device := newCommandServer(t)
+	dc, panel := connectDevice(t, s, device)
+
+	// Drop the panel and wait for the server to notice
+	panel.ws.Close()
+	select {
+	case <-dc.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never noticed the panel leaving")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, online := s.hub.Get(device.ID); !online {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("panel still registered after disconnecting")
+		}
+	}
+
+	// Queue more commands than the send buffer holds
+	queued := make([]DeviceCommand, sendBuffer*2)
+	for i := range queued {
+		cmd, err := s.dispatchCommand(device.ID, DeviceResponse{Command: "pingDevice"}, CommandOptions{TTL: time.Hour})
+		if err != nil || cmd.Status != CommandPending {
+			t.Fatalf("offline dispatch %d: got %s, %v; want pending", i, cmd.Status, err)
+		}
+		queued[i] = cmd
+	}
+
+	dc, panel = connectDevice(t, s, device)
+	for i, cmd := range queued {
+		got := panel.next()
+		if got.RequestID != cmd.RequestID {
+			t.Fatalf("frame %d is request %q, want %q", i, got.RequestID, cmd.RequestID)
+		}
+		waitForCommand(t, s, cmd.ID, CommandSent)
+	}
+	select {
+	case <-dc.Done():
+		t.Fatal("delivering the backlog closed the connection")
+	default:
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the tunables read from the environment at startup
+type Config struct {
+	// PublicURL is the base URL devices reach this server on, used in the
+	// firmware download links sent with otaUpdate
+	PublicURL string
+	// TrustedProxies are the addresses or CIDRs whose X-Forwarded-For is
+	// believed for the client IP in the audit log; none by default
+	TrustedProxies []string
+
+	// ClaimCodeTTL is how long a device claim code stays redeemable
+	ClaimCodeTTL time.Duration
+	// ClaimMaxFailures failed claim attempts from one IP within
+	// ClaimFailureWindow block further claims from it until the window passes
+	ClaimMaxFailures   int
+	ClaimFailureWindow time.Duration
+	// DevicePongWait is how long a device may stay silent, pongs included,
+	// before its connection is dropped; pings go out at 90% of this
+	DevicePongWait time.Duration
+	// CommandAckTimeout is how long sendPacket waits for an ack by default
+	CommandAckTimeout time.Duration
+	// CommandTTL is how long a command waits for an offline device by default
+	CommandTTL time.Duration
+	// CommandJobConcurrency caps how many commands one command job has in flight
+	CommandJobConcurrency int
+
+	// Retention of raw readings and of their 1m and 1h rollups; 0 keeps forever
+	FrequencyRawRetention    time.Duration
+	FrequencyMinuteRetention time.Duration
+	FrequencyHourRetention   time.Duration
+	// RollupInterval is how often rollups are built and expired data pruned
+	RollupInterval time.Duration
+
+	// ExcursionLow and ExcursionHigh bound the normal frequency band in Hz; a
+	// device outside it for ExcursionMinDuration records an excursion
+	ExcursionLow         float64
+	ExcursionHigh        float64
+	ExcursionMinDuration time.Duration
+	// ExcursionRocof is the |df/dt| in Hz/s that also opens an excursion; 0 disables it
+	ExcursionRocof float64
+
+	// RocofWindow is the span of readings ROCOF is fitted over. Devices report
+	// about once a minute, so it has to cover at least two reports.
+	RocofWindow time.Duration
+
+	// WebhookTimeout bounds one delivery attempt. Failed deliveries are retried
+	// after WebhookRetryBase, doubling up to WebhookRetryMax, and given up on
+	// after WebhookMaxAttempts attempts.
+	WebhookTimeout     time.Duration
+	WebhookRetryBase   time.Duration
+	WebhookRetryMax    time.Duration
+	WebhookMaxAttempts int
+	// WebhookAllowPrivate lets webhooks reach loopback, private and link-local
+	// addresses, e.g. a receiver on the same LAN; off by default
+	WebhookAllowPrivate bool
+
+	// LoadShedThresholds are the under-frequency levels in Hz, highest first;
+	// breakers of priority n are opened once frequency has stayed below the
+	// n-th for LoadShedDelay and LoadShedMinReadings readings in a row. Empty,
+	// the default, disables load shedding.
+	LoadShedThresholds  []float64
+	LoadShedDelay       time.Duration
+	LoadShedMinReadings int
+	// Shed breakers come back once frequency has been at or above
+	// LoadShedRestoreHz for LoadShedRestoreDelay, one tier per
+	// LoadShedRestoreStagger, last shed first
+	LoadShedRestoreHz      float64
+	LoadShedRestoreDelay   time.Duration
+	LoadShedRestoreStagger time.Duration
+}
+
+// DefaultConfig is used for anything not set in the environment
+func DefaultConfig() Config {
+	return Config{
+		PublicURL: "http://localhost:8080",
+
+		ClaimCodeTTL:       15 * time.Minute,
+		ClaimMaxFailures:   5,
+		ClaimFailureWindow: 15 * time.Minute,
+
+		DevicePongWait:    60 * time.Second,
+		CommandAckTimeout: 10 * time.Second,
+		CommandTTL:        time.Hour,
+
+		CommandJobConcurrency: 8,
+
+		FrequencyRawRetention:    7 * 24 * time.Hour,
+		FrequencyMinuteRetention: 90 * 24 * time.Hour,
+		FrequencyHourRetention:   0,
+		RollupInterval:           time.Minute,
+
+		ExcursionLow:         59.95,
+		ExcursionHigh:        60.05,
+		ExcursionMinDuration: 5 * time.Second,
+		ExcursionRocof:       0,
+
+		RocofWindow: 2 * time.Minute,
+
+		WebhookTimeout:     10 * time.Second,
+		WebhookRetryBase:   30 * time.Second,
+		WebhookRetryMax:    6 * time.Hour,
+		WebhookMaxAttempts: 10,
+
+		LoadShedDelay:          10 * time.Second,
+		LoadShedMinReadings:    3,
+		LoadShedRestoreHz:      59.9,
+		LoadShedRestoreDelay:   5 * time.Minute,
+		LoadShedRestoreStagger: time.Minute,
+	}
+}
+
+// LoadConfig overlays environment variables on DefaultConfig
+func LoadConfig() Config {
+	cfg := DefaultConfig()
+	envString("PUBLIC_URL", &cfg.PublicURL)
+	envStrings("TRUSTED_PROXIES", &cfg.TrustedProxies)
+	envDuration("CLAIM_CODE_TTL", &cfg.ClaimCodeTTL)
+	envInt("CLAIM_MAX_FAILURES", &cfg.ClaimMaxFailures)
+	envDuration("CLAIM_FAILURE_WINDOW", &cfg.ClaimFailureWindow)
+	envDuration("DEVICE_PONG_WAIT", &cfg.DevicePongWait)
+	envDuration("COMMAND_ACK_TIMEOUT", &cfg.CommandAckTimeout)
+	envDuration("COMMAND_TTL", &cfg.CommandTTL)
+	envInt("COMMAND_JOB_CONCURRENCY", &cfg.CommandJobConcurrency)
+	envDuration("FREQUENCY_RAW_RETENTION", &cfg.FrequencyRawRetention)
+	envDuration("FREQUENCY_1M_RETENTION", &cfg.FrequencyMinuteRetention)
+	envDuration("FREQUENCY_1H_RETENTION", &cfg.FrequencyHourRetention)
+	envDuration("ROLLUP_INTERVAL", &cfg.RollupInterval)
+	envFloat("EXCURSION_LOW_HZ", &cfg.ExcursionLow)
+	envFloat("EXCURSION_HIGH_HZ", &cfg.ExcursionHigh)
+	envDuration("EXCURSION_MIN_DURATION", &cfg.ExcursionMinDuration)
+	envFloat("EXCURSION_ROCOF_HZ_PER_S", &cfg.ExcursionRocof)
+	envDuration("ROCOF_WINDOW", &cfg.RocofWindow)
+	envDuration("WEBHOOK_TIMEOUT", &cfg.WebhookTimeout)
+	envDuration("WEBHOOK_RETRY_BASE", &cfg.WebhookRetryBase)
+	envDuration("WEBHOOK_RETRY_MAX", &cfg.WebhookRetryMax)
+	envInt("WEBHOOK_MAX_ATTEMPTS", &cfg.WebhookMaxAttempts)
+	envBool("WEBHOOK_ALLOW_PRIVATE", &cfg.WebhookAllowPrivate)
+	envFloats("LOAD_SHED_THRESHOLDS_HZ", &cfg.LoadShedThresholds)
+	envDuration("LOAD_SHED_DELAY", &cfg.LoadShedDelay)
+	envInt("LOAD_SHED_MIN_READINGS", &cfg.LoadShedMinReadings)
+	envFloat("LOAD_SHED_RESTORE_HZ", &cfg.LoadShedRestoreHz)
+	envDuration("LOAD_SHED_RESTORE_DELAY", &cfg.LoadShedRestoreDelay)
+	envDuration("LOAD_SHED_RESTORE_STAGGER", &cfg.LoadShedRestoreStagger)
+
+	cfg.PublicURL = strings.TrimRight(cfg.PublicURL, "/")
+	if cfg.CommandJobConcurrency < 1 {
+		log.Fatal("COMMAND_JOB_CONCURRENCY must be at least 1")
+	}
+	for i, hz := range cfg.LoadShedThresholds {
+		if hz >= cfg.LoadShedRestoreHz || (i > 0 && hz >= cfg.LoadShedThresholds[i-1]) {
+			log.Fatal("LOAD_SHED_THRESHOLDS_HZ must be descending and below LOAD_SHED_RESTORE_HZ")
+		}
+	}
+	return cfg
+}
+
+// envString copies the variable into dst if set
+func envString(key string, dst *string) {
+	if value := os.Getenv(key); value != "" {
+		*dst = value
+	}
+}
+
+// envStrings splits a comma-separated list into dst if set
+func envStrings(key string, dst *[]string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	var list []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+	*dst = list
+}
+
+// envDuration parses a Go duration such as "90s" or "168h" into dst if set
+func envDuration(key string, dst *time.Duration) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	*dst = d
+}
+
+// envFloat parses a decimal number into dst if set
+func envFloat(key string, dst *float64) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	*dst = f
+}
+
+// envInt parses a whole number into dst if set
+func envInt(key string, dst *int) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	*dst = n
+}
+
+// envBool parses "true", "false", "1" or "0" into dst if set
+func envBool(key string, dst *bool) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	*dst = b
+}
+
+// envFloats parses a comma-separated list of numbers into dst if set; "off"
+// sets an empty list
+func envFloats(key string, dst *[]float64) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	var list []float64
+	if value != "off" {
+		for _, field := range strings.Split(value, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				log.Fatalf("Invalid %s %q: %v", key, value, err)
+			}
+			list = append(list, f)
+		}
+	}
+	*dst = list
+}
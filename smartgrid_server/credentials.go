@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// handshakeTimeout bounds how long a device may take to send its hello frame
+const handshakeTimeout = 10 * time.Second
+
+var errDeviceRejected = errors.New("device rejected")
+
+// deviceHello is the first frame a device sends after the /ws upgrade
+type deviceHello struct {
+	MACAddr   string `json:"mac_addr"`
+	Token     string `json:"token,omitempty"`
+	ClaimCode string `json:"claim_code,omitempty"`
+	// Model and Firmware identify what the device runs, for OTA rollouts
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	// ConfigVersion is the settings version the device is running, if any
+	ConfigVersion *int `json:"config_version,omitempty"`
+}
+
+// newDeviceSecret returns a random secret and the hash stored for it
+func newDeviceSecret() (secret, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret = hex.EncodeToString(buf)
+	return secret, hashDeviceSecret(secret), nil
+}
+
+func hashDeviceSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyDeviceSecret checks secret against the device's live credential
+func (s *Server) verifyDeviceSecret(deviceID int, secret string) error {
+	if secret == "" {
+		return errDeviceRejected
+	}
+	hash, err := s.store.ActiveCredentialHash(deviceID)
+	if errors.Is(err, ErrNotFound) {
+		// Never issued, or revoked by the owner
+		return errDeviceRejected
+	} else if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashDeviceSecret(secret))) != 1 {
+		return errDeviceRejected
+	}
+	return nil
+}
+
+// issueDeviceSecret stores a fresh credential for deviceID and returns the plaintext
+func (s *Server) issueDeviceSecret(deviceID int) (string, DeviceCredential, error) {
+	secret, hash, err := newDeviceSecret()
+	if err != nil {
+		return "", DeviceCredential{}, err
+	}
+	credential, err := s.store.IssueDeviceCredential(deviceID, hash)
+	return secret, credential, err
+}
+
+// authenticateDevice resolves the hello frame to a device. Known MACs must
+// present their live credential. Otherwise the device has to redeem a claim
+// code, and the credential issued for it is returned so it can be handed over.
+func (s *Server) authenticateDevice(hello deviceHello, remoteIP string) (Device, string, error) {
+	if hello.MACAddr == "" {
+		return Device{}, "", errDeviceRejected
+	}
+
+	if hello.Token != "" {
+		device, err := s.store.GetDeviceByMAC(hello.MACAddr)
+		if err == nil {
+			err = s.verifyDeviceSecret(device.ID, hello.Token)
+		}
+		if err == nil {
+			return device, "", nil
+		} else if !errors.Is(err, ErrNotFound) && !errors.Is(err, errDeviceRejected) {
+			return Device{}, "", err
+		}
+	}
+
+	if hello.ClaimCode != "" {
+		return s.claimDevice(hello, remoteIP)
+	}
+	return Device{}, "", errDeviceRejected
+}
+
+// rejectDevice closes a connection that failed the handshake
+func rejectDevice(conn *websocket.Conn, reason string) {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// activeCredentials lists a device's credentials that are not revoked
+func (s *Server) activeCredentials(deviceID int) ([]DeviceCredential, error) {
+	credentials, err := s.store.ListDeviceCredentials(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	active := []DeviceCredential{}
+	for _, credential := range credentials {
+		if credential.RevokedAt == nil {
+			active = append(active, credential)
+		}
+	}
+	return active, nil
+}
+
+func (s *Server) fetchDeviceCredentials(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	credentials, err := s.store.ListDeviceCredentials(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch credentials"})
+		return
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+// rotateDeviceCredential replaces the device secret. The new secret is returned
+// once and pushed to the device if it is connected right now.
+func (s *Server) rotateDeviceCredential(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	before, err := s.activeCredentials(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not rotate credential"})
+		return
+	}
+	secret, credential, err := s.issueDeviceSecret(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not rotate credential"})
+		return
+	}
+	auditChange(c, before, []DeviceCredential{credential})
+
+	delivered := false
+	if dc, exists := s.hub.Get(deviceID); exists {
+		delivered = dc.Send(gin.H{"command": "setCredential", "token": secret}) == nil
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Credential rotated successfully",
+		"credential": credential,
+		"token":      secret,
+		"delivered":  delivered,
+	})
+}
+
+// revokeDeviceCredential locks the device out until a new credential is issued
+func (s *Server) revokeDeviceCredential(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	before, err := s.activeCredentials(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke credential"})
+		return
+	}
+	if err := s.store.RevokeDeviceCredentials(deviceID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke credential"})
+		return
+	}
+	auditChange(c, before, []DeviceCredential{})
+
+	// Drop the live session so the revocation takes effect immediately
+	s.hub.Disconnect(deviceID, "credential revoked")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Credential revoked successfully"})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventConfig reports a device applying or rejecting its settings
+const EventConfig = "config"
+
+// defaultDeviceSettings is what the firmware runs before it is sent any settings
+func defaultDeviceSettings() DeviceSettings {
+	return DeviceSettings{
+		Telemetry: TelemetrySettings{IntervalS: 60},
+		Sampling:  SamplingSettings{IntervalMs: 2000, MinEdgeUs: 100, MaxEdgeUs: 500000},
+		LED:       LEDSettings{BlinkIntervalMs: 100, LowHz: 59, HighHz: 61, FlashCount: 3},
+	}
+}
+
+// validate rejects settings the firmware cannot run with
+func (d DeviceSettings) validate() error {
+	switch {
+	case d.Telemetry.IntervalS < 1 || d.Telemetry.IntervalS > 3600:
+		return errors.New("telemetry.interval_s must be between 1 and 3600")
+	case d.Sampling.IntervalMs < 100 || d.Sampling.IntervalMs > 60000:
+		return errors.New("sampling.interval_ms must be between 100 and 60000")
+	case d.Sampling.IntervalMs > d.Telemetry.IntervalS*1000:
+		return errors.New("sampling.interval_ms must not exceed the telemetry interval")
+	case d.Sampling.MinEdgeUs < 1 || d.Sampling.MaxEdgeUs <= d.Sampling.MinEdgeUs || d.Sampling.MaxEdgeUs > 10000000:
+		return errors.New("sampling edge bounds must satisfy 1 <= min_edge_us < max_edge_us <= 10000000")
+	case d.LED.BlinkIntervalMs < 10 || d.LED.BlinkIntervalMs > 10000:
+		return errors.New("led.blink_interval_ms must be between 10 and 10000")
+	case d.LED.LowHz <= 0 || d.LED.HighHz <= d.LED.LowHz:
+		return errors.New("led.low_hz must be positive and below led.high_hz")
+	case d.LED.FlashCount < 0 || d.LED.FlashCount > 20:
+		return errors.New("led.flash_count must be between 0 and 20")
+	}
+	return nil
+}
+
+// deviceConfigReport shows the settings a device should run next to the ones
+// it last reported applying
+type deviceConfigReport struct {
+	DeviceID int           `json:"device_id"`
+	Desired  DeviceConfig  `json:"desired"`
+	Applied  *DeviceConfig `json:"applied"`
+	InSync   bool          `json:"in_sync"`
+}
+
+// pushConfig sends cfg with setConfig, replacing any older setConfig still
+// queued for the device so it only ever catches up to the newest version
+func (s *Server) pushConfig(cfg DeviceConfig) (DeviceCommand, error) {
+	pending, err := s.store.ListCommands(cfg.DeviceID, CommandPending, maxCommandList)
+	if err != nil {
+		return DeviceCommand{}, err
+	}
+	for _, cmd := range pending {
+		if cmd.Command == "setConfig" {
+			if err := s.store.CancelCommand(cmd.ID, time.Now()); err != nil && !errors.Is(err, ErrCommandNotPending) {
+				return DeviceCommand{}, err
+			}
+		}
+	}
+
+	payload := DeviceResponse{Command: "setConfig", Config: &cfg.Settings, ConfigVersion: &cfg.Version}
+	return s.dispatchCommand(cfg.DeviceID, payload, CommandOptions{TTL: s.cfg.CommandTTL})
+}
+
+// syncConfig runs when a device connects: it records the settings version the
+// device says it runs and pushes the latest settings if that is not them.
+// Devices that have never been configured keep their built-in defaults.
+func (s *Server) syncConfig(device Device, hello deviceHello) {
+	cfg, err := s.store.LatestDeviceConfig(device.ID)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Println("Failed to load device config:", err)
+		}
+		return
+	}
+	if hello.ConfigVersion != nil {
+		err := s.store.RecordDeviceConfigResult(device.ID, *hello.ConfigVersion, "", time.Now())
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Println("Failed to record applied config:", err)
+		}
+		if *hello.ConfigVersion == cfg.Version {
+			return
+		}
+	}
+	if _, err := s.pushConfig(cfg); err != nil {
+		log.Println("Failed to push config to device", device.ID, err)
+	}
+}
+
+// handleConfigResult records the device's reply to setConfig
+func (s *Server) handleConfigResult(device Device, response DeviceResponse) {
+	if response.ConfigVersion == nil {
+		log.Println("Missing config version in setConfig reply")
+		return
+	}
+	applyErr := ""
+	if response.Status == "error" {
+		applyErr = response.Error
+		if applyErr == "" {
+			applyErr = "Device reported an error"
+		}
+	}
+	err := s.store.RecordDeviceConfigResult(device.ID, *response.ConfigVersion, applyErr, time.Now())
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("Device %d applied unknown config version %d\n", device.ID, *response.ConfigVersion)
+		return
+	} else if err != nil {
+		log.Println("Failed to record applied config:", err)
+		return
+	}
+	s.publish(EventConfig, device, gin.H{"version": *response.ConfigVersion, "applied": applyErr == "", "error": applyErr})
+}
+
+// readDeviceConfig returns the device's desired and applied settings. Before
+// any settings are saved, desired is the firmware defaults at version 0.
+func (s *Server) readDeviceConfig(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	report := deviceConfigReport{DeviceID: deviceID}
+	desired, err := s.store.LatestDeviceConfig(deviceID)
+	if errors.Is(err, ErrNotFound) {
+		desired, err = DeviceConfig{DeviceID: deviceID, Settings: defaultDeviceSettings()}, nil
+	}
+	var applied DeviceConfig
+	if err == nil {
+		applied, err = s.store.AppliedDeviceConfig(deviceID)
+		if err == nil {
+			report.Applied = &applied
+		} else if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve config"})
+		return
+	}
+	report.Desired = desired
+	report.InSync = report.Applied != nil && report.Applied.Version == desired.Version
+
+	c.JSON(http.StatusOK, report)
+}
+
+// updateDeviceConfig saves new settings as the device's next version and
+// pushes them with setConfig. Fields left out of the body keep their current
+// values.
+func (s *Server) updateDeviceConfig(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	current, err := s.store.LatestDeviceConfig(deviceID)
+	if errors.Is(err, ErrNotFound) {
+		current, err = DeviceConfig{Settings: defaultDeviceSettings()}, nil
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve config"})
+		return
+	}
+	settings := current.Settings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if err := settings.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if current.Version > 0 && settings == current.Settings {
+		c.JSON(http.StatusOK, gin.H{"message": "Device config unchanged", "version": current.Version})
+		return
+	}
+
+	userID := currentUserID(c)
+	cfg := DeviceConfig{DeviceID: deviceID, Settings: settings, UpdatedBy: &userID}
+	if err := s.store.CreateDeviceConfig(&cfg); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update config"})
+		return
+	}
+	auditChange(c, gin.H{"version": current.Version, "config": current.Settings}, gin.H{"version": cfg.Version, "config": cfg.Settings})
+
+	// Saved either way; a device that misses this push gets it on reconnect
+	cmd, err := s.pushConfig(cfg)
+	if err != nil {
+		log.Println("Failed to push config to device", deviceID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device config updated successfully", "version": cfg.Version, "status": cmd.Status})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeviceConfigDesiredVersusApplied(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewServer(store, DefaultConfig())
+	router := s.Router()
+	owner, device := seedDevice(t, store, "bob")
+	viewer := User{Name: "carol", Login: "carol", Email: "carol@example.com", Pass: "hash"}
+	if err := store.CreateUser(&viewer); err != nil {
+		t.Fatal(err)
+	}
+	inv := DeviceInvitation{DeviceID: device.ID, Email: viewer.Email, Role: RoleViewer, InvitedBy: &owner.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.CreateDeviceInvitation(&inv); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AcceptDeviceInvitation(inv.ID, viewer.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("/updateDeviceConfig/%d", device.ID)
+	read := func() deviceConfigReport {
+		t.Helper()
+		var report deviceConfigReport
+		w := serve(t, router, viewer.ID, "GET", fmt.Sprintf("/readDeviceConfig/%d", device.ID), "")
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("read got %d: %s", w.Code, w.Body)
+		}
+		return report
+	}
+
+	if report := read(); report.Desired.Version != 0 || report.Desired.Settings != defaultDeviceSettings() || report.Applied != nil {
+		t.Fatalf("unexpected initial config: %+v", report)
+	}
+	if w := serve(t, router, viewer.ID, "PUT", path, `{"telemetry":{"interval_s":30}}`); w.Code != http.StatusForbidden {
+		t.Fatalf("viewer update got %d, want 403", w.Code)
+	}
+	if w := serve(t, router, owner.ID, "PUT", path, `{"telemetry":{"interval_s":0}}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid update got %d, want 400", w.Code)
+	}
+
+	// Two changes while offline leave only the newest queued
+	for _, body := range []string{`{"telemetry":{"interval_s":30}}`, `{"led":{"flash_count":5}}`} {
+		if w := serve(t, router, owner.ID, "PUT", path, body); w.Code != http.StatusOK {
+			t.Fatalf("update got %d: %s", w.Code, w.Body)
+		}
+	}
+	cmds, err := store.ListCommands(device.ID, CommandPending, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 1 || cmds[0].Command != "setConfig" || *cmds[0].Payload.ConfigVersion != 2 {
+		t.Fatalf("got %d queued commands, want only setConfig version 2", len(cmds))
+	}
+	report := read()
+	if report.Desired.Version != 2 || report.Desired.Settings.Telemetry.IntervalS != 30 || report.Desired.Settings.LED.FlashCount != 5 || report.InSync {
+		t.Fatalf("unexpected desired config: %+v", report)
+	}
+
+	// The device rejects version 2, then reconnects running it
+	version := 2
+	s.handleConfigResult(device, DeviceResponse{Command: "setConfig", Status: "error", Error: "bad bounds", ConfigVersion: &version})
+	if report := read(); report.Applied != nil || report.Desired.Error != "bad bounds" {
+		t.Fatalf("unexpected rejected config: %+v", report)
+	}
+	s.syncConfig(device, deviceHello{MACAddr: device.MACAddr, ConfigVersion: &version})
+	if report := read(); !report.InSync || report.Applied.Version != 2 || report.Applied.Error != "" {
+		t.Fatalf("unexpected applied config: %+v", report)
+	}
+	if w := serve(t, router, owner.ID, "PUT", path, `{"led":{"flash_count":5}}`); w.Code != http.StatusOK || bytes.Contains(w.Body.Bytes(), []byte(`"version":3`)) {
+		t.Fatalf("unchanged update got %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// eventBuffer is how many events may queue for one client before it is dropped
+	eventBuffer = 64
+	// streamKeepAlive keeps idle proxies from closing the event stream
+	streamKeepAlive = 25 * time.Second
+)
+
+// Event types pushed to app clients
+const (
+	EventFrequency = "frequency"
+	EventBreaker   = "breaker"
+	EventPresence  = "presence"
+)
+
+// Event is one real-time update about a device
+type Event struct {
+	Type     string    `json:"type"`
+	DeviceID int       `json:"device_id"`
+	Time     time.Time `json:"time"`
+	Data     any       `json:"data"`
+
+	// userIDs are the users the event is routed to
+	userIDs []int
+}
+
+// Subscription receives the events of one user, optionally narrowed to some devices
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	userID  int
+	devices map[int]bool
+}
+
+// Broker fans device events out to subscribed app clients
+type Broker struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe registers for userID's events; an empty deviceIDs means all devices
+func (b *Broker) Subscribe(userID int, deviceIDs []int) *Subscription {
+	ch := make(chan Event, eventBuffer)
+	sub := &Subscription{C: ch, ch: ch, userID: userID}
+	if len(deviceIDs) > 0 {
+		sub.devices = make(map[int]bool, len(deviceIDs))
+		for _, id := range deviceIDs {
+			sub.devices[id] = true
+		}
+	}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe stops delivery and closes sub.C; it is safe to call twice
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Publish hands e to every matching subscriber without blocking. A client that
+// has fallen eventBuffer events behind is cut off and has to reconnect.
+func (b *Broker) Publish(e Event) {
+	var slow []*Subscription
+
+	b.mu.RLock()
+	for sub := range b.subs {
+		if !slices.Contains(e.userIDs, sub.userID) || (sub.devices != nil && !sub.devices[e.DeviceID]) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range slow {
+		b.Unsubscribe(sub)
+	}
+}
+
+// publish stamps and routes an event about device to the app clients and
+// webhooks of everyone with access to it
+func (s *Server) publish(eventType string, device Device, data any) {
+	userIDs, err := s.deviceUserIDs(device)
+	if err != nil {
+		log.Println("Failed to load device members:", err)
+		userIDs = []int{device.UserID}
+	}
+	s.publishTo(userIDs, eventType, device, data)
+}
+
+// publishTo routes an event about device to the given users only
+func (s *Server) publishTo(userIDs []int, eventType string, device Device, data any) {
+	e := Event{
+		Type:     eventType,
+		DeviceID: device.ID,
+		Time:     time.Now(),
+		Data:     data,
+		userIDs:  userIDs,
+	}
+	s.events.Publish(e)
+	s.enqueueWebhookEvent(e)
+}
+
+// streamEvents is a Server-Sent Events stream of the caller's device events.
+// Repeat ?device=ID to narrow it to specific devices.
+func (s *Server) streamEvents(c *gin.Context) {
+	var deviceIDs []int
+	for _, raw := range c.QueryArray("device") {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device ID"})
+			return
+		}
+		if !s.authorizeDevice(c, id, RoleViewer) {
+			return
+		}
+		deviceIDs = append(deviceIDs, id)
+	}
+
+	sub := s.events.Subscribe(currentUserID(c), deviceIDs)
+	defer s.events.Unsubscribe(sub)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			c.SSEvent(e.Type, e)
+			return true
+		case now := <-keepAlive.C:
+			c.SSEvent("ping", gin.H{"time": now})
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
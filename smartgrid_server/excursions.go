@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxExcursionList caps fetchExcursions
+const maxExcursionList = 500
+
+// EventExcursion is pushed to app clients when an excursion opens or closes
+const EventExcursion = "excursion"
+
+// Excursion triggers: leaving the frequency band, or ROCOF beyond its threshold
+const (
+	TriggerFrequency = "frequency"
+	TriggerRocof     = "rocof"
+)
+
+var excursionTriggers = []string{TriggerFrequency, TriggerRocof}
+
+// excursionTracker follows each device's readings against the frequency band
+// and the ROCOF threshold. An excursion is only stored once it has lasted the
+// minimum duration.
+type excursionTracker struct {
+	low, high      float64
+	rocofThreshold float64
+	minDuration    time.Duration
+
+	// mu only guards the map; each device's state has its own lock, held
+	// while its excursions are stored so one slow write never stalls the
+	// readings of every other device
+	mu      sync.Mutex
+	devices map[int]*deviceExcursions
+}
+
+// deviceExcursions is one device's last reading and ongoing excursions by trigger
+type deviceExcursions struct {
+	mu      sync.Mutex
+	last    *FrequencyLog
+	ongoing map[string]*FrequencyExcursion
+}
+
+func newExcursionTracker(cfg Config) *excursionTracker {
+	return &excursionTracker{
+		low:            cfg.ExcursionLow,
+		high:           cfg.ExcursionHigh,
+		rocofThreshold: cfg.ExcursionRocof,
+		minDuration:    cfg.ExcursionMinDuration,
+		devices:        make(map[int]*deviceExcursions),
+	}
+}
+
+// device returns deviceID's state, creating it on first use
+func (t *excursionTracker) device(deviceID int) *deviceExcursions {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.devices[deviceID]
+	if d == nil {
+		d = &deviceExcursions{ongoing: make(map[string]*FrequencyExcursion)}
+		t.devices[deviceID] = d
+	}
+	return d
+}
+
+// nominal is the centre of the band that deviations are measured from
+func (t *excursionTracker) nominal() float64 {
+	return (t.low + t.high) / 2
+}
+
+// direction classifies a reading as "over", "under" or "" when within bounds
+func (t *excursionTracker) direction(trigger string, entry FrequencyLog) string {
+	value, low, high := entry.Frequency, t.low, t.high
+	if trigger == TriggerRocof {
+		if t.rocofThreshold <= 0 || entry.Rocof == nil {
+			return ""
+		}
+		value, low, high = *entry.Rocof, -t.rocofThreshold, t.rocofThreshold
+	}
+	switch {
+	case value > high:
+		return "over"
+	case value < low:
+		return "under"
+	}
+	return ""
+}
+
+// observeExcursion feeds a reading to the tracker, storing and announcing
+// excursions as they open and close
+func (s *Server) observeExcursion(device Device, entry FrequencyLog) {
+	t := s.excursions
+	d := t.device(device.ID)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prev := d.last
+	d.last = &entry
+
+	for _, trigger := range excursionTriggers {
+		dir := t.direction(trigger, entry)
+		if e := d.ongoing[trigger]; e != nil && e.Direction != dir {
+			s.endExcursionLocked(device, d, trigger, entry.Timestamp)
+		}
+		if dir == "" {
+			continue
+		}
+
+		e := d.ongoing[trigger]
+		if e == nil {
+			e = &FrequencyExcursion{DeviceID: device.ID, Trigger: trigger, Direction: dir, StartedAt: entry.Timestamp, PeakFrequency: entry.Frequency}
+			d.ongoing[trigger] = e
+		}
+		if math.Abs(entry.Frequency-t.nominal()) >= math.Abs(e.PeakFrequency-t.nominal()) {
+			e.PeakFrequency = entry.Frequency
+		}
+		e.PeakDeviation = e.PeakFrequency - t.nominal()
+		if entry.Rocof != nil && (e.PeakRocof == nil || math.Abs(*entry.Rocof) >= math.Abs(*e.PeakRocof)) {
+			rocof := *entry.Rocof
+			e.PeakRocof = &rocof
+		}
+		if prev != nil {
+			if dt := entry.Timestamp.Sub(prev.Timestamp).Seconds(); dt > 0 {
+				e.MaxRate = math.Max(e.MaxRate, math.Abs(entry.Frequency-prev.Frequency)/dt)
+			}
+		}
+
+		if e.ID == 0 && entry.Timestamp.Sub(e.StartedAt) >= t.minDuration {
+			if err := s.store.CreateExcursion(e); err != nil {
+				log.Println("Failed to record excursion:", err)
+				continue
+			}
+			s.publish(EventExcursion, device, *e)
+		}
+	}
+}
+
+// endExcursion closes a device's ongoing excursions, e.g. when it disconnects
+func (s *Server) endExcursion(device Device) {
+	t := s.excursions
+	t.mu.Lock()
+	d := t.devices[device.ID]
+	delete(t.devices, device.ID)
+	t.mu.Unlock()
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last == nil {
+		return
+	}
+	for _, trigger := range excursionTriggers {
+		s.endExcursionLocked(device, d, trigger, d.last.Timestamp)
+	}
+}
+
+// endExcursionLocked forgets d's excursion for trigger and, if it was long
+// enough to be stored, records its end at the given time; callers hold d.mu
+func (s *Server) endExcursionLocked(device Device, d *deviceExcursions, trigger string, at time.Time) {
+	e := d.ongoing[trigger]
+	delete(d.ongoing, trigger)
+	if e == nil || e.ID == 0 {
+		return
+	}
+	e.EndedAt = &at
+	if err := s.store.CloseExcursion(*e); err != nil {
+		log.Println("Failed to close excursion:", err)
+		return
+	}
+	s.publish(EventExcursion, device, *e)
+}
+
+// fetchExcursions lists a device's excursions overlapping ?start and ?end
+func (s *Server) fetchExcursions(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	r, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	r.Limit = maxExcursionList
+
+	excursions, err := s.store.ListExcursions(deviceID, r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch excursions"})
+		return
+	}
+	if excursions == nil {
+		excursions = []FrequencyExcursion{}
+	}
+
+	c.JSON(http.StatusOK, excursions)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newExcursionServer tracks the default 59.95-60.05 Hz band with a 5s minimum
+func newExcursionServer(t *testing.T) (*Server, Device) {
+	t.Helper()
+	store := NewMemoryStore()
+	cfg := DefaultConfig()
+	cfg.ExcursionMinDuration = 5 * time.Second
+	s := NewServer(store, cfg)
+	_, device := seedDevice(t, store, "alice")
+	return s, device
+}
+
+// observeAt feeds readings one second apart starting at base
+func observeAt(s *Server, device Device, base time.Time, hz ...float64) {
+	for i, f := range hz {
+		s.observeExcursion(device, FrequencyLog{DeviceID: device.ID, Frequency: f, Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+}
+
+func listExcursions(t *testing.T, s *Server, device Device) []FrequencyExcursion {
+	t.Helper()
+	excursions, err := s.store.ListExcursions(device.ID, FrequencyRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return excursions
+}
+
+func TestExcursionOpensAfterMinimumDurationAndCloses(t *testing.T) {
+	s, device := newExcursionServer(t)
+	sub := s.events.Subscribe(device.UserID, nil)
+	defer s.events.Unsubscribe(sub)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Over the band from +1s; nothing is stored before +6s
+	observeAt(s, device, base, 60.0, 60.10, 60.12, 60.08, 60.07, 60.06)
+	if got := listExcursions(t, s, device); len(got) != 0 {
+		t.Fatalf("excursion stored after 4s: %+v", got)
+	}
+	observeAt(s, device, base.Add(6*time.Second), 60.09, 60.0)
+
+	got := listExcursions(t, s, device)
+	if len(got) != 1 {
+		t.Fatalf("got %d excursions, want 1", len(got))
+	}
+	e := got[0]
+	if e.Trigger != TriggerFrequency || e.Direction != "over" || !e.StartedAt.Equal(base.Add(time.Second)) {
+		t.Errorf("got %+v, want an over-frequency excursion from +1s", e)
+	}
+	if e.EndedAt == nil || !e.EndedAt.Equal(base.Add(7*time.Second)) {
+		t.Errorf("ended at %v, want +7s", e.EndedAt)
+	}
+	if !approx(e.PeakFrequency, 60.12) || !approx(e.MaxRate, 0.1) {
+		t.Errorf("peak %v rate %v, want 60.12 and 0.1 Hz/s", e.PeakFrequency, e.MaxRate)
+	}
+
+	// One event when it was stored and one when it closed
+	for _, ended := range []bool{false, true} {
+		select {
+		case ev := <-sub.C:
+			if ev.Type != EventExcursion || (ev.Data.(FrequencyExcursion).EndedAt != nil) != ended {
+				t.Errorf("got event %+v", ev)
+			}
+		default:
+			t.Fatalf("missing excursion event (ended %v)", ended)
+		}
+	}
+}
+
+func TestExcursionShorterThanMinimumIsDropped(t *testing.T) {
+	s, device := newExcursionServer(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	observeAt(s, device, base, 60.0, 59.9, 59.9, 59.9, 60.0, 59.9, 59.9, 60.0)
+	if got := listExcursions(t, s, device); len(got) != 0 {
+		t.Fatalf("short dips were stored: %+v", got)
+	}
+}
+
+func TestExcursionDirectionChangeAndDisconnect(t *testing.T) {
+	s, device := newExcursionServer(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Over for 6s, then straight under for 6s, then the device drops
+	observeAt(s, device, base, 60.1, 60.1, 60.1, 60.1, 60.1, 60.1, 60.1, 59.9, 59.9, 59.9, 59.9, 59.9, 59.9, 59.9)
+	s.endExcursion(device)
+
+	got := listExcursions(t, s, device)
+	if len(got) != 2 {
+		t.Fatalf("got %d excursions, want 2: %+v", len(got), got)
+	}
+	if got[0].Direction != "over" || got[0].EndedAt == nil || !got[0].EndedAt.Equal(base.Add(7*time.Second)) {
+		t.Errorf("first excursion %+v, want over and ended at +7s", got[0])
+	}
+	if got[1].Direction != "under" || got[1].EndedAt == nil || !got[1].EndedAt.Equal(base.Add(13*time.Second)) {
+		t.Errorf("second excursion %+v, want under and closed at the last reading", got[1])
+	}
+
+	// A reconnect starts from scratch
+	observeAt(s, device, base.Add(time.Minute), 59.9)
+	if got := listExcursions(t, s, device); len(got) != 2 {
+		t.Fatalf("got %d excursions after reconnect, want 2", len(got))
+	}
+}
+
+// blockingExcursionStore stalls CreateExcursion for one device until released
+type blockingExcursionStore struct {
+	Store
+	deviceID int
+	entered  chan struct{}
+	release  chan struct{}
+}
+
+func (b *blockingExcursionStore) CreateExcursion(e *FrequencyExcursion) error {
+	if e.DeviceID == b.deviceID {
+		close(b.entered)
+		<-b.release
+	}
+	return b.Store.CreateExcursion(e)
+}
+
+func TestExcursionWriteDoesNotStallOtherDevices(t *testing.T) {
+	store := NewMemoryStore()
+	_, slow := seedDevice(t, store, "alice")
+	_, fast := seedDevice(t, store, "bob")
+	blocking := &blockingExcursionStore{Store: store, deviceID: slow.ID, entered: make(chan struct{}), release: make(chan struct{})}
+	cfg := DefaultConfig()
+	cfg.ExcursionMinDuration = 0
+	s := NewServer(blocking, cfg)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	done := make(chan struct{})
+	go func() {
+		observeAt(s, slow, base, 59.9)
+		close(done)
+	}()
+	<-blocking.entered
+
+	observed := make(chan struct{})
+	go func() {
+		observeAt(s, fast, base, 59.9)
+		close(observed)
+	}()
+	select {
+	case <-observed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled write for one device blocked readings from another")
+	}
+
+	close(blocking.release)
+	<-done
+	if got := listExcursions(t, s, fast); len(got) != 1 {
+		t.Errorf("got %d excursions for the other device, want 1", len(got))
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventFirmware reports a device's progress through a firmware rollout
+const EventFirmware = "firmware"
+
+const (
+	// maxFirmwareSize caps an uploaded image
+	maxFirmwareSize = 8 << 20
+	// maxRolloutTargets caps how many devices one rollout may update
+	maxRolloutTargets = 1000
+	// firmwareLinkGrace keeps a download link valid a while after its command
+	// expires, so a device that got the command just in time can still fetch it
+	firmwareLinkGrace = time.Hour
+)
+
+// rolloutReport is a rollout with its image, its targets and how many are in each status
+type rolloutReport struct {
+	FirmwareRollout
+	Firmware Firmware        `json:"firmware"`
+	Counts   map[string]int  `json:"counts"`
+	Targets  []RolloutTarget `json:"targets"`
+}
+
+// uploadFirmware stores an image from a multipart form with file,
+// hardware_model, version and optional notes. A sha256 field, if given, must
+// match the uploaded bytes.
+func (s *Server) uploadFirmware(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxFirmwareSize+1<<20)
+	if err := c.Request.ParseMultipartForm(maxFirmwareSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Firmware image too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload"})
+		return
+	}
+	model := strings.TrimSpace(c.PostForm("hardware_model"))
+	version := strings.TrimSpace(c.PostForm("version"))
+	if model == "" || version == "" || len(model) > 64 || len(version) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Hardware model and version required"})
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Firmware file required"})
+		return
+	}
+	if header.Size > maxFirmwareSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Firmware image too large"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read firmware"})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read firmware"})
+		return
+	}
+	if len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Firmware file is empty"})
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if want := strings.TrimSpace(c.PostForm("sha256")); want != "" && !strings.EqualFold(want, digest) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum does not match"})
+		return
+	}
+
+	userID := currentUserID(c)
+	fw := Firmware{
+		HardwareModel: model,
+		Version:       version,
+		SHA256:        digest,
+		Size:          int64(len(data)),
+		Notes:         c.PostForm("notes"),
+		UploadedBy:    &userID,
+	}
+	err = s.store.CreateFirmware(&fw, data)
+	if errors.Is(err, ErrFirmwareExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Firmware version already exists"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not store firmware"})
+		return
+	}
+	auditTarget(c, "firmware", int64(fw.ID))
+	auditChange(c, nil, fw)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Firmware uploaded successfully", "firmwareID": fw.ID, "sha256": digest})
+}
+
+// fetchFirmware lists uploaded images newest first, optionally for one ?model=
+func (s *Server) fetchFirmware(c *gin.Context) {
+	images, err := s.store.ListFirmware(c.Query("model"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch firmware"})
+		return
+	}
+	if images == nil {
+		images = []Firmware{}
+	}
+
+	c.JSON(http.StatusOK, images)
+}
+
+// firmwareSignature signs a download link for one image, device and expiry
+func firmwareSignature(firmwareID, deviceID int, expires int64) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	fmt.Fprintf(mac, "firmware:%d:%d:%d", firmwareID, deviceID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// firmwareURL is the link sent to a device in otaUpdate. Devices hold no
+// JWT, so the link carries its own signature instead.
+func (s *Server) firmwareURL(fw Firmware, deviceID int, expires time.Time) string {
+	exp := expires.Unix()
+	return fmt.Sprintf("%s/downloadFirmware/%d?device=%d&expires=%d&sig=%s",
+		s.cfg.PublicURL, fw.ID, deviceID, exp, firmwareSignature(fw.ID, deviceID, exp))
+}
+
+// downloadFirmware serves an image to anyone holding an unexpired signed link
+func (s *Server) downloadFirmware(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	deviceID, deviceErr := strconv.Atoi(c.Query("device"))
+	expires, expiresErr := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || deviceErr != nil || expiresErr != nil ||
+		!hmac.Equal([]byte(c.Query("sig")), []byte(firmwareSignature(id, deviceID, expires))) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid download link"})
+		return
+	}
+	if time.Now().Unix() > expires {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Download link expired"})
+		return
+	}
+
+	fw, err := s.store.GetFirmware(id)
+	var data []byte
+	if err == nil {
+		data, err = s.store.GetFirmwareData(id)
+	}
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firmware not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch firmware"})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("X-Firmware-Sha256", fw.SHA256)
+	http.ServeContent(c.Writer, c.Request, fw.HardwareModel+"-"+fw.Version+".bin", fw.CreatedAt, bytes.NewReader(data))
+}
+
+// createFirmwareRollout updates a list of devices, a site or a group to one
+// image. Devices are released in a random order, percent of them straight
+// away (100 by default); advanceFirmwareRollout releases more. Only owners
+// may update a device.
+func (s *Server) createFirmwareRollout(c *gin.Context) {
+	var input struct {
+		deviceTarget
+		DeviceIDs  []int  `json:"device_ids"`
+		FirmwareID int    `json:"firmware_id" binding:"required"`
+		Percent    *int   `json:"percent"`
+		TTL        string `json:"ttl,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	percent := 100
+	if input.Percent != nil {
+		percent = *input.Percent
+	}
+	if percent < 0 || percent > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Percent must be between 0 and 100"})
+		return
+	}
+	ttl, err := parseDurationParam(input.TTL, s.cfg.CommandTTL, maxCommandTTL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ttl"})
+		return
+	}
+
+	fw, err := s.store.GetFirmware(input.FirmwareID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firmware not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch firmware"})
+		return
+	}
+	devices, ok := s.jobDevices(c, input.deviceTarget, input.DeviceIDs, RoleOwner)
+	if !ok {
+		return
+	}
+	if len(devices) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No devices to update"})
+		return
+	}
+	if len(devices) > maxRolloutTargets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many devices for one rollout"})
+		return
+	}
+
+	deviceIDs := make([]int, 0, len(devices))
+	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.ID)
+	}
+	rand.Shuffle(len(deviceIDs), func(i, j int) { deviceIDs[i], deviceIDs[j] = deviceIDs[j], deviceIDs[i] })
+
+	rollout := FirmwareRollout{UserID: currentUserID(c), FirmwareID: fw.ID, Percent: percent}
+	if err := s.store.CreateFirmwareRollout(&rollout, deviceIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create rollout"})
+		return
+	}
+	auditTarget(c, "firmware_rollout", int64(rollout.ID))
+	auditChange(c, nil, rollout)
+
+	released, err := s.releaseRolloutTargets(rollout, fw, ttl, percentStage(percent, len(deviceIDs)))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start rollout"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Firmware rollout started", "rolloutID": rollout.ID, "targets": len(deviceIDs), "released": released})
+}
+
+// percentStage picks the first percent of a rollout's targets, rounding up
+func percentStage(percent, total int) func(int, RolloutTarget) bool {
+	cutoff := (total*percent + 99) / 100
+	return func(i int, _ RolloutTarget) bool { return i < cutoff }
+}
+
+// releaseRolloutTargets sends otaUpdate to every waiting target that pick
+// selects by its position in release order, and returns how many it sent
+func (s *Server) releaseRolloutTargets(rollout FirmwareRollout, fw Firmware, ttl time.Duration, pick func(int, RolloutTarget) bool) (int, error) {
+	targets, err := s.store.ListRolloutTargets(rollout.ID)
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	for i, target := range targets {
+		if target.Status != OTAWaiting || !pick(i, target) {
+			continue
+		}
+		if s.stageRolloutTarget(fw, target, ttl) {
+			released++
+		}
+	}
+	s.finishRolloutIfDone(rollout.ID)
+	return released, nil
+}
+
+// stageRolloutTarget queues otaUpdate for one device, or skips it when the
+// image does not fit it. It reports whether the command was sent.
+func (s *Server) stageRolloutTarget(fw Firmware, target RolloutTarget, ttl time.Duration) bool {
+	device, err := s.store.GetDevice(target.DeviceID)
+	if err != nil {
+		log.Printf("Failed to load device %d for rollout %d: %v\n", target.DeviceID, target.RolloutID, err)
+		return false
+	}
+
+	target.Status = OTASkipped
+	switch {
+	case device.HardwareModel == "":
+		target.Error = "Device has not reported its hardware model"
+	case device.HardwareModel != fw.HardwareModel:
+		target.Error = "Firmware is for " + fw.HardwareModel
+	case device.FirmwareVersion == fw.Version:
+		target.Error = "Already running " + fw.Version
+	default:
+		if _, err := s.store.ActiveRolloutTarget(device.ID); err == nil {
+			target.Error = "Another update is in progress"
+			break
+		}
+		payload := DeviceResponse{
+			Command: "otaUpdate",
+			URL:     s.firmwareURL(fw, device.ID, time.Now().Add(ttl+firmwareLinkGrace)),
+			Version: fw.Version,
+			SHA256:  fw.SHA256,
+			Size:    fw.Size,
+		}
+		cmd, err := s.dispatchCommand(device.ID, payload, CommandOptions{TTL: ttl})
+		if err != nil {
+			log.Println("Failed to dispatch firmware update to device", device.ID, err)
+			target.Status, target.Error = OTAFailed, "Could not send command"
+			break
+		}
+		target.Status, target.CommandID = OTAQueued, &cmd.ID
+	}
+
+	s.saveRolloutTarget(device, target)
+	return target.Status == OTAQueued
+}
+
+// saveRolloutTarget stores a target's new state and tells the device's users
+func (s *Server) saveRolloutTarget(device Device, target RolloutTarget) {
+	target.UpdatedAt = time.Now()
+	if err := s.store.UpdateRolloutTarget(target); err != nil {
+		log.Printf("Failed to record rollout %d target %d: %v\n", target.RolloutID, target.ID, err)
+		return
+	}
+	s.publish(EventFirmware, device, gin.H{
+		"rollout_id": target.RolloutID,
+		"status":     target.Status,
+		"progress":   target.Progress,
+		"error":      target.Error,
+	})
+}
+
+// finishRolloutIfDone completes a running rollout once no target is waiting
+// or in progress
+func (s *Server) finishRolloutIfDone(rolloutID int) {
+	targets, err := s.store.ListRolloutTargets(rolloutID)
+	if err != nil {
+		log.Printf("Failed to load rollout %d: %v\n", rolloutID, err)
+		return
+	}
+	for _, target := range targets {
+		switch target.Status {
+		case OTAWaiting, OTAQueued, OTADownloading, OTARebooting:
+			return
+		}
+	}
+	err = s.store.SetRolloutStatus(rolloutID, RolloutCompleted, time.Now())
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to complete rollout %d: %v\n", rolloutID, err)
+	}
+}
+
+// expireRolloutTargets fails targets whose otaUpdate never reached the device
+func (s *Server) expireRolloutTargets(now time.Time) {
+	rolloutIDs, err := s.store.FailExpiredRolloutTargets(now)
+	if err != nil {
+		log.Println("Failed to expire rollout targets:", err)
+		return
+	}
+	for _, id := range rolloutIDs {
+		s.finishRolloutIfDone(id)
+	}
+}
+
+// reportFirmware records the firmware a device says it runs in its hello and
+// settles the rollout that was updating it: the new version means installed,
+// anything else after the download started means the update failed
+func (s *Server) reportFirmware(device Device, hello deviceHello) {
+	if hello.Firmware == "" {
+		return
+	}
+	if err := s.store.SetDeviceFirmware(device.ID, hello.Model, hello.Firmware); err != nil {
+		log.Println("Failed to record device firmware:", err)
+		return
+	}
+
+	target, err := s.store.ActiveRolloutTarget(device.ID)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Println("Failed to load rollout target:", err)
+		}
+		return
+	}
+	rollout, err := s.store.GetFirmwareRollout(target.RolloutID)
+	var fw Firmware
+	if err == nil {
+		fw, err = s.store.GetFirmware(rollout.FirmwareID)
+	}
+	if err != nil {
+		log.Println("Failed to load rollout firmware:", err)
+		return
+	}
+
+	switch {
+	case hello.Firmware == fw.Version:
+		target.Status, target.Progress, target.Error = OTAInstalled, 100, ""
+	case target.Status != OTAQueued:
+		target.Status, target.Error = OTAFailed, "Device came back on "+hello.Firmware
+	default:
+		// Not started yet; the queued otaUpdate goes out with the rest of the queue
+		return
+	}
+	s.saveRolloutTarget(device, target)
+	s.finishRolloutIfDone(target.RolloutID)
+}
+
+// runningRolloutTarget returns the target updating the device if its rollout
+// is still running. Reports for a halted rollout change nothing.
+func (s *Server) runningRolloutTarget(deviceID int) (RolloutTarget, bool) {
+	target, err := s.store.ActiveRolloutTarget(deviceID)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Println("Failed to load rollout target:", err)
+		}
+		return RolloutTarget{}, false
+	}
+	rollout, err := s.store.GetFirmwareRollout(target.RolloutID)
+	if err != nil {
+		log.Printf("Failed to load rollout %d: %v\n", target.RolloutID, err)
+		return RolloutTarget{}, false
+	}
+	return target, rollout.Status == RolloutRunning
+}
+
+// handleOTAProgress records an otaProgress report from the device
+func (s *Server) handleOTAProgress(device Device, response DeviceResponse) {
+	if response.Progress == nil {
+		log.Println("Missing OTA progress")
+		return
+	}
+	target, ok := s.runningRolloutTarget(device.ID)
+	if !ok || target.Status == OTARebooting {
+		return
+	}
+	target.Status, target.Progress = OTADownloading, min(max(*response.Progress, 0), 100)
+	s.saveRolloutTarget(device, target)
+}
+
+// handleOTAResult records the device's reply to otaUpdate: on success the
+// image is written and the device is about to reboot into it
+func (s *Server) handleOTAResult(device Device, response DeviceResponse) {
+	target, ok := s.runningRolloutTarget(device.ID)
+	if !ok {
+		return
+	}
+	if response.Status == "error" {
+		target.Status, target.Error = OTAFailed, response.Error
+		if target.Error == "" {
+			target.Error = "Device reported an error"
+		}
+	} else {
+		target.Status, target.Progress = OTARebooting, 100
+	}
+	s.saveRolloutTarget(device, target)
+	s.finishRolloutIfDone(target.RolloutID)
+}
+
+// loadFirmwareRollout resolves :id to one of the caller's rollouts
+func (s *Server) loadFirmwareRollout(c *gin.Context) (FirmwareRollout, bool) {
+	id, ok := paramID(c, "id", "rollout")
+	if !ok {
+		return FirmwareRollout{}, false
+	}
+	auditTarget(c, "firmware_rollout", int64(id))
+	rollout, err := s.store.GetFirmwareRollout(id)
+	if err := checkOwner(c, rollout.UserID, err); err != nil {
+		abortAuthz(c, err, "Rollout")
+		return FirmwareRollout{}, false
+	}
+	return rollout, true
+}
+
+// readFirmwareRollout returns a rollout with each device's progress and a count per status
+func (s *Server) readFirmwareRollout(c *gin.Context) {
+	rollout, ok := s.loadFirmwareRollout(c)
+	if !ok {
+		return
+	}
+
+	fw, err := s.store.GetFirmware(rollout.FirmwareID)
+	var targets []RolloutTarget
+	if err == nil {
+		targets, err = s.store.ListRolloutTargets(rollout.ID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve rollout"})
+		return
+	}
+	report := rolloutReport{
+		FirmwareRollout: rollout,
+		Firmware:        fw,
+		Counts:          map[string]int{},
+		Targets:         targets,
+	}
+	for _, status := range []string{OTAWaiting, OTAQueued, OTADownloading, OTARebooting, OTAInstalled, OTAFailed, OTASkipped, OTACancelled} {
+		report.Counts[status] = 0
+	}
+	for _, target := range targets {
+		report.Counts[target.Status]++
+	}
+	if report.Targets == nil {
+		report.Targets = []RolloutTarget{}
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// fetchFirmwareRollouts lists the caller's rollouts, newest first
+func (s *Server) fetchFirmwareRollouts(c *gin.Context) {
+	rollouts, err := s.store.ListFirmwareRollouts(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rollouts"})
+		return
+	}
+	if rollouts == nil {
+		rollouts = []FirmwareRollout{}
+	}
+
+	c.JSON(http.StatusOK, rollouts)
+}
+
+// advanceFirmwareRollout releases the next stage of a running rollout: up to
+// a higher percent of its devices, or every waiting device in one of the
+// caller's groups
+func (s *Server) advanceFirmwareRollout(c *gin.Context) {
+	rollout, ok := s.loadFirmwareRollout(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Percent *int   `json:"percent"`
+		GroupID *int   `json:"group_id"`
+		TTL     string `json:"ttl,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if (input.Percent == nil) == (input.GroupID == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give either a percent or a group"})
+		return
+	}
+	ttl, err := parseDurationParam(input.TTL, s.cfg.CommandTTL, maxCommandTTL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ttl"})
+		return
+	}
+	if rollout.Status != RolloutRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rollout is not running"})
+		return
+	}
+
+	targets, err := s.store.ListRolloutTargets(rollout.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve rollout"})
+		return
+	}
+	var pick func(int, RolloutTarget) bool
+	if input.Percent != nil {
+		if *input.Percent < rollout.Percent || *input.Percent > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Percent must be between the current stage and 100"})
+			return
+		}
+		if err := s.store.SetRolloutPercent(rollout.ID, *input.Percent); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not advance rollout"})
+			return
+		}
+		auditChange(c, gin.H{"percent": rollout.Percent}, gin.H{"percent": *input.Percent})
+		pick = percentStage(*input.Percent, len(targets))
+	} else {
+		auditTarget(c, "group", int64(*input.GroupID))
+		group, ok := s.ownDeviceGroup(c, *input.GroupID)
+		if !ok {
+			return
+		}
+		devices, err := s.store.ListGroupDevices(group.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+			return
+		}
+		pick = func(_ int, target RolloutTarget) bool {
+			return slices.ContainsFunc(devices, func(d Device) bool { return d.ID == target.DeviceID })
+		}
+		auditChange(c, nil, gin.H{"group_id": group.ID})
+	}
+
+	fw, err := s.store.GetFirmware(rollout.FirmwareID)
+	var released int
+	if err == nil {
+		released, err = s.releaseRolloutTargets(rollout, fw, ttl, pick)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not advance rollout"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rollout advanced", "released": released})
+}
+
+// haltFirmwareRollout stops a rollout from releasing more devices and
+// withdraws updates not yet delivered. Devices the update already reached may
+// still install it, but their targets are cancelled too and what they report
+// afterwards is ignored.
+func (s *Server) haltFirmwareRollout(c *gin.Context) {
+	rollout, ok := s.loadFirmwareRollout(c)
+	if !ok {
+		return
+	}
+
+	err := s.store.SetRolloutStatus(rollout.ID, RolloutHalted, time.Now())
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rollout is not running"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not halt rollout"})
+		return
+	}
+	auditChange(c, gin.H{"status": rollout.Status}, gin.H{"status": RolloutHalted})
+
+	targets, err := s.store.ListRolloutTargets(rollout.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve rollout"})
+		return
+	}
+	cancelled := 0
+	for _, target := range targets {
+		target.Error = "Rollout halted"
+		switch target.Status {
+		case OTAWaiting:
+		case OTAQueued, OTADownloading, OTARebooting:
+			// A command already on the socket cannot be recalled
+			if target.Status != OTAQueued || target.CommandID == nil || s.store.CancelCommand(*target.CommandID, time.Now()) != nil {
+				target.Error = "Rollout halted after the update reached the device"
+			}
+		default:
+			continue
+		}
+		device, err := s.store.GetDevice(target.DeviceID)
+		if err != nil {
+			continue
+		}
+		target.Status = OTACancelled
+		s.saveRolloutTarget(device, target)
+		cancelled++
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rollout halted", "cancelled": cancelled})
+}
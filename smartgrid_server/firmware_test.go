@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// firmwareFixture is an admin with four esp32 panels and one esp8266, all on
+// 1.0.0, and a 1.2.0 esp32 image uploaded through the API
+type firmwareFixture struct {
+	server     *Server
+	router     *gin.Engine
+	admin      User
+	devices    []Device
+	image      []byte
+	firmwareID int
+}
+
+func newFirmwareFixture(t *testing.T) *firmwareFixture {
+	t.Helper()
+	store := NewMemoryStore()
+	f := &firmwareFixture{server: NewServer(store, DefaultConfig()), image: []byte("esp32 firmware 1.2.0")}
+	f.router = f.server.Router()
+	f.admin, _ = seedDevice(t, store, "bob")
+	if err := store.SetUserAdmin(f.admin.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		device := Device{Name: fmt.Sprintf("panel %d", i), UserID: f.admin.ID}
+		if err := store.CreateDevice(&device); err != nil {
+			t.Fatal(err)
+		}
+		model := "esp32"
+		if i == 4 {
+			model = "esp8266"
+		}
+		if err := store.SetDeviceFirmware(device.ID, model, "1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+		f.devices = append(f.devices, device)
+	}
+
+	// Upload the image, checking the checksum the admin expects
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("hardware_model", "esp32")
+	mw.WriteField("version", "1.2.0")
+	mw.WriteField("sha256", f.digest())
+	part, _ := mw.CreateFormFile("file", "firmware.bin")
+	part.Write(f.image)
+	mw.Close()
+	req := httptest.NewRequest("POST", "/uploadFirmware", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	token, _ := newToken(f.admin.ID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	var uploaded struct {
+		FirmwareID int `json:"firmwareID"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &uploaded); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("upload got %d: %s", w.Code, w.Body)
+	}
+	f.firmwareID = uploaded.FirmwareID
+	return f
+}
+
+func (f *firmwareFixture) digest() string {
+	sum := sha256.Sum256(f.image)
+	return hex.EncodeToString(sum[:])
+}
+
+// startRollout rolls the image out to every panel, percent of them at once
+func (f *firmwareFixture) startRollout(t *testing.T, percent int) int {
+	t.Helper()
+	ids := make([]int, len(f.devices))
+	for i, d := range f.devices {
+		ids[i] = d.ID
+	}
+	body, _ := json.Marshal(gin.H{"device_ids": ids, "firmware_id": f.firmwareID, "percent": percent})
+	w := serve(t, f.router, f.admin.ID, "POST", "/createFirmwareRollout", string(body))
+	var created struct {
+		RolloutID int `json:"rolloutID"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusAccepted {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+	return created.RolloutID
+}
+
+func (f *firmwareFixture) read(t *testing.T, rolloutID int) rolloutReport {
+	t.Helper()
+	var report rolloutReport
+	w := serve(t, f.router, f.admin.ID, "GET", fmt.Sprintf("/readFirmwareRollout/%d", rolloutID), "")
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// queuedDevice returns a device whose otaUpdate is queued in the report
+func (f *firmwareFixture) queuedDevice(t *testing.T, report rolloutReport) Device {
+	t.Helper()
+	for _, target := range report.Targets {
+		if target.Status == OTAQueued {
+			device, err := f.server.store.GetDevice(target.DeviceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return device
+		}
+	}
+	t.Fatalf("no queued target: %+v", report.Counts)
+	return Device{}
+}
+
+func TestFirmwareRolloutStagesAndHalts(t *testing.T) {
+	f := newFirmwareFixture(t)
+	store := f.server.store
+	rolloutID := f.startRollout(t, 40)
+
+	// 40% of five is two devices; the rest wait
+	report := f.read(t, rolloutID)
+	if released := report.Counts[OTAQueued] + report.Counts[OTASkipped]; released != 2 || report.Counts[OTAWaiting] != 3 {
+		t.Fatalf("unexpected first stage: %+v", report.Counts)
+	}
+	advance := fmt.Sprintf("/advanceFirmwareRollout/%d", rolloutID)
+	if w := serve(t, f.router, f.admin.ID, "POST", advance, `{"percent":20}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("shrinking a rollout got %d, want 400", w.Code)
+	}
+	if w := serve(t, f.router, f.admin.ID, "POST", advance, `{"percent":80}`); w.Code != http.StatusOK {
+		t.Fatalf("advance got %d: %s", w.Code, w.Body)
+	}
+	report = f.read(t, rolloutID)
+	if report.Counts[OTAWaiting] != 1 || report.Counts[OTAQueued]+report.Counts[OTASkipped] != 4 {
+		t.Fatalf("unexpected second stage: %+v", report.Counts)
+	}
+
+	// Walk one queued device through download, install and reboot
+	device := f.queuedDevice(t, report)
+	cmds, err := store.ListCommands(device.ID, CommandPending, 10)
+	if err != nil || len(cmds) == 0 || cmds[0].Command != "otaUpdate" {
+		t.Fatalf("no otaUpdate queued: %+v %v", cmds, err)
+	}
+	link, err := url.Parse(cmds[0].Payload.URL)
+	if err != nil || cmds[0].Payload.SHA256 != f.digest() {
+		t.Fatalf("bad otaUpdate payload: %+v", cmds[0].Payload)
+	}
+	if w := serve(t, f.router, 0, "GET", link.RequestURI(), ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), f.image) {
+		t.Fatalf("download got %d", w.Code)
+	}
+	if w := serve(t, f.router, 0, "GET", strings.Replace(link.RequestURI(), "device=", "device=9", 1), ""); w.Code != http.StatusForbidden {
+		t.Fatalf("tampered download got %d, want 403", w.Code)
+	}
+
+	progress := 40
+	f.server.handleOTAProgress(device, DeviceResponse{Command: "otaProgress", Progress: &progress})
+	f.server.handleOTAResult(device, DeviceResponse{Command: "otaUpdate", Status: "ok"})
+	f.server.reportFirmware(device, deviceHello{MACAddr: device.MACAddr, Model: "esp32", Firmware: "1.2.0"})
+	if device, _ = store.GetDevice(device.ID); device.FirmwareVersion != "1.2.0" {
+		t.Fatalf("device still reports %q", device.FirmwareVersion)
+	}
+
+	// Halting withdraws the undelivered updates and the waiting device
+	if w := serve(t, f.router, f.admin.ID, "POST", fmt.Sprintf("/haltFirmwareRollout/%d", rolloutID), ""); w.Code != http.StatusOK {
+		t.Fatalf("halt got %d: %s", w.Code, w.Body)
+	}
+	report = f.read(t, rolloutID)
+	if report.Status != RolloutHalted || report.Counts[OTAInstalled] != 1 || report.Counts[OTAWaiting] != 0 ||
+		report.Counts[OTAQueued] != 0 || report.Counts[OTACancelled]+report.Counts[OTASkipped] != 4 {
+		t.Fatalf("unexpected halted rollout: %+v", report.Counts)
+	}
+	if w := serve(t, f.router, f.admin.ID, "POST", advance, `{"percent":100}`); w.Code != http.StatusConflict {
+		t.Fatalf("advancing a halted rollout got %d, want 409", w.Code)
+	}
+}
+
+func TestFirmwareReportsAfterHaltAreIgnored(t *testing.T) {
+	f := newFirmwareFixture(t)
+	rolloutID := f.startRollout(t, 100)
+	device := f.queuedDevice(t, f.read(t, rolloutID))
+
+	progress := 40
+	f.server.handleOTAProgress(device, DeviceResponse{Command: "otaProgress", Progress: &progress})
+	if w := serve(t, f.router, f.admin.ID, "POST", fmt.Sprintf("/haltFirmwareRollout/%d", rolloutID), ""); w.Code != http.StatusOK {
+		t.Fatalf("halt got %d: %s", w.Code, w.Body)
+	}
+
+	// The device finishes the download it had started; nothing it says counts
+	progress = 90
+	f.server.handleOTAProgress(device, DeviceResponse{Command: "otaProgress", Progress: &progress})
+	f.server.handleOTAResult(device, DeviceResponse{Command: "otaUpdate", Status: "ok"})
+	report := f.read(t, rolloutID)
+	for _, target := range report.Targets {
+		if target.DeviceID == device.ID && (target.Status != OTACancelled || target.Progress != 40) {
+			t.Fatalf("halted target changed: %+v", target)
+		}
+	}
+	if report.Counts[OTARebooting] != 0 || report.Counts[OTADownloading] != 0 || report.Status != RolloutHalted {
+		t.Fatalf("unexpected halted rollout: %s %+v", report.Status, report.Counts)
+	}
+
+	// Nothing is left in progress, so a new rollout can reach the device
+	if _, err := f.server.store.ActiveRolloutTarget(device.ID); err == nil {
+		t.Fatal("halted target still blocks later updates")
+	}
+}
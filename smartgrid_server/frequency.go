@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"time"
+	_ "time/tzdata" // tz= must work on hosts without a zoneinfo database
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxFrequencyPoints caps the rows or buckets in one fetchFrequencyData
+// response; when more exist the response carries X-Truncated: true
+const maxFrequencyPoints = 5000
+
+// frequencyBuckets are the aggregation widths clients may ask for, finest first
+var frequencyBuckets = []struct {
+	name  string
+	width time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+}
+
+// fetchFrequencyData returns raw readings, or per-bucket min, max, avg,
+// stddev and count when ?bucket= is set. bucket=auto picks the finest width
+// that fits the range and is still retained, reported in X-Bucket. ?tz= is an
+// IANA zone name that sets hour and day boundaries and the offset of returned
+// timestamps.
+func (s *Server) fetchFrequencyData(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	r, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	r.Limit = maxFrequencyPoints + 1
+
+	loc := time.UTC
+	if tz := c.Query("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tz"})
+			return
+		}
+	}
+
+	if name := c.Query("bucket"); name != "" {
+		if name == "auto" {
+			name = s.autoBucket(r, loc, time.Now())
+			c.Header("X-Bucket", name)
+		}
+		for _, bucket := range frequencyBuckets {
+			if bucket.name == name {
+				s.fetchFrequencyBuckets(c, deviceID, r, bucket.width, loc)
+				return
+			}
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bucket, use 1m, 5m, 1h, 1d or auto"})
+		return
+	}
+
+	entries, err := s.store.ListFrequency(deviceID, r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch data"})
+		return
+	}
+	entries = truncatePoints(c, entries)
+
+	type logEntry struct {
+		Frequency float64  `json:"frequency"`
+		Rocof     *float64 `json:"rocof,omitempty"`
+		Timestamp string   `json:"timestamp"`
+	}
+
+	logs := make([]logEntry, 0, len(entries))
+	for _, entry := range entries {
+		logs = append(logs, logEntry{entry.Frequency, entry.Rocof, entry.Timestamp.In(loc).Format(time.RFC3339)})
+	}
+
+	c.JSON(http.StatusOK, logs)
+}
+
+func (s *Server) fetchFrequencyBuckets(c *gin.Context, deviceID int, r FrequencyRange, bucket time.Duration, loc *time.Location) {
+	buckets, err := s.store.AggregateFrequency(deviceID, r, bucket, loc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch data"})
+		return
+	}
+	buckets = truncatePoints(c, buckets)
+
+	for i := range buckets {
+		buckets[i].Start = buckets[i].Start.In(loc)
+	}
+
+	c.JSON(http.StatusOK, buckets)
+}
+
+// parseTimeRange reads the optional RFC3339 ?start and ?end, writing a 400 on failure
+func parseTimeRange(c *gin.Context) (FrequencyRange, bool) {
+	var r FrequencyRange
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"start", &r.Start}, {"end", &r.End}} {
+		if value := c.Query(bound.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + bound.name + " time"})
+				return r, false
+			}
+			*bound.dst = t
+		}
+	}
+	return r, true
+}
+
+// autoBucket picks the finest bucket that keeps the range under
+// maxFrequencyPoints and whose source data has not been pruned at its start
+func (s *Server) autoBucket(r FrequencyRange, loc *time.Location, now time.Time) string {
+	if r.Start.IsZero() {
+		return "1d"
+	}
+	end := r.End
+	if end.IsZero() {
+		end = now
+	}
+	for _, bucket := range frequencyBuckets {
+		if end.Sub(r.Start)/bucket.width > maxFrequencyPoints {
+			continue
+		}
+		if since := s.retainedSince(bucket.width, loc, now); since.IsZero() || !r.Start.Before(since) {
+			return bucket.name
+		}
+	}
+	return "1d"
+}
+
+// truncatePoints trims a result fetched with limit maxFrequencyPoints+1 and
+// flags the response when anything was cut
+func truncatePoints[T any](c *gin.Context, points []T) []T {
+	if len(points) > maxFrequencyPoints {
+		c.Header("X-Truncated", "true")
+		return points[:maxFrequencyPoints]
+	}
+	return points
+}
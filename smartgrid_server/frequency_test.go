@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// insertReadings stores one reading per timestamp at the matching frequency
+func insertReadings(t *testing.T, store Store, deviceID int, times []time.Time, hz []float64) {
+	t.Helper()
+	for i, ts := range times {
+		if err := store.InsertFrequency(FrequencyLog{DeviceID: deviceID, Frequency: hz[i], Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func approx(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+func TestAggregateFrequencyBuckets(t *testing.T) {
+	testStores(t, func(t *testing.T, store Store) {
+		_, device := seedDevice(t, store, "alice")
+		base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+		insertReadings(t, store, device.ID,
+			[]time.Time{base.Add(10 * time.Second), base.Add(3 * time.Minute), base.Add(7 * time.Minute), base.Add(21 * time.Minute)},
+			[]float64{60.0, 60.2, 59.9, 60.1})
+
+		buckets, err := store.AggregateFrequency(device.ID, FrequencyRange{}, 5*time.Minute, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != 3 {
+			t.Fatalf("got %d buckets, want 3: %+v", len(buckets), buckets)
+		}
+		first := buckets[0]
+		if !first.Start.Equal(base) || first.Count != 2 || !approx(first.Min, 60.0) || !approx(first.Max, 60.2) ||
+			!approx(first.Avg, 60.1) || math.Abs(first.Stddev-0.1) > 1e-6 {
+			t.Errorf("first bucket: got %+v", first)
+		}
+		if !buckets[1].Start.Equal(base.Add(5*time.Minute)) || buckets[1].Count != 1 || buckets[1].Stddev != 0 {
+			t.Errorf("second bucket: got %+v", buckets[1])
+		}
+		// Empty buckets are left out rather than returned with a zero count
+		if !buckets[2].Start.Equal(base.Add(20 * time.Minute)) {
+			t.Errorf("third bucket starts at %v, want %v", buckets[2].Start, base.Add(20*time.Minute))
+		}
+
+		// Only an end bound is one placeholder after the device ID
+		buckets, err = store.AggregateFrequency(device.ID, FrequencyRange{End: base.Add(4 * time.Minute)}, 5*time.Minute, time.UTC)
+		if err != nil || len(buckets) != 1 || buckets[0].Count != 2 {
+			t.Errorf("end-only range: got %+v, %v", buckets, err)
+		}
+		buckets, err = store.AggregateFrequency(device.ID, FrequencyRange{Start: base.Add(5 * time.Minute)}, 5*time.Minute, time.UTC)
+		if err != nil || len(buckets) != 2 {
+			t.Errorf("start-only range: got %+v, %v", buckets, err)
+		}
+
+		// Limit counts buckets, not readings
+		buckets, err = store.AggregateFrequency(device.ID, FrequencyRange{Limit: 2}, 5*time.Minute, time.UTC)
+		if err != nil || len(buckets) != 2 || buckets[0].Count != 2 {
+			t.Errorf("limited to 2 buckets: got %+v, %v", buckets, err)
+		}
+	})
+}
+
+func TestAggregateFrequencyDayBoundariesFollowTimezone(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStores(t, func(t *testing.T, store Store) {
+		_, device := seedDevice(t, store, "alice")
+		// 23:30 the evening before, just after midnight, and late on the
+		// 23-hour day clocks went forward
+		insertReadings(t, store, device.ID, []time.Time{
+			time.Date(2025, 3, 9, 5, 30, 0, 0, time.UTC),
+			time.Date(2025, 3, 9, 6, 30, 0, 0, time.UTC),
+			time.Date(2025, 3, 10, 4, 30, 0, 0, time.UTC),
+		}, []float64{60, 60, 60})
+
+		buckets, err := store.AggregateFrequency(device.ID, FrequencyRange{}, 24*time.Hour, chicago)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []struct {
+			start time.Time
+			count int64
+		}{
+			{time.Date(2025, 3, 8, 0, 0, 0, 0, chicago), 1},
+			{time.Date(2025, 3, 9, 0, 0, 0, 0, chicago), 2},
+		}
+		if len(buckets) != len(want) {
+			t.Fatalf("got %d day buckets, want %d: %+v", len(buckets), len(want), buckets)
+		}
+		for i, w := range want {
+			if !buckets[i].Start.Equal(w.start) || buckets[i].Count != w.count {
+				t.Errorf("day %d: got start %v count %d, want %v count %d", i, buckets[i].Start, buckets[i].Count, w.start, w.count)
+			}
+		}
+
+		// The same readings split differently on UTC days
+		buckets, err = store.AggregateFrequency(device.ID, FrequencyRange{}, 24*time.Hour, time.UTC)
+		if err != nil || len(buckets) != 2 || buckets[0].Count != 2 {
+			t.Errorf("UTC days: got %+v, %v", buckets, err)
+		}
+	})
+}
+
+// getFrequencyData calls fetchFrequencyData for deviceID with query
+func getFrequencyData(s *Server, deviceID int, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/fetchFrequencyData/"+strconv.Itoa(deviceID)+"?"+query, nil)
+	c.Params = gin.Params{{Key: "id", Value: strconv.Itoa(deviceID)}}
+	s.fetchFrequencyData(c)
+	return w
+}
+
+func TestFetchFrequencyDataCapsPoints(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewServer(store, DefaultConfig())
+	_, device := seedDevice(t, store, "alice")
+
+	base := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= maxFrequencyPoints; i++ {
+		entry := FrequencyLog{DeviceID: device.ID, Frequency: 60, Timestamp: base.Add(time.Duration(i) * time.Minute)}
+		if err := store.InsertFrequency(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, query := range []string{"", "bucket=1m"} {
+		w := getFrequencyData(s, device.ID, query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: got %d: %s", query, w.Code, w.Body)
+		}
+		var points []json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &points); err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != maxFrequencyPoints || w.Header().Get("X-Truncated") != "true" {
+			t.Errorf("%q: got %d points, X-Truncated %q; want %d and true", query, len(points), w.Header().Get("X-Truncated"), maxFrequencyPoints)
+		}
+	}
+
+	// A range that fits is returned whole and unflagged
+	end := base.Add(9 * time.Minute).Format(time.RFC3339)
+	w := getFrequencyData(s, device.ID, "end="+end)
+	var points []json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &points); err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 10 || w.Header().Get("X-Truncated") != "" {
+		t.Errorf("end-only range: got %d points, X-Truncated %q; want 10 and none", len(points), w.Header().Get("X-Truncated"))
+	}
+
+	if w := getFrequencyData(s, device.ID, "bucket=2m"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown bucket: got %d, want 400", w.Code)
+	}
+	if w := getFrequencyData(s, device.ID, "bucket=1h&tz=Mars/Olympus"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown tz: got %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait bounds a single frame write to the device
+	writeWait = 10 * time.Second
+	// sendBuffer is how many frames may queue for one device before Send fails
+	sendBuffer = 32
+	// maxDeviceMessage caps inbound frames; device messages are small JSON
+	maxDeviceMessage = 16 * 1024
+)
+
+var (
+	errConnClosed     = errors.New("device connection closed")
+	errSendBufferFull = errors.New("device send buffer full")
+)
+
+// DeviceConn is one live device WebSocket. Every write goes through send and
+// is performed by writePump, so HTTP handlers never touch the socket directly.
+type DeviceConn struct {
+	hub         *Hub
+	ws          *websocket.Conn
+	Device      Device
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	send      chan outbound
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// flushMu serialises queue delivery so commands go out in order
+	flushMu sync.Mutex
+
+	// sessionID is the device_sessions row for this connection
+	sessionID int64
+	// lastSeen is the UnixNano time of the last frame or pong
+	lastSeen atomic.Int64
+}
+
+// outbound is one queued frame; written, if set, receives the write result
+type outbound struct {
+	msg     []byte
+	written chan<- error
+}
+
+// Hub owns every device connection, keyed by device ID
+type Hub struct {
+	pongWait   time.Duration
+	pingPeriod time.Duration
+
+	mu    sync.RWMutex
+	conns map[int]*DeviceConn
+
+	// pending maps an outbound request ID to whoever is waiting for its ack
+	pendingMu sync.Mutex
+	pending   map[string]pendingAck
+}
+
+// pendingAck is a waiter for the reply to one request sent to one device
+type pendingAck struct {
+	deviceID int
+	ch       chan DeviceResponse
+}
+
+// NewHub pings devices often enough that a silent socket is dropped after pongWait
+func NewHub(pongWait time.Duration) *Hub {
+	return &Hub{
+		pongWait:   pongWait,
+		pingPeriod: pongWait * 9 / 10,
+		conns:      make(map[int]*DeviceConn),
+		pending:    make(map[string]pendingAck),
+	}
+}
+
+// ExpectAck registers interest in deviceID's reply to requestID
+func (h *Hub) ExpectAck(deviceID int, requestID string) <-chan DeviceResponse {
+	ch := make(chan DeviceResponse, 1)
+	h.pendingMu.Lock()
+	h.pending[requestID] = pendingAck{deviceID: deviceID, ch: ch}
+	h.pendingMu.Unlock()
+	return ch
+}
+
+// CancelAck stops waiting for requestID
+func (h *Hub) CancelAck(requestID string) {
+	h.pendingMu.Lock()
+	delete(h.pending, requestID)
+	h.pendingMu.Unlock()
+}
+
+// ResolveAck hands a reply from deviceID to its waiter, reporting whether one
+// existed. A reply naming another device's request is dropped and leaves the
+// waiter in place.
+func (h *Hub) ResolveAck(deviceID int, response DeviceResponse) bool {
+	h.pendingMu.Lock()
+	p, ok := h.pending[response.RequestID]
+	if ok && p.deviceID != deviceID {
+		ok = false
+	} else {
+		delete(h.pending, response.RequestID)
+	}
+	h.pendingMu.Unlock()
+
+	if ok {
+		p.ch <- response
+	}
+	return ok
+}
+
+// Register takes ownership of ws, replacing any older connection for the same
+// device, and starts its writer goroutine
+func (h *Hub) Register(ws *websocket.Conn, device Device) *DeviceConn {
+	dc := &DeviceConn{
+		hub:         h,
+		ws:          ws,
+		Device:      device,
+		RemoteAddr:  ws.RemoteAddr().String(),
+		ConnectedAt: time.Now(),
+		send:        make(chan outbound, sendBuffer),
+		done:        make(chan struct{}),
+	}
+
+	dc.lastSeen.Store(dc.ConnectedAt.UnixNano())
+
+	ws.SetReadLimit(maxDeviceMessage)
+	ws.SetReadDeadline(time.Now().Add(h.pongWait))
+	ws.SetPongHandler(func(string) error {
+		dc.lastSeen.Store(time.Now().UnixNano())
+		return ws.SetReadDeadline(time.Now().Add(h.pongWait))
+	})
+
+	h.mu.Lock()
+	old, exists := h.conns[device.ID]
+	h.conns[device.ID] = dc
+	h.mu.Unlock()
+
+	// Close existing connection if device is reconnecting
+	if exists {
+		old.Close(websocket.CloseNormalClosure, "replaced by a newer connection")
+	}
+
+	go dc.writePump()
+	return dc
+}
+
+// Get returns the live connection for deviceID
+func (h *Hub) Get(deviceID int) (*DeviceConn, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	dc, ok := h.conns[deviceID]
+	return dc, ok
+}
+
+// Remove drops dc from the map unless a newer connection has replaced it
+func (h *Hub) Remove(dc *DeviceConn) {
+	h.mu.Lock()
+	if h.conns[dc.Device.ID] == dc {
+		delete(h.conns, dc.Device.ID)
+	}
+	h.mu.Unlock()
+	dc.Close(websocket.CloseNormalClosure, "")
+}
+
+// Disconnect closes the device's live connection, if any, with reason
+func (h *Hub) Disconnect(deviceID int, reason string) bool {
+	dc, ok := h.Get(deviceID)
+	if ok {
+		dc.Close(websocket.ClosePolicyViolation, reason)
+	}
+	return ok
+}
+
+// Send queues v as a JSON text frame for the writer goroutine
+func (dc *DeviceConn) Send(v any) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-dc.done:
+		return errConnClosed
+	default:
+	}
+
+	select {
+	case dc.send <- outbound{msg: msg}:
+		return nil
+	case <-dc.done:
+		return errConnClosed
+	default:
+		// A device this far behind is not draining its socket
+		dc.Close(websocket.CloseTryAgainLater, "send buffer full")
+		return errSendBufferFull
+	}
+}
+
+// Deliver queues v behind anything already buffered and waits until the
+// writer has put it on the socket. Unlike Send it waits for room in the
+// buffer, so a caller delivering frames one at a time never overflows it.
+func (dc *DeviceConn) Deliver(v any) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	written := make(chan error, 1)
+	select {
+	case dc.send <- outbound{msg: msg, written: written}:
+	case <-dc.done:
+		return errConnClosed
+	}
+
+	select {
+	case err := <-written:
+		return err
+	case <-dc.done:
+		return errConnClosed
+	}
+}
+
+// ReadMessage returns the next frame; the read deadline is pushed forward by
+// every pong, so a device that stops answering pings times out here
+func (dc *DeviceConn) ReadMessage() ([]byte, error) {
+	_, msg, err := dc.ws.ReadMessage()
+	if err == nil {
+		dc.lastSeen.Store(time.Now().UnixNano())
+		dc.ws.SetReadDeadline(time.Now().Add(dc.hub.pongWait))
+	}
+	return msg, err
+}
+
+// LastSeen is when the device last sent a frame or answered a ping
+func (dc *DeviceConn) LastSeen() time.Time {
+	return time.Unix(0, dc.lastSeen.Load())
+}
+
+// Done is closed once the connection has been shut down
+func (dc *DeviceConn) Done() <-chan struct{} {
+	return dc.done
+}
+
+// Close sends a close frame with code and reason and tears the socket down
+func (dc *DeviceConn) Close(code int, reason string) {
+	dc.closeOnce.Do(func() {
+		close(dc.done)
+		msg := websocket.FormatCloseMessage(code, reason)
+		dc.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		dc.ws.Close()
+	})
+}
+
+// writePump is the only goroutine that writes data frames to the socket
+func (dc *DeviceConn) writePump() {
+	ticker := time.NewTicker(dc.hub.pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case out := <-dc.send:
+			dc.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			err := dc.ws.WriteMessage(websocket.TextMessage, out.msg)
+			if out.written != nil {
+				out.written <- err
+			}
+			if err != nil {
+				log.Println("WebSocket write failed for device", dc.Device.ID, err)
+				dc.Close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ticker.C:
+			if err := dc.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.Println("WebSocket ping failed for device", dc.Device.ID, err)
+				dc.Close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-dc.done:
+			return
+		}
+	}
+}
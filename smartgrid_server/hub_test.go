@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialHub connects a fake device to hub as device and returns the hub's side
+// of the connection along with the device's
+func dialHub(t *testing.T, hub *Hub, device Device) (*DeviceConn, *websocket.Conn) {
+	t.Helper()
+	registered := make(chan *DeviceConn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		registered <- hub.Register(ws, device)
+	}))
+	t.Cleanup(ts.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case dc := <-registered:
+		return dc, client
+	case <-time.After(5 * time.Second):
+		t.Fatal("device was never registered")
+		return nil, nil
+	}
+}
+
+// expectClose reads from client until the server's close frame arrives
+func expectClose(t *testing.T, client *websocket.Conn, code int, reason string) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := client.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("got %v, want close frame %d", err, code)
+		}
+		if closeErr.Code != code || closeErr.Text != reason {
+			t.Fatalf("closed with %d %q, want %d %q", closeErr.Code, closeErr.Text, code, reason)
+		}
+		return
+	}
+}
+
+func TestHubReplacesReconnectingDevice(t *testing.T) {
+	hub := NewHub(time.Minute)
+	device := Device{ID: 1}
+
+	first, firstClient := dialHub(t, hub, device)
+	second, secondClient := dialHub(t, hub, device)
+
+	expectClose(t, firstClient, websocket.CloseNormalClosure, "replaced by a newer connection")
+	select {
+	case <-first.Done():
+	default:
+		t.Fatal("replaced connection is not done")
+	}
+	if dc, ok := hub.Get(device.ID); !ok || dc != second {
+		t.Fatal("hub does not hold the newer connection")
+	}
+
+	// The old connection's reader cleaning up must not drop its replacement
+	hub.Remove(first)
+	if dc, ok := hub.Get(device.ID); !ok || dc != second {
+		t.Fatal("removing the old connection dropped the newer one")
+	}
+
+	if err := second.Send(DeviceResponse{Command: "pingDevice"}); err != nil {
+		t.Fatal(err)
+	}
+	var got DeviceResponse
+	secondClient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := secondClient.ReadJSON(&got); err != nil || got.Command != "pingDevice" {
+		t.Fatalf("newer connection read %+v, %v", got, err)
+	}
+}
+
+func TestHubDisconnect(t *testing.T) {
+	hub := NewHub(time.Minute)
+	dc, client := dialHub(t, hub, Device{ID: 1})
+
+	if !hub.Disconnect(1, "credential revoked") {
+		t.Fatal("Disconnect found no connection")
+	}
+	expectClose(t, client, websocket.ClosePolicyViolation, "credential revoked")
+	if err := dc.Send(DeviceResponse{Command: "pingDevice"}); !errors.Is(err, errConnClosed) {
+		t.Fatalf("Send after Disconnect: got %v, want errConnClosed", err)
+	}
+
+	hub.Remove(dc)
+	if hub.Disconnect(1, "credential revoked") {
+		t.Fatal("Disconnect reported a connection that was removed")
+	}
+}
+
+func TestHubAckOnlyFromTargetDevice(t *testing.T) {
+	hub := NewHub(time.Minute)
+	ack := hub.ExpectAck(1, "abc123")
+
+	// Another device echoing the request ID does not answer it
+	if hub.ResolveAck(2, DeviceResponse{RequestID: "abc123", Status: "ok"}) {
+		t.Fatal("ack from another device was accepted")
+	}
+	if !hub.ResolveAck(1, DeviceResponse{RequestID: "abc123", Status: "error"}) {
+		t.Fatal("ack from the target device was dropped")
+	}
+	if response := <-ack; response.Status != "error" {
+		t.Fatalf("waiter got %+v, want the target device's reply", response)
+	}
+}
+
+func TestHubClosesDeviceWithFullSendBuffer(t *testing.T) {
+	hub := NewHub(time.Minute)
+	dc, client := dialHub(t, hub, Device{ID: 1})
+
+	// The device never reads, so once the socket buffers fill the writer
+	// stalls and queued frames pile up
+	frame := strings.Repeat("x", 1<<20)
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		err = dc.Send(frame)
+	}
+	if !errors.Is(err, errSendBufferFull) {
+		t.Fatalf("got %v, want errSendBufferFull", err)
+	}
+	select {
+	case <-dc.Done():
+	default:
+		t.Fatal("connection left open with a full send buffer")
+	}
+	if err := dc.Send(frame); !errors.Is(err, errConnClosed) {
+		t.Fatalf("Send after overflow: got %v, want errConnClosed", err)
+	}
+	client.Close()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxJobTargets caps how many commands one command job may send
+	maxJobTargets = 500
+	// maxCommandJobList caps fetchCommandJobs
+	maxCommandJobList = 100
+)
+
+// commandJobReport is a job with its targets and how many ended in each status
+type commandJobReport struct {
+	CommandJob
+	Counts  map[string]int     `json:"counts"`
+	Targets []CommandJobTarget `json:"targets"`
+}
+
+// commandJobRequest is the body of createCommandJob
+type commandJobRequest struct {
+	deviceTarget
+	DeviceIDs    []int  `json:"device_ids"`
+	Command      string `json:"command"`
+	BreakerState *bool  `json:"breaker_state"`
+	Timeout      string `json:"timeout,omitempty"`
+	TTL          string `json:"ttl,omitempty"`
+}
+
+// createCommandJob sends pingDevice, flashLED or toggleBreaker to a list of
+// devices, a site or a group. toggleBreaker sets every breaker on each device
+// to breaker_state. The job runs in the background with at most
+// CommandJobConcurrency commands awaiting acknowledgement at once; poll
+// readCommandJob for each target's outcome.
+func (s *Server) createCommandJob(c *gin.Context) {
+	var input commandJobRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	s.startCommandJob(c, input)
+}
+
+// sendTargetPacket is the older way to ping or flash every device in a site
+// or group; it now starts a command job for them
+func (s *Server) sendTargetPacket(c *gin.Context) {
+	var input struct {
+		deviceTarget
+		Command string `json:"command"`
+		TTL     string `json:"ttl,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if input.Command != "pingDevice" && input.Command != "flashLED" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only pingDevice and flashLED can be sent to a site or group"})
+		return
+	}
+	s.startCommandJob(c, commandJobRequest{deviceTarget: input.deviceTarget, Command: input.Command, TTL: input.TTL})
+}
+
+// startCommandJob validates input, records the job and runs it in the background
+func (s *Server) startCommandJob(c *gin.Context, input commandJobRequest) {
+	switch input.Command {
+	case "pingDevice", "flashLED":
+		input.BreakerState = nil
+	case "toggleBreaker":
+		if input.BreakerState == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Breaker state required"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown command"})
+		return
+	}
+	userID := currentUserID(c)
+	opts := CommandOptions{Wait: true, RequestedBy: Requester{Source: SourceUser, UserID: &userID}}
+	var err error
+	if opts.Timeout, err = parseDurationParam(input.Timeout, s.cfg.CommandAckTimeout, maxAckTimeout); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timeout"})
+		return
+	}
+	if opts.TTL, err = parseDurationParam(input.TTL, s.cfg.CommandTTL, maxCommandTTL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ttl"})
+		return
+	}
+
+	devices, ok := s.jobDevices(c, input.deviceTarget, input.DeviceIDs, RoleOperator)
+	if !ok {
+		return
+	}
+	var targets []CommandJobTarget
+	for _, device := range devices {
+		if input.Command != "toggleBreaker" {
+			targets = append(targets, CommandJobTarget{DeviceID: device.ID})
+			continue
+		}
+		breakers, err := s.store.ListBreakersByDevice(device.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch breakers"})
+			return
+		}
+		for _, breaker := range breakers {
+			targets = append(targets, CommandJobTarget{DeviceID: device.ID, BreakerID: &breaker.ID})
+		}
+	}
+	if len(targets) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to command"})
+		return
+	}
+	if len(targets) > maxJobTargets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many commands for one job"})
+		return
+	}
+
+	job := CommandJob{
+		UserID:       userID,
+		Command:      input.Command,
+		BreakerState: input.BreakerState,
+		SiteID:       input.SiteID,
+		GroupID:      input.GroupID,
+	}
+	if err := s.store.CreateCommandJob(&job, targets); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create command job"})
+		return
+	}
+	auditTarget(c, "command_job", job.ID)
+	auditChange(c, nil, gin.H{"job": job, "targets": len(targets)})
+	go s.runCommandJob(job, targets, opts)
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Command job started", "jobID": job.ID, "targets": len(targets)})
+}
+
+// jobDevices resolves a job's devices: an explicit list, on every one of which
+// the caller must hold role need, or the devices of a site or group they do
+func (s *Server) jobDevices(c *gin.Context, target deviceTarget, deviceIDs []int, need string) ([]Device, bool) {
+	if deviceIDs == nil {
+		shared, _, ok := s.targetDevices(c, target, need)
+		if !ok {
+			return nil, false
+		}
+		devices := make([]Device, 0, len(shared))
+		for _, d := range shared {
+			devices = append(devices, d.Device)
+		}
+		return devices, true
+	}
+
+	if !target.empty() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give either device_ids, a site or a group"})
+		return nil, false
+	}
+	slices.Sort(deviceIDs)
+	var devices []Device
+	for _, id := range slices.Compact(deviceIDs) {
+		if !s.authorizeDevice(c, id, need) {
+			return nil, false
+		}
+		device, err := s.store.GetDevice(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+			return nil, false
+		}
+		devices = append(devices, device)
+	}
+	return devices, true
+}
+
+// runCommandJob sends every target's command, CommandJobConcurrency at a time
+func (s *Server) runCommandJob(job CommandJob, targets []CommandJobTarget, opts CommandOptions) {
+	slots := make(chan struct{}, s.cfg.CommandJobConcurrency)
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(target CommandJobTarget) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			s.runJobTarget(job, target, opts)
+		}(target)
+	}
+	wg.Wait()
+
+	if err := s.store.CompleteCommandJob(job.ID, time.Now()); err != nil {
+		log.Printf("Failed to complete command job %d: %v\n", job.ID, err)
+	}
+}
+
+// runJobTarget dispatches one target's command and records how far it got
+func (s *Server) runJobTarget(job CommandJob, target CommandJobTarget, opts CommandOptions) {
+	payload := DeviceResponse{Command: job.Command}
+	if target.BreakerID != nil {
+		payload.BreakerID = target.BreakerID
+		payload.BreakerState = job.BreakerState
+	}
+
+	cmd, err := s.dispatchCommand(target.DeviceID, payload, opts)
+	if cmd.ID != 0 {
+		target.CommandID = &cmd.ID
+	}
+	switch {
+	case errors.Is(err, errAckTimeout):
+		target.Status = TargetDelivered
+	case errors.Is(err, errConnClosed):
+		target.Status, target.Error = TargetFailed, "Device disconnected"
+	case err != nil:
+		log.Println("Failed to dispatch command to device", target.DeviceID, err)
+		target.Status, target.Error = TargetFailed, "Could not send command"
+	case cmd.Status == CommandPending:
+		target.Status = TargetOffline
+	case cmd.Status == CommandFailed:
+		target.Status, target.Error = TargetFailed, "Device reported an error"
+		if cmd.Result != nil && cmd.Result.Error != "" {
+			target.Error = cmd.Result.Error
+		}
+	default:
+		target.Status = TargetAcked
+	}
+
+	// As with sendPacket, switching a shed breaker takes it out of load shedding's hands
+	if err == nil && target.BreakerID != nil {
+		if breaker, err := s.store.GetBreaker(*target.BreakerID); err == nil {
+			s.releaseShedBreaker(breaker, &job.UserID, "Switched manually")
+		}
+	}
+
+	target.UpdatedAt = time.Now()
+	if err := s.store.UpdateCommandJobTarget(target); err != nil {
+		log.Printf("Failed to record command job %d target %d: %v\n", job.ID, target.ID, err)
+	}
+}
+
+// loadCommandJob resolves :id to one of the caller's command jobs
+func (s *Server) loadCommandJob(c *gin.Context) (CommandJob, bool) {
+	id, ok := paramID(c, "id", "job")
+	if !ok {
+		return CommandJob{}, false
+	}
+	auditTarget(c, "command_job", int64(id))
+	job, err := s.store.GetCommandJob(int64(id))
+	if err := checkOwner(c, job.UserID, err); err != nil {
+		abortAuthz(c, err, "Job")
+		return CommandJob{}, false
+	}
+	return job, true
+}
+
+// readCommandJob returns a job with each target's outcome and a count per status
+func (s *Server) readCommandJob(c *gin.Context) {
+	job, ok := s.loadCommandJob(c)
+	if !ok {
+		return
+	}
+
+	targets, err := s.store.ListCommandJobTargets(job.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve job"})
+		return
+	}
+	report := commandJobReport{
+		CommandJob: job,
+		Counts:     map[string]int{TargetPending: 0, TargetDelivered: 0, TargetAcked: 0, TargetOffline: 0, TargetFailed: 0},
+		Targets:    targets,
+	}
+	for _, target := range targets {
+		report.Counts[target.Status]++
+	}
+	if report.Targets == nil {
+		report.Targets = []CommandJobTarget{}
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// fetchCommandJobs lists the caller's most recent command jobs, newest first
+func (s *Server) fetchCommandJobs(c *gin.Context) {
+	jobs, err := s.store.ListCommandJobs(currentUserID(c), maxCommandJobList)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
+		return
+	}
+	if jobs == nil {
+		jobs = []CommandJob{}
+	}
+
+	c.JSON(http.StatusOK, jobs)
+}
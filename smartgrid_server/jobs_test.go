@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCommandJobReportsEachTarget(t *testing.T) {
+	store := NewMemoryStore()
+	router := NewServer(store, DefaultConfig()).Router()
+	user, device := seedDevice(t, store, "bob")
+	site := Site{UserID: user.ID, Name: "bob home", Timezone: "UTC"}
+	if err := store.CreateSite(&site); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetDeviceSite(device.ID, &site.ID); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"main", "oven"} {
+		b := Breaker{DeviceID: device.ID, Name: name, Breaker_Number: fmt.Sprint(i + 1)}
+		if err := store.CreateBreaker(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := fmt.Sprintf(`{"site_id":%d,"command":"toggleBreaker","breaker_state":true}`, site.ID)
+	w := serve(t, router, user.ID, "POST", "/createCommandJob", body)
+	var created struct {
+		JobID   int64 `json:"jobID"`
+		Targets int   `json:"targets"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusAccepted || created.Targets != 2 {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	// The device is not connected, so both toggles are left queued
+	var report commandJobReport
+	deadline := time.Now().Add(5 * time.Second)
+	for report.Status != JobCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not complete: %+v", report)
+		}
+		w = serve(t, router, user.ID, "GET", fmt.Sprintf("/readCommandJob/%d", created.JobID), "")
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if report.Counts[TargetOffline] != 2 || len(report.Targets) != 2 {
+		t.Fatalf("unexpected report: %s", w.Body)
+	}
+	for _, target := range report.Targets {
+		if target.BreakerID == nil || target.CommandID == nil || target.DeviceID != device.ID {
+			t.Fatalf("unexpected target: %+v", target)
+		}
+	}
+
+	cmds, err := store.ListCommands(device.ID, CommandPending, 10)
+	if err != nil || len(cmds) != 2 {
+		t.Fatalf("got %d pending commands, want the two toggles: %v", len(cmds), err)
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxShedTier bounds breaker priorities; tiers without a configured
+	// threshold are never shed
+	maxShedTier = 9
+	// maxShedSuspension caps how long shedding may be suspended in one go
+	maxShedSuspension = 7 * 24 * time.Hour
+	// maxShedEventList caps fetchLoadShedEvents
+	maxShedEventList = 500
+	// Readings outside minPlausibleHz to maxPlausibleHz are taken to be sensor
+	// faults and never shed or restore anything
+	minPlausibleHz = 55
+	maxPlausibleHz = 65
+	// shedOverrideCacheTTL bounds how long a device's override is reused
+	// before it is read again
+	shedOverrideCacheTTL = time.Minute
+)
+
+// EventLoadShed is pushed to app clients for every load shedding action
+const EventLoadShed = "load_shed"
+
+// shedState is one device's progress towards shedding or restoring. mu is
+// held for a whole evaluation, including the toggles it sends.
+type shedState struct {
+	mu sync.Mutex
+	// below maps a tier to how long frequency has been under its threshold
+	below       map[int]belowThreshold
+	recovered   time.Time
+	lastRestore time.Time
+}
+
+// belowThreshold is when frequency dropped under a tier's threshold and how
+// many readings in a row have been under it since
+type belowThreshold struct {
+	since    time.Time
+	readings int
+}
+
+// pendingToggle is a shed or restore toggle waiting for the device to confirm it
+type pendingToggle struct {
+	breakerID int
+	restore   bool
+	sentAt    time.Time
+}
+
+// cachedOverride is a device's suspension as of loadedAt; a zero until means none
+type cachedOverride struct {
+	until    time.Time
+	loadedAt time.Time
+}
+
+// loadShedder tracks per-device timing. Which breakers are shed lives on the
+// breakers themselves, so a restart loses nothing but the timers.
+type loadShedder struct {
+	// mu only guards the maps; each device's state has its own lock so one
+	// slow panel or store write never stalls shedding for every other device
+	mu      sync.Mutex
+	devices map[int]*shedState
+	// pending maps the request ID of each unconfirmed toggle to its breaker
+	pending   map[string]pendingToggle
+	overrides map[int]cachedOverride
+}
+
+func newLoadShedder() *loadShedder {
+	return &loadShedder{
+		devices:   make(map[int]*shedState),
+		pending:   make(map[string]pendingToggle),
+		overrides: make(map[int]cachedOverride),
+	}
+}
+
+// state returns the device's state, creating it on first use
+func (sh *loadShedder) state(deviceID int) *shedState {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	st := sh.devices[deviceID]
+	if st == nil {
+		st = &shedState{below: make(map[int]belowThreshold)}
+		sh.devices[deviceID] = st
+	}
+	return st
+}
+
+// togglePending reports whether a shed or restore of breakerID is awaiting its ack
+func (sh *loadShedder) togglePending(breakerID int) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for _, p := range sh.pending {
+		if p.breakerID == breakerID {
+			return true
+		}
+	}
+	return false
+}
+
+// addPending waits for the ack of the toggle sent as requestID, dropping
+// toggles that went unanswered past maxAge
+func (sh *loadShedder) addPending(requestID string, p pendingToggle, maxAge time.Duration) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for id, old := range sh.pending {
+		if p.sentAt.Sub(old.sentAt) > maxAge {
+			delete(sh.pending, id)
+		}
+	}
+	sh.pending[requestID] = p
+}
+
+// setOverride caches a device's suspension after it was changed here
+func (sh *loadShedder) setOverride(deviceID int, until time.Time) {
+	sh.mu.Lock()
+	sh.overrides[deviceID] = cachedOverride{until: until, loadedAt: time.Now()}
+	sh.mu.Unlock()
+}
+
+// forget drops a device's timers, e.g. when it goes offline
+func (sh *loadShedder) forget(deviceID int) {
+	sh.mu.Lock()
+	delete(sh.devices, deviceID)
+	sh.mu.Unlock()
+}
+
+// sheddingSuspended reports whether a manual override covers the device at
+// t, reading the override from the store only when the cached one is stale
+func (s *Server) sheddingSuspended(deviceID int, t time.Time) bool {
+	s.shedding.mu.Lock()
+	cached, ok := s.shedding.overrides[deviceID]
+	s.shedding.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < shedOverrideCacheTTL {
+		return cached.until.After(t)
+	}
+
+	until, err := s.store.GetLoadShedOverride(deviceID)
+	if errors.Is(err, ErrNotFound) {
+		until = time.Time{}
+	} else if err != nil {
+		log.Println("Failed to load shedding override:", err)
+		return false
+	}
+	s.shedding.setOverride(deviceID, until)
+	return until.After(t)
+}
+
+// evaluateLoadShedding opens a device's breakers tier by tier while frequency
+// stays under the thresholds, and brings them back one tier at a time once it
+// has recovered
+func (s *Server) evaluateLoadShedding(device Device, entry FrequencyLog) {
+	thresholds := s.cfg.LoadShedThresholds
+	if len(thresholds) == 0 {
+		return
+	}
+	if entry.Frequency < minPlausibleHz || entry.Frequency > maxPlausibleHz {
+		return
+	}
+	if s.sheddingSuspended(device.ID, entry.Timestamp) {
+		s.shedding.forget(device.ID)
+		return
+	}
+	breakers, err := s.store.ListBreakersByDevice(device.ID)
+	if err != nil {
+		log.Println("Failed to load breakers for load shedding:", err)
+		return
+	}
+
+	st := s.shedding.state(device.ID)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f, at := entry.Frequency, entry.Timestamp
+
+	for tier := 1; tier <= len(thresholds); tier++ {
+		if f >= thresholds[tier-1] {
+			delete(st.below, tier)
+			continue
+		}
+		below, ok := st.below[tier]
+		if !ok {
+			below.since = at
+		}
+		below.readings++
+		st.below[tier] = below
+		if at.Sub(below.since) < s.cfg.LoadShedDelay || below.readings < s.cfg.LoadShedMinReadings {
+			continue
+		}
+		for _, b := range breakers {
+			if b.Priority == tier && b.ShedAt == nil && b.Status && !s.shedding.togglePending(b.ID) {
+				reason := fmt.Sprintf("Frequency %.3f Hz below %.3f Hz since %s", f, thresholds[tier-1], below.since.UTC().Format(time.RFC3339))
+				s.shedBreaker(device, b, tier, f, reason)
+			}
+		}
+	}
+
+	if f < s.cfg.LoadShedRestoreHz {
+		st.recovered = time.Time{}
+		return
+	}
+	if st.recovered.IsZero() {
+		st.recovered = at
+	}
+	if at.Sub(st.recovered) < s.cfg.LoadShedRestoreDelay || at.Sub(st.lastRestore) < s.cfg.LoadShedRestoreStagger {
+		return
+	}
+
+	// The highest tier was shed last, so it comes back first
+	tier := -1
+	for _, b := range breakers {
+		if b.ShedAt != nil && b.Priority > tier {
+			tier = b.Priority
+		}
+	}
+	if tier < 0 {
+		return
+	}
+	reason := fmt.Sprintf("Frequency %.3f Hz, recovered since %s", f, st.recovered.UTC().Format(time.RFC3339))
+	for _, b := range breakers {
+		if b.ShedAt != nil && b.Priority == tier && !s.shedding.togglePending(b.ID) {
+			s.restoreBreaker(device, b, &f, nil, reason)
+		}
+	}
+	st.lastRestore = at
+}
+
+// switchBreaker sends a toggle without waiting: shedding runs inside the
+// device's read loop, which is also where the ack would arrive
+func (s *Server) switchBreaker(device Device, b Breaker, on bool, by Requester) (DeviceCommand, error) {
+	payload := DeviceResponse{Command: "toggleBreaker", BreakerID: &b.ID, BreakerState: &on}
+	// A shed or restore that cannot go out promptly is stale
+	return s.dispatchCommand(device.ID, payload, CommandOptions{TTL: s.cfg.CommandAckTimeout, RequestedBy: by})
+}
+
+// awaitShedToggle remembers a shed or restore toggle until the device answers
+// it. Unanswered toggles are dropped once their command could no longer be
+// delivered, so the next evaluation tries again.
+func (s *Server) awaitShedToggle(cmd DeviceCommand, b Breaker, restore bool) {
+	p := pendingToggle{breakerID: b.ID, restore: restore, sentAt: time.Now()}
+	s.shedding.addPending(cmd.RequestID, p, s.cfg.CommandAckTimeout+time.Minute)
+}
+
+// shedBreaker sends the toggle that opens b. The breaker is only marked as
+// held open by load shedding once the device confirms it, in confirmShedToggle.
+func (s *Server) shedBreaker(device Device, b Breaker, tier int, frequency float64, reason string) {
+	cmd, err := s.switchBreaker(device, b, false, Requester{Source: SourceAutomation})
+	if err != nil {
+		log.Printf("Failed to shed breaker %d: %v\n", b.ID, err)
+		return
+	}
+	s.awaitShedToggle(cmd, b, false)
+	s.logLoadShed(device, LoadShedEvent{BreakerID: &b.ID, Action: ShedActionShed, Tier: &tier, Frequency: &frequency, CommandID: &cmd.ID, Reason: reason})
+}
+
+// confirmShedToggle marks a breaker as held open by load shedding once the
+// device has acked the shed toggle, and clears the mark once it has acked the
+// restore. A failed toggle just stops waiting for it.
+func (s *Server) confirmShedToggle(breaker Breaker, response DeviceResponse) {
+	s.shedding.mu.Lock()
+	p, ok := s.shedding.pending[response.RequestID]
+	delete(s.shedding.pending, response.RequestID)
+	s.shedding.mu.Unlock()
+	if !ok || p.breakerID != breaker.ID || response.Status == "error" {
+		return
+	}
+
+	var shedAt *time.Time
+	if !p.restore {
+		now := time.Now()
+		shedAt = &now
+	}
+	if err := s.store.SetBreakerShed(breaker.ID, shedAt); err != nil {
+		log.Println("Failed to update breaker shed mark:", err)
+	}
+}
+
+// restoreBreaker closes a shed breaker again; userID is nil when automated.
+// The breaker stays marked as shed until the device acks the restore, so a
+// lost or failed restore is retried.
+func (s *Server) restoreBreaker(device Device, b Breaker, frequency *float64, userID *int, reason string) {
+	by := Requester{Source: SourceAutomation}
+	if userID != nil {
+		by = Requester{Source: SourceUser, UserID: userID}
+	}
+	cmd, err := s.switchBreaker(device, b, true, by)
+	if err != nil {
+		log.Printf("Failed to restore breaker %d: %v\n", b.ID, err)
+		return
+	}
+	s.awaitShedToggle(cmd, b, true)
+	tier := b.Priority
+	s.logLoadShed(device, LoadShedEvent{BreakerID: &b.ID, Action: ShedActionRestore, Tier: &tier, Frequency: frequency, CommandID: &cmd.ID, UserID: userID, Reason: reason})
+}
+
+// releaseShedBreaker hands a shed breaker back to whoever is now switching
+// it, so automation will not later restore it behind their back
+func (s *Server) releaseShedBreaker(b Breaker, userID *int, reason string) {
+	if b.ShedAt == nil {
+		return
+	}
+	device, err := s.store.GetDevice(b.DeviceID)
+	if err != nil {
+		log.Println("Failed to load device for shed breaker:", err)
+		return
+	}
+	if err := s.store.SetBreakerShed(b.ID, nil); err != nil {
+		log.Println("Failed to clear breaker shed mark:", err)
+		return
+	}
+	tier := b.Priority
+	s.logLoadShed(device, LoadShedEvent{BreakerID: &b.ID, Action: ShedActionRelease, Tier: &tier, UserID: userID, Reason: reason})
+}
+
+// logLoadShed records e against device and announces it
+func (s *Server) logLoadShed(device Device, e LoadShedEvent) {
+	e.DeviceID = device.ID
+	if err := s.store.CreateLoadShedEvent(&e); err != nil {
+		log.Println("Failed to log load shedding event:", err)
+		return
+	}
+	s.publish(EventLoadShed, device, e)
+}
+
+// fetchLoadShedding shows a device's shedding configuration and state
+func (s *Server) fetchLoadShedding(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	breakers, err := s.store.ListBreakersByDevice(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch breakers"})
+		return
+	}
+	if breakers == nil {
+		breakers = []Breaker{}
+	}
+	var suspendedUntil *time.Time
+	if until, err := s.store.GetLoadShedOverride(deviceID); err == nil && until.After(time.Now()) {
+		suspendedUntil = &until
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":         len(s.cfg.LoadShedThresholds) > 0,
+		"thresholds":      s.cfg.LoadShedThresholds,
+		"restore_hz":      s.cfg.LoadShedRestoreHz,
+		"suspended_until": suspendedUntil,
+		"breakers":        breakers,
+	})
+}
+
+// shedOverrideSummary is what the audit log keeps of a device's override
+func (s *Server) shedOverrideSummary(deviceID int) gin.H {
+	var suspendedUntil *time.Time
+	if until, err := s.store.GetLoadShedOverride(deviceID); err == nil {
+		suspendedUntil = &until
+	}
+	return gin.H{"suspended_until": suspendedUntil}
+}
+
+// suspendLoadShedding is the manual override: automation leaves the device
+// alone for ?duration, and with "restore" every shed breaker comes back now
+func (s *Server) suspendLoadShedding(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Duration string `json:"duration"`
+		Restore  bool   `json:"restore"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+	}
+	duration, err := parseDurationParam(input.Duration, time.Hour, maxShedSuspension)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+		return
+	}
+
+	device, err := s.store.GetDevice(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device"})
+		return
+	}
+	userID := currentUserID(c)
+	until := time.Now().Add(duration)
+	before := s.shedOverrideSummary(deviceID)
+	if err := s.store.SetLoadShedOverride(deviceID, userID, until); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not suspend load shedding"})
+		return
+	}
+	s.shedding.forget(deviceID)
+	s.shedding.setOverride(deviceID, until)
+	auditChange(c, before, gin.H{"suspended_until": until, "restore": input.Restore})
+	s.logLoadShed(device, LoadShedEvent{Action: ShedActionSuspend, UserID: &userID, Reason: "Suspended until " + until.UTC().Format(time.RFC3339)})
+
+	if input.Restore {
+		breakers, err := s.store.ListBreakersByDevice(deviceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch breakers"})
+			return
+		}
+		for _, b := range breakers {
+			if b.ShedAt != nil {
+				s.restoreBreaker(device, b, nil, &userID, "Restored by manual override")
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Load shedding suspended", "until": until})
+}
+
+// resumeLoadShedding ends a manual override early
+func (s *Server) resumeLoadShedding(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	device, err := s.store.GetDevice(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device"})
+		return
+	}
+	before := s.shedOverrideSummary(deviceID)
+	err = s.store.ClearLoadShedOverride(deviceID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Load shedding is not suspended"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not resume load shedding"})
+		return
+	}
+	s.shedding.setOverride(deviceID, time.Time{})
+	auditChange(c, before, gin.H{"suspended_until": nil})
+	userID := currentUserID(c)
+	s.logLoadShed(device, LoadShedEvent{Action: ShedActionResume, UserID: &userID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Load shedding resumed"})
+}
+
+// fetchLoadShedEvents lists a device's shedding log between ?start and ?end, newest first
+func (s *Server) fetchLoadShedEvents(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	r, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	r.Limit = maxShedEventList
+
+	events, err := s.store.ListLoadShedEvents(deviceID, r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch load shedding events"})
+		return
+	}
+	if events == nil {
+		events = []LoadShedEvent{}
+	}
+
+	c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newShedServer connects a panel with one sheddable and one critical breaker,
+// both on, and a single 59.5 Hz threshold
+func newShedServer(t *testing.T) (*Server, User, Device, Breaker, *fakeDevice) {
+	t.Helper()
+	store := NewMemoryStore()
+	cfg := DefaultConfig()
+	cfg.LoadShedThresholds = []float64{59.5}
+	cfg.LoadShedDelay = 10 * time.Second
+	cfg.LoadShedRestoreDelay = time.Minute
+	cfg.LoadShedRestoreStagger = 0
+	s := NewServer(store, cfg)
+	user, device := seedDevice(t, store, "alice")
+	var sheddable Breaker
+	for priority := 0; priority <= 1; priority++ {
+		b := Breaker{DeviceID: device.ID, Name: "tier " + strconv.Itoa(priority), Breaker_Number: strconv.Itoa(priority), Priority: priority}
+		if err := store.CreateBreaker(&b); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetBreakerStatus(b.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		sheddable = b
+	}
+	_, panel := connectDevice(t, s, device)
+	return s, user, device, sheddable, panel
+}
+
+// feedShed runs readings ten seconds apart from base through load shedding
+func feedShed(s *Server, device Device, base time.Time, hz ...float64) {
+	for i, f := range hz {
+		s.evaluateLoadShedding(device, FrequencyLog{DeviceID: device.ID, Frequency: f, Timestamp: base.Add(time.Duration(i) * 10 * time.Second)})
+	}
+}
+
+// ackToggle answers the next toggle the panel receives, which must set want
+func ackToggle(t *testing.T, panel *fakeDevice, breaker Breaker, want bool) {
+	t.Helper()
+	msg := panel.next()
+	if msg.Command != "toggleBreaker" || msg.BreakerID == nil || *msg.BreakerID != breaker.ID || msg.BreakerState == nil || *msg.BreakerState != want {
+		t.Fatalf("panel got %+v, want breaker %d set to %v", msg, breaker.ID, want)
+	}
+	panel.reply(DeviceResponse{Command: "toggleBreaker", RequestID: msg.RequestID, BreakerID: msg.BreakerID, BreakerState: msg.BreakerState, Status: "ok"})
+}
+
+// waitForBreaker polls until ok holds for the stored breaker
+func waitForBreaker(t *testing.T, s *Server, id int, ok func(Breaker) bool) Breaker {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, err := s.store.GetBreaker(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok(b) {
+			return b
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker %d never reached the expected state: %+v", id, b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func toggleCommands(t *testing.T, s *Server, device Device) int {
+	t.Helper()
+	cmds, err := s.store.ListCommands(device.ID, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(cmds)
+}
+
+// toggleCommand returns the device's newest command
+func toggleCommand(t *testing.T, s *Server, device Device) DeviceCommand {
+	t.Helper()
+	cmds, err := s.store.ListCommands(device.ID, "", 1)
+	if err != nil || len(cmds) != 1 {
+		t.Fatalf("got %v, %v", cmds, err)
+	}
+	return cmds[0]
+}
+
+// shedTier walks the breaker through a confirmed shed
+func shedTier(t *testing.T, s *Server, device Device, breaker Breaker, panel *fakeDevice, base time.Time) {
+	t.Helper()
+	feedShed(s, device, base, 59.4, 59.4, 59.4)
+	ackToggle(t, panel, breaker, false)
+	waitForBreaker(t, s, breaker.ID, func(b Breaker) bool { return b.ShedAt != nil && !b.Status })
+}
+
+func TestLoadSheddingIsOffByDefault(t *testing.T) {
+	if got := DefaultConfig().LoadShedThresholds; len(got) != 0 {
+		t.Fatalf("default thresholds %v, want none", got)
+	}
+}
+
+func TestLoadSheddingShedsOnConsecutiveReadingsAndMarksOnAck(t *testing.T) {
+	s, _, device, breaker, panel := newShedServer(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Two low readings past the delay are not enough on their own
+	feedShed(s, device, base, 59.4)
+	feedShed(s, device, base.Add(20*time.Second), 59.4)
+	if n := toggleCommands(t, s, device); n != 0 {
+		t.Fatalf("shed after two readings: %d commands", n)
+	}
+
+	// Implausible readings neither shed nor break the run
+	feedShed(s, device, base.Add(30*time.Second), 0, 70)
+	if n := toggleCommands(t, s, device); n != 0 {
+		t.Fatalf("implausible readings sent %d commands", n)
+	}
+
+	feedShed(s, device, base.Add(50*time.Second), 59.4)
+	if n := toggleCommands(t, s, device); n != 1 {
+		t.Fatalf("got %d commands after the third reading, want 1", n)
+	}
+	// Not marked until the panel confirms, and not sent twice meanwhile
+	if b, _ := s.store.GetBreaker(breaker.ID); b.ShedAt != nil {
+		t.Fatalf("breaker marked shed before the ack: %+v", b)
+	}
+	feedShed(s, device, base.Add(60*time.Second), 59.4)
+	if n := toggleCommands(t, s, device); n != 1 {
+		t.Fatalf("got %d commands while the shed was unconfirmed, want 1", n)
+	}
+
+	ackToggle(t, panel, breaker, false)
+	waitForBreaker(t, s, breaker.ID, func(b Breaker) bool { return b.ShedAt != nil && !b.Status })
+}
+
+func TestLoadSheddingFailedShedIsNotMarked(t *testing.T) {
+	s, _, device, breaker, panel := newShedServer(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	feedShed(s, device, base, 59.4, 59.4, 59.4)
+	msg := panel.next()
+	panel.reply(DeviceResponse{Command: "toggleBreaker", RequestID: msg.RequestID, BreakerID: msg.BreakerID, BreakerState: msg.BreakerState, Status: "error", Error: "relay stuck"})
+	waitForCommand(t, s, toggleCommand(t, s, device).ID, CommandFailed)
+
+	if b, _ := s.store.GetBreaker(breaker.ID); b.ShedAt != nil {
+		t.Fatalf("failed shed was marked: %+v", b)
+	}
+	// The next reading may try again
+	feedShed(s, device, base.Add(30*time.Second), 59.4)
+	if n := toggleCommands(t, s, device); n != 2 {
+		t.Fatalf("got %d commands, want a retry", n)
+	}
+}
+
+func TestLoadSheddingRestoresAfterRecovery(t *testing.T) {
+	s, _, device, breaker, panel := newShedServer(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	shedTier(t, s, device, breaker, panel, base)
+
+	// Recovered, but not yet for the restore delay
+	feedShed(s, device, base.Add(time.Minute), 60, 60, 60)
+	if n := toggleCommands(t, s, device); n != 1 {
+		t.Fatalf("restored after 20s: %d commands", n)
+	}
+	feedShed(s, device, base.Add(2*time.Minute), 60)
+	ackToggle(t, panel, breaker, true)
+	waitForBreaker(t, s, breaker.ID, func(b Breaker) bool { return b.ShedAt == nil && b.Status })
+
+	events, err := s.store.ListLoadShedEvents(device.ID, FrequencyRange{})
+	if err != nil || len(events) != 2 || events[0].Action != ShedActionRestore || events[1].Action != ShedActionShed {
+		t.Fatalf("got events %+v, %v; want shed then restore", events, err)
+	}
+}
+
+// postShedding calls handler on device as user with body
+func postShedding(s *Server, handler gin.HandlerFunc, user User, device Device, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/loadShedding/"+strconv.Itoa(device.ID), strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Params = gin.Params{{Key: "id", Value: strconv.Itoa(device.ID)}}
+	c.Set("userID", user.ID)
+	handler(c)
+	return w
+}
+
+func TestLoadSheddingManualOverride(t *testing.T) {
+	s, user, device, breaker, panel := newShedServer(t)
+	base := time.Now()
+	shedTier(t, s, device, breaker, panel, base)
+
+	// Suspending with restore brings the shed breaker back at once
+	w := postShedding(s, s.suspendLoadShedding, user, device, `{"duration":"1h","restore":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("suspend: got %d: %s", w.Code, w.Body)
+	}
+	ackToggle(t, panel, breaker, true)
+	waitForBreaker(t, s, breaker.ID, func(b Breaker) bool { return b.ShedAt == nil && b.Status })
+
+	// While suspended nothing is shed
+	feedShed(s, device, base.Add(time.Minute), 59.4, 59.4, 59.4, 59.4)
+	if n := toggleCommands(t, s, device); n != 2 {
+		t.Fatalf("got %d commands while suspended, want 2", n)
+	}
+
+	if w := postShedding(s, s.resumeLoadShedding, user, device, ""); w.Code != http.StatusOK {
+		t.Fatalf("resume: got %d: %s", w.Code, w.Body)
+	}
+	if w := postShedding(s, s.resumeLoadShedding, user, device, ""); w.Code != http.StatusConflict {
+		t.Fatalf("second resume: got %d, want 409", w.Code)
+	}
+	shedTier(t, s, device, breaker, panel, base.Add(2*time.Minute))
+}
+
+func TestLoadSheddingFailedRestoreIsRetried(t *testing.T) {
+	s, _, device, breaker, panel := newShedServer(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	shedTier(t, s, device, breaker, panel, base)
+
+	feedShed(s, device, base.Add(time.Minute), 60, 60, 60)
+	feedShed(s, device, base.Add(2*time.Minute), 60)
+	msg := panel.next()
+	if msg.BreakerState == nil || !*msg.BreakerState {
+		t.Fatalf("panel got %+v, want a restore", msg)
+	}
+	// Not restored until the panel confirms, and not sent twice meanwhile
+	if b, _ := s.store.GetBreaker(breaker.ID); b.ShedAt == nil {
+		t.Fatalf("shed mark cleared before the ack: %+v", b)
+	}
+	feedShed(s, device, base.Add(2*time.Minute+10*time.Second), 60)
+	if n := toggleCommands(t, s, device); n != 2 {
+		t.Fatalf("got %d commands while the restore was unconfirmed, want 2", n)
+	}
+
+	panel.reply(DeviceResponse{Command: "toggleBreaker", RequestID: msg.RequestID, BreakerID: msg.BreakerID, BreakerState: msg.BreakerState, Status: "error", Error: "relay stuck"})
+	waitForCommand(t, s, toggleCommand(t, s, device).ID, CommandFailed)
+	if b, _ := s.store.GetBreaker(breaker.ID); b.ShedAt == nil {
+		t.Fatalf("failed restore cleared the shed mark: %+v", b)
+	}
+
+	feedShed(s, device, base.Add(3*time.Minute), 60)
+	ackToggle(t, panel, breaker, true)
+	waitForBreaker(t, s, breaker.ID, func(b Breaker) bool { return b.ShedAt == nil && b.Status })
+}
+
+func TestLoadSheddingLocksEachDeviceSeparately(t *testing.T) {
+	s, user, device, _, _ := newShedServer(t)
+	other := Device{Name: "other panel", UserID: user.ID}
+	if err := s.store.CreateDevice(&other); err != nil {
+		t.Fatal(err)
+	}
+	b := Breaker{DeviceID: other.ID, Name: "tier 1", Breaker_Number: "1", Priority: 1}
+	if err := s.store.CreateBreaker(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.SetBreakerStatus(b.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// A device stuck mid-evaluation does not hold up the others
+	stuck := s.shedding.state(device.ID)
+	stuck.mu.Lock()
+	defer stuck.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		feedShed(s, other, time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), 59.4, 59.4, 59.4)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("evaluation blocked on another device's lock")
+	}
+	if n := toggleCommands(t, s, other); n != 1 {
+		t.Fatalf("got %d commands, want the shed", n)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// invitationTTL is how long an invitation can be accepted
+const invitationTTL = 7 * 24 * time.Hour
+
+// accessibleDevices returns the devices userID owns followed by those shared with them
+func (s *Server) accessibleDevices(userID int) ([]Device, error) {
+	devices, err := s.store.ListDevicesByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := s.store.ListSharedDevices(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range shared {
+		devices = append(devices, d.Device)
+	}
+	return devices, nil
+}
+
+// bindMemberRole rejects any role but operator or viewer; only the device's
+// user_id administers it
+func bindMemberRole(c *gin.Context, role string) bool {
+	if role != RoleOperator && role != RoleViewer {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be operator or viewer"})
+		return false
+	}
+	return true
+}
+
+// fetchDeviceMembers lists who besides the owner can reach a device
+func (s *Server) fetchDeviceMembers(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	device, err := s.store.GetDevice(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device"})
+		return
+	}
+	owner, err := s.store.GetUser(device.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device owner"})
+		return
+	}
+	members, err := s.store.ListDeviceMembers(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+	if members == nil {
+		members = []DeviceMember{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"owner":   gin.H{"user_id": owner.ID, "name": owner.Name, "login": owner.Login},
+		"members": members,
+	})
+}
+
+// memberInput names a member of the device in the URL
+type memberInput struct {
+	UserID int    `json:"user_id" binding:"required"`
+	Role   string `json:"role"`
+}
+
+// updateDeviceMember changes a member's role
+func (s *Server) updateDeviceMember(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	var input memberInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if !bindMemberRole(c, input.Role) {
+		return
+	}
+
+	before, err := s.store.GetDeviceMember(deviceID, input.UserID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update member"})
+		return
+	}
+	if err := s.store.SetDeviceMemberRole(deviceID, input.UserID, input.Role); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update member"})
+		return
+	}
+	after := before
+	after.Role = input.Role
+	auditChange(c, before, after)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member updated successfully"})
+}
+
+// removeDeviceMember takes a member's access away
+func (s *Server) removeDeviceMember(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	var input memberInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	s.dropDeviceMember(c, deviceID, input.UserID, "Member removed successfully")
+}
+
+// leaveDevice gives up the caller's own membership
+func (s *Server) leaveDevice(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	device, err := s.store.GetDevice(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device"})
+		return
+	}
+	if device.UserID == currentUserID(c) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The owner cannot leave their own device"})
+		return
+	}
+	s.dropDeviceMember(c, deviceID, currentUserID(c), "Left device successfully")
+}
+
+func (s *Server) dropDeviceMember(c *gin.Context, deviceID, userID int, message string) {
+	before, err := s.store.GetDeviceMember(deviceID, userID)
+	if err == nil {
+		err = s.store.RemoveDeviceMember(deviceID, userID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not remove member"})
+		return
+	}
+	s.forgetDeviceAlertRules(deviceID)
+	auditChange(c, before, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// inviteDeviceMember offers a role on the device to an email address. The
+// response carries the invitation's token, which is shown only once; the
+// owner passes it on and the invitee presents it to answer.
+func (s *Server) inviteDeviceMember(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Email string `json:"email" binding:"required"`
+		Role  string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || !strings.Contains(input.Email, "@") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if !bindMemberRole(c, input.Role) {
+		return
+	}
+
+	token, hash, err := newDeviceSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create invitation"})
+		return
+	}
+	userID := currentUserID(c)
+	inv := DeviceInvitation{
+		DeviceID:  deviceID,
+		Email:     strings.TrimSpace(input.Email),
+		TokenHash: hash,
+		Role:      input.Role,
+		InvitedBy: &userID,
+		ExpiresAt: time.Now().Add(invitationTTL),
+	}
+	if err := s.store.CreateDeviceInvitation(&inv); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create invitation"})
+		return
+	}
+	auditTarget(c, "invitation", int64(inv.ID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation created successfully", "invitationID": inv.ID, "token": token, "expiresAt": inv.ExpiresAt})
+}
+
+// fetchDeviceInvitations lists every invitation sent for a device, newest first
+func (s *Server) fetchDeviceInvitations(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	invitations, err := s.store.ListDeviceInvitations(deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+	if invitations == nil {
+		invitations = []DeviceInvitation{}
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+// fetchInvitations lists the pending invitations sent to the caller's email;
+// answering one still takes its token
+func (s *Server) fetchInvitations(c *gin.Context) {
+	user, err := s.store.GetUser(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	invitations, err := s.store.ListPendingInvitations(user.Email, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+	if invitations == nil {
+		invitations = []DeviceInvitation{}
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+// loadInvitation resolves :id to a pending invitation. Invitees must present
+// its token, since account emails are neither verified nor unique; otherwise
+// the caller must own the device it is for.
+func (s *Server) loadInvitation(c *gin.Context, asInvitee bool) (DeviceInvitation, bool) {
+	id, ok := paramID(c, "id", "invitation")
+	if !ok {
+		return DeviceInvitation{}, false
+	}
+	auditTarget(c, "invitation", int64(id))
+
+	inv, err := s.store.GetDeviceInvitation(id)
+	if err != nil {
+		abortAuthz(c, err, "Invitation")
+		return DeviceInvitation{}, false
+	}
+	if asInvitee {
+		var input struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return DeviceInvitation{}, false
+		}
+		// Invitations from before tokens have no hash and match nothing
+		if inv.TokenHash == "" || subtle.ConstantTimeCompare([]byte(inv.TokenHash), []byte(hashDeviceSecret(input.Token))) != 1 {
+			abortAuthz(c, errForbidden, "Invitation")
+			return DeviceInvitation{}, false
+		}
+	} else if !s.authorizeDevice(c, inv.DeviceID, RoleOwner) {
+		return DeviceInvitation{}, false
+	}
+
+	if inv.Status != InvitationPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Invitation is already " + inv.Status})
+		return DeviceInvitation{}, false
+	}
+	return inv, true
+}
+
+// acceptInvitation makes the caller a member of the invitation's device
+func (s *Server) acceptInvitation(c *gin.Context) {
+	inv, ok := s.loadInvitation(c, true)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if !inv.ExpiresAt.After(now) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Invitation has expired"})
+		return
+	}
+	userID := currentUserID(c)
+	device, err := s.store.GetDevice(inv.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device"})
+		return
+	}
+	if device.UserID == userID {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already own this device"})
+		return
+	}
+
+	if err := s.store.AcceptDeviceInvitation(inv.ID, userID, now); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Invitation is no longer pending"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not accept invitation"})
+		return
+	}
+	s.forgetDeviceAlertRules(inv.DeviceID)
+	auditChange(c, nil, DeviceMember{DeviceID: inv.DeviceID, UserID: userID, Role: inv.Role, InvitedBy: inv.InvitedBy, CreatedAt: now})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted", "deviceID": inv.DeviceID, "role": inv.Role})
+}
+
+// declineInvitation turns an invitation down
+func (s *Server) declineInvitation(c *gin.Context) {
+	inv, ok := s.loadInvitation(c, true)
+	if !ok {
+		return
+	}
+	s.closeInvitation(c, inv, InvitationDeclined, "Invitation declined")
+}
+
+// revokeDeviceInvitation withdraws an invitation before it is answered
+func (s *Server) revokeDeviceInvitation(c *gin.Context) {
+	inv, ok := s.loadInvitation(c, false)
+	if !ok {
+		return
+	}
+	s.closeInvitation(c, inv, InvitationRevoked, "Invitation revoked")
+}
+
+func (s *Server) closeInvitation(c *gin.Context, inv DeviceInvitation, status, message string) {
+	if err := s.store.CloseDeviceInvitation(inv.ID, status, time.Now()); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Invitation is no longer pending"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update invitation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
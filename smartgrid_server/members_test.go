@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// memberFixture is bob's device plus carol, who has no device of her own
+type memberFixture struct {
+	router *gin.Engine
+	store  Store
+	owner  User
+	device Device
+	carol  User
+}
+
+func newMemberFixture(t *testing.T) *memberFixture {
+	t.Helper()
+	store := NewMemoryStore()
+	f := &memberFixture{store: store, router: NewServer(store, DefaultConfig()).Router()}
+	f.owner, f.device = seedDevice(t, store, "bob")
+	f.carol = User{Name: "carol", Login: "carol", Email: "carol@example.com", Pass: "hash"}
+	if err := store.CreateUser(&f.carol); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// invite has bob invite email to his device and returns the invitation's
+// accept and decline paths with the token to present
+func (f *memberFixture) invite(t *testing.T, email, role string) (accept, decline, token string) {
+	t.Helper()
+	w := serve(t, f.router, f.owner.ID, "POST", fmt.Sprintf("/inviteDeviceMember/%d", f.device.ID), fmt.Sprintf(`{"email":%q,"role":%q}`, email, role))
+	var created struct {
+		InvitationID int    `json:"invitationID"`
+		Token        string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusOK || created.Token == "" {
+		t.Fatalf("invite: got %d: %s", w.Code, w.Body)
+	}
+	return fmt.Sprintf("/acceptInvitation/%d", created.InvitationID), fmt.Sprintf("/declineInvitation/%d", created.InvitationID), created.Token
+}
+
+func tokenBody(token string) string {
+	return fmt.Sprintf(`{"token":%q}`, token)
+}
+
+func TestSharedDeviceRoles(t *testing.T) {
+	f := newMemberFixture(t)
+	accept, _, token := f.invite(t, f.carol.Email, RoleViewer)
+	if w := serve(t, f.router, f.carol.ID, "POST", accept, tokenBody(token)); w.Code != http.StatusOK {
+		t.Fatalf("accept: got %d: %s", w.Code, w.Body)
+	}
+
+	w := serve(t, f.router, f.carol.ID, "GET", "/fetchDevices", "")
+	var devices []DeviceStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &devices); err != nil || len(devices) != 1 ||
+		devices[0].ID != f.device.ID || devices[0].Role != RoleViewer {
+		t.Fatalf("viewer should see bob's device: %s", w.Body)
+	}
+
+	send := fmt.Sprintf("/sendPacket/%d", f.device.ID)
+	if w := serve(t, f.router, f.carol.ID, "POST", send, `{"command":"pingDevice"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("viewer sent a command: got %d: %s", w.Code, w.Body)
+	}
+	members := fmt.Sprintf("/updateDeviceMember/%d", f.device.ID)
+	promote := fmt.Sprintf(`{"user_id":%d,"role":"operator"}`, f.carol.ID)
+	if w := serve(t, f.router, f.carol.ID, "PUT", members, promote); w.Code != http.StatusForbidden {
+		t.Fatalf("viewer promoted themselves: got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.owner.ID, "PUT", members, promote); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.carol.ID, "POST", send, `{"command":"pingDevice"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("operator could not send a command: got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.carol.ID, "PUT", fmt.Sprintf("/updateDevice/%d", f.device.ID), `{"name":"mine"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("operator renamed the device: got %d: %s", w.Code, w.Body)
+	}
+
+	if w := serve(t, f.router, f.carol.ID, "POST", fmt.Sprintf("/leaveDevice/%d", f.device.ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.carol.ID, "GET", fmt.Sprintf("/readDevice/%d", f.device.ID), ""); w.Code != http.StatusForbidden {
+		t.Fatalf("former member can still read the device: got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestMemberRolesStopAtOperator(t *testing.T) {
+	f := newMemberFixture(t)
+	invite := fmt.Sprintf("/inviteDeviceMember/%d", f.device.ID)
+	if w := serve(t, f.router, f.owner.ID, "POST", invite, `{"email":"carol@example.com","role":"owner"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invited an owner: got %d: %s", w.Code, w.Body)
+	}
+
+	accept, _, token := f.invite(t, f.carol.Email, RoleOperator)
+	if w := serve(t, f.router, f.carol.ID, "POST", accept, tokenBody(token)); w.Code != http.StatusOK {
+		t.Fatalf("accept: got %d: %s", w.Code, w.Body)
+	}
+	promote := fmt.Sprintf(`{"user_id":%d,"role":"owner"}`, f.carol.ID)
+	if w := serve(t, f.router, f.owner.ID, "PUT", fmt.Sprintf("/updateDeviceMember/%d", f.device.ID), promote); w.Code != http.StatusBadRequest {
+		t.Fatalf("promoted a member to owner: got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestInvitationsNeedTheirToken(t *testing.T) {
+	f := newMemberFixture(t)
+	accept, decline, token := f.invite(t, "ALICE@example.com", RoleViewer)
+
+	// Anyone can sign up with alice's address; that alone proves nothing
+	squatter := User{Name: "mallory", Login: "mallory", Email: "alice@example.com", Pass: "hash"}
+	if err := f.store.CreateUser(&squatter); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(t, f.router, squatter.ID, "GET", "/fetchInvitations", ""); !bytes.Contains(w.Body.Bytes(), []byte("bob panel")) {
+		t.Fatalf("invitation not listed for its email: %s", w.Body)
+	}
+	if w := serve(t, f.router, squatter.ID, "POST", accept, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("accepted without a token: got %d: %s", w.Code, w.Body)
+	}
+	for _, path := range []string{accept, decline} {
+		if w := serve(t, f.router, squatter.ID, "POST", path, tokenBody("guess")); w.Code != http.StatusForbidden {
+			t.Fatalf("%s with a wrong token: got %d: %s", path, w.Code, w.Body)
+		}
+	}
+
+	if w := serve(t, f.router, f.owner.ID, "POST", accept, tokenBody(token)); w.Code != http.StatusConflict {
+		t.Fatalf("owner joined their own device: got %d: %s", w.Code, w.Body)
+	}
+
+	// Whoever holds the token may accept, exactly once
+	if w := serve(t, f.router, f.carol.ID, "POST", accept, tokenBody(token)); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.carol.ID, "POST", accept, tokenBody(token)); w.Code != http.StatusConflict {
+		t.Fatalf("accepted twice: got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, squatter.ID, "POST", accept, tokenBody(token)); w.Code != http.StatusConflict {
+		t.Fatalf("token reused: got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.carol.ID, "GET", fmt.Sprintf("/readDevice/%d", f.device.ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("new member cannot read the device: got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, squatter.ID, "GET", fmt.Sprintf("/readDevice/%d", f.device.ID), ""); w.Code != http.StatusForbidden {
+		t.Fatalf("squatter can read the device: got %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS frequency_logs;
+DROP TABLE IF EXISTS breakers;
+DROP TABLE IF EXISTS devices;
+DROP TABLE IF EXISTS users;
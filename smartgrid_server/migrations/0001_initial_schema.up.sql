@@ -0,0 +1,38 @@
+-- Baseline schema. IF NOT EXISTS lets databases created from the old
+-- psqldump.txt adopt the migration history without losing data.
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL,
+    email VARCHAR(50) NOT NULL,
+    login VARCHAR(50) NOT NULL,
+    pass VARCHAR(255) NOT NULL,
+    isverified BOOLEAN NOT NULL
+);
+
+-- login() stores the issued token in users.jwt; the old dump named it jwt_token
+ALTER TABLE users ADD COLUMN IF NOT EXISTS jwt TEXT;
+ALTER TABLE users DROP COLUMN IF EXISTS jwt_token;
+
+CREATE TABLE IF NOT EXISTS devices (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(50) NOT NULL,
+    mac_addr VARCHAR(17)
+);
+
+CREATE TABLE IF NOT EXISTS breakers (
+    id SERIAL PRIMARY KEY,
+    device_id INTEGER REFERENCES devices(id) ON DELETE CASCADE,
+    name VARCHAR(50) NOT NULL,
+    breaker_number VARCHAR(50) NOT NULL,
+    status BOOLEAN DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS frequency_logs (
+    id BIGSERIAL PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    frequency DOUBLE PRECISION NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS frequency_logs_device_time_idx ON frequency_logs (device_id, timestamp);
@@ -0,0 +1,12 @@
+-- Per-device secrets checked on the /ws handshake. Only the SHA-256 of the
+-- secret is stored; the plaintext is shown once when it is issued.
+CREATE TABLE device_credentials (
+    id SERIAL PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    secret_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ
+);
+
+-- At most one live credential per device
+CREATE UNIQUE INDEX device_credentials_active_idx ON device_credentials (device_id) WHERE revoked_at IS NULL;
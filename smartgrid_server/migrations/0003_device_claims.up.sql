@@ -0,0 +1,12 @@
+-- Short-lived codes a device presents on its first /ws connection to bind
+-- its MAC to the device row the owner created
+CREATE TABLE device_claims (
+    id SERIAL PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX device_claims_device_idx ON device_claims (device_id);
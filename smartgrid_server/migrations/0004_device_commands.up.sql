@@ -0,0 +1,18 @@
+-- Every command sent to a device. Offline devices get theirs delivered in
+-- id order when they reconnect; anything past expires_at is never sent.
+CREATE TABLE device_commands (
+    id BIGSERIAL PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    request_id VARCHAR(32) NOT NULL UNIQUE,
+    command VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'sent', 'acked', 'failed', 'expired', 'cancelled')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    sent_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    result JSONB
+);
+
+CREATE INDEX device_commands_device_status_idx ON device_commands (device_id, status, id);
@@ -0,0 +1,11 @@
+-- One row per device WebSocket connection. disconnected_at stays NULL while
+-- the connection is live.
+CREATE TABLE device_sessions (
+    id BIGSERIAL PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    remote_addr VARCHAR(64) NOT NULL,
+    connected_at TIMESTAMPTZ NOT NULL,
+    disconnected_at TIMESTAMPTZ
+);
+
+CREATE INDEX device_sessions_device_idx ON device_sessions (device_id, connected_at DESC);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS frequency_logs_time_idx;
+DROP TABLE IF EXISTS frequency_rollup_state;
+DROP TABLE IF EXISTS frequency_rollups_1h;
+DROP TABLE IF EXISTS frequency_rollups_1m;
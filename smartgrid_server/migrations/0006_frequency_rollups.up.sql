@@ -0,0 +1,25 @@
+-- Pre-aggregated frequency readings. Sums are stored instead of averages so
+-- rows can be merged into coarser buckets. Buckets are aligned to UTC.
+CREATE TABLE frequency_rollups_1m (
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    bucket TIMESTAMPTZ NOT NULL,
+    reading_count BIGINT NOT NULL,
+    min_frequency DOUBLE PRECISION NOT NULL,
+    max_frequency DOUBLE PRECISION NOT NULL,
+    sum_frequency DOUBLE PRECISION NOT NULL,
+    sum_sq_frequency DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (device_id, bucket)
+);
+
+CREATE TABLE frequency_rollups_1h (LIKE frequency_rollups_1m INCLUDING ALL);
+ALTER TABLE frequency_rollups_1h
+    ADD FOREIGN KEY (device_id) REFERENCES devices(id) ON DELETE CASCADE;
+
+-- How far each rollup table has been built; everything before rolled_up_to
+-- is final
+CREATE TABLE frequency_rollup_state (
+    resolution VARCHAR(8) PRIMARY KEY,
+    rolled_up_to TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX frequency_logs_time_idx ON frequency_logs (timestamp);
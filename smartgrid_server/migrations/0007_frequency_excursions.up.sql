@@ -0,0 +1,14 @@
+-- A stretch of time a device's frequency spent outside the configured band.
+-- ended_at stays NULL while the excursion is ongoing.
+CREATE TABLE frequency_excursions (
+    id BIGSERIAL PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    direction VARCHAR(8) NOT NULL CHECK (direction IN ('over', 'under')),
+    started_at TIMESTAMPTZ NOT NULL,
+    ended_at TIMESTAMPTZ,
+    peak_frequency DOUBLE PRECISION NOT NULL,
+    peak_deviation DOUBLE PRECISION NOT NULL,
+    max_rate DOUBLE PRECISION NOT NULL DEFAULT 0
+);
+
+CREATE INDEX frequency_excursions_device_time_idx ON frequency_excursions (device_id, started_at);
@@ -0,0 +1,8 @@
+ALTER TABLE frequency_excursions DROP COLUMN IF EXISTS peak_rocof, DROP COLUMN IF EXISTS trigger;
+ALTER TABLE frequency_rollups_1h
+    DROP COLUMN IF EXISTS sum_rocof, DROP COLUMN IF EXISTS max_rocof,
+    DROP COLUMN IF EXISTS min_rocof, DROP COLUMN IF EXISTS rocof_count;
+ALTER TABLE frequency_rollups_1m
+    DROP COLUMN IF EXISTS sum_rocof, DROP COLUMN IF EXISTS max_rocof,
+    DROP COLUMN IF EXISTS min_rocof, DROP COLUMN IF EXISTS rocof_count;
+ALTER TABLE frequency_logs DROP COLUMN IF EXISTS rocof;
@@ -0,0 +1,21 @@
+-- Rate of change of frequency in Hz/s, computed at ingest over a sliding
+-- window. NULL until a device has enough readings in the window.
+ALTER TABLE frequency_logs ADD COLUMN rocof DOUBLE PRECISION;
+
+ALTER TABLE frequency_rollups_1m
+    ADD COLUMN rocof_count BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN min_rocof DOUBLE PRECISION,
+    ADD COLUMN max_rocof DOUBLE PRECISION,
+    ADD COLUMN sum_rocof DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+ALTER TABLE frequency_rollups_1h
+    ADD COLUMN rocof_count BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN min_rocof DOUBLE PRECISION,
+    ADD COLUMN max_rocof DOUBLE PRECISION,
+    ADD COLUMN sum_rocof DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+-- Excursions can now be opened by a ROCOF threshold as well as the band
+ALTER TABLE frequency_excursions
+    ADD COLUMN trigger VARCHAR(16) NOT NULL DEFAULT 'frequency'
+        CHECK (trigger IN ('frequency', 'rocof')),
+    ADD COLUMN peak_rocof DOUBLE PRECISION;
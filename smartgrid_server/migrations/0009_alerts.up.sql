@@ -0,0 +1,37 @@
+-- User-defined alert rules. device_id NULL applies the rule to every device
+-- the user owns; breaker_id narrows breaker_changed rules to one breaker.
+CREATE TABLE alert_rules (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id INTEGER REFERENCES devices(id) ON DELETE CASCADE,
+    breaker_id INTEGER REFERENCES breakers(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    kind VARCHAR(32) NOT NULL
+        CHECK (kind IN ('frequency_below', 'frequency_above', 'device_offline', 'breaker_changed')),
+    threshold DOUBLE PRECISION,
+    duration_seconds INTEGER NOT NULL DEFAULT 0 CHECK (duration_seconds >= 0),
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX alert_rules_user_idx ON alert_rules (user_id);
+CREATE INDEX alert_rules_device_idx ON alert_rules (device_id);
+
+-- Alerts raised by rules. At most one open or acknowledged alert exists per
+-- rule and device; resolved alerts are kept as history.
+CREATE TABLE alerts (
+    id BIGSERIAL PRIMARY KEY,
+    rule_id INTEGER NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'open'
+        CHECK (status IN ('open', 'acknowledged', 'resolved')),
+    message TEXT NOT NULL,
+    value DOUBLE PRECISION,
+    opened_at TIMESTAMPTZ NOT NULL,
+    acknowledged_at TIMESTAMPTZ,
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX alerts_active_idx ON alerts (rule_id, device_id) WHERE status <> 'resolved';
+CREATE INDEX alerts_user_idx ON alerts (user_id, opened_at DESC);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS breaker_schedule_runs;
+DROP TABLE IF EXISTS breaker_schedules;
@@ -0,0 +1,32 @@
+-- Automatic breaker actions. A schedule either repeats on a cron expression or
+-- runs once at run_at; cron expressions are read in the schedule's timezone.
+-- next_run_at is NULL once a one-shot schedule has run or a schedule is disabled.
+CREATE TABLE breaker_schedules (
+    id SERIAL PRIMARY KEY,
+    breaker_id INTEGER NOT NULL REFERENCES breakers(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    state BOOLEAN NOT NULL,
+    cron_expr VARCHAR(100),
+    run_at TIMESTAMPTZ,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    next_run_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK ((cron_expr IS NULL) <> (run_at IS NULL))
+);
+
+CREATE INDEX breaker_schedules_breaker_idx ON breaker_schedules (breaker_id);
+CREATE INDEX breaker_schedules_due_idx ON breaker_schedules (next_run_at) WHERE enabled;
+
+-- One row per scheduled run, including runs that were skipped or missed
+CREATE TABLE breaker_schedule_runs (
+    id BIGSERIAL PRIMARY KEY,
+    schedule_id INTEGER NOT NULL REFERENCES breaker_schedules(id) ON DELETE CASCADE,
+    scheduled_for TIMESTAMPTZ NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    command_id BIGINT REFERENCES device_commands(id) ON DELETE SET NULL,
+    error TEXT NOT NULL DEFAULT '',
+    ran_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX breaker_schedule_runs_schedule_idx ON breaker_schedule_runs (schedule_id, scheduled_for DESC);
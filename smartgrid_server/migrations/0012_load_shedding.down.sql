@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS load_shed_events;
+DROP TABLE IF EXISTS load_shed_overrides;
+ALTER TABLE breakers DROP COLUMN IF EXISTS shed_at, DROP COLUMN IF EXISTS priority;
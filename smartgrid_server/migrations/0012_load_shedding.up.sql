@@ -0,0 +1,31 @@
+-- Under-frequency load shedding. priority 0 is critical and never shed; tier
+-- n is opened when frequency stays below the n-th configured threshold.
+-- shed_at is set while the breaker is held open by the shedding automation.
+ALTER TABLE breakers
+    ADD COLUMN priority SMALLINT NOT NULL DEFAULT 0 CHECK (priority >= 0),
+    ADD COLUMN shed_at TIMESTAMPTZ;
+
+-- A manual override suspends shedding on a device until the given time
+CREATE TABLE load_shed_overrides (
+    device_id INTEGER PRIMARY KEY REFERENCES devices(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    until TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Every shed, restore and override, automated or manual
+CREATE TABLE load_shed_events (
+    id BIGSERIAL PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    breaker_id INTEGER REFERENCES breakers(id) ON DELETE SET NULL,
+    action VARCHAR(16) NOT NULL
+        CHECK (action IN ('shed', 'restore', 'release', 'suspend', 'resume')),
+    tier SMALLINT,
+    frequency DOUBLE PRECISION,
+    command_id BIGINT REFERENCES device_commands(id) ON DELETE SET NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX load_shed_events_device_idx ON load_shed_events (device_id, created_at DESC);
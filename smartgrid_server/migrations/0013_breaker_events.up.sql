@@ -0,0 +1,22 @@
+-- Append-only history of breaker state changes. A "requested" row is written
+-- when a toggle is dispatched and a "confirmed" or "failed" row when the device
+-- answers it; confirmations the device sends unprompted have source 'device'.
+-- Rows are never updated.
+CREATE TABLE breaker_events (
+    id BIGSERIAL PRIMARY KEY,
+    breaker_id INTEGER NOT NULL REFERENCES breakers(id) ON DELETE CASCADE,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('requested', 'confirmed', 'failed')),
+    state BOOLEAN NOT NULL,
+    source VARCHAR(16) NOT NULL CHECK (source IN ('user', 'schedule', 'automation', 'device')),
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    schedule_id INTEGER REFERENCES breaker_schedules(id) ON DELETE SET NULL,
+    command_id BIGINT REFERENCES device_commands(id) ON DELETE SET NULL,
+    requested_at TIMESTAMPTZ,
+    acknowledged_at TIMESTAMPTZ,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX breaker_events_breaker_idx ON breaker_events (breaker_id, created_at DESC);
+CREATE INDEX breaker_events_command_idx ON breaker_events (command_id) WHERE kind = 'requested';
@@ -0,0 +1,25 @@
+-- Admins may read the audit log. The flag is only ever set by an operator
+-- with "server admin grant <login>", never through the API.
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- One row per mutating API call. actor_id and target_id deliberately carry no
+-- foreign keys so entries outlive the users and resources they describe.
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id INTEGER,
+    method VARCHAR(10) NOT NULL,
+    route VARCHAR(200) NOT NULL,
+    path TEXT NOT NULL,
+    target_type VARCHAR(32) NOT NULL DEFAULT '',
+    target_id BIGINT,
+    before JSONB,
+    after JSONB,
+    client_ip VARCHAR(64) NOT NULL DEFAULT '',
+    status SMALLINT NOT NULL,
+    outcome VARCHAR(16) NOT NULL CHECK (outcome IN ('success', 'denied', 'rejected', 'error')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_log_created_idx ON audit_log (created_at DESC);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor_id, id DESC);
+CREATE INDEX audit_log_target_idx ON audit_log (target_type, target_id, id DESC);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS device_invitations;
+DROP TABLE IF EXISTS device_members;
@@ -0,0 +1,31 @@
+-- Shared device access. devices.user_id stays the primary owner and has no
+-- row here; members are granted owner, operator or viewer through invitations.
+CREATE TABLE device_members (
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL CHECK (role IN ('owner', 'operator', 'viewer')),
+    invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (device_id, user_id)
+);
+
+CREATE INDEX device_members_user_idx ON device_members (user_id);
+
+-- Invitations are addressed to an email so people can be invited before they
+-- sign up; whoever holds an account with that email may accept.
+CREATE TABLE device_invitations (
+    id SERIAL PRIMARY KEY,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(16) NOT NULL CHECK (role IN ('owner', 'operator', 'viewer')),
+    invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'accepted', 'declined', 'revoked')),
+    accepted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    responded_at TIMESTAMPTZ
+);
+
+CREATE INDEX device_invitations_device_idx ON device_invitations (device_id, created_at DESC);
+CREATE INDEX device_invitations_email_idx ON device_invitations (LOWER(email)) WHERE status = 'pending';
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS device_group_members;
+DROP TABLE IF EXISTS device_groups;
+ALTER TABLE devices DROP COLUMN IF EXISTS site_id;
+DROP TABLE IF EXISTS sites;
@@ -0,0 +1,34 @@
+-- Sites are physical places a user's devices live at; a device is at one
+-- site at most. The timezone sets day boundaries for site-wide telemetry.
+CREATE TABLE sites (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX sites_user_idx ON sites (user_id);
+
+ALTER TABLE devices ADD COLUMN site_id INTEGER REFERENCES sites(id) ON DELETE SET NULL;
+
+CREATE INDEX devices_site_idx ON devices (site_id) WHERE site_id IS NOT NULL;
+
+-- Groups are arbitrary named sets; a device can be in any number of them
+CREATE TABLE device_groups (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX device_groups_user_idx ON device_groups (user_id);
+
+CREATE TABLE device_group_members (
+    group_id INTEGER NOT NULL REFERENCES device_groups(id) ON DELETE CASCADE,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, device_id)
+);
+
+CREATE INDEX device_group_members_device_idx ON device_group_members (device_id);
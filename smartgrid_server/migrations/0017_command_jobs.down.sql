@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS command_job_targets;
+DROP TABLE IF EXISTS command_jobs;
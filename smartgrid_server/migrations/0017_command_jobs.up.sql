@@ -0,0 +1,31 @@
+-- A command job sends one command to many devices. Each target row is one
+-- device command, or one per breaker for breaker jobs, and its outcome.
+CREATE TABLE command_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    command VARCHAR(32) NOT NULL,
+    breaker_state BOOLEAN,
+    site_id INTEGER REFERENCES sites(id) ON DELETE SET NULL,
+    group_id INTEGER REFERENCES device_groups(id) ON DELETE SET NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'running'
+        CHECK (status IN ('running', 'completed', 'aborted')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX command_jobs_user_idx ON command_jobs (user_id, id DESC);
+CREATE INDEX command_jobs_running_idx ON command_jobs (id) WHERE status = 'running';
+
+CREATE TABLE command_job_targets (
+    id BIGSERIAL PRIMARY KEY,
+    job_id BIGINT NOT NULL REFERENCES command_jobs(id) ON DELETE CASCADE,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    breaker_id INTEGER REFERENCES breakers(id) ON DELETE SET NULL,
+    command_id BIGINT REFERENCES device_commands(id) ON DELETE SET NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'delivered', 'acked', 'offline', 'failed')),
+    error TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX command_job_targets_job_idx ON command_job_targets (job_id, id);
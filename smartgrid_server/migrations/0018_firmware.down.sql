@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS firmware_rollout_targets;
+DROP TABLE IF EXISTS firmware_rollouts;
+ALTER TABLE devices DROP COLUMN IF EXISTS firmware_version, DROP COLUMN IF EXISTS hardware_model;
+DROP TABLE IF EXISTS firmware;
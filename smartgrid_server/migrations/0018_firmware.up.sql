@@ -0,0 +1,49 @@
+-- Firmware images for over-the-air updates, one per hardware model and version
+CREATE TABLE firmware (
+    id SERIAL PRIMARY KEY,
+    hardware_model VARCHAR(64) NOT NULL,
+    version VARCHAR(64) NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    size INTEGER NOT NULL,
+    data BYTEA NOT NULL,
+    notes TEXT NOT NULL DEFAULT '',
+    uploaded_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (hardware_model, version)
+);
+
+-- What each device said it runs in its last hello; NULL until it reports
+ALTER TABLE devices
+    ADD COLUMN hardware_model VARCHAR(64),
+    ADD COLUMN firmware_version VARCHAR(64);
+
+-- A rollout updates a fixed set of devices in stages. percent is how much of
+-- the set has been released so far; devices outside it wait.
+CREATE TABLE firmware_rollouts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    firmware_id INTEGER NOT NULL REFERENCES firmware(id),
+    percent SMALLINT NOT NULL DEFAULT 100 CHECK (percent BETWEEN 0 AND 100),
+    status VARCHAR(16) NOT NULL DEFAULT 'running'
+        CHECK (status IN ('running', 'halted', 'completed')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX firmware_rollouts_user_idx ON firmware_rollouts (user_id, id DESC);
+
+CREATE TABLE firmware_rollout_targets (
+    id BIGSERIAL PRIMARY KEY,
+    rollout_id INTEGER NOT NULL REFERENCES firmware_rollouts(id) ON DELETE CASCADE,
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'waiting'
+        CHECK (status IN ('waiting', 'queued', 'downloading', 'rebooting', 'installed', 'failed', 'skipped', 'cancelled')),
+    progress SMALLINT NOT NULL DEFAULT 0,
+    command_id BIGINT REFERENCES device_commands(id) ON DELETE SET NULL,
+    error TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (rollout_id, device_id)
+);
+
+CREATE INDEX firmware_rollout_targets_device_idx ON firmware_rollout_targets (device_id)
+    WHERE status IN ('queued', 'downloading', 'rebooting');
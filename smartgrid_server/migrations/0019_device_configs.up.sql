@@ -0,0 +1,12 @@
+-- Every version of a device's configuration document. The newest is what the
+-- device should run; the most recently applied is what it reported running.
+CREATE TABLE device_configs (
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    config JSONB NOT NULL,
+    updated_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    applied_at TIMESTAMPTZ,
+    apply_error TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (device_id, version)
+);
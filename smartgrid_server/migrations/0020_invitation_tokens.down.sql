@@ -0,0 +1,5 @@
+ALTER TABLE device_invitations DROP CONSTRAINT device_invitations_role_check,
+    ADD CONSTRAINT device_invitations_role_check CHECK (role IN ('owner', 'operator', 'viewer'));
+ALTER TABLE device_members DROP CONSTRAINT device_members_role_check,
+    ADD CONSTRAINT device_members_role_check CHECK (role IN ('owner', 'operator', 'viewer'));
+ALTER TABLE device_invitations DROP COLUMN IF EXISTS token_hash;
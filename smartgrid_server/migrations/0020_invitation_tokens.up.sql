@@ -0,0 +1,11 @@
+-- Emails are neither verified nor unique, so invitations are now accepted by
+-- presenting a single-use token. Invitations sent before then cannot be.
+ALTER TABLE device_invitations ADD COLUMN token_hash CHAR(64) UNIQUE;
+UPDATE device_invitations SET status = 'revoked', responded_at = NOW() WHERE status = 'pending';
+
+-- Only the primary owner administers a device; members operate or view it.
+UPDATE device_members SET role = 'operator' WHERE role = 'owner';
+ALTER TABLE device_members DROP CONSTRAINT device_members_role_check,
+    ADD CONSTRAINT device_members_role_check CHECK (role IN ('operator', 'viewer'));
+ALTER TABLE device_invitations DROP CONSTRAINT device_invitations_role_check,
+    ADD CONSTRAINT device_invitations_role_check CHECK (role IN ('operator', 'viewer')) NOT VALID;
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSessionList caps fetchDeviceSessions
+const maxSessionList = 200
+
+// DeviceStatus is a device as returned to clients, with its presence. Online
+// comes from the hub; the session log fills in devices that are offline.
+type DeviceStatus struct {
+	Device
+	Online         bool       `json:"online"`
+	LastSeen       *time.Time `json:"last_seen"`
+	ConnectedSince *time.Time `json:"connected_since"`
+	Role           string     `json:"role,omitempty"`
+}
+
+// openSession records that dc has connected
+func (s *Server) openSession(dc *DeviceConn) {
+	s.publish(EventPresence, dc.Device, gin.H{"online": true, "connected_since": dc.ConnectedAt})
+	s.deviceOnline(dc.Device)
+
+	session := DeviceSession{DeviceID: dc.Device.ID, RemoteAddr: dc.RemoteAddr, ConnectedAt: dc.ConnectedAt}
+	if err := s.store.OpenDeviceSession(&session); err != nil {
+		log.Println("Failed to record device session:", err)
+		return
+	}
+	dc.sessionID = session.ID
+}
+
+// closeSession records that dc has gone away
+func (s *Server) closeSession(dc *DeviceConn) {
+	// A replaced connection is not the device going offline
+	if _, online := s.hub.Get(dc.Device.ID); !online {
+		s.endExcursion(dc.Device)
+		s.rocof.forget(dc.Device.ID)
+		s.shedding.forget(dc.Device.ID)
+		s.publish(EventPresence, dc.Device, gin.H{"online": false, "last_seen": dc.LastSeen()})
+		s.deviceOffline(dc.Device, dc.LastSeen())
+	}
+
+	if dc.sessionID == 0 {
+		return
+	}
+	if err := s.store.CloseDeviceSession(dc.sessionID, time.Now()); err != nil {
+		log.Println("Failed to close device session:", err)
+	}
+}
+
+// devicePresence decorates devices with whether they are connected and when
+// they were last heard from
+func (s *Server) devicePresence(devices []Device) ([]DeviceStatus, error) {
+	ids := make([]int, len(devices))
+	for i, device := range devices {
+		ids[i] = device.ID
+	}
+	latest, err := s.store.LatestDeviceSessions(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]DeviceStatus, len(devices))
+	for i, device := range devices {
+		status := DeviceStatus{Device: device}
+		if dc, ok := s.hub.Get(device.ID); ok {
+			connectedAt, lastSeen := dc.ConnectedAt, dc.LastSeen()
+			status.Online = true
+			status.ConnectedSince = &connectedAt
+			status.LastSeen = &lastSeen
+		} else if session, ok := latest[device.ID]; ok {
+			status.LastSeen = session.DisconnectedAt
+		}
+		statuses[i] = status
+	}
+	return statuses, nil
+}
+
+// fetchDeviceSessions returns a device's connection history, newest first
+func (s *Server) fetchDeviceSessions(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	limit := maxSessionList
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxSessionList)
+	}
+
+	sessions, err := s.store.ListDeviceSessions(deviceID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	if sessions == nil {
+		sessions = []DeviceSession{}
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
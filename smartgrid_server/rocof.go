@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rocofTracker keeps each device's recent readings and estimates df/dt as
+// the least-squares slope across the window, which damps single-sample noise
+type rocofTracker struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	recent map[int][]FrequencyLog
+}
+
+func newRocofTracker(window time.Duration) *rocofTracker {
+	return &rocofTracker{window: window, recent: make(map[int][]FrequencyLog)}
+}
+
+// observe adds entry to its device's window and returns the ROCOF in Hz/s,
+// or nil while the window holds fewer than two readings
+func (t *rocofTracker) observe(entry FrequencyLog) *float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := entry.Timestamp.Add(-t.window)
+	readings := filterRows(append(t.recent[entry.DeviceID], entry), func(r FrequencyLog) bool {
+		return !r.Timestamp.Before(cutoff) && !r.Timestamp.After(entry.Timestamp)
+	})
+	t.recent[entry.DeviceID] = readings
+	if len(readings) < 2 {
+		return nil
+	}
+
+	// Times are taken relative to the newest reading to keep them small
+	var sumT, sumF float64
+	for _, r := range readings {
+		sumT += r.Timestamp.Sub(entry.Timestamp).Seconds()
+		sumF += r.Frequency
+	}
+	n := float64(len(readings))
+	meanT, meanF := sumT/n, sumF/n
+
+	var cov, varT float64
+	for _, r := range readings {
+		dt := r.Timestamp.Sub(entry.Timestamp).Seconds() - meanT
+		cov += dt * (r.Frequency - meanF)
+		varT += dt * dt
+	}
+	if varT == 0 {
+		return nil
+	}
+	rocof := cov / varT
+	return &rocof
+}
+
+// forget drops a device's window, e.g. when it disconnects
+func (t *rocofTracker) forget(deviceID int) {
+	t.mu.Lock()
+	delete(t.recent, deviceID)
+	t.mu.Unlock()
+}
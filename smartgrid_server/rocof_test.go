@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func reading(deviceID int, at time.Time, hz float64) FrequencyLog {
+	return FrequencyLog{DeviceID: deviceID, Frequency: hz, Timestamp: at}
+}
+
+// fmtRocof prints an observed ROCOF, which is nil while unknown
+func fmtRocof(rocof *float64) any {
+	if rocof == nil {
+		return nil
+	}
+	return *rocof
+}
+
+func TestRocofNeedsTwoReadings(t *testing.T) {
+	tracker := newRocofTracker(2 * time.Minute)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if got := tracker.observe(reading(1, base, 60)); got != nil {
+		t.Fatalf("first reading gave ROCOF %v, want nil", *got)
+	}
+	// A second reading with the same timestamp still has no slope
+	if got := tracker.observe(reading(1, base, 60.1)); got != nil {
+		t.Fatalf("same-instant readings gave ROCOF %v, want nil", *got)
+	}
+	got := tracker.observe(reading(1, base.Add(10*time.Second), 60.2))
+	if got == nil {
+		t.Fatal("no ROCOF after readings 10s apart")
+	}
+}
+
+func TestRocofIsLeastSquaresSlope(t *testing.T) {
+	tracker := newRocofTracker(2 * time.Minute)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// A steady 0.01 Hz/s ramp
+	var got *float64
+	for i := 0; i < 5; i++ {
+		got = tracker.observe(reading(1, base.Add(time.Duration(i)*10*time.Second), 60+0.1*float64(i)))
+	}
+	if got == nil || math.Abs(*got-0.01) > 1e-9 {
+		t.Fatalf("ramp: got %v, want 0.01 Hz/s", fmtRocof(got))
+	}
+
+	// One noisy sample moves the fit far less than a two-point difference would
+	tracker = newRocofTracker(2 * time.Minute)
+	for i, hz := range []float64{60, 60, 60, 60, 60.5} {
+		got = tracker.observe(reading(1, base.Add(time.Duration(i)*10*time.Second), hz))
+	}
+	// Centred on t = -20s and 60.1 Hz: (2 + 1 + 0 - 1 + 8) / 1000, where the
+	// last two readings alone would give 0.05 Hz/s
+	if got == nil || math.Abs(*got-0.01) > 1e-9 {
+		t.Fatalf("spike: got %v, want 0.01 Hz/s", fmtRocof(got))
+	}
+}
+
+func TestRocofWindowDropsOldReadings(t *testing.T) {
+	tracker := newRocofTracker(time.Minute)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tracker.observe(reading(1, base, 55))
+	tracker.observe(reading(1, base.Add(90*time.Second), 60))
+	// The 55 Hz reading is outside the window, so this is a fresh start
+	if got := tracker.observe(reading(1, base.Add(90*time.Second), 60)); got != nil {
+		t.Fatalf("got ROCOF %v from a reading outside the window", *got)
+	}
+	got := tracker.observe(reading(1, base.Add(120*time.Second), 60.3))
+	if got == nil || math.Abs(*got-0.01) > 1e-9 {
+		t.Fatalf("got %v, want 0.01 Hz/s from the readings inside the window", fmtRocof(got))
+	}
+
+	// A late reading only sees readings up to its own time
+	got = tracker.observe(reading(1, base.Add(100*time.Second), 60.1))
+	if got == nil || math.Abs(*got-0.01) > 1e-9 {
+		t.Fatalf("out-of-order reading: got %v, want 0.01 Hz/s", fmtRocof(got))
+	}
+}
+
+func TestRocofTracksDevicesSeparately(t *testing.T) {
+	tracker := newRocofTracker(time.Minute)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tracker.observe(reading(1, base, 60))
+	if got := tracker.observe(reading(2, base.Add(10*time.Second), 61)); got != nil {
+		t.Fatalf("device 2 got ROCOF %v from device 1's reading", *got)
+	}
+	tracker.forget(1)
+	if got := tracker.observe(reading(1, base.Add(10*time.Second), 60.1)); got != nil {
+		t.Fatalf("got ROCOF %v after forget", *got)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// rollupLag leaves room for readings still being written when a minute closes
+const rollupLag = 30 * time.Second
+
+// maintainFrequency builds rollups and applies retention every RollupInterval
+func (s *Server) maintainFrequency(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.RollupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.rollupAndPrune(now); err != nil {
+				log.Println("Frequency rollup failed:", err)
+			}
+		}
+	}
+}
+
+// rollupAndPrune advances every rollup resolution to now and deletes data past
+// its retention. Nothing is deleted before the next resolution has absorbed it.
+func (s *Server) rollupAndPrune(now time.Time) error {
+	for _, res := range rollupResolutions {
+		if err := s.store.RollupFrequency(res, now.Add(-rollupLag)); err != nil {
+			return err
+		}
+	}
+
+	watermarks, err := s.store.FrequencyWatermarks()
+	if err != nil {
+		return err
+	}
+	for _, tier := range []struct {
+		resolution time.Duration
+		retention  time.Duration
+		absorbed   time.Time
+	}{
+		{0, s.cfg.FrequencyRawRetention, watermarks[time.Minute]},
+		{time.Minute, s.cfg.FrequencyMinuteRetention, watermarks[time.Hour]},
+		{time.Hour, s.cfg.FrequencyHourRetention, now},
+	} {
+		if tier.retention <= 0 {
+			continue
+		}
+		before := minTime(now.Add(-tier.retention), tier.absorbed)
+		n, err := s.store.PruneFrequency(tier.resolution, before)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Pruned %d frequency rows at resolution %v\n", n, tier.resolution)
+		}
+	}
+	return nil
+}
+
+// retainedSince is the oldest time buckets of the given width can still be
+// built for, or zero when some source is kept forever
+func (s *Server) retainedSince(bucket time.Duration, loc *time.Location, now time.Time) time.Time {
+	retention := map[time.Duration]time.Duration{
+		time.Minute: s.cfg.FrequencyMinuteRetention,
+		time.Hour:   s.cfg.FrequencyHourRetention,
+	}
+	longest := s.cfg.FrequencyRawRetention
+	for _, tier := range rollupTiers(bucket, loc) {
+		if longest <= 0 || retention[tier] <= 0 {
+			return time.Time{}
+		}
+		longest = max(longest, retention[tier])
+	}
+	return now.Add(-longest)
+}
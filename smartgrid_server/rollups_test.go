@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRollupAndPruneKeepsAggregates(t *testing.T) {
+	testStores(t, func(t *testing.T, store Store) {
+		cfg := DefaultConfig()
+		cfg.FrequencyRawRetention = time.Hour
+		cfg.FrequencyMinuteRetention = 24 * time.Hour
+		cfg.FrequencyHourRetention = 0
+		s := NewServer(store, cfg)
+		_, device := seedDevice(t, store, "alice")
+
+		// Two hours of readings every 20s, ending three hours ago
+		now := time.Date(2025, 3, 2, 12, 0, 0, 0, time.UTC)
+		start := now.Add(-5 * time.Hour)
+		for i := 0; i < 360; i++ {
+			hz := 60 + math.Sin(float64(i)/10)/10
+			if err := store.InsertFrequency(FrequencyLog{DeviceID: device.ID, Frequency: hz, Timestamp: start.Add(time.Duration(i) * 20 * time.Second)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before, err := store.AggregateFrequency(device.ID, FrequencyRange{}, time.Hour, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.rollupAndPrune(now); err != nil {
+			t.Fatal(err)
+		}
+
+		watermarks, err := store.FrequencyWatermarks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := now.Add(-time.Minute); !watermarks[time.Minute].Equal(want) {
+			t.Errorf("minute watermark %v, want %v", watermarks[time.Minute], want)
+		}
+		if want := now.Add(-time.Hour); !watermarks[time.Hour].Equal(want) {
+			t.Errorf("hour watermark %v, want %v", watermarks[time.Hour], want)
+		}
+
+		// Raw readings are past retention once they are rolled up
+		raw, err := store.ListFrequency(device.ID, FrequencyRange{})
+		if err != nil || len(raw) != 0 {
+			t.Fatalf("%d raw readings left after pruning, %v", len(raw), err)
+		}
+
+		// ...but the buckets built from them are unchanged
+		after, err := store.AggregateFrequency(device.ID, FrequencyRange{}, time.Hour, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != len(before) {
+			t.Fatalf("got %d hour buckets after rollup, want %d", len(after), len(before))
+		}
+		for i := range before {
+			b, a := before[i], after[i]
+			if !a.Start.Equal(b.Start) || a.Count != b.Count || !approx(a.Min, b.Min) || !approx(a.Max, b.Max) ||
+				math.Abs(a.Avg-b.Avg) > 1e-9 || math.Abs(a.Stddev-b.Stddev) > 1e-6 {
+				t.Errorf("bucket %d: got %+v, want %+v", i, a, b)
+			}
+		}
+		minutes, err := store.AggregateFrequency(device.ID, FrequencyRange{Start: start, End: start.Add(59 * time.Second)}, time.Minute, time.UTC)
+		if err != nil || len(minutes) != 1 || minutes[0].Count != 3 {
+			t.Errorf("first minute from rollups: got %+v, %v", minutes, err)
+		}
+
+		// A day later the minute rollups expire too; hour rollups are kept forever
+		if err := s.rollupAndPrune(now.Add(30 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		minutes, err = store.AggregateFrequency(device.ID, FrequencyRange{Start: start, End: start.Add(59 * time.Second)}, time.Minute, time.UTC)
+		if err != nil || len(minutes) != 0 {
+			t.Errorf("minute buckets after minute retention: got %+v, %v", minutes, err)
+		}
+		hours, err := store.AggregateFrequency(device.ID, FrequencyRange{}, time.Hour, time.UTC)
+		if err != nil || len(hours) != len(before) {
+			t.Errorf("hour buckets after minute retention: got %d, %v; want %d", len(hours), err, len(before))
+		}
+	})
+}
+
+func TestRollupAndPruneKeepsReadingsNotYetRolledUp(t *testing.T) {
+	store := NewMemoryStore()
+	cfg := DefaultConfig()
+	cfg.FrequencyRawRetention = time.Minute
+	s := NewServer(store, cfg)
+	_, device := seedDevice(t, store, "alice")
+
+	// Readings in the minute still open are not absorbed by a rollup yet, so
+	// they outlive the one-minute retention
+	now := time.Date(2025, 3, 2, 12, 0, 20, 0, time.UTC)
+	for _, ts := range []time.Time{now.Add(-5 * time.Minute), now.Add(-10 * time.Second)} {
+		if err := store.InsertFrequency(FrequencyLog{DeviceID: device.ID, Frequency: 60, Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.rollupAndPrune(now); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := store.ListFrequency(device.ID, FrequencyRange{})
+	if len(raw) != 1 || !raw[0].Timestamp.Equal(now.Add(-10*time.Second)) {
+		t.Errorf("got raw readings %+v, want only the one after the minute watermark", raw)
+	}
+}
+
+func TestAutoBucketPicksFinestRetainedWidth(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FrequencyRawRetention = 7 * 24 * time.Hour
+	cfg.FrequencyMinuteRetention = 90 * 24 * time.Hour
+	cfg.FrequencyHourRetention = 365 * 24 * time.Hour
+	s := NewServer(NewMemoryStore(), cfg)
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	cases := []struct {
+		name       string
+		start, end time.Time
+		want       string
+	}{
+		{"open start", time.Time{}, now, "1d"},
+		{"last hour", now.Add(-time.Hour), time.Time{}, "1m"},
+		{"three days", now.Add(-3 * day), now, "1m"},
+		{"five days", now.Add(-5 * day), now, "5m"},
+		{"thirty days", now.Add(-30 * day), now, "1h"},
+		{"one hour two months ago", now.Add(-60 * day), now.Add(-60*day + time.Hour), "1m"},
+		{"older than every rollup", now.Add(-400 * day), now.Add(-399 * day), "1d"},
+	}
+	for _, tc := range cases {
+		if got := s.autoBucket(FrequencyRange{Start: tc.start, End: tc.end}, time.UTC, now); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	// Raw readings kept forever can serve any minute bucket
+	cfg.FrequencyRawRetention = 0
+	s = NewServer(NewMemoryStore(), cfg)
+	if got := s.autoBucket(FrequencyRange{Start: now.Add(-400 * day), End: now.Add(-399 * day)}, time.UTC, now); got != "1m" {
+		t.Errorf("with raw kept forever: got %s, want 1m", got)
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// scheduleTick is how often due schedules are looked for
+	scheduleTick = 15 * time.Second
+	// scheduleGrace is how late a run may start before it is recorded as
+	// missed instead, e.g. after the server was down over its run time
+	scheduleGrace = 5 * time.Minute
+	// defaultUpcomingRuns and maxUpcomingRuns bound fetchUpcomingRuns
+	defaultUpcomingRuns = 10
+	maxUpcomingRuns     = 100
+	// maxScheduleRunList caps fetchScheduleRuns
+	maxScheduleRunList = 200
+)
+
+// oneShotLayouts are accepted for run_at when it carries no UTC offset; the
+// time is then read in the schedule's timezone
+var oneShotLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+// UpcomingRun is one future action on a breaker
+type UpcomingRun struct {
+	ScheduleID int       `json:"schedule_id"`
+	Name       string    `json:"name"`
+	State      bool      `json:"state"`
+	At         time.Time `json:"at"`
+}
+
+// upcoming returns up to n run times strictly after the given time
+func (sch BreakerSchedule) upcoming(after time.Time, n int) ([]time.Time, error) {
+	if sch.RunAt != nil {
+		if n > 0 && sch.RunAt.After(after) {
+			return []time.Time{*sch.RunAt}, nil
+		}
+		return nil, nil
+	}
+	if sch.Cron == nil {
+		return nil, errors.New("schedule has neither cron nor run_at")
+	}
+
+	loc, err := time.LoadLocation(sch.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := cron.ParseStandard(*sch.Cron)
+	if err != nil {
+		return nil, err
+	}
+
+	var times []time.Time
+	for t := after.In(loc); len(times) < n; {
+		if t = spec.Next(t); t.IsZero() {
+			break
+		}
+		times = append(times, t)
+	}
+	return times, nil
+}
+
+// next returns the first run after the given time, or nil if there is none
+func (sch BreakerSchedule) next(after time.Time) (*time.Time, error) {
+	times, err := sch.upcoming(after, 1)
+	if err != nil || len(times) == 0 {
+		return nil, err
+	}
+	return &times[0], nil
+}
+
+// runSchedules fires due schedules until ctx is cancelled
+func (s *Server) runSchedules(ctx context.Context) {
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.runDueSchedules(now)
+		}
+	}
+}
+
+// runDueSchedules claims every schedule due by now and dispatches its action.
+// A schedule is advanced past now before it runs, so runs missed while the
+// server was down are recorded once rather than replayed one by one.
+func (s *Server) runDueSchedules(now time.Time) {
+	due, err := s.store.DueBreakerSchedules(now)
+	if err != nil {
+		log.Println("Failed to load due schedules:", err)
+		return
+	}
+
+	for _, sch := range due {
+		scheduledFor := *sch.NextRunAt
+		next, err := sch.next(now)
+		if err != nil {
+			// Stop a schedule that can no longer be evaluated rather than retry it forever
+			log.Printf("Schedule %d stopped: %v\n", sch.ID, err)
+			next = nil
+		}
+		if err := s.store.AdvanceBreakerSchedule(sch.ID, scheduledFor, next); err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				log.Println("Failed to advance schedule:", err)
+			}
+			continue
+		}
+
+		if now.Sub(scheduledFor) > scheduleGrace {
+			s.recordScheduleRun(ScheduleRun{ScheduleID: sch.ID, ScheduledFor: scheduledFor, Status: RunMissed, RanAt: now})
+			continue
+		}
+		go s.runSchedule(sch, scheduledFor)
+	}
+}
+
+// runSchedule sends the schedule's toggle through dispatchCommand and records
+// how far it got
+func (s *Server) runSchedule(sch BreakerSchedule, scheduledFor time.Time) {
+	run := ScheduleRun{ScheduleID: sch.ID, ScheduledFor: scheduledFor}
+
+	breaker, err := s.store.GetBreaker(sch.BreakerID)
+	switch {
+	case err != nil:
+		run.Status, run.Error = RunError, err.Error()
+	case breaker.ShedAt != nil && sch.State:
+		// Load shedding outranks a schedule; it restores the breaker itself
+		run.Status, run.Error = RunSkipped, "Breaker is held open by load shedding"
+	default:
+		s.releaseShedBreaker(breaker, nil, fmt.Sprintf("Switched off by schedule %d", sch.ID))
+		state := sch.State
+		payload := DeviceResponse{Command: "toggleBreaker", BreakerID: &breaker.ID, BreakerState: &state}
+		opts := CommandOptions{
+			Wait:        true,
+			Timeout:     s.cfg.CommandAckTimeout,
+			TTL:         s.cfg.CommandTTL,
+			RequestedBy: Requester{Source: SourceSchedule, ScheduleID: &sch.ID},
+		}
+		cmd, err := s.dispatchCommand(breaker.DeviceID, payload, opts)
+
+		run.Status = cmd.Status
+		if cmd.ID != 0 {
+			run.CommandID = &cmd.ID
+		}
+		switch {
+		case err != nil && cmd.ID == 0:
+			run.Status, run.Error = RunError, err.Error()
+		case err != nil:
+			run.Error = err.Error()
+		case cmd.Result != nil:
+			run.Error = cmd.Result.Error
+		}
+	}
+
+	run.RanAt = time.Now()
+	s.recordScheduleRun(run)
+}
+
+func (s *Server) recordScheduleRun(run ScheduleRun) {
+	if err := s.store.CreateScheduleRun(&run); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Println("Failed to record schedule run:", err)
+	}
+}
+
+// scheduleInput is the body of createBreakerSchedule and updateBreakerSchedule;
+// exactly one of Cron and RunAt is required
+type scheduleInput struct {
+	BreakerID int     `json:"breaker_id"`
+	Name      string  `json:"name" binding:"required"`
+	State     *bool   `json:"state" binding:"required"`
+	Cron      *string `json:"cron"`
+	RunAt     *string `json:"run_at"`
+	Timezone  string  `json:"timezone"`
+	Enabled   *bool   `json:"enabled"`
+}
+
+// applyScheduleInput validates input into sch and works out its next run
+func applyScheduleInput(c *gin.Context, input scheduleInput, sch *BreakerSchedule) bool {
+	fail := func(msg string) bool {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return false
+	}
+
+	if (input.Cron == nil) == (input.RunAt == nil) {
+		return fail("Exactly one of cron and run_at is required")
+	}
+	if input.Timezone == "" {
+		input.Timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(input.Timezone)
+	if err != nil {
+		return fail("Unknown timezone")
+	}
+
+	sch.Cron, sch.RunAt = nil, nil
+	if input.Cron != nil {
+		expr := strings.TrimSpace(*input.Cron)
+		// The timezone field is the one place a schedule's zone is set
+		if strings.HasPrefix(expr, "TZ=") || strings.HasPrefix(expr, "CRON_TZ=") {
+			return fail("Set the timezone field instead of a TZ= prefix")
+		}
+		if _, err := cron.ParseStandard(expr); err != nil {
+			return fail("Invalid cron expression: " + err.Error())
+		}
+		sch.Cron = &expr
+	} else {
+		at, err := time.Parse(time.RFC3339, *input.RunAt)
+		for _, layout := range oneShotLayouts {
+			if err == nil {
+				break
+			}
+			at, err = time.ParseInLocation(layout, *input.RunAt, loc)
+		}
+		if err != nil {
+			return fail("run_at must be RFC 3339 or a local YYYY-MM-DDTHH:MM time")
+		}
+		if !at.After(time.Now()) {
+			return fail("run_at is in the past")
+		}
+		sch.RunAt = &at
+	}
+
+	sch.Name, sch.State, sch.Timezone = input.Name, *input.State, input.Timezone
+	sch.Enabled = input.Enabled == nil || *input.Enabled
+	sch.NextRunAt = nil
+	if sch.Enabled {
+		if sch.NextRunAt, err = sch.next(time.Now()); err != nil {
+			return fail(err.Error())
+		}
+	}
+	return true
+}
+
+// loadBreakerSchedule resolves :id to a schedule on a breaker the caller
+// holds at least role need on
+func (s *Server) loadBreakerSchedule(c *gin.Context, need string) (BreakerSchedule, bool) {
+	id, ok := paramID(c, "id", "schedule")
+	if !ok {
+		return BreakerSchedule{}, false
+	}
+
+	auditTarget(c, "schedule", int64(id))
+	sch, err := s.store.GetBreakerSchedule(id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return BreakerSchedule{}, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedule"})
+		return BreakerSchedule{}, false
+	}
+	if !s.authorizeBreaker(c, sch.BreakerID, need) {
+		return BreakerSchedule{}, false
+	}
+	return sch, true
+}
+
+func (s *Server) createBreakerSchedule(c *gin.Context) {
+	var input scheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil || input.BreakerID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if !s.authorizeBreaker(c, input.BreakerID, RoleOperator) {
+		return
+	}
+
+	sch := BreakerSchedule{BreakerID: input.BreakerID}
+	if !applyScheduleInput(c, input, &sch) {
+		return
+	}
+	if err := s.store.CreateBreakerSchedule(&sch); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create schedule"})
+		return
+	}
+	auditTarget(c, "schedule", int64(sch.ID))
+	auditChange(c, nil, sch)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule created successfully", "scheduleID": sch.ID, "nextRunAt": sch.NextRunAt})
+}
+
+func (s *Server) readBreakerSchedule(c *gin.Context) {
+	sch, ok := s.loadBreakerSchedule(c, RoleViewer)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, sch)
+}
+
+func (s *Server) updateBreakerSchedule(c *gin.Context) {
+	sch, ok := s.loadBreakerSchedule(c, RoleOperator)
+	if !ok {
+		return
+	}
+
+	var input scheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	before := sch
+	if !applyScheduleInput(c, input, &sch) {
+		return
+	}
+	if err := s.store.UpdateBreakerSchedule(sch); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update schedule"})
+		return
+	}
+	auditChange(c, before, sch)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule updated successfully", "nextRunAt": sch.NextRunAt})
+}
+
+func (s *Server) deleteBreakerSchedule(c *gin.Context) {
+	sch, ok := s.loadBreakerSchedule(c, RoleOperator)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteBreakerSchedule(sch.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete schedule"})
+		return
+	}
+	auditChange(c, sch, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted successfully"})
+}
+
+func (s *Server) fetchBreakerSchedules(c *gin.Context) {
+	breakerID, ok := paramID(c, "id", "breaker")
+	if !ok {
+		return
+	}
+
+	schedules, err := s.store.ListBreakerSchedules(breakerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedules"})
+		return
+	}
+	if schedules == nil {
+		schedules = []BreakerSchedule{}
+	}
+
+	c.JSON(http.StatusOK, schedules)
+}
+
+// fetchUpcomingRuns merges the next ?count runs of all of a breaker's schedules
+func (s *Server) fetchUpcomingRuns(c *gin.Context) {
+	breakerID, ok := paramID(c, "id", "breaker")
+	if !ok {
+		return
+	}
+	count := defaultUpcomingRuns
+	if raw := c.Query("count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid count"})
+			return
+		}
+		count = min(n, maxUpcomingRuns)
+	}
+
+	schedules, err := s.store.ListBreakerSchedules(breakerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedules"})
+		return
+	}
+
+	runs := []UpcomingRun{}
+	for _, sch := range schedules {
+		if !sch.Enabled || sch.NextRunAt == nil {
+			continue
+		}
+		// next_run_at already accounts for skips, so count on from there
+		times, err := sch.upcoming(*sch.NextRunAt, count-1)
+		if err != nil {
+			log.Printf("Schedule %d cannot be evaluated: %v\n", sch.ID, err)
+			continue
+		}
+		for _, at := range append([]time.Time{*sch.NextRunAt}, times...) {
+			runs = append(runs, UpcomingRun{ScheduleID: sch.ID, Name: sch.Name, State: sch.State, At: at})
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].At.Before(runs[j].At) })
+	if len(runs) > count {
+		runs = runs[:count]
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
+
+// skipBreakerSchedule passes over a schedule's next run, logging it as skipped
+func (s *Server) skipBreakerSchedule(c *gin.Context) {
+	sch, ok := s.loadBreakerSchedule(c, RoleOperator)
+	if !ok {
+		return
+	}
+	if !sch.Enabled || sch.NextRunAt == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Schedule has no upcoming run"})
+		return
+	}
+
+	skipped := *sch.NextRunAt
+	next, err := sch.next(skipped)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not evaluate schedule"})
+		return
+	}
+	err = s.store.AdvanceBreakerSchedule(sch.ID, skipped, next)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The next run has already started"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not skip run"})
+		return
+	}
+	s.recordScheduleRun(ScheduleRun{ScheduleID: sch.ID, ScheduledFor: skipped, Status: RunSkipped, RanAt: time.Now()})
+	auditChange(c, gin.H{"next_run_at": skipped}, gin.H{"next_run_at": next})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Next run skipped", "skipped": skipped, "nextRunAt": next})
+}
+
+// fetchScheduleRuns is a schedule's run history, newest first
+func (s *Server) fetchScheduleRuns(c *gin.Context) {
+	sch, ok := s.loadBreakerSchedule(c, RoleViewer)
+	if !ok {
+		return
+	}
+	limit := maxScheduleRunList
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxScheduleRunList)
+	}
+
+	runs, err := s.store.ListScheduleRuns(sch.ID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedule runs"})
+		return
+	}
+	if runs == nil {
+		runs = []ScheduleRun{}
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newScheduleServer returns a server with one breaker on an unconnected device
+func newScheduleServer(t *testing.T) (*Server, User, Device, Breaker) {
+	t.Helper()
+	store := NewMemoryStore()
+	s := NewServer(store, DefaultConfig())
+	user, device := seedDevice(t, store, "alice")
+	breaker := Breaker{DeviceID: device.ID, Name: "Heater", Breaker_Number: "1", Priority: 1}
+	if err := store.CreateBreaker(&breaker); err != nil {
+		t.Fatal(err)
+	}
+	return s, user, device, breaker
+}
+
+// createSchedule stores sch on breaker with its first run at next
+func createSchedule(t *testing.T, s *Server, breaker Breaker, sch BreakerSchedule, next time.Time) BreakerSchedule {
+	t.Helper()
+	sch.BreakerID, sch.Name, sch.Enabled, sch.NextRunAt = breaker.ID, "test", true, &next
+	if sch.Timezone == "" {
+		sch.Timezone = "UTC"
+	}
+	if err := s.store.CreateBreakerSchedule(&sch); err != nil {
+		t.Fatal(err)
+	}
+	return sch
+}
+
+func cronSchedule(expr, tz string) BreakerSchedule {
+	return BreakerSchedule{Cron: &expr, Timezone: tz}
+}
+
+// waitForRuns polls until sch has recorded n runs, newest first
+func waitForRuns(t *testing.T, s *Server, sch BreakerSchedule, n int) []ScheduleRun {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runs, err := s.store.ListScheduleRuns(sch.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) >= n {
+			return runs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d runs, want %d", len(runs), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScheduleCronFollowsTimezone(t *testing.T) {
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sch := cronSchedule("0 18 * * *", "America/Chicago")
+
+	// 18:00 local either side of the March clock change is 00:00 and 23:00 UTC
+	times, err := sch.upcoming(time.Date(2025, 3, 8, 12, 0, 0, 0, time.UTC), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{
+		time.Date(2025, 3, 8, 18, 0, 0, 0, chicago),
+		time.Date(2025, 3, 9, 18, 0, 0, 0, chicago),
+	}
+	if len(times) != 2 || !times[0].Equal(want[0]) || !times[1].Equal(want[1]) {
+		t.Fatalf("got %v, want %v", times, want)
+	}
+	if got := times[1].UTC().Hour(); got != 23 {
+		t.Errorf("run after the change is at %02d:00 UTC, want 23:00", got)
+	}
+
+	// Runs are strictly after the given time
+	next, err := sch.next(want[0])
+	if err != nil || next == nil || !next.Equal(want[1]) {
+		t.Errorf("next after a run time: got %v, %v; want %v", next, err, want[1])
+	}
+
+	if _, err := cronSchedule("not a cron", "UTC").next(time.Now()); err == nil {
+		t.Error("invalid expression was evaluated")
+	}
+}
+
+func TestScheduleOneShotRunsOnce(t *testing.T) {
+	at := time.Date(2025, 3, 1, 18, 0, 0, 0, time.UTC)
+	sch := BreakerSchedule{RunAt: &at, Timezone: "UTC"}
+
+	if next, err := sch.next(at.Add(-time.Hour)); err != nil || next == nil || !next.Equal(at) {
+		t.Errorf("before run_at: got %v, %v; want %v", next, err, at)
+	}
+	if next, err := sch.next(at); err != nil || next != nil {
+		t.Errorf("at run_at: got %v, %v; want no further run", next, err)
+	}
+}
+
+func TestRunDueSchedulesRecordsMissedRunsOnce(t *testing.T) {
+	s, _, _, breaker := newScheduleServer(t)
+	now := time.Date(2025, 3, 1, 12, 7, 0, 0, time.UTC)
+
+	// Hourly, last due three hours ago while the server was down
+	hourly := createSchedule(t, s, breaker, cronSchedule("0 * * * *", "UTC"), now.Add(-3*time.Hour-7*time.Minute))
+	at := now.Add(-time.Hour)
+	once := createSchedule(t, s, breaker, BreakerSchedule{RunAt: &at}, at)
+
+	s.runDueSchedules(now)
+
+	for _, sch := range []BreakerSchedule{hourly, once} {
+		runs := waitForRuns(t, s, sch, 1)
+		if len(runs) != 1 || runs[0].Status != RunMissed || !runs[0].ScheduledFor.Equal(*sch.NextRunAt) {
+			t.Errorf("schedule %d: got runs %+v, want one missed run", sch.ID, runs)
+		}
+	}
+
+	got, _ := s.store.GetBreakerSchedule(hourly.ID)
+	if want := time.Date(2025, 3, 1, 13, 0, 0, 0, time.UTC); got.NextRunAt == nil || !got.NextRunAt.Equal(want) {
+		t.Errorf("hourly next run %v, want %v", got.NextRunAt, want)
+	}
+	got, _ = s.store.GetBreakerSchedule(once.ID)
+	if got.NextRunAt != nil {
+		t.Errorf("one-shot next run %v, want none", got.NextRunAt)
+	}
+
+	// Nothing is due again until the next run time
+	s.runDueSchedules(now.Add(time.Minute))
+	if runs, _ := s.store.ListScheduleRuns(hourly.ID, 10); len(runs) != 1 {
+		t.Errorf("got %d runs after a second tick, want 1", len(runs))
+	}
+}
+
+func TestRunDueSchedulesTogglesBreaker(t *testing.T) {
+	s, _, device, breaker := newScheduleServer(t)
+	s.cfg.CommandAckTimeout = 5 * time.Second
+	_, panel := connectDevice(t, s, device)
+	go func() {
+		msg := panel.next()
+		if msg.Command != "toggleBreaker" || msg.BreakerID == nil || *msg.BreakerID != breaker.ID || msg.BreakerState == nil || !*msg.BreakerState {
+			t.Errorf("device got %+v, want breaker %d switched on", msg, breaker.ID)
+		}
+		panel.reply(DeviceResponse{Command: "ACK", RequestID: msg.RequestID, Status: "ok"})
+	}()
+
+	now := time.Now()
+	on := cronSchedule("0 * * * *", "UTC")
+	on.State = true
+	sch := createSchedule(t, s, breaker, on, now.Add(-time.Minute))
+	s.runDueSchedules(now)
+
+	runs := waitForRuns(t, s, sch, 1)
+	if runs[0].Status != CommandAcked || runs[0].CommandID == nil {
+		t.Fatalf("got run %+v, want an acked command", runs[0])
+	}
+}
+
+func TestSkipBreakerScheduleSkipsNextRun(t *testing.T) {
+	s, user, _, breaker := newScheduleServer(t)
+	first := time.Now().Add(time.Hour).Truncate(time.Hour)
+	sch := createSchedule(t, s, breaker, cronSchedule("0 * * * *", "UTC"), first)
+
+	skip := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/skipBreakerSchedule/"+strconv.Itoa(sch.ID), nil)
+		c.Params = gin.Params{{Key: "id", Value: strconv.Itoa(sch.ID)}}
+		c.Set("userID", user.ID)
+		s.skipBreakerSchedule(c)
+		return w
+	}
+
+	if w := skip(); w.Code != http.StatusOK {
+		t.Fatalf("skip: got %d: %s", w.Code, w.Body)
+	}
+	got, _ := s.store.GetBreakerSchedule(sch.ID)
+	if got.NextRunAt == nil || !got.NextRunAt.Equal(first.Add(time.Hour)) {
+		t.Errorf("next run %v, want %v", got.NextRunAt, first.Add(time.Hour))
+	}
+	runs, _ := s.store.ListScheduleRuns(sch.ID, 10)
+	if len(runs) != 1 || runs[0].Status != RunSkipped || !runs[0].ScheduledFor.Equal(first) {
+		t.Errorf("got runs %+v, want the first run skipped", runs)
+	}
+
+	// The skipped time never fires
+	s.runDueSchedules(first)
+	if runs, _ := s.store.ListScheduleRuns(sch.ID, 10); len(runs) != 1 {
+		t.Errorf("got %d runs after the skipped time, want 1", len(runs))
+	}
+
+	// A disabled schedule has nothing to skip
+	got.Enabled, got.NextRunAt = false, nil
+	if err := s.store.UpdateBreakerSchedule(got); err != nil {
+		t.Fatal(err)
+	}
+	if w := skip(); w.Code != http.StatusConflict {
+		t.Errorf("skip disabled: got %d, want 409", w.Code)
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -20,7 +20,6 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var db *sql.DB
 var jwtSecret []byte
 
 // WebSocket upgrader
@@ -28,11 +27,6 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-var (
-	deviceConnections = make(map[string]*websocket.Conn) // Maps MAC to WebSocket
-	mu                sync.Mutex
-)
-
 // JWT Claims struct
 type Claims struct {
 	Login  string `json:"login"`
@@ -53,6 +47,8 @@ type User struct {
 	Login      string `json:"login"`
 	Pass       string `json:"pass"`
 	IsVerified bool   `json:"isverified"`
+	// IsAdmin is read-only over the API; see "server admin"
+	IsAdmin bool `json:"is_admin"`
 }
 
 type Device struct {
@@ -60,6 +56,10 @@ type Device struct {
 	Name    string `json:"name"`
 	MACAddr string `json:"mac_addr"`
 	UserID  int    `json:"user_id"`
+	SiteID  *int   `json:"site_id"`
+	// As reported in the device's last hello
+	HardwareModel   string `json:"hardware_model,omitempty"`
+	FirmwareVersion string `json:"firmware_version,omitempty"`
 }
 
 type Breaker struct {
@@ -68,78 +68,141 @@ type Breaker struct {
 	Name           string `json:"name"`
 	Breaker_Number string `json:"breaker_number"`
 	Status         bool   `json:"status"`
+	// Priority is the load shedding tier; 0 is critical and never shed
+	Priority int `json:"priority"`
+	// ShedAt is set while load shedding holds the breaker open
+	ShedAt *time.Time `json:"shed_at"`
 }
 
+// DeviceResponse is the JSON frame exchanged with devices in both directions.
+// Outbound commands carry a RequestID that the device echoes in its reply,
+// along with Status "ok" or "error" and an optional Error message.
 type DeviceResponse struct {
 	Command      string   `json:"command"`
+	RequestID    string   `json:"requestId,omitempty"`
 	MACAddr      string   `json:"mac_addr,omitempty"`
 	BreakerID    *int     `json:"breakerId,omitempty"`
 	BreakerState *bool    `json:"breakerState,omitempty"`
 	Frequency    *float64 `json:"frequency,omitempty"`
+	Status       string   `json:"status,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	// otaUpdate carries the image to fetch; otaProgress reports Progress in percent
+	URL      string `json:"url,omitempty"`
+	Version  string `json:"version,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Progress *int   `json:"progress,omitempty"`
+	// setConfig carries the settings and their version; the device echoes the version
+	Config        *DeviceSettings `json:"config,omitempty"`
+	ConfigVersion *int            `json:"configVersion,omitempty"`
 }
 
-// Load environment variables from .env file
-func init() {
-	// Load environment variables from .env file
-	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+// Server holds the dependencies shared by every handler
+type Server struct {
+	store  Store
+	cfg    Config
+	hub    *Hub
+	events *Broker
+
+	excursions *excursionTracker
+	rocof      *rocofTracker
+	alerts     *alertEngine
+	webhooks   *webhookDispatcher
+	shedding   *loadShedder
+	claims     *claimLimiter
+}
+
+func NewServer(store Store, cfg Config) *Server {
+	return &Server{
+		store:  store,
+		cfg:    cfg,
+		hub:    NewHub(cfg.DevicePongWait),
+		events: NewBroker(),
+
+		excursions: newExcursionTracker(cfg),
+		rocof:      newRocofTracker(cfg.RocofWindow),
+		alerts:     newAlertEngine(),
+		webhooks:   newWebhookDispatcher(cfg),
+		shedding:   newLoadShedder(),
+		claims:     newClaimLimiter(cfg),
 	}
+}
 
-	// Set JWT secret
-	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+// paramID parses a numeric route parameter, writing a 400 on failure
+func paramID(c *gin.Context, name, label string) (int, bool) {
+	id, err := strconv.Atoi(c.Param(name))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + label + " ID"})
+		return 0, false
+	}
+	return id, true
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("WebSocket upgrade failed:", err)
 		return
 	}
 
-	// Read MAC address from device
-	_, msg, err := conn.ReadMessage()
+	// Read the hello frame carrying the MAC address and device credential
+	var hello deviceHello
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.ReadJSON(&hello); err != nil {
+		log.Println("Failed to read device hello:", err)
+		rejectDevice(conn, "expected hello frame")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	macAddress := hello.MACAddr
 
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Println("Failed to read MAC address:", err)
-		conn.Close()
-		return
+		remoteIP = r.RemoteAddr
 	}
-	macAddress := string(msg)
 
-	// Check if this MAC is already linked to a device
-	var deviceID, userID int
-	err = db.QueryRow(`SELECT id, user_id FROM devices WHERE mac_addr = $1`, macAddress).Scan(&deviceID, &userID)
-	if err == sql.ErrNoRows {
-		// MAC is new, find the first device without a MAC and link it
-		err = db.QueryRow(`UPDATE devices SET mac_addr = $1 WHERE mac_addr IS NULL RETURNING id, user_id`, macAddress).Scan(&deviceID, &userID)
-		if err != nil {
-			log.Println("No available device entry to update for MAC:", macAddress)
-			conn.Close()
-			return
-		}
-		log.Printf("Linked MAC %s to device %d\n", macAddress, deviceID)
+	device, secret, err := s.authenticateDevice(hello, remoteIP)
+	if errors.Is(err, errDeviceRejected) {
+		log.Println("Rejected device connection for MAC:", macAddress)
+		rejectDevice(conn, "unknown device or invalid credential")
+		return
+	} else if errors.Is(err, errClaimThrottled) {
+		rejectDevice(conn, "too many failed claim attempts, try again later")
+		return
 	} else if err != nil {
 		log.Println("Database error:", err)
 		conn.Close()
 		return
 	}
 
-	// Close existing connection if device is reconnecting
-	mu.Lock()
-	if oldConn, exists := deviceConnections[macAddress]; exists {
-		oldConn.Close() // Properly close the old connection
+	// A newly provisioned device learns its credential here, exactly once
+	if secret != "" {
+		if err := conn.WriteJSON(gin.H{"command": "provisioned", "deviceId": device.ID, "token": secret}); err != nil {
+			log.Println("Failed to deliver credential to", macAddress, err)
+			conn.Close()
+			return
+		}
 	}
-	deviceConnections[macAddress] = conn
-	mu.Unlock()
+
+	// The hub takes over the socket, replacing any older connection
+	dc := s.hub.Register(conn, device)
 
 	log.Println("Device connected:", macAddress)
 
+	s.openSession(dc)
+	s.reportFirmware(device, hello)
+	s.syncConfig(device, hello)
+
 	// Start a goroutine to receive packets from the device
-	go receivePacket(conn)
+	go s.receivePacket(dc)
+
+	// Hand over anything queued while the device was offline
+	if err := s.deliverPending(dc); err != nil {
+		log.Println("Failed to deliver queued commands to", macAddress, err)
+	}
 }
 
-func createUser(c *gin.Context) {
+func (s *Server) createUser(c *gin.Context) {
 	var user User
 	if err := c.BindJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
@@ -153,52 +216,39 @@ func createUser(c *gin.Context) {
 		return
 	}
 	user.Pass = string(hashedPassword)
+	user.IsAdmin = false
 
-	// Prepare the SQL statement for inserting the user
-	sqlStatement := `INSERT INTO users (name, email, login, pass, isverified) VALUES ($1, $2, $3, $4, $5) RETURNING id`
-	err = db.QueryRow(sqlStatement, user.Name, user.Email, user.Login, user.Pass, user.IsVerified).Scan(&user.ID)
-	if err != nil {
+	if err := s.store.CreateUser(&user); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create user"})
 		return
 	}
+	auditTarget(c, "user", int64(user.ID))
+	auditChange(c, nil, userSummary(user))
 
 	// Respond with success
 	c.JSON(http.StatusOK, gin.H{"message": "User created successfully", "user_id": user.ID})
 }
 
-func readUser(c *gin.Context) { // Search User
+func (s *Server) readUser(c *gin.Context) { // Search User
 	searchParam := c.Query("query")
 
-	sqlStatement := `
-        SELECT id, name, email, login, pass, isverified
-        FROM users
-        WHERE name ILIKE $1 OR email ILIKE $1 OR login ILIKE $1`
-
-	rows, err := db.Query(sqlStatement, "%"+searchParam+"%")
+	users, err := s.store.SearchUsers(searchParam)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
 		return
 	}
-	defer rows.Close()
 
-	var users []User
-	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Login, &user.Pass, &user.IsVerified); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan user"})
-			return
-		}
-		users = append(users, user)
+	// Never hand password hashes to other accounts
+	for i := range users {
+		users[i].Pass = ""
 	}
 
 	c.JSON(http.StatusOK, users)
 }
 
-func updateUser(c *gin.Context) {
-	idParam := c.Param("id")
-	id, err := strconv.Atoi(idParam)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+func (s *Server) updateUser(c *gin.Context) {
+	id, ok := paramID(c, "id", "user")
+	if !ok {
 		return
 	}
 
@@ -214,72 +264,61 @@ func updateUser(c *gin.Context) {
 		return
 	}
 	user.Pass = string(hashedPassword)
+	user.ID = id
 
-	sqlStatement := `
-        UPDATE users
-        SET name = $1, email = $2, login = $3, pass = $4, isverified = $5
-        WHERE id = $6`
-	res, err := db.Exec(sqlStatement, user.Name, user.Email, user.Login, user.Pass, user.IsVerified, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+	before, err := s.store.GetUser(id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
-	}
-
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve affected rows"})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 		return
 	}
-
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	if err := s.store.UpdateUser(user); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 		return
 	}
+	auditChange(c, userSummary(before), userSummary(user))
 
 	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
 }
 
-func deleteUser(c *gin.Context) {
-	idParam := c.Param("id")
-	id, err := strconv.Atoi(idParam)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+func (s *Server) deleteUser(c *gin.Context) {
+	id, ok := paramID(c, "id", "user")
+	if !ok {
 		return
 	}
 
-	sqlStatement := `DELETE FROM users WHERE id = $1`
-	res, err := db.Exec(sqlStatement, id)
-	if err != nil {
+	before, beforeErr := s.store.GetUser(id)
+	if err := s.store.DeleteUser(id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
 		return
 	}
-
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve affected rows"})
-		return
-	}
-
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
+	if beforeErr == nil {
+		auditChange(c, userSummary(before), nil)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
 }
 
-func login(c *gin.Context) {
+func (s *Server) login(c *gin.Context) {
 	var login Login
 	if err := c.BindJSON(&login); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
 
-	var user User
-	sqlStatement := `SELECT id, name, email, login, pass, isverified FROM users WHERE login = $1`
-	row := db.QueryRow(sqlStatement, login.Login)
-	if err := row.Scan(&user.ID, &user.Name, &user.Email, &user.Login, &user.Pass, &user.IsVerified); err != nil {
-		if err == sql.ErrNoRows {
+	user, err := s.store.GetUserByLogin(login.Login)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect login or password"})
 			return
 		}
@@ -292,36 +331,39 @@ func login(c *gin.Context) {
 		return
 	}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: user.ID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	tokenString, err := newToken(user.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create token"})
 		return
 	}
 
 	// Update the JWT token in the database
-	updateTokenSQL := `UPDATE users SET jwt = $1 WHERE id = $2`
-	_, err = db.Exec(updateTokenSQL, &tokenString, &user.ID)
-	if err != nil {
+	if err := s.store.SetUserToken(user.ID, tokenString); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update JWT token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": tokenString, "userID": claims.UserID})
+	c.JSON(http.StatusOK, gin.H{"token": tokenString, "userID": user.ID})
 }
 
-func createDevice(c *gin.Context) {
+// newToken signs a 24 hour JWT for userID
+func newToken(userID int) (string, error) {
+	expirationTime := time.Now().Add(24 * time.Hour)
+	claims := &Claims{
+		UserID: userID,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expirationTime.Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+func (s *Server) createDevice(c *gin.Context) {
 	type DeviceInput struct {
 		Name   string `json:"name" binding:"required"`
-		UserID int    `json:"user_id" binding:"required"`
+		UserID int    `json:"user_id"`
 	}
 
 	var input DeviceInput
@@ -330,26 +372,46 @@ func createDevice(c *gin.Context) {
 		return
 	}
 
-	sqlStatement := `INSERT INTO devices (name, user_id) VALUES ($1, $2) RETURNING id`
-	fmt.Println(sqlStatement, input.Name, input.UserID)
-	var deviceID int
-	err := db.QueryRow(sqlStatement, input.Name, input.UserID).Scan(&deviceID)
-	if err != nil {
+	// Devices are always created for the caller; user_id is kept for older clients
+	if input.UserID == 0 {
+		input.UserID = currentUserID(c)
+	} else if input.UserID != currentUserID(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot create a device for another user"})
+		return
+	}
+
+	device := Device{Name: input.Name, UserID: input.UserID}
+	if err := s.store.CreateDevice(&device); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create device"})
 		return
 	}
+	auditTarget(c, "device", int64(device.ID))
+	auditChange(c, nil, device)
+
+	// The panel presents this code on its first /ws connection to bind its MAC
+	code, expiresAt, err := s.issueClaimCode(device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create claim code"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Device created successfully", "device_id": deviceID})
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "Device created successfully",
+		"device_id":        device.ID,
+		"claim_code":       code,
+		"claim_expires_at": expiresAt,
+	})
 }
 
-func readDevice(c *gin.Context) {
-	deviceID := c.Param("id")
-	var device Device
+func (s *Server) readDevice(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
 
-	sqlStatement := `SELECT id, name, mac_addr, user_id FROM devices WHERE id = $1`
-	err := db.QueryRow(sqlStatement, deviceID).Scan(&device.ID, &device.Name, &device.MACAddr, &device.UserID)
+	device, err := s.store.GetDevice(deviceID)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 			return
 		}
@@ -357,11 +419,21 @@ func readDevice(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, device)
+	statuses, err := s.devicePresence([]Device{device})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve device"})
+		return
+	}
+	statuses[0].Role = c.GetString("deviceRole")
+
+	c.JSON(http.StatusOK, statuses[0])
 }
 
-func updateDevice(c *gin.Context) {
-	deviceID := c.Param("id")
+func (s *Server) updateDevice(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
 
 	type DeviceUpdate struct {
 		Name string `json:"name"`
@@ -373,48 +445,53 @@ func updateDevice(c *gin.Context) {
 		return
 	}
 
-	sqlStatement := `UPDATE devices SET name = $1 WHERE id = $2`
-	res, err := db.Exec(sqlStatement, deviceUpdate.Name, deviceID)
-	if err != nil {
+	before, beforeErr := s.store.GetDevice(deviceID)
+	if err := s.store.UpdateDeviceName(deviceID, deviceUpdate.Name); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update device"})
 		return
 	}
-
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
-		return
+	if beforeErr == nil {
+		after := before
+		after.Name = deviceUpdate.Name
+		auditChange(c, before, after)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Device updated successfully"})
 }
 
-func deleteDevice(c *gin.Context) {
+func (s *Server) deleteDevice(c *gin.Context) {
 	// Get the device ID from the URL parameter
-	deviceID := c.Param("id")
-
-	// Delete the device from the database
-	sqlStatement := `DELETE FROM devices WHERE id = $1`
-	res, err := db.Exec(sqlStatement, deviceID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete device"})
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
 		return
 	}
 
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+	before, beforeErr := s.store.GetDevice(deviceID)
+	if err := s.store.DeleteDevice(deviceID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete device"})
 		return
 	}
+	if beforeErr == nil {
+		auditChange(c, before, nil)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Device deleted successfully"})
 }
 
-func createBreaker(c *gin.Context) {
+func (s *Server) createBreaker(c *gin.Context) {
 	type BreakerInput struct {
 		DeviceID   int    `json:"device_id" binding:"required"`
 		Name       string `json:"name" binding:"required"`
 		BreakerNum string `json:"breaker_number" binding:"required"`
+		Priority   int    `json:"priority"`
 	}
 
 	var input BreakerInput
@@ -423,42 +500,55 @@ func createBreaker(c *gin.Context) {
 		return
 	}
 
-	sqlStatement := `INSERT INTO breakers (name, device_id, breaker_number) VALUES ($1, $2, $3) RETURNING id`
-	fmt.Println(sqlStatement, input.Name, input.DeviceID, input.BreakerNum)
-	var breakerID int
-	err := db.QueryRow(sqlStatement, input.Name, input.DeviceID, input.BreakerNum).Scan(&breakerID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create device"})
+	if input.Priority < 0 || input.Priority > maxShedTier {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid priority"})
+		return
+	}
+
+	if !s.authorizeDevice(c, input.DeviceID, RoleOwner) {
+		return
+	}
+
+	breaker := Breaker{DeviceID: input.DeviceID, Name: input.Name, Breaker_Number: input.BreakerNum, Priority: input.Priority}
+	if err := s.store.CreateBreaker(&breaker); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create breaker"})
 		return
 	}
+	auditTarget(c, "breaker", int64(breaker.ID))
+	auditChange(c, nil, breaker)
 
-	c.JSON(http.StatusOK, gin.H{"message": "Breaker created successfully", "breakerID": breakerID})
+	c.JSON(http.StatusOK, gin.H{"message": "Breaker created successfully", "breakerID": breaker.ID})
 }
 
-func readBreaker(c *gin.Context) {
-	breakerID := c.Param("id")
-	var breaker Breaker
+func (s *Server) readBreaker(c *gin.Context) {
+	breakerID, ok := paramID(c, "id", "breaker")
+	if !ok {
+		return
+	}
 
-	sqlStatement := `SELECT id, name, device_id, breaker_number FROM breakers WHERE id = $1`
-	err := db.QueryRow(sqlStatement, breakerID).Scan(&breaker.ID, &breaker.Name, &breaker.DeviceID, &breaker.Breaker_Number)
+	breaker, err := s.store.GetBreaker(breakerID)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Breaker not found"})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve device"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve breaker"})
 		return
 	}
 
 	c.JSON(http.StatusOK, breaker)
 }
 
-func updateBreaker(c *gin.Context) {
-	breakerID := c.Param("id")
+func (s *Server) updateBreaker(c *gin.Context) {
+	breakerID, ok := paramID(c, "id", "breaker")
+	if !ok {
+		return
+	}
 
 	type BreakerUpdate struct {
 		Name          string `json:"name"`
 		BreakerNumber string `json:"breaker_number"`
+		Priority      *int   `json:"priority"`
 	}
 
 	var breakerUpdate BreakerUpdate
@@ -466,112 +556,169 @@ func updateBreaker(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
-
-	sqlStatement := `UPDATE breakers SET name = $1, breaker_number = $2 WHERE id = $3`
-	res, err := db.Exec(sqlStatement, breakerUpdate.Name, breakerUpdate.BreakerNumber, breakerID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update breaker"})
+	if p := breakerUpdate.Priority; p != nil && (*p < 0 || *p > maxShedTier) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid priority"})
 		return
 	}
 
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
+	before, err := s.store.GetBreaker(breakerID)
+	if errors.Is(err, ErrNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Breaker not found"})
 		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update breaker"})
+		return
+	}
+	if err := s.store.UpdateBreaker(breakerID, breakerUpdate.Name, breakerUpdate.BreakerNumber); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Breaker not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update breaker"})
+		return
+	}
+	if breakerUpdate.Priority != nil {
+		if err := s.store.SetBreakerPriority(breakerID, *breakerUpdate.Priority); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update breaker"})
+			return
+		}
+	}
+
+	if after, err := s.store.GetBreaker(breakerID); err == nil {
+		auditChange(c, before, after)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Breaker updated successfully"})
 }
 
-func deleteBreaker(c *gin.Context) {
-	// Get the device ID from the URL parameter
-	breakerID := c.Param("id")
-
-	// Delete the device from the database
-	sqlStatement := `DELETE FROM breakers WHERE id = $1`
-	res, err := db.Exec(sqlStatement, breakerID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete device"})
+func (s *Server) deleteBreaker(c *gin.Context) {
+	// Get the breaker ID from the URL parameter
+	breakerID, ok := paramID(c, "id", "breaker")
+	if !ok {
 		return
 	}
 
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Breaker not found"})
+	before, beforeErr := s.store.GetBreaker(breakerID)
+	if err := s.store.DeleteBreaker(breakerID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Breaker not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete breaker"})
 		return
 	}
+	if beforeErr == nil {
+		auditChange(c, before, nil)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Breaker deleted successfully"})
 }
 
-func sendPacket(c *gin.Context) {
-	deviceID := c.Param("id")
-
-	// Get MAC address from database
-	var macAddr string
-	err := db.QueryRow(`SELECT mac_addr FROM devices WHERE id = $1`, deviceID).Scan(&macAddr)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
-		return
-	}
-
-	// Check if the device is connected via WebSocket
-	mu.Lock()
-	conn, exists := deviceConnections[macAddr]
-	mu.Unlock()
-
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not connected"})
+func (s *Server) sendPacket(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
 		return
 	}
 
-	// Parse user command
+	// Parse user command; wait=true blocks until the device acknowledges it
 	var reqBody struct {
 		Command      string `json:"command"`
 		BreakerID    *int   `json:"breakerId,omitempty"`
 		BreakerState *bool  `json:"breakerState,omitempty"`
+		Wait         bool   `json:"wait,omitempty"`
+		Timeout      string `json:"timeout,omitempty"`
+		TTL          string `json:"ttl,omitempty"`
 	}
 	if err := c.ShouldBindJSON(&reqBody); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
 		return
 	}
+	userID := currentUserID(c)
+	opts := CommandOptions{Wait: reqBody.Wait, RequestedBy: Requester{Source: SourceUser, UserID: &userID}}
+	var err error
+	if opts.Timeout, err = parseDurationParam(reqBody.Timeout, s.cfg.CommandAckTimeout, maxAckTimeout); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timeout"})
+		return
+	}
+	if opts.TTL, err = parseDurationParam(reqBody.TTL, s.cfg.CommandTTL, maxCommandTTL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ttl"})
+		return
+	}
 
 	// Create payload
-	var payload string
+	payload := DeviceResponse{Command: reqBody.Command}
+	var breaker Breaker
 	switch reqBody.Command {
-	case "pingDevice":
-		payload = `{"command": "pingDevice"}`
-	case "flashLED":
-		payload = `{"command": "flashLED"}`
+	case "pingDevice", "flashLED":
 	case "toggleBreaker":
 		if reqBody.BreakerID == nil || reqBody.BreakerState == nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Breaker ID and state required"})
 			return
 		}
-		payload = fmt.Sprintf(`{"command": "toggleBreaker", "breakerId": %d, "breakerState": %v}`, *reqBody.BreakerID, *reqBody.BreakerState)
+		// The breaker must sit on the device the command is routed to
+		breaker, err = s.store.GetBreaker(*reqBody.BreakerID)
+		if err != nil || breaker.DeviceID != deviceID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Breaker does not belong to this device"})
+			return
+		}
+		payload.BreakerID = reqBody.BreakerID
+		payload.BreakerState = reqBody.BreakerState
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown command"})
 		return
 	}
 
-	// Send command via WebSocket
-	err = conn.WriteMessage(websocket.TextMessage, []byte(payload))
-	if err != nil {
-		log.Println("WebSocket write failed for:", macAddr, err)
-		mu.Lock()
-		delete(deviceConnections, macAddr) // Remove stale connection
-		mu.Unlock()
-		conn.Close()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Device disconnected"})
+	// Record the command and deliver it now if the device is connected
+	cmd, err := s.dispatchCommand(deviceID, payload, opts)
+	if cmd.ID != 0 {
+		auditTarget(c, "command", cmd.ID)
+		auditChange(c, nil, gin.H{"device_id": deviceID, "command": payload.Command, "breaker_id": payload.BreakerID, "breaker_state": payload.BreakerState})
+	}
+	switch {
+	case errors.Is(err, errAckTimeout):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Device did not acknowledge the command", "commandId": cmd.ID, "requestId": cmd.RequestID})
+		return
+	case errors.Is(err, errConnClosed):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Device disconnected", "commandId": cmd.ID, "requestId": cmd.RequestID})
+		return
+	case err != nil:
+		log.Println("Failed to dispatch command to device", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not send command"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Command sent successfully"})
+	// Switching a shed breaker by hand takes it out of load shedding's hands
+	s.releaseShedBreaker(breaker, &userID, "Switched manually")
+
+	ids := gin.H{"commandId": cmd.ID, "requestId": cmd.RequestID}
+	switch cmd.Status {
+	case CommandPending:
+		ids["message"] = "Device offline, command queued"
+		ids["expiresAt"] = cmd.ExpiresAt
+		c.JSON(http.StatusAccepted, ids)
+	case CommandSent:
+		ids["message"] = "Command sent successfully"
+		c.JSON(http.StatusOK, ids)
+	case CommandFailed:
+		ids["error"] = "Device reported an error"
+		ids["result"] = cmd.Result
+		c.JSON(http.StatusBadGateway, ids)
+	default:
+		ids["message"] = "Command acknowledged"
+		ids["result"] = cmd.Result
+		c.JSON(http.StatusOK, ids)
+	}
 }
 
-func receivePacket(conn *websocket.Conn) {
+// receivePacket is the read loop for one device; the hub forgets the
+// connection as soon as it exits
+func (s *Server) receivePacket(dc *DeviceConn) {
+	defer s.closeSession(dc)
+	defer s.hub.Remove(dc)
+
+	device := dc.Device
 	for {
-		_, message, err := conn.ReadMessage()
+		message, err := dc.ReadMessage()
 		if err != nil {
 			log.Println("Failed to read response from ESP32:", err)
 			return
@@ -590,51 +737,85 @@ func receivePacket(conn *websocket.Conn) {
 		// Route message based on command type
 		switch response.Command {
 		case "toggleBreaker":
-			handleCommandAcknowledgment(response)
+			s.handleCommandAcknowledgment(device, response)
 		case "frequencyUpdate":
-			handleTelemetryData(response)
+			s.handleTelemetryData(device, response)
+		case "otaProgress":
+			// Progress reports share the otaUpdate request ID but do not answer it
+			s.handleOTAProgress(device, response)
+			continue
+		case "otaUpdate":
+			s.handleOTAResult(device, response)
+		case "setConfig":
+			s.handleConfigResult(device, response)
+		case "ACK", "pingDevice", "flashLED":
+			// Plain acks; recorded against their request ID below
 		default:
 			log.Println("Unknown command received:", response.Command)
 		}
+
+		// Close out the command and wake up a sendPacket call waiting on it
+		if response.RequestID != "" {
+			s.completeCommand(device, response)
+			s.hub.ResolveAck(device.ID, response)
+		}
 	}
 }
 
-func handleCommandAcknowledgment(response DeviceResponse) {
+func (s *Server) handleCommandAcknowledgment(device Device, response DeviceResponse) {
 	if response.BreakerID == nil || response.BreakerState == nil {
 		log.Println("Missing breaker toggle response data")
 		return
 	}
 
-	// Update breaker status in the database
-	_, err := db.Exec(`UPDATE breakers SET status = $1 WHERE id = $2`, *response.BreakerState, *response.BreakerID)
-	if err != nil {
+	// A device may only report on its own breakers
+	breaker, err := s.store.GetBreaker(*response.BreakerID)
+	if err != nil || breaker.DeviceID != device.ID {
+		log.Printf("Device %d acknowledged unknown breaker %d\n", device.ID, *response.BreakerID)
+		return
+	}
+	if response.Status == "error" {
+		log.Printf("Device %d failed to toggle breaker %d: %s\n", device.ID, *response.BreakerID, response.Error)
+		s.recordBreakerAck(device, breaker, response)
+		s.confirmShedToggle(breaker, response)
+		return
+	}
+
+	// Update breaker status in the store
+	if err := s.store.SetBreakerStatus(*response.BreakerID, *response.BreakerState); err != nil {
 		log.Println("Database update failed:", err)
 		return
 	}
+	s.recordBreakerAck(device, breaker, response)
+	s.confirmShedToggle(breaker, response)
+	s.publish(EventBreaker, device, gin.H{"breaker_id": breaker.ID, "status": *response.BreakerState})
+	if breaker.Status != *response.BreakerState {
+		breaker.Status = *response.BreakerState
+		s.evaluateBreakerRules(device, breaker)
+	}
 	// log.Printf("Breaker %d updated to status %v", *response.BreakerID, *response.BreakerState)
 }
 
-func handleTelemetryData(response DeviceResponse) {
+// handleTelemetryData records a reading against the authenticated device; the
+// mac_addr inside the frame is ignored so one panel cannot report for another
+func (s *Server) handleTelemetryData(device Device, response DeviceResponse) {
 	if response.Frequency == nil {
 		log.Println("Missing frequency data")
 		return
 	}
 
-	// Retrieve device ID from MAC address
-	var deviceID int
-	err := db.QueryRow(`SELECT id FROM devices WHERE mac_addr = $1`, response.MACAddr).Scan(&deviceID)
-	if err != nil {
-		log.Println("Device not found for MAC:", response.MACAddr)
-		return
-	}
-
-	// Insert frequency data into logs
-	_, err = db.Exec(`INSERT INTO frequency_logs (device_id, frequency, timestamp) VALUES ($1, $2, NOW())`, deviceID, *response.Frequency)
-	if err != nil {
+	// Insert frequency data into logs, with ROCOF over the recent window
+	entry := FrequencyLog{DeviceID: device.ID, Frequency: *response.Frequency, Timestamp: time.Now()}
+	entry.Rocof = s.rocof.observe(entry)
+	if err := s.store.InsertFrequency(entry); err != nil {
 		log.Println("Failed to insert frequency data:", err)
 		return
 	}
-	// log.Printf("Frequency %.2f Hz logged for device %d", *response.Frequency, deviceID)
+	s.publish(EventFrequency, device, gin.H{"frequency": entry.Frequency, "rocof": entry.Rocof, "timestamp": entry.Timestamp.Format(time.RFC3339)})
+	s.observeExcursion(device, entry)
+	s.evaluateFrequencyRules(device, entry)
+	s.evaluateLoadShedding(device, entry)
+	// log.Printf("Frequency %.2f Hz logged for device %d", *response.Frequency, device.ID)
 }
 
 func AuthMiddleware() gin.HandlerFunc {
@@ -664,203 +845,271 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
-func fetchDevices(c *gin.Context) {
+func (s *Server) fetchDevices(c *gin.Context) {
 	// Retrieve the user ID from the context
-	userID, exists := c.Get("userID")
-	if !exists {
+	userID := c.GetInt("userID")
+	if userID == 0 {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	// Query devices associated with the user
-	var devices []Device
-	sqlStatement := `SELECT id, user_id, name, mac_addr FROM devices WHERE user_id = $1`
-	rows, err := db.Query(sqlStatement, userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+	// ?site= or ?group= narrows the list to that site or group
+	target, ok := bindTargetQuery(c)
+	if !ok {
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var device Device
-		var macAddr sql.NullString // Handles NULL values
-
-		if err := rows.Scan(&device.ID, &device.UserID, &device.Name, &macAddr); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse device data"})
-			return
-		}
-
-		// Convert NullString to standard string (empty string if NULL)
-		device.MACAddr = macAddr.String
-
-		devices = append(devices, device)
+	if !target.empty() {
+		s.fetchTargetDevices(c, target)
+		return
 	}
 
-	c.JSON(http.StatusOK, devices)
-}
-
-func fetchBreakers(c *gin.Context) {
-	// Retrieve the user ID from the context
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	// Query devices the user owns, then those shared with them
+	devices, err := s.store.ListDevicesByUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
 		return
 	}
-
-	// Retrieve the device ID from the URL parameter
-	deviceID := c.Param("id")
-	if deviceID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Device ID is required"})
+	owned := len(devices)
+	shared, err := s.store.ListSharedDevices(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
 		return
 	}
+	for _, d := range shared {
+		devices = append(devices, d.Device)
+	}
 
-	// Verify the device belongs to the authenticated user
-	var device Device
-	sqlStatement := `SELECT id, user_id FROM devices WHERE id = $1 AND user_id = $2`
-	err := db.QueryRow(sqlStatement, deviceID, userID).Scan(&device.ID, &device.UserID)
+	statuses, err := s.devicePresence(devices)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found or does not belong to the user"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+		return
+	}
+	for i := range statuses {
+		if i < owned {
+			statuses[i].Role = RoleOwner
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify device"})
+			statuses[i].Role = shared[i-owned].Role
 		}
+	}
+
+	c.JSON(http.StatusOK, statuses)
+}
+
+func (s *Server) fetchBreakers(c *gin.Context) {
+	// Retrieve the device ID from the URL parameter; RequireDeviceOwner has
+	// already verified the device belongs to the authenticated user
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
 		return
 	}
 
 	// Query breakers associated with the device ID
-	var breakers []Breaker
-	sqlStatement = `SELECT id, device_id, name, breaker_number, status FROM breakers WHERE device_id = $1`
-	rows, err := db.Query(sqlStatement, deviceID)
+	breakers, err := s.store.ListBreakersByDevice(deviceID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch breakers"})
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var breaker Breaker
-
-		if err := rows.Scan(&breaker.ID, &breaker.DeviceID, &breaker.Name, &breaker.Breaker_Number, &breaker.Status); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse breaker data"})
-			return
-		}
-
-		breakers = append(breakers, breaker)
-	}
 
 	// Return the list of breakers as a JSON response
 	c.JSON(http.StatusOK, breakers)
 }
 
-func fetchFrequencyData(c *gin.Context) {
-	deviceID := c.Param("id")
-	startTime := c.Query("start") // Optional start time
-	endTime := c.Query("end")     // Optional end time
+// Router wires every HTTP route to its handler
+func (s *Server) Router() *gin.Engine {
+	router := gin.Default()
+	// gin believes X-Forwarded-For from anyone unless told otherwise, which
+	// would let callers choose the client IP the audit log records
+	if err := router.SetTrustedProxies(s.cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	router.Use(s.AuditLog())
+
+	// WebSocket endpoint
+	router.GET("/ws", func(c *gin.Context) {
+		s.handleWebSocket(c.Writer, c.Request)
+	})
 
-	query := `SELECT frequency, timestamp FROM frequency_logs WHERE device_id = $1`
-	args := []interface{}{deviceID}
+	// Public routes
+	router.POST("/createUser", s.createUser) // C USER
+	router.POST("/login", s.login)
+	// Devices fetch firmware with the signed link sent in otaUpdate
+	router.GET("/downloadFirmware/:id", s.downloadFirmware)
+
+	// Everything else requires a valid JWT and access to the target resource
+	auth := router.Group("/", AuthMiddleware())
+	viewDevice := s.RequireDeviceRole("id", RoleViewer)
+	operateDevice := s.RequireDeviceRole("id", RoleOperator)
+	ownDevice := s.RequireDeviceRole("id", RoleOwner)
+	viewBreaker := s.RequireBreakerRole("id", RoleViewer)
+	ownBreaker := s.RequireBreakerRole("id", RoleOwner)
+
+	auth.GET("/searchUser", s.readUser)                             // R USER
+	auth.PUT("/updateUser/:id", RequireSelf("id"), s.updateUser)    // U USER
+	auth.DELETE("/deleteUser/:id", RequireSelf("id"), s.deleteUser) // D USER
+
+	auth.POST("/createDevice", s.createDevice)                  // C DEVICE
+	auth.GET("/readDevice/:id", viewDevice, s.readDevice)       // R DEVICE
+	auth.PUT("/updateDevice/:id", ownDevice, s.updateDevice)    // U DEVICE
+	auth.DELETE("/deleteDevice/:id", ownDevice, s.deleteDevice) // D DEVICE
+
+	auth.POST("/createBreaker", s.createBreaker)                   // C BREAKER
+	auth.GET("/readBreaker/:id", viewBreaker, s.readBreaker)       // R BREAKER
+	auth.PUT("/updateBreaker/:id", ownBreaker, s.updateBreaker)    // U BREAKER
+	auth.DELETE("/deleteBreaker/:id", ownBreaker, s.deleteBreaker) // D BREAKER
+
+	auth.GET("/fetchDevices", s.fetchDevices)
+	auth.GET("/streamEvents", s.streamEvents)
+	auth.GET("/fetchBreakers/:id", viewDevice, s.fetchBreakers)
+	auth.GET("/fetchBreakerSchedules/:id", viewBreaker, s.fetchBreakerSchedules)
+	auth.GET("/fetchUpcomingRuns/:id", viewBreaker, s.fetchUpcomingRuns)
+	auth.GET("/fetchBreakerTimeline/:id", viewBreaker, s.fetchBreakerTimeline)
+	auth.GET("/fetchFrequencyData/:id", viewDevice, s.fetchFrequencyData)
+	auth.GET("/fetchDeviceSessions/:id", viewDevice, s.fetchDeviceSessions)
+	auth.GET("/readDeviceConfig/:id", viewDevice, s.readDeviceConfig)
+	auth.PUT("/updateDeviceConfig/:id", operateDevice, s.updateDeviceConfig)
+	auth.GET("/fetchExcursions/:id", viewDevice, s.fetchExcursions)
+
+	auth.GET("/fetchLoadShedding/:id", viewDevice, s.fetchLoadShedding)
+	auth.POST("/suspendLoadShedding/:id", operateDevice, s.suspendLoadShedding)
+	auth.POST("/resumeLoadShedding/:id", operateDevice, s.resumeLoadShedding)
+	auth.GET("/fetchLoadShedEvents/:id", viewDevice, s.fetchLoadShedEvents)
+
+	auth.POST("/sendPacket/:id", operateDevice, s.sendPacket)
+	auth.GET("/fetchCommands/:id", viewDevice, s.fetchCommands)
+	auth.POST("/cancelCommand/:id", s.cancelCommand)
+
+	auth.POST("/createBreakerSchedule", s.createBreakerSchedule)
+	auth.GET("/readBreakerSchedule/:id", s.readBreakerSchedule)
+	auth.PUT("/updateBreakerSchedule/:id", s.updateBreakerSchedule)
+	auth.DELETE("/deleteBreakerSchedule/:id", s.deleteBreakerSchedule)
+	auth.POST("/skipBreakerSchedule/:id", s.skipBreakerSchedule)
+	auth.GET("/fetchScheduleRuns/:id", s.fetchScheduleRuns)
+
+	auth.POST("/createAlertRule", s.createAlertRule)
+	auth.GET("/fetchAlertRules", s.fetchAlertRules)
+	auth.GET("/readAlertRule/:id", s.readAlertRule)
+	auth.PUT("/updateAlertRule/:id", s.updateAlertRule)
+	auth.DELETE("/deleteAlertRule/:id", s.deleteAlertRule)
+	auth.GET("/fetchAlerts", s.fetchAlerts)
+	auth.POST("/acknowledgeAlert/:id", s.acknowledgeAlert)
+	auth.POST("/resolveAlert/:id", s.resolveAlert)
+	auth.DELETE("/deleteAlert/:id", s.deleteAlert)
+
+	auth.POST("/createWebhook", s.createWebhook)
+	auth.GET("/fetchWebhooks", s.fetchWebhooks)
+	auth.GET("/readWebhook/:id", s.readWebhook)
+	auth.PUT("/updateWebhook/:id", s.updateWebhook)
+	auth.DELETE("/deleteWebhook/:id", s.deleteWebhook)
+	auth.POST("/testWebhook/:id", s.testWebhook)
+	auth.GET("/fetchWebhookDeliveries/:id", s.fetchWebhookDeliveries)
+	auth.POST("/redeliverWebhookDelivery/:id", s.redeliverWebhookDelivery)
+
+	auth.POST("/createClaimCode/:id", ownDevice, s.createClaimCode)
+	auth.GET("/fetchDeviceCredentials/:id", ownDevice, s.fetchDeviceCredentials)
+	auth.POST("/rotateDeviceCredential/:id", ownDevice, s.rotateDeviceCredential)
+	auth.POST("/revokeDeviceCredential/:id", ownDevice, s.revokeDeviceCredential)
+
+	auth.GET("/fetchDeviceMembers/:id", viewDevice, s.fetchDeviceMembers)
+	auth.PUT("/updateDeviceMember/:id", ownDevice, s.updateDeviceMember)
+	auth.POST("/removeDeviceMember/:id", ownDevice, s.removeDeviceMember)
+	auth.POST("/leaveDevice/:id", viewDevice, s.leaveDevice)
+	auth.POST("/inviteDeviceMember/:id", ownDevice, s.inviteDeviceMember)
+	auth.GET("/fetchDeviceInvitations/:id", ownDevice, s.fetchDeviceInvitations)
+	auth.POST("/revokeDeviceInvitation/:id", s.revokeDeviceInvitation)
+	auth.GET("/fetchInvitations", s.fetchInvitations)
+	auth.POST("/acceptInvitation/:id", s.acceptInvitation)
+	auth.POST("/declineInvitation/:id", s.declineInvitation)
+
+	auth.POST("/createSite", s.createSite)
+	auth.GET("/fetchSites", s.fetchSites)
+	auth.GET("/readSite/:id", s.readSite)
+	auth.PUT("/updateSite/:id", s.updateSite)
+	auth.DELETE("/deleteSite/:id", s.deleteSite)
+	auth.PUT("/assignDeviceSite/:id", ownDevice, s.assignDeviceSite)
+
+	auth.POST("/createDeviceGroup", s.createDeviceGroup)
+	auth.GET("/fetchDeviceGroups", s.fetchDeviceGroups)
+	auth.GET("/readDeviceGroup/:id", s.readDeviceGroup)
+	auth.PUT("/updateDeviceGroup/:id", s.updateDeviceGroup)
+	auth.DELETE("/deleteDeviceGroup/:id", s.deleteDeviceGroup)
+	auth.POST("/addGroupDevice/:id", s.addGroupDevice)
+	auth.POST("/removeGroupDevice/:id", s.removeGroupDevice)
+
+	// ?site= or ?group= (site_id or group_id in bodies) target many devices at once
+	auth.GET("/fetchFrequencySummary", s.fetchFrequencySummary)
+	auth.POST("/createCommandJob", s.createCommandJob)
+	auth.POST("/sendTargetPacket", s.sendTargetPacket)
+	auth.GET("/fetchCommandJobs", s.fetchCommandJobs)
+	auth.GET("/readCommandJob/:id", s.readCommandJob)
+
+	auth.POST("/uploadFirmware", s.RequireAdmin(), s.uploadFirmware)
+	auth.GET("/fetchFirmware", s.fetchFirmware)
+	auth.POST("/createFirmwareRollout", s.createFirmwareRollout)
+	auth.GET("/fetchFirmwareRollouts", s.fetchFirmwareRollouts)
+	auth.GET("/readFirmwareRollout/:id", s.readFirmwareRollout)
+	auth.POST("/advanceFirmwareRollout/:id", s.advanceFirmwareRollout)
+	auth.POST("/haltFirmwareRollout/:id", s.haltFirmwareRollout)
+
+	auth.GET("/fetchAuditLog", s.RequireAdmin(), s.fetchAuditLog)
+
+	return router
+}
 
-	if startTime != "" {
-		query += " AND timestamp >= $2"
-		args = append(args, startTime)
-	}
-	if endTime != "" {
-		query += " AND timestamp <= $3"
-		args = append(args, endTime)
+// openStore picks the storage backend from STORE_DRIVER (postgres or memory)
+func openStore() (Store, func(), error) {
+	if os.Getenv("STORE_DRIVER") == "memory" {
+		log.Println("Using in-memory store; data will not survive a restart")
+		return NewMemoryStore(), func() {}, nil
 	}
 
-	rows, err := db.Query(query, args...)
+	db, err := connectDB()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch data"})
-		return
+		return nil, nil, err
 	}
-	defer rows.Close()
 
-	var logs []struct {
-		Frequency float64 `json:"frequency"`
-		Timestamp string  `json:"timestamp"`
+	// Refuse to serve against a schema older than this binary expects
+	migrator, err := NewMigrator(db)
+	if err == nil {
+		err = migrator.CheckCurrent(context.Background())
 	}
-
-	for rows.Next() {
-		var log struct {
-			Frequency float64
-			Timestamp time.Time
-		}
-		if err := rows.Scan(&log.Frequency, &log.Timestamp); err != nil {
-			continue
-		}
-		logs = append(logs, struct {
-			Frequency float64 `json:"frequency"`
-			Timestamp string  `json:"timestamp"`
-		}{log.Frequency, log.Timestamp.Format(time.RFC3339)})
+	if err != nil {
+		db.Close()
+		return nil, nil, err
 	}
-
-	c.JSON(http.StatusOK, logs)
+	return NewPostgresStore(db), func() { db.Close() }, nil
 }
 
-func connectDB() (*sql.DB, error) {
-	connStr := fmt.Sprintf(
-		"user=%s password=%s dbname=%s sslmode=%s",
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"),
-		os.Getenv("DB_SSLMODE"),
-	)
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, err
+func main() {
+	// Load environment variables from .env file
+	if err := godotenv.Load(".env"); err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	// Verify connection
-	if err := db.Ping(); err != nil {
-		return nil, err
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdminCommand(os.Args[2:]); err != nil {
+			log.Fatal("Admin command failed: ", err)
+		}
+		return
 	}
 
-	fmt.Println("Connected to PostgreSQL database!")
-	return db, nil
-}
+	// Set JWT secret
+	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
 
-func main() {
-	var err error
-	db, err = connectDB()
+	store, closeStore, err := openStore()
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		log.Fatal("Failed to open store: ", err)
 	}
-	defer db.Close()
-
-	router := gin.Default()
-
-	// WebSocket endpoint
-	router.GET("/ws", func(c *gin.Context) {
-		handleWebSocket(c.Writer, c.Request)
-	})
-
-	router.POST("/createUser", createUser)       // C USER
-	router.GET("/searchUser", readUser)          // R USER
-	router.PUT("/updateUser/:id", updateUser)    // U USER
-	router.DELETE("/deleteUser/:id", deleteUser) // D USER
-
-	router.POST("/createDevice", createDevice)       // C DEVICE
-	router.GET("/readDevice/:id", readDevice)        // R DEVICE
-	router.PUT("/updateDevice/:id", updateDevice)    // U DEVICE
-	router.DELETE("/deleteDevice/:id", deleteDevice) // D DEVICE
-
-	router.POST("/createBreaker", createBreaker)       // C BREAKER
-	router.GET("/readBreaker/:id", readBreaker)        // R DEVICE
-	router.PUT("/updateBreaker/:id", updateBreaker)    // U BREAKER
-	router.DELETE("/deleteBreaker/:id", deleteBreaker) // D BREAKER
-
-	// Other routes...
-	router.POST("/login", login)
-
-	// Protected route to fetch devices, requires valid JWT
-	router.GET("/fetchDevices", AuthMiddleware(), fetchDevices)
-	router.GET("/fetchBreakers/:id", AuthMiddleware(), fetchBreakers)
-	router.GET("/fetchFrequencyData/:id", AuthMiddleware(), fetchFrequencyData)
+	defer closeStore()
 
-	// In your main function, add the endpoint
-	router.POST("/sendPacket/:id", sendPacket)
+	server := NewServer(store, LoadConfig())
+	server.Start(context.Background())
+	router := server.Router()
 
 	log.Println("Server is running on :8080")
 	if err := router.Run(":8080"); err != nil {
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sites and groups belong to the user who made them. A device sits at one of
+// its owner's sites at most, while groups can collect any device the caller
+// can see, including shared ones.
+
+type siteInput struct {
+	Name     string `json:"name" binding:"required"`
+	Address  string `json:"address"`
+	Timezone string `json:"timezone"`
+}
+
+// bindSite validates the request body into site; the timezone defaults to UTC
+func bindSite(c *gin.Context, site *Site) bool {
+	var input siteInput
+	if err := c.ShouldBindJSON(&input); err != nil || strings.TrimSpace(input.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return false
+	}
+	if input.Timezone == "" {
+		input.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(input.Timezone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return false
+	}
+
+	site.Name = strings.TrimSpace(input.Name)
+	site.Address = input.Address
+	site.Timezone = input.Timezone
+	return true
+}
+
+// loadSite resolves :id to one of the caller's sites
+func (s *Server) loadSite(c *gin.Context) (Site, bool) {
+	id, ok := paramID(c, "id", "site")
+	if !ok {
+		return Site{}, false
+	}
+	auditTarget(c, "site", int64(id))
+	return s.ownSite(c, id)
+}
+
+// ownSite fetches a site and checks it is the caller's
+func (s *Server) ownSite(c *gin.Context, id int) (Site, bool) {
+	site, err := s.store.GetSite(id)
+	if err := checkOwner(c, site.UserID, err); err != nil {
+		abortAuthz(c, err, "Site")
+		return Site{}, false
+	}
+	return site, true
+}
+
+func (s *Server) createSite(c *gin.Context) {
+	site := Site{UserID: currentUserID(c)}
+	if !bindSite(c, &site) {
+		return
+	}
+
+	if err := s.store.CreateSite(&site); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create site"})
+		return
+	}
+	auditTarget(c, "site", int64(site.ID))
+	auditChange(c, nil, site)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Site created successfully", "siteID": site.ID})
+}
+
+func (s *Server) fetchSites(c *gin.Context) {
+	sites, err := s.store.ListSitesByUser(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sites"})
+		return
+	}
+	if sites == nil {
+		sites = []Site{}
+	}
+
+	c.JSON(http.StatusOK, sites)
+}
+
+func (s *Server) readSite(c *gin.Context) {
+	site, ok := s.loadSite(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, site)
+}
+
+func (s *Server) updateSite(c *gin.Context) {
+	site, ok := s.loadSite(c)
+	if !ok {
+		return
+	}
+	before := site
+	if !bindSite(c, &site) {
+		return
+	}
+
+	if err := s.store.UpdateSite(site); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update site"})
+		return
+	}
+	auditChange(c, before, site)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Site updated successfully"})
+}
+
+// deleteSite removes a site; its devices stay but no longer belong to a site
+func (s *Server) deleteSite(c *gin.Context) {
+	site, ok := s.loadSite(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteSite(site.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete site"})
+		return
+	}
+	auditChange(c, site, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Site deleted successfully"})
+}
+
+// assignDeviceSite moves a device to one of the caller's sites, or out of
+// its site when site_id is null
+func (s *Server) assignDeviceSite(c *gin.Context) {
+	deviceID, ok := paramID(c, "id", "device")
+	if !ok {
+		return
+	}
+
+	var input struct {
+		SiteID *int `json:"site_id"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if input.SiteID != nil {
+		if _, ok := s.ownSite(c, *input.SiteID); !ok {
+			return
+		}
+	}
+
+	device, err := s.store.GetDevice(deviceID)
+	if err == nil {
+		err = s.store.SetDeviceSite(deviceID, input.SiteID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not assign device"})
+		return
+	}
+	auditChange(c, gin.H{"site_id": device.SiteID}, gin.H{"site_id": input.SiteID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device assigned successfully"})
+}
+
+// loadDeviceGroup resolves :id to one of the caller's groups
+func (s *Server) loadDeviceGroup(c *gin.Context) (DeviceGroup, bool) {
+	id, ok := paramID(c, "id", "group")
+	if !ok {
+		return DeviceGroup{}, false
+	}
+	auditTarget(c, "group", int64(id))
+	return s.ownDeviceGroup(c, id)
+}
+
+// ownDeviceGroup fetches a group and checks it is the caller's
+func (s *Server) ownDeviceGroup(c *gin.Context, id int) (DeviceGroup, bool) {
+	group, err := s.store.GetDeviceGroup(id)
+	if err := checkOwner(c, group.UserID, err); err != nil {
+		abortAuthz(c, err, "Group")
+		return DeviceGroup{}, false
+	}
+	return group, true
+}
+
+// bindGroupName reads the group's name from the request body
+func bindGroupName(c *gin.Context) (string, bool) {
+	var input struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || strings.TrimSpace(input.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return "", false
+	}
+	return strings.TrimSpace(input.Name), true
+}
+
+func (s *Server) createDeviceGroup(c *gin.Context) {
+	name, ok := bindGroupName(c)
+	if !ok {
+		return
+	}
+
+	group := DeviceGroup{UserID: currentUserID(c), Name: name}
+	if err := s.store.CreateDeviceGroup(&group); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create group"})
+		return
+	}
+	auditTarget(c, "group", int64(group.ID))
+	auditChange(c, nil, group)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group created successfully", "groupID": group.ID})
+}
+
+func (s *Server) fetchDeviceGroups(c *gin.Context) {
+	groups, err := s.store.ListDeviceGroupsByUser(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
+		return
+	}
+	if groups == nil {
+		groups = []DeviceGroup{}
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+// readDeviceGroup returns a group with the IDs of the devices in it
+func (s *Server) readDeviceGroup(c *gin.Context) {
+	group, ok := s.loadDeviceGroup(c)
+	if !ok {
+		return
+	}
+
+	devices, err := s.store.ListGroupDevices(group.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve group"})
+		return
+	}
+	deviceIDs := make([]int, 0, len(devices))
+	for _, device := range devices {
+		deviceIDs = append(deviceIDs, device.ID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": group.ID, "user_id": group.UserID, "name": group.Name, "created_at": group.CreatedAt, "device_ids": deviceIDs})
+}
+
+func (s *Server) updateDeviceGroup(c *gin.Context) {
+	group, ok := s.loadDeviceGroup(c)
+	if !ok {
+		return
+	}
+	name, ok := bindGroupName(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.RenameDeviceGroup(group.ID, name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update group"})
+		return
+	}
+	before := group
+	group.Name = name
+	auditChange(c, before, group)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group updated successfully"})
+}
+
+func (s *Server) deleteDeviceGroup(c *gin.Context) {
+	group, ok := s.loadDeviceGroup(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteDeviceGroup(group.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete group"})
+		return
+	}
+	auditChange(c, group, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group deleted successfully"})
+}
+
+// bindGroupDevice loads the caller's group and reads the device named in the body
+func (s *Server) bindGroupDevice(c *gin.Context) (DeviceGroup, int, bool) {
+	group, ok := s.loadDeviceGroup(c)
+	if !ok {
+		return DeviceGroup{}, 0, false
+	}
+	var input struct {
+		DeviceID int `json:"device_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return DeviceGroup{}, 0, false
+	}
+	return group, input.DeviceID, true
+}
+
+// addGroupDevice adds a device the caller can see to their group
+func (s *Server) addGroupDevice(c *gin.Context) {
+	group, deviceID, ok := s.bindGroupDevice(c)
+	if !ok || !s.authorizeDevice(c, deviceID, RoleViewer) {
+		return
+	}
+
+	if err := s.store.AddGroupDevice(group.ID, deviceID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add device to group"})
+		return
+	}
+	auditChange(c, nil, gin.H{"device_id": deviceID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device added to group"})
+}
+
+// removeGroupDevice takes a device out of the caller's group, even one they
+// can no longer see
+func (s *Server) removeGroupDevice(c *gin.Context) {
+	group, deviceID, ok := s.bindGroupDevice(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.RemoveGroupDevice(group.ID, deviceID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device is not in this group"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not remove device from group"})
+		return
+	}
+	auditChange(c, gin.H{"device_id": deviceID}, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device removed from group"})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// siteFixture is bob's device at his site and in his group, shared with carol
+// as a viewer, and alice's device, which carol cannot reach
+type siteFixture struct {
+	router *gin.Engine
+	store  Store
+	bob    User
+	device Device
+	other  Device
+	site   Site
+	group  DeviceGroup
+	carol  User
+}
+
+func newSiteFixture(t *testing.T) *siteFixture {
+	t.Helper()
+	store := NewMemoryStore()
+	f := &siteFixture{store: store, router: NewServer(store, DefaultConfig()).Router()}
+	f.bob, f.device = seedDevice(t, store, "bob")
+	_, f.other = seedDevice(t, store, "alice")
+	f.site = Site{UserID: f.bob.ID, Name: "bob home", Timezone: "America/Chicago"}
+	if err := store.CreateSite(&f.site); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetDeviceSite(f.device.ID, &f.site.ID); err != nil {
+		t.Fatal(err)
+	}
+	f.group = DeviceGroup{UserID: f.bob.ID, Name: "panels"}
+	if err := store.CreateDeviceGroup(&f.group); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddGroupDevice(f.group.ID, f.device.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	f.carol = User{Name: "carol", Login: "carol", Email: "carol@example.com", Pass: "hash"}
+	if err := store.CreateUser(&f.carol); err != nil {
+		t.Fatal(err)
+	}
+	inv := DeviceInvitation{DeviceID: f.device.ID, Email: f.carol.Email, Role: RoleViewer, InvitedBy: &f.bob.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.CreateDeviceInvitation(&inv); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AcceptDeviceInvitation(inv.ID, f.carol.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFrequencySummaryByGroup(t *testing.T) {
+	f := newSiteFixture(t)
+	now := time.Now().Add(-time.Minute)
+	for i, hz := range []float64{59.9, 60.1} {
+		if err := f.store.InsertFrequency(FrequencyLog{DeviceID: f.device.ID, Frequency: hz, Timestamp: now.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := serve(t, f.router, f.bob.ID, "GET", fmt.Sprintf("/fetchFrequencySummary?group=%d", f.group.ID), "")
+	var summary struct {
+		Devices []frequencySummary `json:"devices"`
+		Overall frequencySummary   `json:"overall"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil || len(summary.Devices) != 1 {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if o := summary.Overall; o.Count != 2 || *o.Min != 59.9 || *o.Max != 60.1 || *o.Avg < 59.999 || *o.Avg > 60.001 {
+		t.Fatalf("unexpected summary: %s", w.Body)
+	}
+}
+
+func TestViewerGroupsSharedDevice(t *testing.T) {
+	f := newSiteFixture(t)
+
+	// A viewer can group a shared device but cannot command it through the group
+	w := serve(t, f.router, f.carol.ID, "POST", "/createDeviceGroup", `{"name":"watched"}`)
+	var created struct {
+		GroupID int `json:"groupID"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	add := fmt.Sprintf("/addGroupDevice/%d", created.GroupID)
+	if w := serve(t, f.router, f.carol.ID, "POST", add, fmt.Sprintf(`{"device_id":%d}`, f.other.ID)); w.Code != http.StatusForbidden {
+		t.Fatalf("grouped a device they cannot see: got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.carol.ID, "POST", add, fmt.Sprintf(`{"device_id":%d}`, f.device.ID)); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var devices []DeviceStatus
+	w = serve(t, f.router, f.carol.ID, "GET", fmt.Sprintf("/fetchDevices?group=%d", created.GroupID), "")
+	if err := json.Unmarshal(w.Body.Bytes(), &devices); err != nil || len(devices) != 1 || devices[0].Role != RoleViewer {
+		t.Fatalf("unexpected group listing: %s", w.Body)
+	}
+	w = serve(t, f.router, f.carol.ID, "POST", "/createCommandJob", fmt.Sprintf(`{"group_id":%d,"command":"pingDevice"}`, created.GroupID))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("viewer commanded a shared device: got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, f.carol.ID, "GET", fmt.Sprintf("/fetchDevices?site=%d", f.site.ID), ""); w.Code != http.StatusForbidden {
+		t.Fatalf("listed someone else's site: got %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,987 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when the requested row does not exist
+var ErrNotFound = errors.New("not found")
+
+// Claim redemption failures; handlers treat all of them as a rejected device
+var (
+	ErrClaimExpired  = errors.New("claim code expired")
+	ErrClaimUsed     = errors.New("claim code already used")
+	ErrClaimConflict = errors.New("MAC address is bound to another device")
+)
+
+// ErrCommandNotPending is returned when cancelling a command already sent
+var ErrCommandNotPending = errors.New("command is no longer pending")
+
+// ErrFirmwareExists is returned when a model already has firmware of that version
+var ErrFirmwareExists = errors.New("firmware version already exists")
+
+// FrequencyLog is a single frequency reading reported by a device
+type FrequencyLog struct {
+	DeviceID  int       `json:"-"`
+	Frequency float64   `json:"frequency"`
+	Timestamp time.Time `json:"timestamp"`
+	// Rocof is df/dt in Hz/s over the configured window, nil until known
+	Rocof *float64 `json:"rocof,omitempty"`
+}
+
+// FrequencyRange limits a frequency query; zero times are unbounded
+type FrequencyRange struct {
+	Start time.Time
+	End   time.Time
+	// Limit caps the rows returned; 0 is unlimited
+	Limit int
+}
+
+// contains reports whether t falls inside the range, bounds included
+func (r FrequencyRange) contains(t time.Time) bool {
+	return (r.Start.IsZero() || !t.Before(r.Start)) && (r.End.IsZero() || !t.After(r.End))
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// FrequencyBucket summarises the readings in one aggregation interval
+type FrequencyBucket struct {
+	Start  time.Time `json:"start"`
+	Count  int64     `json:"count"`
+	Min    float64   `json:"min"`
+	Max    float64   `json:"max"`
+	Avg    float64   `json:"avg"`
+	Stddev float64   `json:"stddev"`
+	// ROCOF summary over the readings that had one
+	RocofMin *float64 `json:"rocof_min,omitempty"`
+	RocofMax *float64 `json:"rocof_max,omitempty"`
+	RocofAvg *float64 `json:"rocof_avg,omitempty"`
+}
+
+// FrequencyRollup is one pre-aggregated bucket. Sums rather than averages are
+// kept so rollups can be merged into coarser buckets.
+type FrequencyRollup struct {
+	DeviceID int
+	Bucket   time.Time
+	Count    int64
+	Min      float64
+	Max      float64
+	Sum      float64
+	SumSq    float64
+
+	RocofCount int64
+	RocofMin   float64
+	RocofMax   float64
+	RocofSum   float64
+}
+
+// rollupReading turns a single reading into a one-sample rollup
+func rollupReading(entry FrequencyLog) FrequencyRollup {
+	f := entry.Frequency
+	r := FrequencyRollup{DeviceID: entry.DeviceID, Bucket: entry.Timestamp, Count: 1, Min: f, Max: f, Sum: f, SumSq: f * f}
+	if entry.Rocof != nil {
+		rocof := *entry.Rocof
+		r.RocofCount, r.RocofMin, r.RocofMax, r.RocofSum = 1, rocof, rocof, rocof
+	}
+	return r
+}
+
+// merge folds o into r
+func (r *FrequencyRollup) merge(o FrequencyRollup) {
+	if r.Count == 0 {
+		r.Min, r.Max = o.Min, o.Max
+	}
+	r.Count += o.Count
+	r.Min = math.Min(r.Min, o.Min)
+	r.Max = math.Max(r.Max, o.Max)
+	r.Sum += o.Sum
+	r.SumSq += o.SumSq
+
+	if o.RocofCount == 0 {
+		return
+	}
+	if r.RocofCount == 0 {
+		r.RocofMin, r.RocofMax = o.RocofMin, o.RocofMax
+	}
+	r.RocofCount += o.RocofCount
+	r.RocofMin = math.Min(r.RocofMin, o.RocofMin)
+	r.RocofMax = math.Max(r.RocofMax, o.RocofMax)
+	r.RocofSum += o.RocofSum
+}
+
+// bucket reports r as a FrequencyBucket with population stddev
+func (r FrequencyRollup) bucket() FrequencyBucket {
+	n := float64(r.Count)
+	avg := r.Sum / n
+	b := FrequencyBucket{
+		Start:  r.Bucket,
+		Count:  r.Count,
+		Min:    r.Min,
+		Max:    r.Max,
+		Avg:    avg,
+		Stddev: math.Sqrt(math.Max(0, r.SumSq/n-avg*avg)),
+	}
+	if r.RocofCount > 0 {
+		rocofAvg := r.RocofSum / float64(r.RocofCount)
+		b.RocofMin, b.RocofMax, b.RocofAvg = &r.RocofMin, &r.RocofMax, &rocofAvg
+	}
+	return b
+}
+
+// rollupResolutions are the rollup tables, finest first. Each is built from
+// the one before it, raw readings feeding the first.
+var rollupResolutions = []time.Duration{time.Minute, time.Hour}
+
+// rollupTiers lists the rollup resolutions that may feed buckets of the given
+// width, coarsest first. Rollups are aligned to UTC, so hour rollups only line
+// up with local hours and days in zones on a whole-hour offset.
+func rollupTiers(bucket time.Duration, loc *time.Location) []time.Duration {
+	var tiers []time.Duration
+	if _, offset := time.Now().In(loc).Zone(); bucket >= time.Hour && offset%3600 == 0 {
+		tiers = append(tiers, time.Hour)
+	}
+	return append(tiers, time.Minute)
+}
+
+// FrequencyExcursion is a stretch of time a device spent outside the
+// frequency band. EndedAt is nil while it is ongoing.
+type FrequencyExcursion struct {
+	ID       int64 `json:"id"`
+	DeviceID int   `json:"device_id"`
+	// Trigger is "frequency" for the band or "rocof" for the ROCOF threshold
+	Trigger   string     `json:"trigger"`
+	Direction string     `json:"direction"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at"`
+	// PeakFrequency is the reading furthest from nominal; PeakDeviation is
+	// its signed distance from nominal in Hz
+	PeakFrequency float64 `json:"peak_frequency"`
+	PeakDeviation float64 `json:"peak_deviation"`
+	// MaxRate is the steepest change between consecutive readings in Hz/s
+	MaxRate float64 `json:"max_rate"`
+	// PeakRocof is the windowed ROCOF with the largest magnitude, if any
+	PeakRocof *float64 `json:"peak_rocof"`
+}
+
+// Alert rule kinds
+const (
+	RuleFrequencyBelow = "frequency_below"
+	RuleFrequencyAbove = "frequency_above"
+	RuleDeviceOffline  = "device_offline"
+	RuleBreakerChanged = "breaker_changed"
+)
+
+// AlertRule is a user's condition on one of their devices, or on all of them
+// when DeviceID is nil. Threshold applies to frequency rules; DurationSeconds
+// is how long a frequency or offline condition must hold before alerting.
+type AlertRule struct {
+	ID              int       `json:"id"`
+	UserID          int       `json:"user_id"`
+	DeviceID        *int      `json:"device_id"`
+	BreakerID       *int      `json:"breaker_id"`
+	Name            string    `json:"name"`
+	Kind            string    `json:"kind"`
+	Threshold       *float64  `json:"threshold"`
+	DurationSeconds int       `json:"duration_seconds"`
+	Enabled         bool      `json:"enabled"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Duration is how long the rule's condition must hold
+func (r AlertRule) Duration() time.Duration {
+	return time.Duration(r.DurationSeconds) * time.Second
+}
+
+// Alert lifecycle states
+const (
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// Alert is raised by a rule for one device
+type Alert struct {
+	ID             int64      `json:"id"`
+	RuleID         int        `json:"rule_id"`
+	UserID         int        `json:"user_id"`
+	DeviceID       int        `json:"device_id"`
+	Status         string     `json:"status"`
+	Message        string     `json:"message"`
+	Value          *float64   `json:"value"`
+	OpenedAt       time.Time  `json:"opened_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+}
+
+// AlertFilter narrows ListAlerts; zero fields match everything
+type AlertFilter struct {
+	Status   string
+	DeviceID int
+	Limit    int
+}
+
+// Webhook posts a user's events to an external URL. EventTypes narrows which
+// events are sent; empty means every type but frequency.
+type Webhook struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"-"`
+	EventTypes []string  `json:"event_types"`
+	Enabled    bool      `json:"enabled"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event queued for a webhook, together with the
+// outcome of its latest attempt
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at,omitempty"`
+	ResponseStatus *int            `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// BreakerSchedule turns a breaker on or off automatically, either repeatedly
+// on Cron or once at RunAt. Cron is read in Timezone.
+type BreakerSchedule struct {
+	ID        int        `json:"id"`
+	BreakerID int        `json:"breaker_id"`
+	Name      string     `json:"name"`
+	State     bool       `json:"state"`
+	Cron      *string    `json:"cron"`
+	RunAt     *time.Time `json:"run_at"`
+	Timezone  string     `json:"timezone"`
+	Enabled   bool       `json:"enabled"`
+	NextRunAt *time.Time `json:"next_run_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Schedule run outcomes beyond the command statuses a dispatched run records
+const (
+	RunSkipped = "skipped"
+	RunMissed  = "missed"
+	RunError   = "error"
+)
+
+// ScheduleRun records what happened at one of a schedule's run times
+type ScheduleRun struct {
+	ID           int64     `json:"id"`
+	ScheduleID   int       `json:"schedule_id"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+	Status       string    `json:"status"`
+	CommandID    *int64    `json:"command_id,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	RanAt        time.Time `json:"ran_at"`
+}
+
+// Load shedding log actions
+const (
+	ShedActionShed    = "shed"
+	ShedActionRestore = "restore"
+	// ShedActionRelease hands a shed breaker back to manual control
+	ShedActionRelease = "release"
+	ShedActionSuspend = "suspend"
+	ShedActionResume  = "resume"
+)
+
+// LoadShedEvent logs one shedding action; UserID is nil for automated ones
+type LoadShedEvent struct {
+	ID        int64     `json:"id"`
+	DeviceID  int       `json:"device_id"`
+	BreakerID *int      `json:"breaker_id,omitempty"`
+	Action    string    `json:"action"`
+	Tier      *int      `json:"tier,omitempty"`
+	Frequency *float64  `json:"frequency,omitempty"`
+	CommandID *int64    `json:"command_id,omitempty"`
+	UserID    *int      `json:"user_id,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Breaker event kinds
+const (
+	BreakerRequested = "requested"
+	BreakerConfirmed = "confirmed"
+	BreakerFailed    = "failed"
+)
+
+// Who asked for a breaker change
+const (
+	SourceUser       = "user"
+	SourceSchedule   = "schedule"
+	SourceAutomation = "automation"
+	// SourceDevice marks state the device reported without being asked
+	SourceDevice = "device"
+)
+
+// Requester says who asked for a command; UserID and ScheduleID are set
+// for their respective sources
+type Requester struct {
+	Source     string `json:"source"`
+	UserID     *int   `json:"user_id,omitempty"`
+	ScheduleID *int   `json:"schedule_id,omitempty"`
+}
+
+// BreakerEvent is one entry in a breaker's append-only timeline
+type BreakerEvent struct {
+	ID        int64  `json:"id"`
+	BreakerID int    `json:"breaker_id"`
+	DeviceID  int    `json:"device_id"`
+	Kind      string `json:"kind"`
+	State     bool   `json:"state"`
+	Requester
+	CommandID      *int64     `json:"command_id,omitempty"`
+	RequestedAt    *time.Time `json:"requested_at,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// Audit outcomes, derived from the response status
+const (
+	AuditSuccess  = "success"
+	AuditDenied   = "denied"
+	AuditRejected = "rejected"
+	AuditError    = "error"
+)
+
+// AuditEntry records one mutating API call. Before and After summarise the
+// target where the handler provides them.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	ActorID    *int            `json:"actor_id"`
+	Method     string          `json:"method"`
+	Route      string          `json:"route"`
+	Path       string          `json:"path"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   *int64          `json:"target_id,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	ClientIP   string          `json:"client_ip"`
+	Status     int             `json:"status"`
+	Outcome    string          `json:"outcome"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// AuditFilter narrows an audit query; zero values match everything. BeforeID
+// pages backwards through the log.
+type AuditFilter struct {
+	ActorID    *int
+	TargetType string
+	TargetID   *int64
+	Method     string
+	Route      string
+	Outcome    string
+	Start, End time.Time
+	BeforeID   int64
+	Limit      int
+}
+
+// Device roles, weakest first. The device's user_id is always an owner.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleOwner    = "owner"
+)
+
+// DeviceMember grants a user other than the primary owner access to a device;
+// Name and Login are filled in when listing a device's members
+type DeviceMember struct {
+	DeviceID  int       `json:"device_id"`
+	UserID    int       `json:"user_id"`
+	Role      string    `json:"role"`
+	InvitedBy *int      `json:"invited_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name,omitempty"`
+	Login     string    `json:"login,omitempty"`
+}
+
+// SharedDevice is a device reached through a membership
+type SharedDevice struct {
+	Device
+	Role string `json:"role"`
+}
+
+// Invitation states
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+	InvitationRevoked  = "revoked"
+)
+
+// DeviceInvitation offers a role on a device to whoever presents its token.
+// Email only says who it was sent to; TokenHash is the sha256 of the token.
+type DeviceInvitation struct {
+	ID          int        `json:"id"`
+	DeviceID    int        `json:"device_id"`
+	DeviceName  string     `json:"device_name,omitempty"`
+	Email       string     `json:"email"`
+	TokenHash   string     `json:"-"`
+	Role        string     `json:"role"`
+	InvitedBy   *int       `json:"invited_by,omitempty"`
+	Status      string     `json:"status"`
+	AcceptedBy  *int       `json:"accepted_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+}
+
+// Site is a place one user's devices are installed at
+type Site struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Address   string    `json:"address"`
+	Timezone  string    `json:"timezone"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeviceGroup is a user's named set of devices; devices may be in many groups
+type DeviceGroup struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeviceCredential describes an issued device secret; only its hash is stored
+type DeviceCredential struct {
+	ID        int        `json:"id"`
+	DeviceID  int        `json:"device_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Device command lifecycle: pending until written to the socket, sent until
+// the device replies, then acked or failed. Expired and cancelled commands
+// are never delivered.
+const (
+	CommandPending   = "pending"
+	CommandSent      = "sent"
+	CommandAcked     = "acked"
+	CommandFailed    = "failed"
+	CommandExpired   = "expired"
+	CommandCancelled = "cancelled"
+)
+
+// DeviceCommand is one queued or delivered command and its outcome
+type DeviceCommand struct {
+	ID          int64           `json:"id"`
+	DeviceID    int             `json:"device_id"`
+	RequestID   string          `json:"request_id"`
+	Command     string          `json:"command"`
+	Payload     DeviceResponse  `json:"payload"`
+	Status      string          `json:"status"`
+	CreatedAt   time.Time       `json:"created_at"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	SentAt      *time.Time      `json:"sent_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	Result      *DeviceResponse `json:"result,omitempty"`
+}
+
+// Command job lifecycle. A job runs until every target has an outcome; jobs
+// cut off by a restart are aborted.
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobAborted   = "aborted"
+)
+
+// Command job target outcomes: delivered means written to the socket but not
+// acknowledged in time, offline means left queued for the device
+const (
+	TargetPending   = "pending"
+	TargetDelivered = "delivered"
+	TargetAcked     = "acked"
+	TargetOffline   = "offline"
+	TargetFailed    = "failed"
+)
+
+// CommandJob sends one command to many devices
+type CommandJob struct {
+	ID           int64      `json:"id"`
+	UserID       int        `json:"user_id"`
+	Command      string     `json:"command"`
+	BreakerState *bool      `json:"breaker_state,omitempty"`
+	SiteID       *int       `json:"site_id,omitempty"`
+	GroupID      *int       `json:"group_id,omitempty"`
+	Status       string     `json:"status"`
+	CreatedAt    time.Time  `json:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+}
+
+// CommandJobTarget is one device, or one breaker on it, that a job commands
+type CommandJobTarget struct {
+	ID        int64     `json:"id"`
+	JobID     int64     `json:"job_id"`
+	DeviceID  int       `json:"device_id"`
+	BreakerID *int      `json:"breaker_id,omitempty"`
+	CommandID *int64    `json:"command_id,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Firmware is an uploaded image; its bytes are only read by downloadFirmware
+type Firmware struct {
+	ID            int       `json:"id"`
+	HardwareModel string    `json:"hardware_model"`
+	Version       string    `json:"version"`
+	SHA256        string    `json:"sha256"`
+	Size          int64     `json:"size"`
+	Notes         string    `json:"notes"`
+	UploadedBy    *int      `json:"uploaded_by,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Firmware rollout lifecycle. A running rollout completes once no target is
+// still waiting or in progress; a halted one never releases another device.
+const (
+	RolloutRunning   = "running"
+	RolloutHalted    = "halted"
+	RolloutCompleted = "completed"
+)
+
+// Rollout target lifecycle: waiting until its stage is released, queued once
+// otaUpdate is sent, then downloading and rebooting as the device reports,
+// installed when it reconnects on the new version
+const (
+	OTAWaiting     = "waiting"
+	OTAQueued      = "queued"
+	OTADownloading = "downloading"
+	OTARebooting   = "rebooting"
+	OTAInstalled   = "installed"
+	OTAFailed      = "failed"
+	OTASkipped     = "skipped"
+	OTACancelled   = "cancelled"
+)
+
+// FirmwareRollout moves a fixed set of devices to one firmware image in stages
+type FirmwareRollout struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	FirmwareID int        `json:"firmware_id"`
+	Percent    int        `json:"percent"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// RolloutTarget is one device's progress through a rollout
+type RolloutTarget struct {
+	ID        int64     `json:"id"`
+	RolloutID int       `json:"rollout_id"`
+	DeviceID  int       `json:"device_id"`
+	Status    string    `json:"status"`
+	Progress  int       `json:"progress"`
+	CommandID *int64    `json:"command_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DeviceSettings is the configuration document pushed to a device with setConfig
+type DeviceSettings struct {
+	Telemetry TelemetrySettings `json:"telemetry"`
+	Sampling  SamplingSettings  `json:"sampling"`
+	LED       LEDSettings       `json:"led"`
+}
+
+type TelemetrySettings struct {
+	// IntervalS is how often the device sends frequencyUpdate
+	IntervalS int `json:"interval_s"`
+}
+
+type SamplingSettings struct {
+	// IntervalMs is how often the measured frequency is read
+	IntervalMs int `json:"interval_ms"`
+	// Zero crossings closer or further apart than these are discarded as noise
+	MinEdgeUs int `json:"min_edge_us"`
+	MaxEdgeUs int `json:"max_edge_us"`
+}
+
+type LEDSettings struct {
+	// The LED blinks every BlinkIntervalMs while frequency is outside LowHz..HighHz
+	BlinkIntervalMs int     `json:"blink_interval_ms"`
+	LowHz           float64 `json:"low_hz"`
+	HighHz          float64 `json:"high_hz"`
+	// FlashCount is how many times flashLED blinks
+	FlashCount int `json:"flash_count"`
+}
+
+// DeviceConfig is one version of a device's settings and whether the device applied it
+type DeviceConfig struct {
+	DeviceID  int            `json:"device_id"`
+	Version   int            `json:"version"`
+	Settings  DeviceSettings `json:"config"`
+	UpdatedBy *int           `json:"updated_by,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	AppliedAt *time.Time     `json:"applied_at,omitempty"`
+	// Error is the device's reason for rejecting this version
+	Error string `json:"error,omitempty"`
+}
+
+// DeviceSession is one device connection; DisconnectedAt is nil while live
+type DeviceSession struct {
+	ID             int64      `json:"id"`
+	DeviceID       int        `json:"device_id"`
+	RemoteAddr     string     `json:"remote_addr"`
+	ConnectedAt    time.Time  `json:"connected_at"`
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
+}
+
+// Store is the persistence layer used by the HTTP and WebSocket handlers
+type Store interface {
+	UserStore
+	DeviceStore
+	BreakerStore
+	FrequencyStore
+	CredentialStore
+	ClaimStore
+	CommandStore
+	SessionStore
+	ExcursionStore
+	AlertStore
+	WebhookStore
+	ScheduleStore
+	LoadShedStore
+	BreakerEventStore
+	AuditStore
+	MemberStore
+	SiteStore
+	GroupStore
+	CommandJobStore
+	FirmwareStore
+	RolloutStore
+	DeviceConfigStore
+}
+
+type UserStore interface {
+	CreateUser(user *User) error
+	SearchUsers(query string) ([]User, error)
+	GetUserByLogin(login string) (User, error)
+	UpdateUser(user User) error
+	DeleteUser(id int) error
+	SetUserToken(id int, token string) error
+	GetUser(id int) (User, error)
+	// SetUserAdmin is for operators; CreateUser and UpdateUser never change the flag
+	SetUserAdmin(id int, admin bool) error
+}
+
+type DeviceStore interface {
+	CreateDevice(device *Device) error
+	GetDevice(id int) (Device, error)
+	GetDeviceByMAC(mac string) (Device, error)
+	ListDevicesByUser(userID int) ([]Device, error)
+	UpdateDeviceName(id int, name string) error
+	// SetDeviceFirmware records what a device reported running; an empty
+	// model keeps the one already known
+	SetDeviceFirmware(id int, model, version string) error
+	DeleteDevice(id int) error
+}
+
+type BreakerStore interface {
+	CreateBreaker(breaker *Breaker) error
+	GetBreaker(id int) (Breaker, error)
+	ListBreakersByDevice(deviceID int) ([]Breaker, error)
+	UpdateBreaker(id int, name, breakerNumber string) error
+	SetBreakerStatus(id int, status bool) error
+	SetBreakerPriority(id int, priority int) error
+	// SetBreakerShed marks the breaker as held open by load shedding, or clears it with nil
+	SetBreakerShed(id int, at *time.Time) error
+	DeleteBreaker(id int) error
+}
+
+type FrequencyStore interface {
+	InsertFrequency(entry FrequencyLog) error
+	ListFrequency(deviceID int, r FrequencyRange) ([]FrequencyLog, error)
+	// AggregateFrequency groups readings into buckets of the given width.
+	// Hour and day buckets follow wall-clock boundaries in loc. Rollups from
+	// rollupTiers serve everything before their watermark, raw rows the rest.
+	AggregateFrequency(deviceID int, r FrequencyRange, bucket time.Duration, loc *time.Location) ([]FrequencyBucket, error)
+
+	// RollupFrequency builds the resolution's rollups for every complete bucket
+	// before until and advances its watermark. Coarser resolutions never pass
+	// the watermark of the one they are built from.
+	RollupFrequency(resolution time.Duration, until time.Time) error
+	// FrequencyWatermarks reports how far each rollup resolution is built
+	FrequencyWatermarks() (map[time.Duration]time.Time, error)
+	// PruneFrequency deletes data older than before; resolution 0 is raw readings
+	PruneFrequency(resolution time.Duration, before time.Time) (int64, error)
+}
+
+type CredentialStore interface {
+	// IssueDeviceCredential revokes any live credential and stores secretHash in its place
+	IssueDeviceCredential(deviceID int, secretHash string) (DeviceCredential, error)
+	// ActiveCredentialHash returns ErrNotFound when the device has no live credential
+	ActiveCredentialHash(deviceID int) (string, error)
+	ListDeviceCredentials(deviceID int) ([]DeviceCredential, error)
+	RevokeDeviceCredentials(deviceID int) error
+}
+
+type ClaimStore interface {
+	// CreateDeviceClaim stores a new code for deviceID and voids its unused ones
+	CreateDeviceClaim(deviceID int, codeHash string, expiresAt time.Time) error
+	// RedeemDeviceClaim marks the code used and binds mac to its device. It
+	// returns ErrNotFound, ErrClaimExpired, ErrClaimUsed or ErrClaimConflict
+	// when the code cannot be redeemed.
+	RedeemDeviceClaim(codeHash, mac string, now time.Time) (Device, error)
+}
+
+type CommandStore interface {
+	CreateCommand(cmd *DeviceCommand) error
+	GetCommand(id int64) (DeviceCommand, error)
+	// ListCommands returns a device's commands newest first; status "" means any
+	ListCommands(deviceID int, status string, limit int) ([]DeviceCommand, error)
+	// PendingCommands returns undelivered, unexpired commands oldest first
+	PendingCommands(deviceID int, now time.Time) ([]DeviceCommand, error)
+	MarkCommandSent(id int64, at time.Time) error
+	// CompleteCommand records the device's reply to a pending or sent command
+	CompleteCommand(deviceID int, requestID, status string, result DeviceResponse, at time.Time) error
+	CancelCommand(id int64, at time.Time) error
+	// ExpireCommands marks pending and sent commands past their TTL as expired
+	ExpireCommands(now time.Time) (int, error)
+}
+
+type SessionStore interface {
+	OpenDeviceSession(session *DeviceSession) error
+	CloseDeviceSession(id int64, at time.Time) error
+	// CloseStaleDeviceSessions ends sessions left open by a previous process
+	CloseStaleDeviceSessions(at time.Time) error
+	// ListDeviceSessions returns a device's sessions newest first
+	ListDeviceSessions(deviceID int, limit int) ([]DeviceSession, error)
+	// LatestDeviceSessions returns the most recent session per device, if any
+	LatestDeviceSessions(deviceIDs []int) (map[int]DeviceSession, error)
+}
+
+type ExcursionStore interface {
+	CreateExcursion(excursion *FrequencyExcursion) error
+	// CloseExcursion records the end time and final peak and rate
+	CloseExcursion(excursion FrequencyExcursion) error
+	// CloseOpenExcursions ends excursions left open by a previous process
+	CloseOpenExcursions(at time.Time) error
+	// ListExcursions returns excursions overlapping r, oldest first
+	ListExcursions(deviceID int, r FrequencyRange) ([]FrequencyExcursion, error)
+}
+
+type AlertStore interface {
+	CreateAlertRule(rule *AlertRule) error
+	GetAlertRule(id int) (AlertRule, error)
+	ListAlertRules(userID int) ([]AlertRule, error)
+	// ListDeviceAlertRules returns the enabled rules that apply to device
+	ListDeviceAlertRules(device Device) ([]AlertRule, error)
+	// ListAlertRulesByKind returns every enabled rule of a kind
+	ListAlertRulesByKind(kind string) ([]AlertRule, error)
+	UpdateAlertRule(rule AlertRule) error
+	DeleteAlertRule(id int) error
+
+	CreateAlert(alert *Alert) error
+	GetAlert(id int64) (Alert, error)
+	// ListAlerts returns a user's alerts newest first
+	ListAlerts(userID int, filter AlertFilter) ([]Alert, error)
+	// ActiveAlert returns the open or acknowledged alert for a rule and device
+	ActiveAlert(ruleID, deviceID int) (Alert, error)
+	// SetAlertStatus moves an alert forward, stamping the matching time
+	SetAlertStatus(id int64, status string, at time.Time) error
+	DeleteAlert(id int64) error
+}
+
+type WebhookStore interface {
+	CreateWebhook(hook *Webhook) error
+	GetWebhook(id int) (Webhook, error)
+	ListWebhooks(userID int) ([]Webhook, error)
+	UpdateWebhook(hook Webhook) error
+	DeleteWebhook(id int) error
+
+	// EnqueueWebhookDelivery adds a delivery to the outbox
+	EnqueueWebhookDelivery(delivery *WebhookDelivery) error
+	GetWebhookDelivery(id int64) (WebhookDelivery, error)
+	// ListWebhookDeliveries returns a webhook's deliveries newest first; status "" means any
+	ListWebhookDeliveries(webhookID int, status string, limit int) ([]WebhookDelivery, error)
+	// ClaimWebhookDeliveries returns pending deliveries due by now, oldest
+	// first, pushing their next attempt to leaseUntil so no other worker takes
+	// them while they are in flight
+	ClaimWebhookDeliveries(now, leaseUntil time.Time, limit int) ([]WebhookDelivery, error)
+	// RecordWebhookAttempt saves the status, attempt count and result fields of delivery
+	RecordWebhookAttempt(delivery WebhookDelivery) error
+}
+
+type ScheduleStore interface {
+	CreateBreakerSchedule(schedule *BreakerSchedule) error
+	GetBreakerSchedule(id int) (BreakerSchedule, error)
+	ListBreakerSchedules(breakerID int) ([]BreakerSchedule, error)
+	UpdateBreakerSchedule(schedule BreakerSchedule) error
+	DeleteBreakerSchedule(id int) error
+	// DueBreakerSchedules returns enabled schedules whose next run is at or before now
+	DueBreakerSchedules(now time.Time) ([]BreakerSchedule, error)
+	// AdvanceBreakerSchedule moves next_run_at from from to next, failing with
+	// ErrNotFound if it is no longer from, so each run is taken only once
+	AdvanceBreakerSchedule(id int, from time.Time, next *time.Time) error
+
+	CreateScheduleRun(run *ScheduleRun) error
+	// ListScheduleRuns returns a schedule's runs newest first
+	ListScheduleRuns(scheduleID int, limit int) ([]ScheduleRun, error)
+}
+
+type LoadShedStore interface {
+	// GetLoadShedOverride returns when a device's shedding suspension ends
+	GetLoadShedOverride(deviceID int) (time.Time, error)
+	SetLoadShedOverride(deviceID, userID int, until time.Time) error
+	ClearLoadShedOverride(deviceID int) error
+
+	CreateLoadShedEvent(event *LoadShedEvent) error
+	// ListLoadShedEvents returns a device's events within r, newest first
+	ListLoadShedEvents(deviceID int, r FrequencyRange) ([]LoadShedEvent, error)
+}
+
+type BreakerEventStore interface {
+	CreateBreakerEvent(event *BreakerEvent) error
+	// FindBreakerRequest returns the requested event for the command the
+	// device is answering, or ErrNotFound
+	FindBreakerRequest(deviceID int, requestID string) (BreakerEvent, error)
+	// ListBreakerEvents returns a breaker's timeline within r, newest first
+	ListBreakerEvents(breakerID int, r FrequencyRange) ([]BreakerEvent, error)
+}
+
+type AuditStore interface {
+	CreateAuditEntry(entry *AuditEntry) error
+	// ListAuditEntries returns matching entries newest first
+	ListAuditEntries(filter AuditFilter) ([]AuditEntry, error)
+}
+
+type MemberStore interface {
+	GetDeviceMember(deviceID, userID int) (DeviceMember, error)
+	// ListDeviceMembers returns a device's members with their names, oldest first
+	ListDeviceMembers(deviceID int) ([]DeviceMember, error)
+	// ListSharedDevices returns the devices userID is a member of
+	ListSharedDevices(userID int) ([]SharedDevice, error)
+	SetDeviceMemberRole(deviceID, userID int, role string) error
+	RemoveDeviceMember(deviceID, userID int) error
+
+	CreateDeviceInvitation(inv *DeviceInvitation) error
+	GetDeviceInvitation(id int) (DeviceInvitation, error)
+	// ListDeviceInvitations returns every invitation for a device, newest first
+	ListDeviceInvitations(deviceID int) ([]DeviceInvitation, error)
+	// ListPendingInvitations returns unexpired pending invitations for email,
+	// matched case-insensitively, with their device names
+	ListPendingInvitations(email string, now time.Time) ([]DeviceInvitation, error)
+	// AcceptDeviceInvitation marks a pending invitation accepted and makes
+	// userID a member with its role, replacing any earlier role
+	AcceptDeviceInvitation(id, userID int, at time.Time) error
+	// CloseDeviceInvitation declines or revokes a pending invitation
+	CloseDeviceInvitation(id int, status string, at time.Time) error
+}
+
+type SiteStore interface {
+	CreateSite(site *Site) error
+	GetSite(id int) (Site, error)
+	ListSitesByUser(userID int) ([]Site, error)
+	UpdateSite(site Site) error
+	// DeleteSite leaves its devices in place without a site
+	DeleteSite(id int) error
+	// SetDeviceSite moves a device to siteID, or out of any site with nil
+	SetDeviceSite(deviceID int, siteID *int) error
+	ListSiteDevices(siteID int) ([]Device, error)
+}
+
+type GroupStore interface {
+	CreateDeviceGroup(group *DeviceGroup) error
+	GetDeviceGroup(id int) (DeviceGroup, error)
+	ListDeviceGroupsByUser(userID int) ([]DeviceGroup, error)
+	RenameDeviceGroup(id int, name string) error
+	DeleteDeviceGroup(id int) error
+	// AddGroupDevice is a no-op when the device is already in the group
+	AddGroupDevice(groupID, deviceID int) error
+	RemoveGroupDevice(groupID, deviceID int) error
+	ListGroupDevices(groupID int) ([]Device, error)
+}
+
+type CommandJobStore interface {
+	// CreateCommandJob records a running job and its pending targets, filling in their IDs
+	CreateCommandJob(job *CommandJob, targets []CommandJobTarget) error
+	GetCommandJob(id int64) (CommandJob, error)
+	// ListCommandJobs returns a user's jobs newest first
+	ListCommandJobs(userID int, limit int) ([]CommandJob, error)
+	ListCommandJobTargets(jobID int64) ([]CommandJobTarget, error)
+	// UpdateCommandJobTarget saves a target's command, status and error
+	UpdateCommandJobTarget(target CommandJobTarget) error
+	CompleteCommandJob(id int64, at time.Time) error
+	// AbortRunningCommandJobs fails the pending targets of every running job
+	// and marks the jobs aborted
+	AbortRunningCommandJobs(at time.Time) error
+}
+
+type FirmwareStore interface {
+	// CreateFirmware returns ErrFirmwareExists if the model already has the version
+	CreateFirmware(fw *Firmware, data []byte) error
+	GetFirmware(id int) (Firmware, error)
+	GetFirmwareData(id int) ([]byte, error)
+	// ListFirmware returns uploaded images newest first; model "" means any
+	ListFirmware(model string) ([]Firmware, error)
+}
+
+type RolloutStore interface {
+	// CreateFirmwareRollout records a running rollout with a waiting target
+	// per device, in the order given
+	CreateFirmwareRollout(rollout *FirmwareRollout, deviceIDs []int) error
+	GetFirmwareRollout(id int) (FirmwareRollout, error)
+	// ListFirmwareRollouts returns a user's rollouts newest first
+	ListFirmwareRollouts(userID int) ([]FirmwareRollout, error)
+	// ListRolloutTargets returns a rollout's targets in release order
+	ListRolloutTargets(rolloutID int) ([]RolloutTarget, error)
+	// UpdateRolloutTarget saves a target's status, progress, command and error
+	UpdateRolloutTarget(target RolloutTarget) error
+	// SetRolloutStatus ends a running rollout, failing with ErrNotFound if it
+	// is no longer running
+	SetRolloutStatus(id int, status string, at time.Time) error
+	SetRolloutPercent(id, percent int) error
+	// ActiveRolloutTarget returns the device's queued, downloading or
+	// rebooting target, or ErrNotFound
+	ActiveRolloutTarget(deviceID int) (RolloutTarget, error)
+	// FailExpiredRolloutTargets fails queued targets whose otaUpdate expired
+	// or was cancelled undelivered and returns the rollouts they belong to
+	FailExpiredRolloutTargets(at time.Time) ([]int, error)
+}
+
+type DeviceConfigStore interface {
+	// CreateDeviceConfig stores settings as the device's next version, filling in Version
+	CreateDeviceConfig(cfg *DeviceConfig) error
+	// LatestDeviceConfig returns the version the device should run, or ErrNotFound
+	LatestDeviceConfig(deviceID int) (DeviceConfig, error)
+	// AppliedDeviceConfig returns the version the device last reported
+	// applying, or ErrNotFound
+	AppliedDeviceConfig(deviceID int) (DeviceConfig, error)
+	// RecordDeviceConfigResult marks a version applied at at, or records why
+	// the device rejected it when applyErr is set
+	RecordDeviceConfigResult(deviceID, version int, applyErr string, at time.Time) error
+}
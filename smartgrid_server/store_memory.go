@@ -0,0 +1,2419 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore implements Store in process memory, for tests and demos
+type MemoryStore struct {
+	mu sync.Mutex
+
+	nextID    map[string]int
+	users     map[int]User
+	tokens    map[int]string
+	devices   map[int]Device
+	breakers  map[int]Breaker
+	frequency []FrequencyLog
+
+	credentials      []DeviceCredential
+	credentialHashes map[int]string // credential ID -> secret hash
+	claims           []memoryClaim
+	commands         []DeviceCommand
+	sessions         []DeviceSession
+	excursions       []FrequencyExcursion
+	alertRules       map[int]AlertRule
+	alerts           []Alert
+	webhooks         map[int]Webhook
+	deliveries       []WebhookDelivery
+	schedules        map[int]BreakerSchedule
+	scheduleRuns     []ScheduleRun
+	shedOverrides    map[int]time.Time
+	shedEvents       []LoadShedEvent
+	breakerEvents    []BreakerEvent
+	auditLog         []AuditEntry
+	members          []DeviceMember
+	invitations      map[int]DeviceInvitation
+	sites            map[int]Site
+	groups           map[int]DeviceGroup
+	groupDevices     []memoryGroupDevice
+	commandJobs      map[int64]CommandJob
+	jobTargets       []CommandJobTarget
+	firmware         map[int]Firmware
+	firmwareData     map[int][]byte
+	rollouts         map[int]FirmwareRollout
+	rolloutTargets   []RolloutTarget
+	deviceConfigs    []DeviceConfig
+
+	rollups    map[time.Duration][]FrequencyRollup
+	watermarks map[time.Duration]time.Time
+}
+
+type memoryRollupKey struct {
+	deviceID int
+	bucket   int64
+}
+
+type memoryGroupDevice struct {
+	groupID  int
+	deviceID int
+}
+
+type memoryClaim struct {
+	deviceID  int
+	codeHash  string
+	expiresAt time.Time
+	used      bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nextID:   make(map[string]int),
+		users:    make(map[int]User),
+		tokens:   make(map[int]string),
+		devices:  make(map[int]Device),
+		breakers: make(map[int]Breaker),
+
+		credentialHashes: make(map[int]string),
+		alertRules:       make(map[int]AlertRule),
+		webhooks:         make(map[int]Webhook),
+		schedules:        make(map[int]BreakerSchedule),
+		shedOverrides:    make(map[int]time.Time),
+		invitations:      make(map[int]DeviceInvitation),
+		sites:            make(map[int]Site),
+		groups:           make(map[int]DeviceGroup),
+		commandJobs:      make(map[int64]CommandJob),
+		firmware:         make(map[int]Firmware),
+		firmwareData:     make(map[int][]byte),
+		rollouts:         make(map[int]FirmwareRollout),
+
+		rollups:    make(map[time.Duration][]FrequencyRollup),
+		watermarks: make(map[time.Duration]time.Time),
+	}
+}
+
+// newID hands out SERIAL-style ids per table; callers hold mu
+func (m *MemoryStore) newID(table string) int {
+	m.nextID[table]++
+	return m.nextID[table]
+}
+
+// sortedKeys returns map keys in ascending order so listings are stable
+func sortedKeys[K cmp.Ordered, V any](rows map[K]V) []K {
+	keys := make([]K, 0, len(rows))
+	for id := range rows {
+		keys = append(keys, id)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (m *MemoryStore) CreateUser(user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user.ID = m.newID("users")
+	user.IsAdmin = false
+	m.users[user.ID] = *user
+	return nil
+}
+
+func (m *MemoryStore) SearchUsers(query string) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	query = strings.ToLower(query)
+	var users []User
+	for _, id := range sortedKeys(m.users) {
+		user := m.users[id]
+		if strings.Contains(strings.ToLower(user.Name), query) ||
+			strings.Contains(strings.ToLower(user.Email), query) ||
+			strings.Contains(strings.ToLower(user.Login), query) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (m *MemoryStore) GetUserByLogin(login string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range sortedKeys(m.users) {
+		if m.users[id].Login == login {
+			return m.users[id], nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *MemoryStore) UpdateUser(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.IsAdmin = existing.IsAdmin
+	m.users[user.ID] = user
+	return nil
+}
+
+func (m *MemoryStore) GetUser(id int) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (m *MemoryStore) SetUserAdmin(id int, admin bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.IsAdmin = admin
+	m.users[id] = user
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.users, id)
+	delete(m.tokens, id)
+
+	// Mirror ON DELETE CASCADE
+	for deviceID, device := range m.devices {
+		if device.UserID == id {
+			m.deleteDeviceLocked(deviceID)
+		}
+	}
+	m.deleteAlertRulesLocked(func(rule AlertRule) bool { return rule.UserID == id })
+	m.alerts = filterRows(m.alerts, func(alert Alert) bool { return alert.UserID != id })
+	for hookID, hook := range m.webhooks {
+		if hook.UserID == id {
+			m.deleteWebhookLocked(hookID)
+		}
+	}
+	m.members = filterRows(m.members, func(member DeviceMember) bool { return member.UserID != id })
+	for siteID, site := range m.sites {
+		if site.UserID == id {
+			m.deleteSiteLocked(siteID)
+		}
+	}
+	for groupID, group := range m.groups {
+		if group.UserID == id {
+			m.deleteGroupLocked(groupID)
+		}
+	}
+	for jobID, job := range m.commandJobs {
+		if job.UserID == id {
+			delete(m.commandJobs, jobID)
+			m.jobTargets = filterRows(m.jobTargets, func(t CommandJobTarget) bool { return t.JobID != jobID })
+		}
+	}
+	for rolloutID, rollout := range m.rollouts {
+		if rollout.UserID == id {
+			delete(m.rollouts, rolloutID)
+			m.rolloutTargets = filterRows(m.rolloutTargets, func(t RolloutTarget) bool { return t.RolloutID != rolloutID })
+		}
+	}
+	for i, cfg := range m.deviceConfigs {
+		if cfg.UpdatedBy != nil && *cfg.UpdatedBy == id {
+			m.deviceConfigs[i].UpdatedBy = nil
+		}
+	}
+	for fwID, fw := range m.firmware {
+		if fw.UploadedBy != nil && *fw.UploadedBy == id {
+			fw.UploadedBy = nil
+			m.firmware[fwID] = fw
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SetUserToken(id int, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens[id] = token
+	return nil
+}
+
+func (m *MemoryStore) CreateDevice(device *Device) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device.ID = m.newID("devices")
+	m.devices[device.ID] = *device
+	return nil
+}
+
+func (m *MemoryStore) GetDevice(id int) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device, ok := m.devices[id]
+	if !ok {
+		return Device{}, ErrNotFound
+	}
+	return device, nil
+}
+
+func (m *MemoryStore) GetDeviceByMAC(mac string) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range sortedKeys(m.devices) {
+		if mac != "" && m.devices[id].MACAddr == mac {
+			return m.devices[id], nil
+		}
+	}
+	return Device{}, ErrNotFound
+}
+
+func (m *MemoryStore) ListDevicesByUser(userID int) ([]Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var devices []Device
+	for _, id := range sortedKeys(m.devices) {
+		if m.devices[id].UserID == userID {
+			devices = append(devices, m.devices[id])
+		}
+	}
+	return devices, nil
+}
+
+func (m *MemoryStore) UpdateDeviceName(id int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device, ok := m.devices[id]
+	if !ok {
+		return ErrNotFound
+	}
+	device.Name = name
+	m.devices[id] = device
+	return nil
+}
+
+func (m *MemoryStore) SetDeviceFirmware(id int, model, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device, ok := m.devices[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if model != "" {
+		device.HardwareModel = model
+	}
+	device.FirmwareVersion = version
+	m.devices[id] = device
+	return nil
+}
+
+func (m *MemoryStore) DeleteDevice(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[id]; !ok {
+		return ErrNotFound
+	}
+	m.deleteDeviceLocked(id)
+	return nil
+}
+
+// deleteDeviceLocked removes a device and everything that cascades from it
+func (m *MemoryStore) deleteDeviceLocked(id int) {
+	delete(m.devices, id)
+	for breakerID, breaker := range m.breakers {
+		if breaker.DeviceID == id {
+			m.deleteBreakerLocked(breakerID)
+		}
+	}
+	m.frequency = filterRows(m.frequency, func(entry FrequencyLog) bool { return entry.DeviceID != id })
+	m.credentials = filterRows(m.credentials, func(cred DeviceCredential) bool { return cred.DeviceID != id })
+	m.claims = filterRows(m.claims, func(claim memoryClaim) bool { return claim.deviceID != id })
+	m.commands = filterRows(m.commands, func(cmd DeviceCommand) bool { return cmd.DeviceID != id })
+	m.sessions = filterRows(m.sessions, func(session DeviceSession) bool { return session.DeviceID != id })
+	m.excursions = filterRows(m.excursions, func(e FrequencyExcursion) bool { return e.DeviceID != id })
+	m.deleteAlertRulesLocked(func(rule AlertRule) bool { return rule.DeviceID != nil && *rule.DeviceID == id })
+	delete(m.shedOverrides, id)
+	m.members = filterRows(m.members, func(member DeviceMember) bool { return member.DeviceID != id })
+	m.groupDevices = filterRows(m.groupDevices, func(g memoryGroupDevice) bool { return g.deviceID != id })
+	m.jobTargets = filterRows(m.jobTargets, func(t CommandJobTarget) bool { return t.DeviceID != id })
+	m.rolloutTargets = filterRows(m.rolloutTargets, func(t RolloutTarget) bool { return t.DeviceID != id })
+	m.deviceConfigs = filterRows(m.deviceConfigs, func(cfg DeviceConfig) bool { return cfg.DeviceID != id })
+	for invitationID, inv := range m.invitations {
+		if inv.DeviceID == id {
+			delete(m.invitations, invitationID)
+		}
+	}
+	m.shedEvents = filterRows(m.shedEvents, func(e LoadShedEvent) bool { return e.DeviceID != id })
+	m.alerts = filterRows(m.alerts, func(alert Alert) bool { return alert.DeviceID != id })
+	for res, rollups := range m.rollups {
+		m.rollups[res] = filterRows(rollups, func(rollup FrequencyRollup) bool { return rollup.DeviceID != id })
+	}
+}
+
+// filterRows keeps the rows for which keep returns true, reusing the backing array
+func filterRows[T any](rows []T, keep func(T) bool) []T {
+	kept := rows[:0]
+	for _, row := range rows {
+		if keep(row) {
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
+
+func (m *MemoryStore) CreateBreaker(breaker *Breaker) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[breaker.DeviceID]; !ok {
+		return ErrNotFound
+	}
+	breaker.ID = m.newID("breakers")
+	breaker.Status = true
+	m.breakers[breaker.ID] = *breaker
+	return nil
+}
+
+func (m *MemoryStore) GetBreaker(id int) (Breaker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	breaker, ok := m.breakers[id]
+	if !ok {
+		return Breaker{}, ErrNotFound
+	}
+	return breaker, nil
+}
+
+func (m *MemoryStore) ListBreakersByDevice(deviceID int) ([]Breaker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var breakers []Breaker
+	for _, id := range sortedKeys(m.breakers) {
+		if m.breakers[id].DeviceID == deviceID {
+			breakers = append(breakers, m.breakers[id])
+		}
+	}
+	return breakers, nil
+}
+
+func (m *MemoryStore) UpdateBreaker(id int, name, breakerNumber string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	breaker, ok := m.breakers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	breaker.Name = name
+	breaker.Breaker_Number = breakerNumber
+	m.breakers[id] = breaker
+	return nil
+}
+
+func (m *MemoryStore) SetBreakerStatus(id int, status bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	breaker, ok := m.breakers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	breaker.Status = status
+	m.breakers[id] = breaker
+	return nil
+}
+
+func (m *MemoryStore) SetBreakerPriority(id int, priority int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	breaker, ok := m.breakers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	breaker.Priority = priority
+	m.breakers[id] = breaker
+	return nil
+}
+
+func (m *MemoryStore) SetBreakerShed(id int, at *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	breaker, ok := m.breakers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	breaker.ShedAt = at
+	m.breakers[id] = breaker
+	return nil
+}
+
+func (m *MemoryStore) DeleteBreaker(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.breakers[id]; !ok {
+		return ErrNotFound
+	}
+	m.deleteBreakerLocked(id)
+	return nil
+}
+
+// deleteBreakerLocked removes a breaker and everything that cascades from it
+func (m *MemoryStore) deleteBreakerLocked(id int) {
+	delete(m.breakers, id)
+	m.breakerEvents = filterRows(m.breakerEvents, func(e BreakerEvent) bool { return e.BreakerID != id })
+	m.deleteAlertRulesLocked(func(rule AlertRule) bool { return rule.BreakerID != nil && *rule.BreakerID == id })
+	for scheduleID, schedule := range m.schedules {
+		if schedule.BreakerID == id {
+			m.deleteScheduleLocked(scheduleID)
+		}
+	}
+	for i, t := range m.jobTargets {
+		if t.BreakerID != nil && *t.BreakerID == id {
+			m.jobTargets[i].BreakerID = nil
+		}
+	}
+}
+
+func (m *MemoryStore) InsertFrequency(entry FrequencyLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[entry.DeviceID]; !ok {
+		return ErrNotFound
+	}
+	m.frequency = append(m.frequency, entry)
+	return nil
+}
+
+func (m *MemoryStore) ListFrequency(deviceID int, r FrequencyRange) ([]FrequencyLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	logs := m.frequencyInRangeLocked(deviceID, r)
+	if r.Limit > 0 && len(logs) > r.Limit {
+		logs = logs[:r.Limit]
+	}
+	return logs, nil
+}
+
+func (m *MemoryStore) AggregateFrequency(deviceID int, r FrequencyRange, bucket time.Duration, loc *time.Location) ([]FrequencyBucket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Coarsest tier first; each serves from the previous watermark to its own
+	var parts []FrequencyRollup
+	var lower time.Time
+	for _, tier := range rollupTiers(bucket, loc) {
+		upper := m.watermarks[tier]
+		for _, rollup := range m.rollups[tier] {
+			t := rollup.Bucket
+			if rollup.DeviceID == deviceID && r.contains(t) && !t.Before(lower) && t.Before(upper) {
+				parts = append(parts, rollup)
+			}
+		}
+		lower = maxTime(lower, upper)
+	}
+	for _, entry := range m.frequencyInRangeLocked(deviceID, r) {
+		if !entry.Timestamp.Before(lower) {
+			parts = append(parts, rollupReading(entry))
+		}
+	}
+	sort.SliceStable(parts, func(i, j int) bool { return parts[i].Bucket.Before(parts[j].Bucket) })
+
+	var merged []FrequencyRollup
+	for _, part := range parts {
+		start := bucketStart(part.Bucket, bucket, loc)
+		if len(merged) == 0 || !merged[len(merged)-1].Bucket.Equal(start) {
+			if r.Limit > 0 && len(merged) == r.Limit {
+				break
+			}
+			merged = append(merged, FrequencyRollup{DeviceID: deviceID, Bucket: start})
+		}
+		merged[len(merged)-1].merge(part)
+	}
+
+	buckets := make([]FrequencyBucket, len(merged))
+	for i, rollup := range merged {
+		buckets[i] = rollup.bucket()
+	}
+	return buckets, nil
+}
+
+func (m *MemoryStore) RollupFrequency(resolution time.Duration, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until = until.Truncate(resolution)
+	from := m.watermarks[resolution]
+
+	// The first resolution reads raw readings, later ones the resolution before
+	var source []FrequencyRollup
+	for i, res := range rollupResolutions {
+		if res != resolution {
+			continue
+		}
+		if i == 0 {
+			for _, entry := range m.frequency {
+				source = append(source, rollupReading(entry))
+			}
+		} else {
+			prev := rollupResolutions[i-1]
+			until = minTime(until, m.watermarks[prev])
+			source = m.rollups[prev]
+		}
+	}
+	if !until.After(from) {
+		return nil
+	}
+
+	built := make(map[memoryRollupKey]*FrequencyRollup)
+	var order []memoryRollupKey
+	for _, part := range source {
+		if part.Bucket.Before(from) || !part.Bucket.Before(until) {
+			continue
+		}
+		key := memoryRollupKey{part.DeviceID, part.Bucket.Truncate(resolution).Unix()}
+		if built[key] == nil {
+			built[key] = &FrequencyRollup{DeviceID: part.DeviceID, Bucket: part.Bucket.Truncate(resolution)}
+			order = append(order, key)
+		}
+		built[key].merge(part)
+	}
+
+	// Buckets in [from, until) are rebuilt from scratch
+	m.rollups[resolution] = filterRows(m.rollups[resolution], func(rollup FrequencyRollup) bool {
+		return rollup.Bucket.Before(from) || !rollup.Bucket.Before(until)
+	})
+	for _, key := range order {
+		m.rollups[resolution] = append(m.rollups[resolution], *built[key])
+	}
+	m.watermarks[resolution] = until
+	return nil
+}
+
+func (m *MemoryStore) FrequencyWatermarks() (map[time.Duration]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	watermarks := make(map[time.Duration]time.Time, len(m.watermarks))
+	for res, t := range m.watermarks {
+		watermarks[res] = t
+	}
+	return watermarks, nil
+}
+
+func (m *MemoryStore) PruneFrequency(resolution time.Duration, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if resolution == 0 {
+		n := len(m.frequency)
+		m.frequency = filterRows(m.frequency, func(entry FrequencyLog) bool { return !entry.Timestamp.Before(before) })
+		return int64(n - len(m.frequency)), nil
+	}
+	n := len(m.rollups[resolution])
+	m.rollups[resolution] = filterRows(m.rollups[resolution], func(rollup FrequencyRollup) bool { return !rollup.Bucket.Before(before) })
+	return int64(n - len(m.rollups[resolution])), nil
+}
+
+// bucketStart mirrors the Postgres bucketing in AggregateFrequency
+func bucketStart(t time.Time, bucket time.Duration, loc *time.Location) time.Time {
+	local := t.In(loc)
+	switch bucket {
+	case time.Hour:
+		return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, loc)
+	case 24 * time.Hour:
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	}
+	return t.Truncate(bucket)
+}
+
+// frequencyInRangeLocked returns a device's readings in r, oldest first
+func (m *MemoryStore) frequencyInRangeLocked(deviceID int, r FrequencyRange) []FrequencyLog {
+	var logs []FrequencyLog
+	for _, entry := range m.frequency {
+		if entry.DeviceID == deviceID && r.contains(entry.Timestamp) {
+			logs = append(logs, entry)
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].Timestamp.Before(logs[j].Timestamp) })
+	return logs
+}
+
+func (m *MemoryStore) IssueDeviceCredential(deviceID int, secretHash string) (DeviceCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return DeviceCredential{}, ErrNotFound
+	}
+	m.revokeCredentialsLocked(deviceID)
+
+	credential := DeviceCredential{ID: m.newID("device_credentials"), DeviceID: deviceID, CreatedAt: time.Now()}
+	m.credentials = append(m.credentials, credential)
+	m.credentialHashes[credential.ID] = secretHash
+	return credential, nil
+}
+
+func (m *MemoryStore) ActiveCredentialHash(deviceID int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, credential := range m.credentials {
+		if credential.DeviceID == deviceID && credential.RevokedAt == nil {
+			return m.credentialHashes[credential.ID], nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *MemoryStore) ListDeviceCredentials(deviceID int) ([]DeviceCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var credentials []DeviceCredential
+	for _, credential := range m.credentials {
+		if credential.DeviceID == deviceID {
+			credentials = append(credentials, credential)
+		}
+	}
+	return credentials, nil
+}
+
+func (m *MemoryStore) RevokeDeviceCredentials(deviceID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revokeCredentialsLocked(deviceID)
+	return nil
+}
+
+func (m *MemoryStore) revokeCredentialsLocked(deviceID int) {
+	now := time.Now()
+	for i := range m.credentials {
+		if m.credentials[i].DeviceID == deviceID && m.credentials[i].RevokedAt == nil {
+			m.credentials[i].RevokedAt = &now
+		}
+	}
+}
+
+func (m *MemoryStore) CreateDeviceClaim(deviceID int, codeHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return ErrNotFound
+	}
+	now := time.Now()
+	for i := range m.claims {
+		if m.claims[i].deviceID == deviceID && !m.claims[i].used && m.claims[i].expiresAt.After(now) {
+			m.claims[i].expiresAt = now
+		}
+	}
+	m.claims = append(m.claims, memoryClaim{deviceID: deviceID, codeHash: codeHash, expiresAt: expiresAt})
+	return nil
+}
+
+func (m *MemoryStore) RedeemDeviceClaim(codeHash, mac string, now time.Time) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.claims {
+		claim := &m.claims[i]
+		if claim.codeHash != codeHash {
+			continue
+		}
+		if claim.used {
+			return Device{}, ErrClaimUsed
+		}
+		if !now.Before(claim.expiresAt) {
+			return Device{}, ErrClaimExpired
+		}
+		for id, other := range m.devices {
+			if id != claim.deviceID && other.MACAddr == mac {
+				return Device{}, ErrClaimConflict
+			}
+		}
+
+		claim.used = true
+		device := m.devices[claim.deviceID]
+		device.MACAddr = mac
+		m.devices[device.ID] = device
+		return device, nil
+	}
+	return Device{}, ErrNotFound
+}
+
+func (m *MemoryStore) CreateCommand(cmd *DeviceCommand) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[cmd.DeviceID]; !ok {
+		return ErrNotFound
+	}
+	cmd.ID = int64(m.newID("device_commands"))
+	cmd.Status = CommandPending
+	cmd.CreatedAt = time.Now()
+	m.commands = append(m.commands, *cmd)
+	return nil
+}
+
+// findCommand returns a pointer into m.commands; callers hold mu
+func (m *MemoryStore) findCommand(match func(*DeviceCommand) bool) *DeviceCommand {
+	for i := range m.commands {
+		if match(&m.commands[i]) {
+			return &m.commands[i]
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetCommand(id int64) (DeviceCommand, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cmd := m.findCommand(func(cmd *DeviceCommand) bool { return cmd.ID == id })
+	if cmd == nil {
+		return DeviceCommand{}, ErrNotFound
+	}
+	return *cmd, nil
+}
+
+func (m *MemoryStore) ListCommands(deviceID int, status string, limit int) ([]DeviceCommand, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var cmds []DeviceCommand
+	for i := len(m.commands) - 1; i >= 0 && len(cmds) < limit; i-- {
+		cmd := m.commands[i]
+		if cmd.DeviceID == deviceID && (status == "" || cmd.Status == status) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds, nil
+}
+
+func (m *MemoryStore) PendingCommands(deviceID int, now time.Time) ([]DeviceCommand, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var cmds []DeviceCommand
+	for _, cmd := range m.commands {
+		if cmd.DeviceID == deviceID && cmd.Status == CommandPending && cmd.ExpiresAt.After(now) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds, nil
+}
+
+func (m *MemoryStore) MarkCommandSent(id int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cmd := m.findCommand(func(cmd *DeviceCommand) bool { return cmd.ID == id }); cmd != nil && cmd.Status == CommandPending {
+		cmd.Status = CommandSent
+		cmd.SentAt = &at
+	}
+	return nil
+}
+
+func (m *MemoryStore) CompleteCommand(deviceID int, requestID, status string, result DeviceResponse, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cmd := m.findCommand(func(cmd *DeviceCommand) bool {
+		return cmd.DeviceID == deviceID && cmd.RequestID == requestID &&
+			(cmd.Status == CommandPending || cmd.Status == CommandSent)
+	})
+	if cmd == nil {
+		return ErrNotFound
+	}
+	cmd.Status = status
+	cmd.Result = &result
+	cmd.CompletedAt = &at
+	if cmd.SentAt == nil {
+		cmd.SentAt = &at
+	}
+	return nil
+}
+
+func (m *MemoryStore) CancelCommand(id int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cmd := m.findCommand(func(cmd *DeviceCommand) bool { return cmd.ID == id })
+	if cmd == nil {
+		return ErrNotFound
+	}
+	if cmd.Status != CommandPending {
+		return ErrCommandNotPending
+	}
+	cmd.Status = CommandCancelled
+	cmd.CompletedAt = &at
+	return nil
+}
+
+func (m *MemoryStore) ExpireCommands(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired := 0
+	for i := range m.commands {
+		cmd := &m.commands[i]
+		if (cmd.Status == CommandPending || cmd.Status == CommandSent) && !cmd.ExpiresAt.After(now) {
+			cmd.Status = CommandExpired
+			cmd.CompletedAt = &now
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (m *MemoryStore) OpenDeviceSession(session *DeviceSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[session.DeviceID]; !ok {
+		return ErrNotFound
+	}
+	session.ID = int64(m.newID("device_sessions"))
+	m.sessions = append(m.sessions, *session)
+	return nil
+}
+
+func (m *MemoryStore) CloseDeviceSession(id int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.sessions {
+		if m.sessions[i].ID == id && m.sessions[i].DisconnectedAt == nil {
+			m.sessions[i].DisconnectedAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CloseStaleDeviceSessions(at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.sessions {
+		if m.sessions[i].DisconnectedAt == nil {
+			m.sessions[i].DisconnectedAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) ListDeviceSessions(deviceID int, limit int) ([]DeviceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Sessions are appended as they open, so walking backwards is newest first
+	var sessions []DeviceSession
+	for i := len(m.sessions) - 1; i >= 0 && len(sessions) < limit; i-- {
+		if m.sessions[i].DeviceID == deviceID {
+			sessions = append(sessions, m.sessions[i])
+		}
+	}
+	return sessions, nil
+}
+
+func (m *MemoryStore) LatestDeviceSessions(deviceIDs []int) (map[int]DeviceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := make(map[int]bool, len(deviceIDs))
+	for _, id := range deviceIDs {
+		wanted[id] = true
+	}
+	latest := make(map[int]DeviceSession)
+	for _, session := range m.sessions {
+		if wanted[session.DeviceID] {
+			latest[session.DeviceID] = session
+		}
+	}
+	return latest, nil
+}
+
+func (m *MemoryStore) CreateExcursion(excursion *FrequencyExcursion) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[excursion.DeviceID]; !ok {
+		return ErrNotFound
+	}
+	excursion.ID = int64(m.newID("frequency_excursions"))
+	m.excursions = append(m.excursions, *excursion)
+	return nil
+}
+
+func (m *MemoryStore) CloseExcursion(excursion FrequencyExcursion) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.excursions {
+		if m.excursions[i].ID == excursion.ID {
+			m.excursions[i] = excursion
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryStore) CloseOpenExcursions(at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.excursions {
+		if m.excursions[i].EndedAt == nil {
+			m.excursions[i].EndedAt = &at
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) ListExcursions(deviceID int, r FrequencyRange) ([]FrequencyExcursion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var excursions []FrequencyExcursion
+	for _, e := range m.excursions {
+		if e.DeviceID != deviceID {
+			continue
+		}
+		if !r.Start.IsZero() && e.EndedAt != nil && e.EndedAt.Before(r.Start) {
+			continue
+		}
+		if !r.End.IsZero() && e.StartedAt.After(r.End) {
+			continue
+		}
+		excursions = append(excursions, e)
+	}
+	sort.SliceStable(excursions, func(i, j int) bool { return excursions[i].StartedAt.Before(excursions[j].StartedAt) })
+	if r.Limit > 0 && len(excursions) > r.Limit {
+		excursions = excursions[:r.Limit]
+	}
+	return excursions, nil
+}
+
+// deleteAlertRulesLocked removes matching rules and the alerts they raised
+func (m *MemoryStore) deleteAlertRulesLocked(match func(AlertRule) bool) {
+	for id, rule := range m.alertRules {
+		if match(rule) {
+			delete(m.alertRules, id)
+			m.alerts = filterRows(m.alerts, func(alert Alert) bool { return alert.RuleID != id })
+		}
+	}
+}
+
+func (m *MemoryStore) CreateAlertRule(rule *AlertRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[rule.UserID]; !ok {
+		return ErrNotFound
+	}
+	rule.ID = m.newID("alert_rules")
+	rule.CreatedAt = time.Now()
+	m.alertRules[rule.ID] = *rule
+	return nil
+}
+
+func (m *MemoryStore) GetAlertRule(id int) (AlertRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rule, ok := m.alertRules[id]
+	if !ok {
+		return AlertRule{}, ErrNotFound
+	}
+	return rule, nil
+}
+
+// listAlertRules returns matching rules in id order
+func (m *MemoryStore) listAlertRules(match func(AlertRule) bool) []AlertRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rules []AlertRule
+	for _, id := range sortedKeys(m.alertRules) {
+		if match(m.alertRules[id]) {
+			rules = append(rules, m.alertRules[id])
+		}
+	}
+	return rules
+}
+
+func (m *MemoryStore) ListAlertRules(userID int) ([]AlertRule, error) {
+	return m.listAlertRules(func(rule AlertRule) bool { return rule.UserID == userID }), nil
+}
+
+func (m *MemoryStore) ListDeviceAlertRules(device Device) ([]AlertRule, error) {
+	return m.listAlertRules(func(rule AlertRule) bool {
+		if !rule.Enabled {
+			return false
+		}
+		if rule.DeviceID != nil && *rule.DeviceID != device.ID {
+			return false
+		}
+		return rule.UserID == device.UserID || m.memberIndexLocked(device.ID, rule.UserID) >= 0
+	}), nil
+}
+
+func (m *MemoryStore) ListAlertRulesByKind(kind string) ([]AlertRule, error) {
+	return m.listAlertRules(func(rule AlertRule) bool { return rule.Enabled && rule.Kind == kind }), nil
+}
+
+func (m *MemoryStore) UpdateAlertRule(rule AlertRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.alertRules[rule.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	rule.UserID, rule.CreatedAt = existing.UserID, existing.CreatedAt
+	m.alertRules[rule.ID] = rule
+	return nil
+}
+
+func (m *MemoryStore) DeleteAlertRule(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.alertRules[id]; !ok {
+		return ErrNotFound
+	}
+	m.deleteAlertRulesLocked(func(rule AlertRule) bool { return rule.ID == id })
+	return nil
+}
+
+func (m *MemoryStore) CreateAlert(alert *Alert) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.alertRules[alert.RuleID]; !ok {
+		return ErrNotFound
+	}
+	for _, existing := range m.alerts {
+		// Mirror the partial unique index on active alerts
+		if existing.RuleID == alert.RuleID && existing.DeviceID == alert.DeviceID && existing.Status != AlertResolved {
+			return errors.New("rule already has an active alert for this device")
+		}
+	}
+	alert.ID = int64(m.newID("alerts"))
+	m.alerts = append(m.alerts, *alert)
+	return nil
+}
+
+// findAlert returns a pointer into m.alerts; callers hold mu
+func (m *MemoryStore) findAlert(match func(*Alert) bool) *Alert {
+	for i := range m.alerts {
+		if match(&m.alerts[i]) {
+			return &m.alerts[i]
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetAlert(id int64) (Alert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	alert := m.findAlert(func(a *Alert) bool { return a.ID == id })
+	if alert == nil {
+		return Alert{}, ErrNotFound
+	}
+	return *alert, nil
+}
+
+func (m *MemoryStore) ListAlerts(userID int, filter AlertFilter) ([]Alert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var alerts []Alert
+	for i := len(m.alerts) - 1; i >= 0; i-- {
+		alert := m.alerts[i]
+		if alert.UserID != userID ||
+			(filter.Status != "" && alert.Status != filter.Status) ||
+			(filter.DeviceID != 0 && alert.DeviceID != filter.DeviceID) {
+			continue
+		}
+		alerts = append(alerts, alert)
+		if filter.Limit > 0 && len(alerts) == filter.Limit {
+			break
+		}
+	}
+	return alerts, nil
+}
+
+func (m *MemoryStore) ActiveAlert(ruleID, deviceID int) (Alert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	alert := m.findAlert(func(a *Alert) bool {
+		return a.RuleID == ruleID && a.DeviceID == deviceID && a.Status != AlertResolved
+	})
+	if alert == nil {
+		return Alert{}, ErrNotFound
+	}
+	return *alert, nil
+}
+
+func (m *MemoryStore) SetAlertStatus(id int64, status string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	alert := m.findAlert(func(a *Alert) bool { return a.ID == id })
+	switch {
+	case alert == nil:
+		return ErrNotFound
+	case status == AlertResolved && alert.Status != AlertResolved:
+		alert.Status, alert.ResolvedAt = AlertResolved, &at
+	case status == AlertAcknowledged && alert.Status == AlertOpen:
+		alert.Status, alert.AcknowledgedAt = AlertAcknowledged, &at
+	default:
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteAlert(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := len(m.alerts)
+	m.alerts = filterRows(m.alerts, func(alert Alert) bool { return alert.ID != id })
+	if len(m.alerts) == n {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateWebhook(hook *Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[hook.UserID]; !ok {
+		return ErrNotFound
+	}
+	hook.ID = m.newID("webhooks")
+	hook.CreatedAt = time.Now()
+	m.webhooks[hook.ID] = *hook
+	return nil
+}
+
+func (m *MemoryStore) GetWebhook(id int) (Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hook, ok := m.webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNotFound
+	}
+	return hook, nil
+}
+
+func (m *MemoryStore) ListWebhooks(userID int) ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var hooks []Webhook
+	for _, id := range sortedKeys(m.webhooks) {
+		if m.webhooks[id].UserID == userID {
+			hooks = append(hooks, m.webhooks[id])
+		}
+	}
+	return hooks, nil
+}
+
+func (m *MemoryStore) UpdateWebhook(hook Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.webhooks[hook.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	existing.URL, existing.EventTypes, existing.Enabled = hook.URL, hook.EventTypes, hook.Enabled
+	m.webhooks[hook.ID] = existing
+	return nil
+}
+
+func (m *MemoryStore) DeleteWebhook(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.webhooks[id]; !ok {
+		return ErrNotFound
+	}
+	m.deleteWebhookLocked(id)
+	return nil
+}
+
+// deleteWebhookLocked removes a webhook and its deliveries; callers hold mu
+func (m *MemoryStore) deleteWebhookLocked(id int) {
+	delete(m.webhooks, id)
+	m.deliveries = filterRows(m.deliveries, func(d WebhookDelivery) bool { return d.WebhookID != id })
+}
+
+func (m *MemoryStore) EnqueueWebhookDelivery(delivery *WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.webhooks[delivery.WebhookID]; !ok {
+		return ErrNotFound
+	}
+	delivery.ID = int64(m.newID("webhook_deliveries"))
+	delivery.CreatedAt = time.Now()
+	m.deliveries = append(m.deliveries, *delivery)
+	return nil
+}
+
+func (m *MemoryStore) GetWebhookDelivery(id int64) (WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.deliveries {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return WebhookDelivery{}, ErrNotFound
+}
+
+func (m *MemoryStore) ListWebhookDeliveries(webhookID int, status string, limit int) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deliveries []WebhookDelivery
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		d := m.deliveries[i]
+		if d.WebhookID == webhookID && (status == "" || d.Status == status) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MemoryStore) ClaimWebhookDeliveries(now, leaseUntil time.Time, limit int) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []*WebhookDelivery
+	for i := range m.deliveries {
+		d := &m.deliveries[i]
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]WebhookDelivery, len(due))
+	for i, d := range due {
+		d.NextAttemptAt = leaseUntil
+		claimed[i] = *d
+	}
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].ID < claimed[j].ID })
+	return claimed, nil
+}
+
+func (m *MemoryStore) RecordWebhookAttempt(delivery WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == delivery.ID {
+			delivery.WebhookID, delivery.EventType = m.deliveries[i].WebhookID, m.deliveries[i].EventType
+			delivery.Payload, delivery.CreatedAt = m.deliveries[i].Payload, m.deliveries[i].CreatedAt
+			m.deliveries[i] = delivery
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryStore) CreateBreakerSchedule(schedule *BreakerSchedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.breakers[schedule.BreakerID]; !ok {
+		return ErrNotFound
+	}
+	schedule.ID = m.newID("breaker_schedules")
+	schedule.CreatedAt = time.Now()
+	m.schedules[schedule.ID] = *schedule
+	return nil
+}
+
+func (m *MemoryStore) GetBreakerSchedule(id int) (BreakerSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	schedule, ok := m.schedules[id]
+	if !ok {
+		return BreakerSchedule{}, ErrNotFound
+	}
+	return schedule, nil
+}
+
+func (m *MemoryStore) ListBreakerSchedules(breakerID int) ([]BreakerSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var schedules []BreakerSchedule
+	for _, id := range sortedKeys(m.schedules) {
+		if m.schedules[id].BreakerID == breakerID {
+			schedules = append(schedules, m.schedules[id])
+		}
+	}
+	return schedules, nil
+}
+
+func (m *MemoryStore) UpdateBreakerSchedule(schedule BreakerSchedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.schedules[schedule.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	schedule.BreakerID, schedule.CreatedAt = existing.BreakerID, existing.CreatedAt
+	m.schedules[schedule.ID] = schedule
+	return nil
+}
+
+func (m *MemoryStore) DeleteBreakerSchedule(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.schedules[id]; !ok {
+		return ErrNotFound
+	}
+	m.deleteScheduleLocked(id)
+	return nil
+}
+
+// deleteScheduleLocked removes a schedule and its runs; callers hold mu
+func (m *MemoryStore) deleteScheduleLocked(id int) {
+	delete(m.schedules, id)
+	m.scheduleRuns = filterRows(m.scheduleRuns, func(run ScheduleRun) bool { return run.ScheduleID != id })
+}
+
+func (m *MemoryStore) DueBreakerSchedules(now time.Time) ([]BreakerSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []BreakerSchedule
+	for _, schedule := range m.schedules {
+		if schedule.Enabled && schedule.NextRunAt != nil && !schedule.NextRunAt.After(now) {
+			due = append(due, schedule)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextRunAt.Equal(*due[j].NextRunAt) {
+			return due[i].NextRunAt.Before(*due[j].NextRunAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	return due, nil
+}
+
+func (m *MemoryStore) AdvanceBreakerSchedule(id int, from time.Time, next *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	schedule, ok := m.schedules[id]
+	if !ok || schedule.NextRunAt == nil || !schedule.NextRunAt.Equal(from) {
+		return ErrNotFound
+	}
+	schedule.NextRunAt = next
+	m.schedules[id] = schedule
+	return nil
+}
+
+func (m *MemoryStore) CreateScheduleRun(run *ScheduleRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.schedules[run.ScheduleID]; !ok {
+		return ErrNotFound
+	}
+	run.ID = int64(m.newID("breaker_schedule_runs"))
+	m.scheduleRuns = append(m.scheduleRuns, *run)
+	return nil
+}
+
+func (m *MemoryStore) ListScheduleRuns(scheduleID int, limit int) ([]ScheduleRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var runs []ScheduleRun
+	for i := len(m.scheduleRuns) - 1; i >= 0; i-- {
+		if m.scheduleRuns[i].ScheduleID == scheduleID {
+			runs = append(runs, m.scheduleRuns[i])
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].ScheduledFor.After(runs[j].ScheduledFor) })
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (m *MemoryStore) GetLoadShedOverride(deviceID int) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until, ok := m.shedOverrides[deviceID]
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return until, nil
+}
+
+func (m *MemoryStore) SetLoadShedOverride(deviceID, userID int, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return ErrNotFound
+	}
+	m.shedOverrides[deviceID] = until
+	return nil
+}
+
+func (m *MemoryStore) ClearLoadShedOverride(deviceID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.shedOverrides[deviceID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.shedOverrides, deviceID)
+	return nil
+}
+
+func (m *MemoryStore) CreateLoadShedEvent(event *LoadShedEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[event.DeviceID]; !ok {
+		return ErrNotFound
+	}
+	event.ID = int64(m.newID("load_shed_events"))
+	event.CreatedAt = time.Now()
+	m.shedEvents = append(m.shedEvents, *event)
+	return nil
+}
+
+func (m *MemoryStore) ListLoadShedEvents(deviceID int, r FrequencyRange) ([]LoadShedEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []LoadShedEvent
+	for i := len(m.shedEvents) - 1; i >= 0; i-- {
+		e := m.shedEvents[i]
+		if e.DeviceID != deviceID || !r.contains(e.CreatedAt) {
+			continue
+		}
+		events = append(events, e)
+		if r.Limit > 0 && len(events) == r.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) CreateBreakerEvent(event *BreakerEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if b, ok := m.breakers[event.BreakerID]; !ok || b.DeviceID != event.DeviceID {
+		return ErrNotFound
+	}
+	event.ID = int64(m.newID("breaker_events"))
+	event.CreatedAt = time.Now()
+	m.breakerEvents = append(m.breakerEvents, *event)
+	return nil
+}
+
+func (m *MemoryStore) FindBreakerRequest(deviceID int, requestID string) (BreakerEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, cmd := range m.commands {
+		if cmd.DeviceID != deviceID || cmd.RequestID != requestID {
+			continue
+		}
+		for _, e := range m.breakerEvents {
+			if e.Kind == BreakerRequested && e.CommandID != nil && *e.CommandID == cmd.ID {
+				return e, nil
+			}
+		}
+	}
+	return BreakerEvent{}, ErrNotFound
+}
+
+func (m *MemoryStore) ListBreakerEvents(breakerID int, r FrequencyRange) ([]BreakerEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []BreakerEvent
+	for i := len(m.breakerEvents) - 1; i >= 0; i-- {
+		e := m.breakerEvents[i]
+		if e.BreakerID != breakerID || !r.contains(e.CreatedAt) {
+			continue
+		}
+		events = append(events, e)
+		if r.Limit > 0 && len(events) == r.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) CreateAuditEntry(entry *AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.ID = int64(m.newID("audit_log"))
+	entry.CreatedAt = time.Now()
+	m.auditLog = append(m.auditLog, *entry)
+	return nil
+}
+
+func (m *MemoryStore) ListAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := FrequencyRange{Start: filter.Start, End: filter.End}
+	var entries []AuditEntry
+	for i := len(m.auditLog) - 1; i >= 0; i-- {
+		e := m.auditLog[i]
+		switch {
+		case filter.ActorID != nil && (e.ActorID == nil || *e.ActorID != *filter.ActorID),
+			filter.TargetType != "" && e.TargetType != filter.TargetType,
+			filter.TargetID != nil && (e.TargetID == nil || *e.TargetID != *filter.TargetID),
+			filter.Method != "" && e.Method != filter.Method,
+			filter.Route != "" && e.Route != filter.Route,
+			filter.Outcome != "" && e.Outcome != filter.Outcome,
+			filter.BeforeID != 0 && e.ID >= filter.BeforeID,
+			!r.contains(e.CreatedAt):
+			continue
+		}
+		entries = append(entries, e)
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// memberIndexLocked finds a membership in m.members, or returns -1
+func (m *MemoryStore) memberIndexLocked(deviceID, userID int) int {
+	for i, member := range m.members {
+		if member.DeviceID == deviceID && member.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryStore) GetDeviceMember(deviceID, userID int) (DeviceMember, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.memberIndexLocked(deviceID, userID)
+	if i < 0 {
+		return DeviceMember{}, ErrNotFound
+	}
+	return m.members[i], nil
+}
+
+func (m *MemoryStore) ListDeviceMembers(deviceID int) ([]DeviceMember, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var members []DeviceMember
+	for _, member := range m.members {
+		if member.DeviceID == deviceID {
+			member.Name, member.Login = m.users[member.UserID].Name, m.users[member.UserID].Login
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func (m *MemoryStore) ListSharedDevices(userID int) ([]SharedDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var devices []SharedDevice
+	for _, id := range sortedKeys(m.devices) {
+		if i := m.memberIndexLocked(id, userID); i >= 0 {
+			devices = append(devices, SharedDevice{Device: m.devices[id], Role: m.members[i].Role})
+		}
+	}
+	return devices, nil
+}
+
+func (m *MemoryStore) SetDeviceMemberRole(deviceID, userID int, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.memberIndexLocked(deviceID, userID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.members[i].Role = role
+	return nil
+}
+
+func (m *MemoryStore) RemoveDeviceMember(deviceID, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.memberIndexLocked(deviceID, userID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.members = append(m.members[:i], m.members[i+1:]...)
+	return nil
+}
+
+func (m *MemoryStore) CreateDeviceInvitation(inv *DeviceInvitation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device, ok := m.devices[inv.DeviceID]
+	if !ok {
+		return ErrNotFound
+	}
+	inv.ID = m.newID("device_invitations")
+	inv.DeviceName = device.Name
+	inv.Status = InvitationPending
+	inv.CreatedAt = time.Now()
+	m.invitations[inv.ID] = *inv
+	return nil
+}
+
+// invitationLocked returns an invitation with its current device name
+func (m *MemoryStore) invitationLocked(id int) (DeviceInvitation, bool) {
+	inv, ok := m.invitations[id]
+	inv.DeviceName = m.devices[inv.DeviceID].Name
+	return inv, ok
+}
+
+func (m *MemoryStore) GetDeviceInvitation(id int) (DeviceInvitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invitationLocked(id)
+	if !ok {
+		return DeviceInvitation{}, ErrNotFound
+	}
+	return inv, nil
+}
+
+// listInvitationsLocked returns matching invitations newest first
+func (m *MemoryStore) listInvitationsLocked(match func(DeviceInvitation) bool) []DeviceInvitation {
+	keys := sortedKeys(m.invitations)
+	var invitations []DeviceInvitation
+	for i := len(keys) - 1; i >= 0; i-- {
+		if inv, _ := m.invitationLocked(keys[i]); match(inv) {
+			invitations = append(invitations, inv)
+		}
+	}
+	return invitations
+}
+
+func (m *MemoryStore) ListDeviceInvitations(deviceID int) ([]DeviceInvitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listInvitationsLocked(func(inv DeviceInvitation) bool { return inv.DeviceID == deviceID }), nil
+}
+
+func (m *MemoryStore) ListPendingInvitations(email string, now time.Time) ([]DeviceInvitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listInvitationsLocked(func(inv DeviceInvitation) bool {
+		return strings.EqualFold(inv.Email, email) && inv.Status == InvitationPending && inv.ExpiresAt.After(now)
+	}), nil
+}
+
+func (m *MemoryStore) AcceptDeviceInvitation(id, userID int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invitations[id]
+	if !ok || inv.Status != InvitationPending {
+		return ErrNotFound
+	}
+	inv.Status, inv.AcceptedBy, inv.RespondedAt = InvitationAccepted, &userID, &at
+	m.invitations[id] = inv
+
+	if i := m.memberIndexLocked(inv.DeviceID, userID); i >= 0 {
+		m.members[i].Role = inv.Role
+		return nil
+	}
+	m.members = append(m.members, DeviceMember{DeviceID: inv.DeviceID, UserID: userID, Role: inv.Role, InvitedBy: inv.InvitedBy, CreatedAt: at})
+	return nil
+}
+
+func (m *MemoryStore) CloseDeviceInvitation(id int, status string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invitations[id]
+	if !ok || inv.Status != InvitationPending {
+		return ErrNotFound
+	}
+	inv.Status, inv.RespondedAt = status, &at
+	m.invitations[id] = inv
+	return nil
+}
+
+func (m *MemoryStore) CreateSite(site *Site) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[site.UserID]; !ok {
+		return ErrNotFound
+	}
+	site.ID = m.newID("sites")
+	site.CreatedAt = time.Now()
+	m.sites[site.ID] = *site
+	return nil
+}
+
+func (m *MemoryStore) GetSite(id int) (Site, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	site, ok := m.sites[id]
+	if !ok {
+		return Site{}, ErrNotFound
+	}
+	return site, nil
+}
+
+func (m *MemoryStore) ListSitesByUser(userID int) ([]Site, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sites []Site
+	for _, id := range sortedKeys(m.sites) {
+		if m.sites[id].UserID == userID {
+			sites = append(sites, m.sites[id])
+		}
+	}
+	return sites, nil
+}
+
+func (m *MemoryStore) UpdateSite(site Site) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.sites[site.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	current.Name, current.Address, current.Timezone = site.Name, site.Address, site.Timezone
+	m.sites[site.ID] = current
+	return nil
+}
+
+func (m *MemoryStore) DeleteSite(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sites[id]; !ok {
+		return ErrNotFound
+	}
+	m.deleteSiteLocked(id)
+	return nil
+}
+
+// deleteSiteLocked removes a site, mirroring ON DELETE SET NULL on its devices
+func (m *MemoryStore) deleteSiteLocked(id int) {
+	delete(m.sites, id)
+	for jobID, job := range m.commandJobs {
+		if job.SiteID != nil && *job.SiteID == id {
+			job.SiteID = nil
+			m.commandJobs[jobID] = job
+		}
+	}
+	for deviceID, device := range m.devices {
+		if device.SiteID != nil && *device.SiteID == id {
+			device.SiteID = nil
+			m.devices[deviceID] = device
+		}
+	}
+}
+
+func (m *MemoryStore) SetDeviceSite(deviceID int, siteID *int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device, ok := m.devices[deviceID]
+	if !ok {
+		return ErrNotFound
+	}
+	if siteID != nil {
+		if _, ok := m.sites[*siteID]; !ok {
+			return ErrNotFound
+		}
+		id := *siteID
+		siteID = &id
+	}
+	device.SiteID = siteID
+	m.devices[deviceID] = device
+	return nil
+}
+
+func (m *MemoryStore) ListSiteDevices(siteID int) ([]Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var devices []Device
+	for _, id := range sortedKeys(m.devices) {
+		if device := m.devices[id]; device.SiteID != nil && *device.SiteID == siteID {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+func (m *MemoryStore) CreateDeviceGroup(group *DeviceGroup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[group.UserID]; !ok {
+		return ErrNotFound
+	}
+	group.ID = m.newID("device_groups")
+	group.CreatedAt = time.Now()
+	m.groups[group.ID] = *group
+	return nil
+}
+
+func (m *MemoryStore) GetDeviceGroup(id int) (DeviceGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[id]
+	if !ok {
+		return DeviceGroup{}, ErrNotFound
+	}
+	return group, nil
+}
+
+func (m *MemoryStore) ListDeviceGroupsByUser(userID int) ([]DeviceGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var groups []DeviceGroup
+	for _, id := range sortedKeys(m.groups) {
+		if m.groups[id].UserID == userID {
+			groups = append(groups, m.groups[id])
+		}
+	}
+	return groups, nil
+}
+
+func (m *MemoryStore) RenameDeviceGroup(id int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[id]
+	if !ok {
+		return ErrNotFound
+	}
+	group.Name = name
+	m.groups[id] = group
+	return nil
+}
+
+func (m *MemoryStore) DeleteDeviceGroup(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.groups[id]; !ok {
+		return ErrNotFound
+	}
+	m.deleteGroupLocked(id)
+	return nil
+}
+
+func (m *MemoryStore) deleteGroupLocked(id int) {
+	delete(m.groups, id)
+	for jobID, job := range m.commandJobs {
+		if job.GroupID != nil && *job.GroupID == id {
+			job.GroupID = nil
+			m.commandJobs[jobID] = job
+		}
+	}
+	m.groupDevices = filterRows(m.groupDevices, func(g memoryGroupDevice) bool { return g.groupID != id })
+}
+
+func (m *MemoryStore) AddGroupDevice(groupID, deviceID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.groups[groupID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := m.devices[deviceID]; !ok {
+		return ErrNotFound
+	}
+	row := memoryGroupDevice{groupID, deviceID}
+	if !slices.Contains(m.groupDevices, row) {
+		m.groupDevices = append(m.groupDevices, row)
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveGroupDevice(groupID, deviceID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.Index(m.groupDevices, memoryGroupDevice{groupID, deviceID})
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.groupDevices = slices.Delete(m.groupDevices, i, i+1)
+	return nil
+}
+
+func (m *MemoryStore) ListGroupDevices(groupID int) ([]Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var devices []Device
+	for _, id := range sortedKeys(m.devices) {
+		if slices.Contains(m.groupDevices, memoryGroupDevice{groupID, id}) {
+			devices = append(devices, m.devices[id])
+		}
+	}
+	return devices, nil
+}
+
+func (m *MemoryStore) CreateCommandJob(job *CommandJob, targets []CommandJobTarget) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[job.UserID]; !ok {
+		return ErrNotFound
+	}
+	for _, t := range targets {
+		if _, ok := m.devices[t.DeviceID]; !ok {
+			return ErrNotFound
+		}
+	}
+	job.ID = int64(m.newID("command_jobs"))
+	job.Status = JobRunning
+	job.CreatedAt = time.Now()
+	m.commandJobs[job.ID] = *job
+	for i := range targets {
+		t := &targets[i]
+		t.ID = int64(m.newID("command_job_targets"))
+		t.JobID = job.ID
+		t.Status = TargetPending
+		t.UpdatedAt = job.CreatedAt
+		m.jobTargets = append(m.jobTargets, *t)
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetCommandJob(id int64) (CommandJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.commandJobs[id]
+	if !ok {
+		return CommandJob{}, ErrNotFound
+	}
+	return job, nil
+}
+
+func (m *MemoryStore) ListCommandJobs(userID int, limit int) ([]CommandJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := sortedKeys(m.commandJobs)
+	var jobs []CommandJob
+	for i := len(keys) - 1; i >= 0 && (limit <= 0 || len(jobs) < limit); i-- {
+		if job := m.commandJobs[keys[i]]; job.UserID == userID {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (m *MemoryStore) ListCommandJobTargets(jobID int64) ([]CommandJobTarget, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var targets []CommandJobTarget
+	for _, t := range m.jobTargets {
+		if t.JobID == jobID {
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+func (m *MemoryStore) UpdateCommandJobTarget(target CommandJobTarget) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, t := range m.jobTargets {
+		if t.ID == target.ID {
+			t.CommandID, t.Status, t.Error, t.UpdatedAt = target.CommandID, target.Status, target.Error, target.UpdatedAt
+			m.jobTargets[i] = t
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryStore) CompleteCommandJob(id int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.commandJobs[id]
+	if !ok || job.Status != JobRunning {
+		return ErrNotFound
+	}
+	job.Status, job.CompletedAt = JobCompleted, &at
+	m.commandJobs[id] = job
+	return nil
+}
+
+func (m *MemoryStore) AbortRunningCommandJobs(at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, job := range m.commandJobs {
+		if job.Status != JobRunning {
+			continue
+		}
+		for i, t := range m.jobTargets {
+			if t.JobID == id && t.Status == TargetPending {
+				m.jobTargets[i].Status, m.jobTargets[i].Error, m.jobTargets[i].UpdatedAt = TargetFailed, "Server restarted", at
+			}
+		}
+		job.Status, job.CompletedAt = JobAborted, &at
+		m.commandJobs[id] = job
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateFirmware(fw *Firmware, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.firmware {
+		if existing.HardwareModel == fw.HardwareModel && existing.Version == fw.Version {
+			return ErrFirmwareExists
+		}
+	}
+	fw.ID = m.newID("firmware")
+	fw.CreatedAt = time.Now()
+	m.firmware[fw.ID] = *fw
+	m.firmwareData[fw.ID] = slices.Clone(data)
+	return nil
+}
+
+func (m *MemoryStore) GetFirmware(id int) (Firmware, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fw, ok := m.firmware[id]
+	if !ok {
+		return Firmware{}, ErrNotFound
+	}
+	return fw, nil
+}
+
+func (m *MemoryStore) GetFirmwareData(id int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.firmwareData[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (m *MemoryStore) ListFirmware(model string) ([]Firmware, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := sortedKeys(m.firmware)
+	var images []Firmware
+	for i := len(keys) - 1; i >= 0; i-- {
+		if fw := m.firmware[keys[i]]; model == "" || fw.HardwareModel == model {
+			images = append(images, fw)
+		}
+	}
+	return images, nil
+}
+
+func (m *MemoryStore) CreateFirmwareRollout(rollout *FirmwareRollout, deviceIDs []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[rollout.UserID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := m.firmware[rollout.FirmwareID]; !ok {
+		return ErrNotFound
+	}
+	for _, deviceID := range deviceIDs {
+		if _, ok := m.devices[deviceID]; !ok {
+			return ErrNotFound
+		}
+	}
+	rollout.ID = m.newID("firmware_rollouts")
+	rollout.Status = RolloutRunning
+	rollout.CreatedAt = time.Now()
+	m.rollouts[rollout.ID] = *rollout
+	for _, deviceID := range deviceIDs {
+		m.rolloutTargets = append(m.rolloutTargets, RolloutTarget{
+			ID:        int64(m.newID("firmware_rollout_targets")),
+			RolloutID: rollout.ID,
+			DeviceID:  deviceID,
+			Status:    OTAWaiting,
+			UpdatedAt: rollout.CreatedAt,
+		})
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetFirmwareRollout(id int) (FirmwareRollout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rollout, ok := m.rollouts[id]
+	if !ok {
+		return FirmwareRollout{}, ErrNotFound
+	}
+	return rollout, nil
+}
+
+func (m *MemoryStore) ListFirmwareRollouts(userID int) ([]FirmwareRollout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := sortedKeys(m.rollouts)
+	var rollouts []FirmwareRollout
+	for i := len(keys) - 1; i >= 0; i-- {
+		if rollout := m.rollouts[keys[i]]; rollout.UserID == userID {
+			rollouts = append(rollouts, rollout)
+		}
+	}
+	return rollouts, nil
+}
+
+func (m *MemoryStore) ListRolloutTargets(rolloutID int) ([]RolloutTarget, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var targets []RolloutTarget
+	for _, t := range m.rolloutTargets {
+		if t.RolloutID == rolloutID {
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+func (m *MemoryStore) UpdateRolloutTarget(target RolloutTarget) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, t := range m.rolloutTargets {
+		if t.ID == target.ID {
+			t.Status, t.Progress, t.CommandID, t.Error, t.UpdatedAt = target.Status, target.Progress, target.CommandID, target.Error, target.UpdatedAt
+			m.rolloutTargets[i] = t
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryStore) SetRolloutStatus(id int, status string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rollout, ok := m.rollouts[id]
+	if !ok || rollout.Status != RolloutRunning {
+		return ErrNotFound
+	}
+	rollout.Status, rollout.FinishedAt = status, &at
+	m.rollouts[id] = rollout
+	return nil
+}
+
+func (m *MemoryStore) SetRolloutPercent(id, percent int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rollout, ok := m.rollouts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	rollout.Percent = percent
+	m.rollouts[id] = rollout
+	return nil
+}
+
+func (m *MemoryStore) ActiveRolloutTarget(deviceID int) (RolloutTarget, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.rolloutTargets) - 1; i >= 0; i-- {
+		t := m.rolloutTargets[i]
+		if t.DeviceID != deviceID {
+			continue
+		}
+		switch t.Status {
+		case OTAQueued, OTADownloading, OTARebooting:
+			return t, nil
+		}
+	}
+	return RolloutTarget{}, ErrNotFound
+}
+
+func (m *MemoryStore) FailExpiredRolloutTargets(at time.Time) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rolloutIDs []int
+	for i, t := range m.rolloutTargets {
+		if t.Status != OTAQueued || t.CommandID == nil {
+			continue
+		}
+		j := slices.IndexFunc(m.commands, func(cmd DeviceCommand) bool { return cmd.ID == *t.CommandID })
+		if j < 0 || (m.commands[j].Status != CommandExpired && m.commands[j].Status != CommandCancelled) {
+			continue
+		}
+		t.Status, t.Error, t.UpdatedAt = OTAFailed, "Update was not delivered before it expired", at
+		m.rolloutTargets[i] = t
+		if !slices.Contains(rolloutIDs, t.RolloutID) {
+			rolloutIDs = append(rolloutIDs, t.RolloutID)
+		}
+	}
+	return rolloutIDs, nil
+}
+
+func (m *MemoryStore) CreateDeviceConfig(cfg *DeviceConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[cfg.DeviceID]; !ok {
+		return ErrNotFound
+	}
+	cfg.Version = 1
+	for _, existing := range m.deviceConfigs {
+		if existing.DeviceID == cfg.DeviceID && existing.Version >= cfg.Version {
+			cfg.Version = existing.Version + 1
+		}
+	}
+	cfg.CreatedAt = time.Now()
+	cfg.AppliedAt, cfg.Error = nil, ""
+	m.deviceConfigs = append(m.deviceConfigs, *cfg)
+	return nil
+}
+
+func (m *MemoryStore) LatestDeviceConfig(deviceID int) (DeviceConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var latest *DeviceConfig
+	for i, cfg := range m.deviceConfigs {
+		if cfg.DeviceID == deviceID && (latest == nil || cfg.Version > latest.Version) {
+			latest = &m.deviceConfigs[i]
+		}
+	}
+	if latest == nil {
+		return DeviceConfig{}, ErrNotFound
+	}
+	return *latest, nil
+}
+
+func (m *MemoryStore) AppliedDeviceConfig(deviceID int) (DeviceConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var applied *DeviceConfig
+	for i, cfg := range m.deviceConfigs {
+		if cfg.DeviceID != deviceID || cfg.AppliedAt == nil {
+			continue
+		}
+		if applied == nil || cfg.AppliedAt.After(*applied.AppliedAt) ||
+			(cfg.AppliedAt.Equal(*applied.AppliedAt) && cfg.Version > applied.Version) {
+			applied = &m.deviceConfigs[i]
+		}
+	}
+	if applied == nil {
+		return DeviceConfig{}, ErrNotFound
+	}
+	return *applied, nil
+}
+
+func (m *MemoryStore) RecordDeviceConfigResult(deviceID, version int, applyErr string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, cfg := range m.deviceConfigs {
+		if cfg.DeviceID == deviceID && cfg.Version == version {
+			if applyErr != "" {
+				m.deviceConfigs[i].Error = applyErr
+			} else {
+				m.deviceConfigs[i].AppliedAt, m.deviceConfigs[i].Error = &at, ""
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
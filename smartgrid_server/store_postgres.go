@@ -0,0 +1,2150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore implements Store on top of lib/pq
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func connectDB() (*sql.DB, error) {
+	connStr := fmt.Sprintf(
+		"user=%s password=%s dbname=%s sslmode=%s",
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_NAME"),
+		os.Getenv("DB_SSLMODE"),
+	)
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify connection
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Connected to PostgreSQL database!")
+	return db, nil
+}
+
+// rowsAffected maps an UPDATE/DELETE that touched nothing to ErrNotFound
+func rowsAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// notFound translates sql.ErrNoRows into ErrNotFound
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) CreateUser(user *User) error {
+	sqlStatement := `INSERT INTO users (name, email, login, pass, isverified) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	return s.db.QueryRow(sqlStatement, user.Name, user.Email, user.Login, user.Pass, user.IsVerified).Scan(&user.ID)
+}
+
+func (s *PostgresStore) SearchUsers(query string) ([]User, error) {
+	sqlStatement := `
+        SELECT id, name, email, login, pass, isverified, is_admin
+        FROM users
+        WHERE name ILIKE $1 OR email ILIKE $1 OR login ILIKE $1`
+
+	rows, err := s.db.Query(sqlStatement, "%"+query+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Login, &user.Pass, &user.IsVerified, &user.IsAdmin); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *PostgresStore) GetUserByLogin(login string) (User, error) {
+	var user User
+	sqlStatement := `SELECT id, name, email, login, pass, isverified, is_admin FROM users WHERE login = $1`
+	err := s.db.QueryRow(sqlStatement, login).Scan(&user.ID, &user.Name, &user.Email, &user.Login, &user.Pass, &user.IsVerified, &user.IsAdmin)
+	return user, notFound(err)
+}
+
+func (s *PostgresStore) GetUser(id int) (User, error) {
+	var user User
+	sqlStatement := `SELECT id, name, email, login, pass, isverified, is_admin FROM users WHERE id = $1`
+	err := s.db.QueryRow(sqlStatement, id).Scan(&user.ID, &user.Name, &user.Email, &user.Login, &user.Pass, &user.IsVerified, &user.IsAdmin)
+	return user, notFound(err)
+}
+
+func (s *PostgresStore) SetUserAdmin(id int, admin bool) error {
+	res, err := s.db.Exec(`UPDATE users SET is_admin = $2 WHERE id = $1`, id, admin)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) UpdateUser(user User) error {
+	sqlStatement := `
+        UPDATE users
+        SET name = $1, email = $2, login = $3, pass = $4, isverified = $5
+        WHERE id = $6`
+	res, err := s.db.Exec(sqlStatement, user.Name, user.Email, user.Login, user.Pass, user.IsVerified, user.ID)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteUser(id int) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) SetUserToken(id int, token string) error {
+	_, err := s.db.Exec(`UPDATE users SET jwt = $1 WHERE id = $2`, token, id)
+	return err
+}
+
+func (s *PostgresStore) CreateDevice(device *Device) error {
+	sqlStatement := `INSERT INTO devices (name, user_id) VALUES ($1, $2) RETURNING id`
+	return s.db.QueryRow(sqlStatement, device.Name, device.UserID).Scan(&device.ID)
+}
+
+const deviceColumns = `id, user_id, name, mac_addr, site_id, hardware_model, firmware_version`
+
+// scanDevice reads deviceColumns in order
+func scanDevice(row interface{ Scan(...any) error }) (Device, error) {
+	var device Device
+	var macAddr, model, version sql.NullString // Handles NULL values
+	if err := row.Scan(&device.ID, &device.UserID, &device.Name, &macAddr, &device.SiteID, &model, &version); err != nil {
+		return device, notFound(err)
+	}
+	device.MACAddr = macAddr.String
+	device.HardwareModel, device.FirmwareVersion = model.String, version.String
+	return device, nil
+}
+
+func (s *PostgresStore) GetDevice(id int) (Device, error) {
+	return scanDevice(s.db.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) GetDeviceByMAC(mac string) (Device, error) {
+	return scanDevice(s.db.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE mac_addr = $1`, mac))
+}
+
+func (s *PostgresStore) ListDevicesByUser(userID int) ([]Device, error) {
+	return scanDevices(s.db.Query(`SELECT `+deviceColumns+` FROM devices WHERE user_id = $1 ORDER BY id`, userID))
+}
+
+func scanDevices(rows *sql.Rows, err error) ([]Device, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+func (s *PostgresStore) UpdateDeviceName(id int, name string) error {
+	res, err := s.db.Exec(`UPDATE devices SET name = $1 WHERE id = $2`, name, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) SetDeviceFirmware(id int, model, version string) error {
+	res, err := s.db.Exec(`
+        UPDATE devices SET hardware_model = COALESCE(NULLIF($2, ''), hardware_model), firmware_version = $3
+        WHERE id = $1`, id, model, version)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteDevice(id int) error {
+	res, err := s.db.Exec(`DELETE FROM devices WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) CreateBreaker(breaker *Breaker) error {
+	sqlStatement := `INSERT INTO breakers (name, device_id, breaker_number, priority) VALUES ($1, $2, $3, $4) RETURNING id, status`
+	return s.db.QueryRow(sqlStatement, breaker.Name, breaker.DeviceID, breaker.Breaker_Number, breaker.Priority).Scan(&breaker.ID, &breaker.Status)
+}
+
+func (s *PostgresStore) GetBreaker(id int) (Breaker, error) {
+	var breaker Breaker
+	sqlStatement := `SELECT id, device_id, name, breaker_number, status, priority, shed_at FROM breakers WHERE id = $1`
+	err := s.db.QueryRow(sqlStatement, id).Scan(&breaker.ID, &breaker.DeviceID, &breaker.Name, &breaker.Breaker_Number, &breaker.Status,
+		&breaker.Priority, &breaker.ShedAt)
+	return breaker, notFound(err)
+}
+
+func (s *PostgresStore) ListBreakersByDevice(deviceID int) ([]Breaker, error) {
+	sqlStatement := `SELECT id, device_id, name, breaker_number, status, priority, shed_at FROM breakers WHERE device_id = $1 ORDER BY id`
+	rows, err := s.db.Query(sqlStatement, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var breakers []Breaker
+	for rows.Next() {
+		var breaker Breaker
+		if err := rows.Scan(&breaker.ID, &breaker.DeviceID, &breaker.Name, &breaker.Breaker_Number, &breaker.Status,
+			&breaker.Priority, &breaker.ShedAt); err != nil {
+			return nil, err
+		}
+		breakers = append(breakers, breaker)
+	}
+	return breakers, rows.Err()
+}
+
+func (s *PostgresStore) UpdateBreaker(id int, name, breakerNumber string) error {
+	res, err := s.db.Exec(`UPDATE breakers SET name = $1, breaker_number = $2 WHERE id = $3`, name, breakerNumber, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) SetBreakerStatus(id int, status bool) error {
+	res, err := s.db.Exec(`UPDATE breakers SET status = $1 WHERE id = $2`, status, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) SetBreakerPriority(id int, priority int) error {
+	res, err := s.db.Exec(`UPDATE breakers SET priority = $1 WHERE id = $2`, priority, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) SetBreakerShed(id int, at *time.Time) error {
+	res, err := s.db.Exec(`UPDATE breakers SET shed_at = $1 WHERE id = $2`, at, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteBreaker(id int) error {
+	res, err := s.db.Exec(`DELETE FROM breakers WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) InsertFrequency(entry FrequencyLog) error {
+	_, err := s.db.Exec(`INSERT INTO frequency_logs (device_id, frequency, timestamp, rocof) VALUES ($1, $2, $3, $4)`,
+		entry.DeviceID, entry.Frequency, entry.Timestamp, entry.Rocof)
+	return err
+}
+
+// frequencyFilter collects the arguments of a frequency query so the device
+// and time bounds can be applied to several tables in one statement
+type frequencyFilter struct {
+	args       []interface{}
+	start, end int
+}
+
+func newFrequencyFilter(deviceID int, r FrequencyRange) *frequencyFilter {
+	f := &frequencyFilter{}
+	f.arg(deviceID)
+	if !r.Start.IsZero() {
+		f.start = f.arg(r.Start)
+	}
+	if !r.End.IsZero() {
+		f.end = f.arg(r.End)
+	}
+	return f
+}
+
+// arg appends a query argument and returns its placeholder number
+func (f *frequencyFilter) arg(v interface{}) int {
+	f.args = append(f.args, v)
+	return len(f.args)
+}
+
+// where restricts a table whose time column is col to the device and range
+func (f *frequencyFilter) where(col string) string {
+	where := `device_id = $1`
+	if f.start > 0 {
+		where += fmt.Sprintf(" AND %s >= $%d", col, f.start)
+	}
+	if f.end > 0 {
+		where += fmt.Sprintf(" AND %s <= $%d", col, f.end)
+	}
+	return where
+}
+
+// limitClause appends LIMIT for a positive limit
+func limitClause(limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d", limit)
+}
+
+// rollupTables names the table and state key of each rollup resolution
+var rollupTables = map[time.Duration]struct{ table, key string }{
+	time.Minute: {"frequency_rollups_1m", "1m"},
+	time.Hour:   {"frequency_rollups_1h", "1h"},
+}
+
+// rollupColumns selects a rollup table, or raw readings as one-sample
+// rollups; rollupAggregates merges rows of either into one
+const (
+	rollupColumns = `bucket, reading_count, min_frequency, max_frequency, sum_frequency, sum_sq_frequency,
+        rocof_count, min_rocof, max_rocof, sum_rocof`
+	rawAsRollup = `timestamp, 1, frequency, frequency, frequency, frequency * frequency,
+        CASE WHEN rocof IS NULL THEN 0 ELSE 1 END, rocof, rocof, COALESCE(rocof, 0)`
+	rollupAggregates = `SUM(reading_count), MIN(min_frequency), MAX(max_frequency), SUM(sum_frequency),
+        SUM(sum_sq_frequency), SUM(rocof_count), MIN(min_rocof), MAX(max_rocof), SUM(sum_rocof)`
+)
+
+// scanRollup reads a bucket followed by the rollupAggregates columns
+func scanRollup(rows *sql.Rows) (FrequencyRollup, error) {
+	var r FrequencyRollup
+	var rocofMin, rocofMax sql.NullFloat64
+	err := rows.Scan(&r.Bucket, &r.Count, &r.Min, &r.Max, &r.Sum, &r.SumSq,
+		&r.RocofCount, &rocofMin, &rocofMax, &r.RocofSum)
+	r.RocofMin, r.RocofMax = rocofMin.Float64, rocofMax.Float64
+	return r, err
+}
+
+// epochBucket truncates a timestamp column to a whole number of seconds since the epoch
+func epochBucket(col string, width time.Duration) string {
+	secs := int64(width / time.Second)
+	return fmt.Sprintf("to_timestamp(floor(extract(epoch FROM %s) / %d) * %d)", col, secs, secs)
+}
+
+func (s *PostgresStore) ListFrequency(deviceID int, r FrequencyRange) ([]FrequencyLog, error) {
+	f := newFrequencyFilter(deviceID, r)
+	query := `SELECT frequency, timestamp, rocof FROM frequency_logs WHERE ` + f.where("timestamp") +
+		` ORDER BY timestamp` + limitClause(r.Limit)
+
+	rows, err := s.db.Query(query, f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []FrequencyLog
+	for rows.Next() {
+		entry := FrequencyLog{DeviceID: deviceID}
+		if err := rows.Scan(&entry.Frequency, &entry.Timestamp, &entry.Rocof); err != nil {
+			return nil, err
+		}
+		logs = append(logs, entry)
+	}
+	return logs, rows.Err()
+}
+
+func (s *PostgresStore) AggregateFrequency(deviceID int, r FrequencyRange, bucket time.Duration, loc *time.Location) ([]FrequencyBucket, error) {
+	watermarks, err := s.FrequencyWatermarks()
+	if err != nil {
+		return nil, err
+	}
+	f := newFrequencyFilter(deviceID, r)
+
+	// Coarsest tier first; each serves from the previous watermark to its own
+	var sources []string
+	lower := 0
+	for _, tier := range rollupTiers(bucket, loc) {
+		upper := f.arg(watermarks[tier])
+		cond := fmt.Sprintf("bucket < $%d", upper)
+		if lower > 0 {
+			cond += fmt.Sprintf(" AND bucket >= $%d", lower)
+		}
+		sources = append(sources, `SELECT `+rollupColumns+` FROM `+rollupTables[tier].table+
+			` WHERE `+f.where("bucket")+` AND `+cond)
+		lower = upper
+	}
+	raw := `SELECT ` + rawAsRollup + ` FROM frequency_logs WHERE ` + f.where("timestamp")
+	if lower > 0 {
+		raw += fmt.Sprintf(" AND timestamp >= $%d", lower)
+	}
+	sources = append(sources, raw)
+
+	// Sub-hour buckets line up with every real UTC offset, so plain epoch
+	// arithmetic works; hours and days are truncated on the local clock
+	var bucketExpr string
+	switch bucket {
+	case time.Hour, 24 * time.Hour:
+		unit := "hour"
+		if bucket == 24*time.Hour {
+			unit = "day"
+		}
+		tz := f.arg(loc.String())
+		bucketExpr = fmt.Sprintf("date_trunc('%s', bucket AT TIME ZONE $%d) AT TIME ZONE $%d", unit, tz, tz)
+	default:
+		bucketExpr = epochBucket("bucket", bucket)
+	}
+
+	rows, err := s.db.Query(`
+        SELECT `+bucketExpr+` AS start, `+rollupAggregates+`
+        FROM (`+strings.Join(sources, " UNION ALL ")+`) AS parts (`+rollupColumns+`)
+        GROUP BY start ORDER BY start`+limitClause(r.Limit), f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []FrequencyBucket
+	for rows.Next() {
+		rollup, err := scanRollup(rows)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, rollup.bucket())
+	}
+	return buckets, rows.Err()
+}
+
+func (s *PostgresStore) RollupFrequency(resolution time.Duration, until time.Time) error {
+	target, ok := rollupTables[resolution]
+	if !ok {
+		return fmt.Errorf("no rollup table for %s", resolution)
+	}
+	until = until.Truncate(resolution)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serialise builders of the same resolution on the state row
+	if _, err := tx.Exec(`
+        INSERT INTO frequency_rollup_state (resolution, rolled_up_to) VALUES ($1, $2)
+        ON CONFLICT (resolution) DO NOTHING`, target.key, time.Time{}); err != nil {
+		return err
+	}
+	var from time.Time
+	if err := tx.QueryRow(`SELECT rolled_up_to FROM frequency_rollup_state WHERE resolution = $1 FOR UPDATE`, target.key).Scan(&from); err != nil {
+		return err
+	}
+
+	// The first resolution reads raw readings, later ones the resolution before
+	source := `SELECT device_id, ` + rawAsRollup + ` FROM frequency_logs`
+	for i, res := range rollupResolutions {
+		if res != resolution || i == 0 {
+			continue
+		}
+		prev := rollupTables[rollupResolutions[i-1]]
+		var prevUntil time.Time
+		err := tx.QueryRow(`SELECT rolled_up_to FROM frequency_rollup_state WHERE resolution = $1`, prev.key).Scan(&prevUntil)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		until = minTime(until, prevUntil)
+		source = `SELECT device_id, ` + rollupColumns + ` FROM ` + prev.table
+	}
+	if !until.After(from) {
+		return nil
+	}
+
+	if _, err := tx.Exec(`
+        INSERT INTO `+target.table+` (device_id, `+rollupColumns+`)
+        SELECT device_id, `+epochBucket("bucket", resolution)+`, `+rollupAggregates+`
+        FROM (`+source+`) AS parts (device_id, `+rollupColumns+`)
+        WHERE bucket >= $1 AND bucket < $2
+        GROUP BY 1, 2
+        ON CONFLICT (device_id, bucket) DO UPDATE SET
+            reading_count = EXCLUDED.reading_count,
+            min_frequency = EXCLUDED.min_frequency,
+            max_frequency = EXCLUDED.max_frequency,
+            sum_frequency = EXCLUDED.sum_frequency,
+            sum_sq_frequency = EXCLUDED.sum_sq_frequency,
+            rocof_count = EXCLUDED.rocof_count,
+            min_rocof = EXCLUDED.min_rocof,
+            max_rocof = EXCLUDED.max_rocof,
+            sum_rocof = EXCLUDED.sum_rocof`, from, until); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE frequency_rollup_state SET rolled_up_to = $2 WHERE resolution = $1`, target.key, until); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) FrequencyWatermarks() (map[time.Duration]time.Time, error) {
+	watermarks := make(map[time.Duration]time.Time)
+	for res, target := range rollupTables {
+		var t time.Time
+		err := s.db.QueryRow(`SELECT rolled_up_to FROM frequency_rollup_state WHERE resolution = $1`, target.key).Scan(&t)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		watermarks[res] = t
+	}
+	return watermarks, nil
+}
+
+func (s *PostgresStore) PruneFrequency(resolution time.Duration, before time.Time) (int64, error) {
+	query := `DELETE FROM frequency_logs WHERE timestamp < $1`
+	if resolution != 0 {
+		target, ok := rollupTables[resolution]
+		if !ok {
+			return 0, fmt.Errorf("no rollup table for %s", resolution)
+		}
+		query = `DELETE FROM ` + target.table + ` WHERE bucket < $1`
+	}
+	res, err := s.db.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *PostgresStore) IssueDeviceCredential(deviceID int, secretHash string) (DeviceCredential, error) {
+	credential := DeviceCredential{DeviceID: deviceID}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return credential, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE device_credentials SET revoked_at = NOW() WHERE device_id = $1 AND revoked_at IS NULL`, deviceID); err != nil {
+		return credential, err
+	}
+	err = tx.QueryRow(`INSERT INTO device_credentials (device_id, secret_hash) VALUES ($1, $2) RETURNING id, created_at`,
+		deviceID, secretHash).Scan(&credential.ID, &credential.CreatedAt)
+	if err != nil {
+		return credential, err
+	}
+	return credential, tx.Commit()
+}
+
+func (s *PostgresStore) ActiveCredentialHash(deviceID int) (string, error) {
+	var hash string
+	err := s.db.QueryRow(`SELECT secret_hash FROM device_credentials WHERE device_id = $1 AND revoked_at IS NULL`, deviceID).Scan(&hash)
+	return hash, notFound(err)
+}
+
+func (s *PostgresStore) ListDeviceCredentials(deviceID int) ([]DeviceCredential, error) {
+	rows, err := s.db.Query(`SELECT id, device_id, created_at, revoked_at FROM device_credentials WHERE device_id = $1 ORDER BY id`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []DeviceCredential
+	for rows.Next() {
+		var credential DeviceCredential
+		if err := rows.Scan(&credential.ID, &credential.DeviceID, &credential.CreatedAt, &credential.RevokedAt); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (s *PostgresStore) RevokeDeviceCredentials(deviceID int) error {
+	_, err := s.db.Exec(`UPDATE device_credentials SET revoked_at = NOW() WHERE device_id = $1 AND revoked_at IS NULL`, deviceID)
+	return err
+}
+
+func (s *PostgresStore) CreateDeviceClaim(deviceID int, codeHash string, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE device_claims SET expires_at = LEAST(expires_at, NOW()) WHERE device_id = $1 AND used_at IS NULL`, deviceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO device_claims (device_id, code_hash, expires_at) VALUES ($1, $2, $3)`, deviceID, codeHash, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) RedeemDeviceClaim(codeHash, mac string, now time.Time) (Device, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Device{}, err
+	}
+	defer tx.Rollback()
+
+	var claimID, deviceID int
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRow(`SELECT id, device_id, expires_at, used_at FROM device_claims WHERE code_hash = $1 FOR UPDATE`, codeHash).
+		Scan(&claimID, &deviceID, &expiresAt, &usedAt)
+	if err != nil {
+		return Device{}, notFound(err)
+	}
+	if usedAt.Valid {
+		return Device{}, ErrClaimUsed
+	}
+	if !now.Before(expiresAt) {
+		return Device{}, ErrClaimExpired
+	}
+
+	var otherID int
+	err = tx.QueryRow(`SELECT id FROM devices WHERE mac_addr = $1 AND id <> $2`, mac, deviceID).Scan(&otherID)
+	if err == nil {
+		return Device{}, ErrClaimConflict
+	} else if err != sql.ErrNoRows {
+		return Device{}, err
+	}
+
+	if _, err := tx.Exec(`UPDATE device_claims SET used_at = $1 WHERE id = $2`, now, claimID); err != nil {
+		return Device{}, err
+	}
+	device, err := scanDevice(tx.QueryRow(`UPDATE devices SET mac_addr = $1 WHERE id = $2 RETURNING `+deviceColumns, mac, deviceID))
+	if err != nil {
+		return Device{}, err
+	}
+	return device, tx.Commit()
+}
+
+const commandColumns = `id, device_id, request_id, command, payload, status, created_at, expires_at, sent_at, completed_at, result`
+
+func scanCommand(row interface{ Scan(...any) error }) (DeviceCommand, error) {
+	var cmd DeviceCommand
+	var payload, result []byte
+	err := row.Scan(&cmd.ID, &cmd.DeviceID, &cmd.RequestID, &cmd.Command, &payload, &cmd.Status,
+		&cmd.CreatedAt, &cmd.ExpiresAt, &cmd.SentAt, &cmd.CompletedAt, &result)
+	if err != nil {
+		return cmd, notFound(err)
+	}
+	if err := json.Unmarshal(payload, &cmd.Payload); err != nil {
+		return cmd, err
+	}
+	if result != nil {
+		cmd.Result = new(DeviceResponse)
+		if err := json.Unmarshal(result, cmd.Result); err != nil {
+			return cmd, err
+		}
+	}
+	return cmd, nil
+}
+
+func scanCommands(rows *sql.Rows, err error) ([]DeviceCommand, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cmds []DeviceCommand
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, rows.Err()
+}
+
+func (s *PostgresStore) CreateCommand(cmd *DeviceCommand) error {
+	payload, err := json.Marshal(cmd.Payload)
+	if err != nil {
+		return err
+	}
+	return s.db.QueryRow(`
+        INSERT INTO device_commands (device_id, request_id, command, payload, expires_at)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, status, created_at`,
+		cmd.DeviceID, cmd.RequestID, cmd.Command, string(payload), cmd.ExpiresAt).
+		Scan(&cmd.ID, &cmd.Status, &cmd.CreatedAt)
+}
+
+func (s *PostgresStore) GetCommand(id int64) (DeviceCommand, error) {
+	return scanCommand(s.db.QueryRow(`SELECT `+commandColumns+` FROM device_commands WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListCommands(deviceID int, status string, limit int) ([]DeviceCommand, error) {
+	return scanCommands(s.db.Query(`
+        SELECT `+commandColumns+` FROM device_commands
+        WHERE device_id = $1 AND ($2 = '' OR status = $2)
+        ORDER BY id DESC LIMIT $3`, deviceID, status, limit))
+}
+
+func (s *PostgresStore) PendingCommands(deviceID int, now time.Time) ([]DeviceCommand, error) {
+	return scanCommands(s.db.Query(`
+        SELECT `+commandColumns+` FROM device_commands
+        WHERE device_id = $1 AND status = 'pending' AND expires_at > $2
+        ORDER BY id`, deviceID, now))
+}
+
+func (s *PostgresStore) MarkCommandSent(id int64, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE device_commands SET status = 'sent', sent_at = $2 WHERE id = $1 AND status = 'pending'`, id, at)
+	return err
+}
+
+func (s *PostgresStore) CompleteCommand(deviceID int, requestID, status string, result DeviceResponse, at time.Time) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`
+        UPDATE device_commands
+        SET status = $3, result = $4, completed_at = $5, sent_at = COALESCE(sent_at, $5)
+        WHERE device_id = $1 AND request_id = $2 AND status IN ('pending', 'sent')`,
+		deviceID, requestID, status, string(body), at)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) CancelCommand(id int64, at time.Time) error {
+	var status string
+	err := s.db.QueryRow(`
+        WITH target AS (SELECT id, status FROM device_commands WHERE id = $1 FOR UPDATE),
+        cancelled AS (
+            UPDATE device_commands d SET status = 'cancelled', completed_at = $2
+            FROM target WHERE d.id = target.id AND target.status = 'pending'
+            RETURNING d.id
+        )
+        SELECT target.status FROM target`, id, at).Scan(&status)
+	if err != nil {
+		return notFound(err)
+	}
+	if status != CommandPending {
+		return ErrCommandNotPending
+	}
+	return nil
+}
+
+func (s *PostgresStore) ExpireCommands(now time.Time) (int, error) {
+	res, err := s.db.Exec(`
+        UPDATE device_commands SET status = 'expired', completed_at = $1
+        WHERE status IN ('pending', 'sent') AND expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func scanSessions(rows *sql.Rows, err error) ([]DeviceSession, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []DeviceSession
+	for rows.Next() {
+		var session DeviceSession
+		if err := rows.Scan(&session.ID, &session.DeviceID, &session.RemoteAddr,
+			&session.ConnectedAt, &session.DisconnectedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *PostgresStore) OpenDeviceSession(session *DeviceSession) error {
+	return s.db.QueryRow(`
+        INSERT INTO device_sessions (device_id, remote_addr, connected_at)
+        VALUES ($1, $2, $3) RETURNING id`,
+		session.DeviceID, session.RemoteAddr, session.ConnectedAt).Scan(&session.ID)
+}
+
+func (s *PostgresStore) CloseDeviceSession(id int64, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE device_sessions SET disconnected_at = $2 WHERE id = $1 AND disconnected_at IS NULL`, id, at)
+	return err
+}
+
+func (s *PostgresStore) CloseStaleDeviceSessions(at time.Time) error {
+	_, err := s.db.Exec(`UPDATE device_sessions SET disconnected_at = $1 WHERE disconnected_at IS NULL`, at)
+	return err
+}
+
+func (s *PostgresStore) ListDeviceSessions(deviceID int, limit int) ([]DeviceSession, error) {
+	return scanSessions(s.db.Query(`
+        SELECT id, device_id, remote_addr, connected_at, disconnected_at FROM device_sessions
+        WHERE device_id = $1 ORDER BY connected_at DESC, id DESC LIMIT $2`, deviceID, limit))
+}
+
+func (s *PostgresStore) LatestDeviceSessions(deviceIDs []int) (map[int]DeviceSession, error) {
+	sessions, err := scanSessions(s.db.Query(`
+        SELECT DISTINCT ON (device_id) id, device_id, remote_addr, connected_at, disconnected_at
+        FROM device_sessions WHERE device_id = ANY($1)
+        ORDER BY device_id, connected_at DESC, id DESC`, pq.Array(deviceIDs)))
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[int]DeviceSession, len(sessions))
+	for _, session := range sessions {
+		latest[session.DeviceID] = session
+	}
+	return latest, nil
+}
+
+func (s *PostgresStore) CreateExcursion(excursion *FrequencyExcursion) error {
+	return s.db.QueryRow(`
+        INSERT INTO frequency_excursions (device_id, trigger, direction, started_at, peak_frequency, peak_deviation, max_rate, peak_rocof)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		excursion.DeviceID, excursion.Trigger, excursion.Direction, excursion.StartedAt,
+		excursion.PeakFrequency, excursion.PeakDeviation, excursion.MaxRate, excursion.PeakRocof).Scan(&excursion.ID)
+}
+
+func (s *PostgresStore) CloseExcursion(excursion FrequencyExcursion) error {
+	res, err := s.db.Exec(`
+        UPDATE frequency_excursions
+        SET ended_at = $2, peak_frequency = $3, peak_deviation = $4, max_rate = $5, peak_rocof = $6
+        WHERE id = $1`,
+		excursion.ID, excursion.EndedAt, excursion.PeakFrequency, excursion.PeakDeviation, excursion.MaxRate, excursion.PeakRocof)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) CloseOpenExcursions(at time.Time) error {
+	_, err := s.db.Exec(`UPDATE frequency_excursions SET ended_at = $1 WHERE ended_at IS NULL`, at)
+	return err
+}
+
+func (s *PostgresStore) ListExcursions(deviceID int, r FrequencyRange) ([]FrequencyExcursion, error) {
+	query := `
+        SELECT id, device_id, trigger, direction, started_at, ended_at, peak_frequency, peak_deviation, max_rate, peak_rocof
+        FROM frequency_excursions WHERE device_id = $1`
+	args := []interface{}{deviceID}
+	if !r.Start.IsZero() {
+		args = append(args, r.Start)
+		query += fmt.Sprintf(" AND (ended_at IS NULL OR ended_at >= $%d)", len(args))
+	}
+	if !r.End.IsZero() {
+		args = append(args, r.End)
+		query += fmt.Sprintf(" AND started_at <= $%d", len(args))
+	}
+	query += ` ORDER BY started_at` + limitClause(r.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var excursions []FrequencyExcursion
+	for rows.Next() {
+		var e FrequencyExcursion
+		if err := rows.Scan(&e.ID, &e.DeviceID, &e.Trigger, &e.Direction, &e.StartedAt, &e.EndedAt,
+			&e.PeakFrequency, &e.PeakDeviation, &e.MaxRate, &e.PeakRocof); err != nil {
+			return nil, err
+		}
+		excursions = append(excursions, e)
+	}
+	return excursions, rows.Err()
+}
+
+const alertRuleColumns = `id, user_id, device_id, breaker_id, name, kind, threshold, duration_seconds, enabled, created_at`
+
+func scanAlertRules(rows *sql.Rows, err error) ([]AlertRule, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AlertRule
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func scanAlertRule(row interface{ Scan(...any) error }) (AlertRule, error) {
+	var r AlertRule
+	err := row.Scan(&r.ID, &r.UserID, &r.DeviceID, &r.BreakerID, &r.Name, &r.Kind,
+		&r.Threshold, &r.DurationSeconds, &r.Enabled, &r.CreatedAt)
+	return r, notFound(err)
+}
+
+func (s *PostgresStore) CreateAlertRule(rule *AlertRule) error {
+	return s.db.QueryRow(`
+        INSERT INTO alert_rules (user_id, device_id, breaker_id, name, kind, threshold, duration_seconds, enabled)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		rule.UserID, rule.DeviceID, rule.BreakerID, rule.Name, rule.Kind, rule.Threshold,
+		rule.DurationSeconds, rule.Enabled).Scan(&rule.ID, &rule.CreatedAt)
+}
+
+func (s *PostgresStore) GetAlertRule(id int) (AlertRule, error) {
+	return scanAlertRule(s.db.QueryRow(`SELECT `+alertRuleColumns+` FROM alert_rules WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListAlertRules(userID int) ([]AlertRule, error) {
+	return scanAlertRules(s.db.Query(`SELECT `+alertRuleColumns+` FROM alert_rules WHERE user_id = $1 ORDER BY id`, userID))
+}
+
+func (s *PostgresStore) ListDeviceAlertRules(device Device) ([]AlertRule, error) {
+	return scanAlertRules(s.db.Query(`
+        SELECT `+alertRuleColumns+` FROM alert_rules
+        WHERE enabled AND (device_id = $1 OR device_id IS NULL)
+            AND (user_id = $2 OR user_id IN (SELECT user_id FROM device_members WHERE device_id = $1))
+        ORDER BY id`, device.ID, device.UserID))
+}
+
+func (s *PostgresStore) ListAlertRulesByKind(kind string) ([]AlertRule, error) {
+	return scanAlertRules(s.db.Query(`SELECT `+alertRuleColumns+` FROM alert_rules WHERE enabled AND kind = $1 ORDER BY id`, kind))
+}
+
+func (s *PostgresStore) UpdateAlertRule(rule AlertRule) error {
+	res, err := s.db.Exec(`
+        UPDATE alert_rules
+        SET device_id = $2, breaker_id = $3, name = $4, kind = $5, threshold = $6, duration_seconds = $7, enabled = $8
+        WHERE id = $1`,
+		rule.ID, rule.DeviceID, rule.BreakerID, rule.Name, rule.Kind, rule.Threshold, rule.DurationSeconds, rule.Enabled)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteAlertRule(id int) error {
+	res, err := s.db.Exec(`DELETE FROM alert_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+const alertColumns = `id, rule_id, user_id, device_id, status, message, value, opened_at, acknowledged_at, resolved_at`
+
+func scanAlert(row interface{ Scan(...any) error }) (Alert, error) {
+	var a Alert
+	err := row.Scan(&a.ID, &a.RuleID, &a.UserID, &a.DeviceID, &a.Status, &a.Message, &a.Value,
+		&a.OpenedAt, &a.AcknowledgedAt, &a.ResolvedAt)
+	return a, notFound(err)
+}
+
+func (s *PostgresStore) CreateAlert(alert *Alert) error {
+	return s.db.QueryRow(`
+        INSERT INTO alerts (rule_id, user_id, device_id, status, message, value, opened_at, resolved_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		alert.RuleID, alert.UserID, alert.DeviceID, alert.Status, alert.Message, alert.Value, alert.OpenedAt, alert.ResolvedAt).Scan(&alert.ID)
+}
+
+func (s *PostgresStore) GetAlert(id int64) (Alert, error) {
+	return scanAlert(s.db.QueryRow(`SELECT `+alertColumns+` FROM alerts WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListAlerts(userID int, filter AlertFilter) ([]Alert, error) {
+	query := `SELECT ` + alertColumns + ` FROM alerts WHERE user_id = $1`
+	args := []interface{}{userID}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+	if filter.DeviceID != 0 {
+		args = append(args, filter.DeviceID)
+		query += fmt.Sprintf(" AND device_id = $%d", len(args))
+	}
+	query += ` ORDER BY opened_at DESC, id DESC` + limitClause(filter.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []Alert
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+func (s *PostgresStore) ActiveAlert(ruleID, deviceID int) (Alert, error) {
+	return scanAlert(s.db.QueryRow(`
+        SELECT `+alertColumns+` FROM alerts
+        WHERE rule_id = $1 AND device_id = $2 AND status <> 'resolved'`, ruleID, deviceID))
+}
+
+func (s *PostgresStore) SetAlertStatus(id int64, status string, at time.Time) error {
+	query := `UPDATE alerts SET status = 'acknowledged', acknowledged_at = $2 WHERE id = $1 AND status = 'open'`
+	if status == AlertResolved {
+		query = `UPDATE alerts SET status = 'resolved', resolved_at = $2 WHERE id = $1 AND status <> 'resolved'`
+	}
+	res, err := s.db.Exec(query, id, at)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteAlert(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM alerts WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+const webhookColumns = `id, user_id, url, secret, event_types, enabled, created_at`
+
+func scanWebhook(row interface{ Scan(...any) error }) (Webhook, error) {
+	var w Webhook
+	err := row.Scan(&w.ID, &w.UserID, &w.URL, &w.Secret, pq.Array(&w.EventTypes), &w.Enabled, &w.CreatedAt)
+	return w, notFound(err)
+}
+
+func (s *PostgresStore) CreateWebhook(hook *Webhook) error {
+	return s.db.QueryRow(`
+        INSERT INTO webhooks (user_id, url, secret, event_types, enabled)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		hook.UserID, hook.URL, hook.Secret, pq.Array(hook.EventTypes), hook.Enabled).Scan(&hook.ID, &hook.CreatedAt)
+}
+
+func (s *PostgresStore) GetWebhook(id int) (Webhook, error) {
+	return scanWebhook(s.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListWebhooks(userID int) ([]Webhook, error) {
+	rows, err := s.db.Query(`SELECT `+webhookColumns+` FROM webhooks WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *PostgresStore) UpdateWebhook(hook Webhook) error {
+	res, err := s.db.Exec(`UPDATE webhooks SET url = $2, event_types = $3, enabled = $4 WHERE id = $1`,
+		hook.ID, hook.URL, pq.Array(hook.EventTypes), hook.Enabled)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteWebhook(id int) error {
+	res, err := s.db.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+const webhookDeliveryColumns = `id, webhook_id, event_type, payload, status, attempts, next_attempt_at,
+    last_attempt_at, response_status, last_error, created_at, delivered_at`
+
+func scanWebhookDeliveries(rows *sql.Rows, err error) ([]WebhookDelivery, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload []byte
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastAttemptAt, &d.ResponseStatus, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+	d.Payload = payload
+	return d, notFound(err)
+}
+
+func (s *PostgresStore) EnqueueWebhookDelivery(delivery *WebhookDelivery) error {
+	return s.db.QueryRow(`
+        INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, next_attempt_at)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		delivery.WebhookID, delivery.EventType, string(delivery.Payload), delivery.Status, delivery.NextAttemptAt).
+		Scan(&delivery.ID, &delivery.CreatedAt)
+}
+
+func (s *PostgresStore) GetWebhookDelivery(id int64) (WebhookDelivery, error) {
+	return scanWebhookDelivery(s.db.QueryRow(`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListWebhookDeliveries(webhookID int, status string, limit int) ([]WebhookDelivery, error) {
+	return scanWebhookDeliveries(s.db.Query(`
+        SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+        WHERE webhook_id = $1 AND ($2 = '' OR status = $2)
+        ORDER BY id DESC LIMIT $3`, webhookID, status, limit))
+}
+
+func (s *PostgresStore) ClaimWebhookDeliveries(now, leaseUntil time.Time, limit int) ([]WebhookDelivery, error) {
+	deliveries, err := scanWebhookDeliveries(s.db.Query(`
+        UPDATE webhook_deliveries SET next_attempt_at = $2
+        WHERE id IN (
+            SELECT id FROM webhook_deliveries
+            WHERE status = 'pending' AND next_attempt_at <= $1
+            ORDER BY next_attempt_at, id LIMIT $3
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING `+webhookDeliveryColumns, now, leaseUntil, limit))
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the subquery's order
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, nil
+}
+
+func (s *PostgresStore) RecordWebhookAttempt(delivery WebhookDelivery) error {
+	res, err := s.db.Exec(`
+        UPDATE webhook_deliveries
+        SET status = $2, attempts = $3, next_attempt_at = $4, last_attempt_at = $5,
+            response_status = $6, last_error = $7, delivered_at = $8
+        WHERE id = $1`,
+		delivery.ID, delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.LastAttemptAt,
+		delivery.ResponseStatus, delivery.LastError, delivery.DeliveredAt)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+const scheduleColumns = `id, breaker_id, name, state, cron_expr, run_at, timezone, enabled, next_run_at, created_at`
+
+func scanBreakerSchedules(rows *sql.Rows, err error) ([]BreakerSchedule, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []BreakerSchedule
+	for rows.Next() {
+		schedule, err := scanBreakerSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+func scanBreakerSchedule(row interface{ Scan(...any) error }) (BreakerSchedule, error) {
+	var sch BreakerSchedule
+	err := row.Scan(&sch.ID, &sch.BreakerID, &sch.Name, &sch.State, &sch.Cron, &sch.RunAt,
+		&sch.Timezone, &sch.Enabled, &sch.NextRunAt, &sch.CreatedAt)
+	return sch, notFound(err)
+}
+
+func (s *PostgresStore) CreateBreakerSchedule(schedule *BreakerSchedule) error {
+	return s.db.QueryRow(`
+        INSERT INTO breaker_schedules (breaker_id, name, state, cron_expr, run_at, timezone, enabled, next_run_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		schedule.BreakerID, schedule.Name, schedule.State, schedule.Cron, schedule.RunAt,
+		schedule.Timezone, schedule.Enabled, schedule.NextRunAt).Scan(&schedule.ID, &schedule.CreatedAt)
+}
+
+func (s *PostgresStore) GetBreakerSchedule(id int) (BreakerSchedule, error) {
+	return scanBreakerSchedule(s.db.QueryRow(`SELECT `+scheduleColumns+` FROM breaker_schedules WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListBreakerSchedules(breakerID int) ([]BreakerSchedule, error) {
+	return scanBreakerSchedules(s.db.Query(`SELECT `+scheduleColumns+` FROM breaker_schedules WHERE breaker_id = $1 ORDER BY id`, breakerID))
+}
+
+func (s *PostgresStore) UpdateBreakerSchedule(schedule BreakerSchedule) error {
+	res, err := s.db.Exec(`
+        UPDATE breaker_schedules
+        SET name = $2, state = $3, cron_expr = $4, run_at = $5, timezone = $6, enabled = $7, next_run_at = $8
+        WHERE id = $1`,
+		schedule.ID, schedule.Name, schedule.State, schedule.Cron, schedule.RunAt,
+		schedule.Timezone, schedule.Enabled, schedule.NextRunAt)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteBreakerSchedule(id int) error {
+	res, err := s.db.Exec(`DELETE FROM breaker_schedules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DueBreakerSchedules(now time.Time) ([]BreakerSchedule, error) {
+	return scanBreakerSchedules(s.db.Query(`
+        SELECT `+scheduleColumns+` FROM breaker_schedules
+        WHERE enabled AND next_run_at <= $1
+        ORDER BY next_run_at, id`, now))
+}
+
+func (s *PostgresStore) AdvanceBreakerSchedule(id int, from time.Time, next *time.Time) error {
+	res, err := s.db.Exec(`UPDATE breaker_schedules SET next_run_at = $3 WHERE id = $1 AND next_run_at = $2`, id, from, next)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) CreateScheduleRun(run *ScheduleRun) error {
+	return s.db.QueryRow(`
+        INSERT INTO breaker_schedule_runs (schedule_id, scheduled_for, status, command_id, error, ran_at)
+        VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		run.ScheduleID, run.ScheduledFor, run.Status, run.CommandID, run.Error, run.RanAt).Scan(&run.ID)
+}
+
+func (s *PostgresStore) ListScheduleRuns(scheduleID int, limit int) ([]ScheduleRun, error) {
+	rows, err := s.db.Query(`
+        SELECT id, schedule_id, scheduled_for, status, command_id, error, ran_at
+        FROM breaker_schedule_runs WHERE schedule_id = $1
+        ORDER BY scheduled_for DESC, id DESC LIMIT $2`, scheduleID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []ScheduleRun
+	for rows.Next() {
+		var run ScheduleRun
+		if err := rows.Scan(&run.ID, &run.ScheduleID, &run.ScheduledFor, &run.Status, &run.CommandID, &run.Error, &run.RanAt); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (s *PostgresStore) GetLoadShedOverride(deviceID int) (time.Time, error) {
+	var until time.Time
+	err := s.db.QueryRow(`SELECT until FROM load_shed_overrides WHERE device_id = $1`, deviceID).Scan(&until)
+	return until, notFound(err)
+}
+
+func (s *PostgresStore) SetLoadShedOverride(deviceID, userID int, until time.Time) error {
+	_, err := s.db.Exec(`
+        INSERT INTO load_shed_overrides (device_id, user_id, until) VALUES ($1, $2, $3)
+        ON CONFLICT (device_id) DO UPDATE SET user_id = $2, until = $3, created_at = NOW()`,
+		deviceID, userID, until)
+	return err
+}
+
+func (s *PostgresStore) ClearLoadShedOverride(deviceID int) error {
+	res, err := s.db.Exec(`DELETE FROM load_shed_overrides WHERE device_id = $1`, deviceID)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) CreateLoadShedEvent(event *LoadShedEvent) error {
+	return s.db.QueryRow(`
+        INSERT INTO load_shed_events (device_id, breaker_id, action, tier, frequency, command_id, user_id, reason)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		event.DeviceID, event.BreakerID, event.Action, event.Tier, event.Frequency, event.CommandID, event.UserID, event.Reason).
+		Scan(&event.ID, &event.CreatedAt)
+}
+
+func (s *PostgresStore) ListLoadShedEvents(deviceID int, r FrequencyRange) ([]LoadShedEvent, error) {
+	query := `
+        SELECT id, device_id, breaker_id, action, tier, frequency, command_id, user_id, reason, created_at
+        FROM load_shed_events WHERE device_id = $1`
+	args := []interface{}{deviceID}
+	if !r.Start.IsZero() {
+		args = append(args, r.Start)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !r.End.IsZero() {
+		args = append(args, r.End)
+		query += fmt.Sprintf(" AND created_at <= $%d", len(args))
+	}
+	query += ` ORDER BY created_at DESC, id DESC` + limitClause(r.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []LoadShedEvent
+	for rows.Next() {
+		var e LoadShedEvent
+		if err := rows.Scan(&e.ID, &e.DeviceID, &e.BreakerID, &e.Action, &e.Tier, &e.Frequency,
+			&e.CommandID, &e.UserID, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *PostgresStore) CreateBreakerEvent(event *BreakerEvent) error {
+	return s.db.QueryRow(`
+        INSERT INTO breaker_events (breaker_id, device_id, kind, state, source, user_id, schedule_id,
+            command_id, requested_at, acknowledged_at, error)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, created_at`,
+		event.BreakerID, event.DeviceID, event.Kind, event.State, event.Source, event.UserID, event.ScheduleID,
+		event.CommandID, event.RequestedAt, event.AcknowledgedAt, event.Error).
+		Scan(&event.ID, &event.CreatedAt)
+}
+
+const breakerEventColumns = `e.id, e.breaker_id, e.device_id, e.kind, e.state, e.source, e.user_id, e.schedule_id,
+        e.command_id, e.requested_at, e.acknowledged_at, e.error, e.created_at`
+
+func scanBreakerEvent(row interface{ Scan(...any) error }) (BreakerEvent, error) {
+	var e BreakerEvent
+	err := row.Scan(&e.ID, &e.BreakerID, &e.DeviceID, &e.Kind, &e.State, &e.Source, &e.UserID, &e.ScheduleID,
+		&e.CommandID, &e.RequestedAt, &e.AcknowledgedAt, &e.Error, &e.CreatedAt)
+	return e, err
+}
+
+func (s *PostgresStore) FindBreakerRequest(deviceID int, requestID string) (BreakerEvent, error) {
+	e, err := scanBreakerEvent(s.db.QueryRow(`
+        SELECT `+breakerEventColumns+`
+        FROM breaker_events e JOIN device_commands c ON c.id = e.command_id
+        WHERE c.device_id = $1 AND c.request_id = $2 AND e.kind = 'requested'`, deviceID, requestID))
+	return e, notFound(err)
+}
+
+func (s *PostgresStore) ListBreakerEvents(breakerID int, r FrequencyRange) ([]BreakerEvent, error) {
+	query := `SELECT ` + breakerEventColumns + ` FROM breaker_events e WHERE e.breaker_id = $1`
+	args := []interface{}{breakerID}
+	if !r.Start.IsZero() {
+		args = append(args, r.Start)
+		query += fmt.Sprintf(" AND e.created_at >= $%d", len(args))
+	}
+	if !r.End.IsZero() {
+		args = append(args, r.End)
+		query += fmt.Sprintf(" AND e.created_at <= $%d", len(args))
+	}
+	query += ` ORDER BY e.created_at DESC, e.id DESC` + limitClause(r.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []BreakerEvent
+	for rows.Next() {
+		e, err := scanBreakerEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// nullJSON stores an empty document as NULL
+func nullJSON(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
+
+func (s *PostgresStore) CreateAuditEntry(entry *AuditEntry) error {
+	return s.db.QueryRow(`
+        INSERT INTO audit_log (actor_id, method, route, path, target_type, target_id, before, after,
+            client_ip, status, outcome)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, created_at`,
+		entry.ActorID, entry.Method, entry.Route, entry.Path, entry.TargetType, entry.TargetID,
+		nullJSON(entry.Before), nullJSON(entry.After), entry.ClientIP, entry.Status, entry.Outcome).
+		Scan(&entry.ID, &entry.CreatedAt)
+}
+
+func (s *PostgresStore) ListAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	query := `
+        SELECT id, actor_id, method, route, path, target_type, target_id, before, after,
+            client_ip, status, outcome, created_at
+        FROM audit_log WHERE TRUE`
+	var args []interface{}
+	where := func(clause string, value interface{}) {
+		args = append(args, value)
+		query += fmt.Sprintf(" AND "+clause, len(args))
+	}
+	if filter.ActorID != nil {
+		where("actor_id = $%d", *filter.ActorID)
+	}
+	if filter.TargetType != "" {
+		where("target_type = $%d", filter.TargetType)
+	}
+	if filter.TargetID != nil {
+		where("target_id = $%d", *filter.TargetID)
+	}
+	if filter.Method != "" {
+		where("method = $%d", filter.Method)
+	}
+	if filter.Route != "" {
+		where("route = $%d", filter.Route)
+	}
+	if filter.Outcome != "" {
+		where("outcome = $%d", filter.Outcome)
+	}
+	if !filter.Start.IsZero() {
+		where("created_at >= $%d", filter.Start)
+	}
+	if !filter.End.IsZero() {
+		where("created_at <= $%d", filter.End)
+	}
+	if filter.BeforeID != 0 {
+		where("id < $%d", filter.BeforeID)
+	}
+	query += ` ORDER BY id DESC` + limitClause(filter.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Method, &e.Route, &e.Path, &e.TargetType, &e.TargetID,
+			&before, &after, &e.ClientIP, &e.Status, &e.Outcome, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Before, e.After = before, after
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) GetDeviceMember(deviceID, userID int) (DeviceMember, error) {
+	var m DeviceMember
+	err := s.db.QueryRow(`
+        SELECT device_id, user_id, role, invited_by, created_at FROM device_members
+        WHERE device_id = $1 AND user_id = $2`, deviceID, userID).
+		Scan(&m.DeviceID, &m.UserID, &m.Role, &m.InvitedBy, &m.CreatedAt)
+	return m, notFound(err)
+}
+
+func (s *PostgresStore) ListDeviceMembers(deviceID int) ([]DeviceMember, error) {
+	rows, err := s.db.Query(`
+        SELECT m.device_id, m.user_id, m.role, m.invited_by, m.created_at, u.name, u.login
+        FROM device_members m JOIN users u ON u.id = m.user_id
+        WHERE m.device_id = $1 ORDER BY m.created_at, m.user_id`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []DeviceMember
+	for rows.Next() {
+		var m DeviceMember
+		if err := rows.Scan(&m.DeviceID, &m.UserID, &m.Role, &m.InvitedBy, &m.CreatedAt, &m.Name, &m.Login); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *PostgresStore) ListSharedDevices(userID int) ([]SharedDevice, error) {
+	rows, err := s.db.Query(`
+        SELECT d.id, d.user_id, d.name, d.mac_addr, d.site_id, d.hardware_model, d.firmware_version, m.role
+        FROM device_members m JOIN devices d ON d.id = m.device_id
+        WHERE m.user_id = $1 ORDER BY d.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []SharedDevice
+	for rows.Next() {
+		var d SharedDevice
+		var macAddr, model, version sql.NullString
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Name, &macAddr, &d.SiteID, &model, &version, &d.Role); err != nil {
+			return nil, err
+		}
+		d.MACAddr = macAddr.String
+		d.HardwareModel, d.FirmwareVersion = model.String, version.String
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (s *PostgresStore) SetDeviceMemberRole(deviceID, userID int, role string) error {
+	res, err := s.db.Exec(`UPDATE device_members SET role = $3 WHERE device_id = $1 AND user_id = $2`, deviceID, userID, role)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) RemoveDeviceMember(deviceID, userID int) error {
+	res, err := s.db.Exec(`DELETE FROM device_members WHERE device_id = $1 AND user_id = $2`, deviceID, userID)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+const invitationColumns = `i.id, i.device_id, d.name, i.email, COALESCE(i.token_hash, ''), i.role, i.invited_by, i.status, i.accepted_by,
+        i.created_at, i.expires_at, i.responded_at`
+
+func scanInvitation(row interface{ Scan(...any) error }) (DeviceInvitation, error) {
+	var inv DeviceInvitation
+	err := row.Scan(&inv.ID, &inv.DeviceID, &inv.DeviceName, &inv.Email, &inv.TokenHash, &inv.Role, &inv.InvitedBy, &inv.Status,
+		&inv.AcceptedBy, &inv.CreatedAt, &inv.ExpiresAt, &inv.RespondedAt)
+	return inv, err
+}
+
+func scanInvitations(rows *sql.Rows, err error) ([]DeviceInvitation, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []DeviceInvitation
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+func (s *PostgresStore) CreateDeviceInvitation(inv *DeviceInvitation) error {
+	return s.db.QueryRow(`
+        INSERT INTO device_invitations (device_id, email, token_hash, role, invited_by, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, status, created_at`,
+		inv.DeviceID, inv.Email, inv.TokenHash, inv.Role, inv.InvitedBy, inv.ExpiresAt).
+		Scan(&inv.ID, &inv.Status, &inv.CreatedAt)
+}
+
+func (s *PostgresStore) GetDeviceInvitation(id int) (DeviceInvitation, error) {
+	inv, err := scanInvitation(s.db.QueryRow(`
+        SELECT `+invitationColumns+`
+        FROM device_invitations i JOIN devices d ON d.id = i.device_id WHERE i.id = $1`, id))
+	return inv, notFound(err)
+}
+
+func (s *PostgresStore) ListDeviceInvitations(deviceID int) ([]DeviceInvitation, error) {
+	return scanInvitations(s.db.Query(`
+        SELECT `+invitationColumns+`
+        FROM device_invitations i JOIN devices d ON d.id = i.device_id
+        WHERE i.device_id = $1 ORDER BY i.created_at DESC, i.id DESC`, deviceID))
+}
+
+func (s *PostgresStore) ListPendingInvitations(email string, now time.Time) ([]DeviceInvitation, error) {
+	return scanInvitations(s.db.Query(`
+        SELECT `+invitationColumns+`
+        FROM device_invitations i JOIN devices d ON d.id = i.device_id
+        WHERE LOWER(i.email) = LOWER($1) AND i.status = 'pending' AND i.expires_at > $2
+        ORDER BY i.created_at DESC, i.id DESC`, email, now))
+}
+
+func (s *PostgresStore) AcceptDeviceInvitation(id, userID int, at time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deviceID int
+	var role string
+	var invitedBy *int
+	err = tx.QueryRow(`
+        UPDATE device_invitations SET status = 'accepted', accepted_by = $2, responded_at = $3
+        WHERE id = $1 AND status = 'pending'
+        RETURNING device_id, role, invited_by`, id, userID, at).Scan(&deviceID, &role, &invitedBy)
+	if err != nil {
+		return notFound(err)
+	}
+	_, err = tx.Exec(`
+        INSERT INTO device_members (device_id, user_id, role, invited_by, created_at)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (device_id, user_id) DO UPDATE SET role = EXCLUDED.role`,
+		deviceID, userID, role, invitedBy, at)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) CloseDeviceInvitation(id int, status string, at time.Time) error {
+	res, err := s.db.Exec(`
+        UPDATE device_invitations SET status = $2, responded_at = $3
+        WHERE id = $1 AND status = 'pending'`, id, status, at)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+const siteColumns = `id, user_id, name, address, timezone, created_at`
+
+func scanSite(row interface{ Scan(...any) error }) (Site, error) {
+	var site Site
+	err := row.Scan(&site.ID, &site.UserID, &site.Name, &site.Address, &site.Timezone, &site.CreatedAt)
+	return site, notFound(err)
+}
+
+func (s *PostgresStore) CreateSite(site *Site) error {
+	return s.db.QueryRow(`
+        INSERT INTO sites (user_id, name, address, timezone) VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at`,
+		site.UserID, site.Name, site.Address, site.Timezone).Scan(&site.ID, &site.CreatedAt)
+}
+
+func (s *PostgresStore) GetSite(id int) (Site, error) {
+	return scanSite(s.db.QueryRow(`SELECT `+siteColumns+` FROM sites WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListSitesByUser(userID int) ([]Site, error) {
+	rows, err := s.db.Query(`SELECT `+siteColumns+` FROM sites WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sites []Site
+	for rows.Next() {
+		site, err := scanSite(rows)
+		if err != nil {
+			return nil, err
+		}
+		sites = append(sites, site)
+	}
+	return sites, rows.Err()
+}
+
+func (s *PostgresStore) UpdateSite(site Site) error {
+	res, err := s.db.Exec(`UPDATE sites SET name = $2, address = $3, timezone = $4 WHERE id = $1`,
+		site.ID, site.Name, site.Address, site.Timezone)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteSite(id int) error {
+	res, err := s.db.Exec(`DELETE FROM sites WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) SetDeviceSite(deviceID int, siteID *int) error {
+	res, err := s.db.Exec(`UPDATE devices SET site_id = $2 WHERE id = $1`, deviceID, siteID)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) ListSiteDevices(siteID int) ([]Device, error) {
+	return scanDevices(s.db.Query(`SELECT `+deviceColumns+` FROM devices WHERE site_id = $1 ORDER BY id`, siteID))
+}
+
+func (s *PostgresStore) CreateDeviceGroup(group *DeviceGroup) error {
+	return s.db.QueryRow(`INSERT INTO device_groups (user_id, name) VALUES ($1, $2) RETURNING id, created_at`,
+		group.UserID, group.Name).Scan(&group.ID, &group.CreatedAt)
+}
+
+func (s *PostgresStore) GetDeviceGroup(id int) (DeviceGroup, error) {
+	var group DeviceGroup
+	err := s.db.QueryRow(`SELECT id, user_id, name, created_at FROM device_groups WHERE id = $1`, id).
+		Scan(&group.ID, &group.UserID, &group.Name, &group.CreatedAt)
+	return group, notFound(err)
+}
+
+func (s *PostgresStore) ListDeviceGroupsByUser(userID int) ([]DeviceGroup, error) {
+	rows, err := s.db.Query(`SELECT id, user_id, name, created_at FROM device_groups WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []DeviceGroup
+	for rows.Next() {
+		var group DeviceGroup
+		if err := rows.Scan(&group.ID, &group.UserID, &group.Name, &group.CreatedAt); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+func (s *PostgresStore) RenameDeviceGroup(id int, name string) error {
+	res, err := s.db.Exec(`UPDATE device_groups SET name = $2 WHERE id = $1`, id, name)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) DeleteDeviceGroup(id int) error {
+	res, err := s.db.Exec(`DELETE FROM device_groups WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) AddGroupDevice(groupID, deviceID int) error {
+	_, err := s.db.Exec(`
+        INSERT INTO device_group_members (group_id, device_id) VALUES ($1, $2)
+        ON CONFLICT DO NOTHING`, groupID, deviceID)
+	return err
+}
+
+func (s *PostgresStore) RemoveGroupDevice(groupID, deviceID int) error {
+	res, err := s.db.Exec(`DELETE FROM device_group_members WHERE group_id = $1 AND device_id = $2`, groupID, deviceID)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) ListGroupDevices(groupID int) ([]Device, error) {
+	return scanDevices(s.db.Query(`
+        SELECT d.id, d.user_id, d.name, d.mac_addr, d.site_id, d.hardware_model, d.firmware_version
+        FROM device_group_members g JOIN devices d ON d.id = g.device_id
+        WHERE g.group_id = $1 ORDER BY d.id`, groupID))
+}
+
+const commandJobColumns = `id, user_id, command, breaker_state, site_id, group_id, status, created_at, completed_at`
+
+func scanCommandJob(row interface{ Scan(...any) error }) (CommandJob, error) {
+	var job CommandJob
+	err := row.Scan(&job.ID, &job.UserID, &job.Command, &job.BreakerState, &job.SiteID, &job.GroupID,
+		&job.Status, &job.CreatedAt, &job.CompletedAt)
+	return job, notFound(err)
+}
+
+func (s *PostgresStore) CreateCommandJob(job *CommandJob, targets []CommandJobTarget) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+        INSERT INTO command_jobs (user_id, command, breaker_state, site_id, group_id)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id, status, created_at`,
+		job.UserID, job.Command, job.BreakerState, job.SiteID, job.GroupID).
+		Scan(&job.ID, &job.Status, &job.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for i := range targets {
+		t := &targets[i]
+		t.JobID = job.ID
+		err := tx.QueryRow(`
+            INSERT INTO command_job_targets (job_id, device_id, breaker_id)
+            VALUES ($1, $2, $3) RETURNING id, status, updated_at`,
+			t.JobID, t.DeviceID, t.BreakerID).Scan(&t.ID, &t.Status, &t.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetCommandJob(id int64) (CommandJob, error) {
+	return scanCommandJob(s.db.QueryRow(`SELECT `+commandJobColumns+` FROM command_jobs WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListCommandJobs(userID int, limit int) ([]CommandJob, error) {
+	rows, err := s.db.Query(`
+        SELECT `+commandJobColumns+` FROM command_jobs
+        WHERE user_id = $1 ORDER BY id DESC`+limitClause(limit), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []CommandJob
+	for rows.Next() {
+		job, err := scanCommandJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *PostgresStore) ListCommandJobTargets(jobID int64) ([]CommandJobTarget, error) {
+	rows, err := s.db.Query(`
+        SELECT id, job_id, device_id, breaker_id, command_id, status, error, updated_at
+        FROM command_job_targets WHERE job_id = $1 ORDER BY id`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []CommandJobTarget
+	for rows.Next() {
+		var t CommandJobTarget
+		if err := rows.Scan(&t.ID, &t.JobID, &t.DeviceID, &t.BreakerID, &t.CommandID, &t.Status, &t.Error, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+func (s *PostgresStore) UpdateCommandJobTarget(target CommandJobTarget) error {
+	res, err := s.db.Exec(`
+        UPDATE command_job_targets SET command_id = $2, status = $3, error = $4, updated_at = $5
+        WHERE id = $1`,
+		target.ID, target.CommandID, target.Status, target.Error, target.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) CompleteCommandJob(id int64, at time.Time) error {
+	res, err := s.db.Exec(`
+        UPDATE command_jobs SET status = 'completed', completed_at = $2
+        WHERE id = $1 AND status = 'running'`, id, at)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) AbortRunningCommandJobs(at time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+        UPDATE command_job_targets t SET status = 'failed', error = 'Server restarted', updated_at = $1
+        FROM command_jobs j
+        WHERE j.id = t.job_id AND j.status = 'running' AND t.status = 'pending'`, at); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE command_jobs SET status = 'aborted', completed_at = $1 WHERE status = 'running'`, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const firmwareColumns = `id, hardware_model, version, sha256, size, notes, uploaded_by, created_at`
+
+func scanFirmware(row interface{ Scan(...any) error }) (Firmware, error) {
+	var fw Firmware
+	err := row.Scan(&fw.ID, &fw.HardwareModel, &fw.Version, &fw.SHA256, &fw.Size, &fw.Notes, &fw.UploadedBy, &fw.CreatedAt)
+	return fw, notFound(err)
+}
+
+func (s *PostgresStore) CreateFirmware(fw *Firmware, data []byte) error {
+	err := s.db.QueryRow(`
+        INSERT INTO firmware (hardware_model, version, sha256, size, data, notes, uploaded_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (hardware_model, version) DO NOTHING
+        RETURNING id, created_at`,
+		fw.HardwareModel, fw.Version, fw.SHA256, fw.Size, data, fw.Notes, fw.UploadedBy).
+		Scan(&fw.ID, &fw.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ErrFirmwareExists
+	}
+	return err
+}
+
+func (s *PostgresStore) GetFirmware(id int) (Firmware, error) {
+	return scanFirmware(s.db.QueryRow(`SELECT `+firmwareColumns+` FROM firmware WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) GetFirmwareData(id int) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM firmware WHERE id = $1`, id).Scan(&data)
+	return data, notFound(err)
+}
+
+func (s *PostgresStore) ListFirmware(model string) ([]Firmware, error) {
+	rows, err := s.db.Query(`
+        SELECT `+firmwareColumns+` FROM firmware
+        WHERE $1 = '' OR hardware_model = $1 ORDER BY id DESC`, model)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []Firmware
+	for rows.Next() {
+		fw, err := scanFirmware(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, fw)
+	}
+	return images, rows.Err()
+}
+
+const rolloutColumns = `id, user_id, firmware_id, percent, status, created_at, finished_at`
+
+func scanRollout(row interface{ Scan(...any) error }) (FirmwareRollout, error) {
+	var r FirmwareRollout
+	err := row.Scan(&r.ID, &r.UserID, &r.FirmwareID, &r.Percent, &r.Status, &r.CreatedAt, &r.FinishedAt)
+	return r, notFound(err)
+}
+
+const rolloutTargetColumns = `t.id, t.rollout_id, t.device_id, t.status, t.progress, t.command_id, t.error, t.updated_at`
+
+func scanRolloutTarget(row interface{ Scan(...any) error }) (RolloutTarget, error) {
+	var t RolloutTarget
+	err := row.Scan(&t.ID, &t.RolloutID, &t.DeviceID, &t.Status, &t.Progress, &t.CommandID, &t.Error, &t.UpdatedAt)
+	return t, notFound(err)
+}
+
+func (s *PostgresStore) CreateFirmwareRollout(rollout *FirmwareRollout, deviceIDs []int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+        INSERT INTO firmware_rollouts (user_id, firmware_id, percent)
+        VALUES ($1, $2, $3) RETURNING id, status, created_at`,
+		rollout.UserID, rollout.FirmwareID, rollout.Percent).
+		Scan(&rollout.ID, &rollout.Status, &rollout.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for _, deviceID := range deviceIDs {
+		if _, err := tx.Exec(`
+            INSERT INTO firmware_rollout_targets (rollout_id, device_id) VALUES ($1, $2)`,
+			rollout.ID, deviceID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetFirmwareRollout(id int) (FirmwareRollout, error) {
+	return scanRollout(s.db.QueryRow(`SELECT `+rolloutColumns+` FROM firmware_rollouts WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListFirmwareRollouts(userID int) ([]FirmwareRollout, error) {
+	rows, err := s.db.Query(`
+        SELECT `+rolloutColumns+` FROM firmware_rollouts
+        WHERE user_id = $1 ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rollouts []FirmwareRollout
+	for rows.Next() {
+		r, err := scanRollout(rows)
+		if err != nil {
+			return nil, err
+		}
+		rollouts = append(rollouts, r)
+	}
+	return rollouts, rows.Err()
+}
+
+func (s *PostgresStore) ListRolloutTargets(rolloutID int) ([]RolloutTarget, error) {
+	rows, err := s.db.Query(`
+        SELECT `+rolloutTargetColumns+` FROM firmware_rollout_targets t
+        WHERE t.rollout_id = $1 ORDER BY t.id`, rolloutID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []RolloutTarget
+	for rows.Next() {
+		t, err := scanRolloutTarget(rows)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+func (s *PostgresStore) UpdateRolloutTarget(target RolloutTarget) error {
+	res, err := s.db.Exec(`
+        UPDATE firmware_rollout_targets
+        SET status = $2, progress = $3, command_id = $4, error = $5, updated_at = $6
+        WHERE id = $1`,
+		target.ID, target.Status, target.Progress, target.CommandID, target.Error, target.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) SetRolloutStatus(id int, status string, at time.Time) error {
+	res, err := s.db.Exec(`
+        UPDATE firmware_rollouts SET status = $2, finished_at = $3
+        WHERE id = $1 AND status = 'running'`, id, status, at)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) SetRolloutPercent(id, percent int) error {
+	res, err := s.db.Exec(`UPDATE firmware_rollouts SET percent = $2 WHERE id = $1`, id, percent)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
+
+func (s *PostgresStore) ActiveRolloutTarget(deviceID int) (RolloutTarget, error) {
+	return scanRolloutTarget(s.db.QueryRow(`
+        SELECT `+rolloutTargetColumns+` FROM firmware_rollout_targets t
+        WHERE t.device_id = $1 AND t.status IN ('queued', 'downloading', 'rebooting')
+        ORDER BY t.id DESC LIMIT 1`, deviceID))
+}
+
+func (s *PostgresStore) FailExpiredRolloutTargets(at time.Time) ([]int, error) {
+	rows, err := s.db.Query(`
+        UPDATE firmware_rollout_targets t
+        SET status = 'failed', error = 'Update was not delivered before it expired', updated_at = $1
+        FROM device_commands c
+        WHERE c.id = t.command_id AND t.status = 'queued' AND c.status IN ('expired', 'cancelled')
+        RETURNING t.rollout_id`, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rolloutIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(rolloutIDs, id) {
+			rolloutIDs = append(rolloutIDs, id)
+		}
+	}
+	return rolloutIDs, rows.Err()
+}
+
+const deviceConfigColumns = `device_id, version, config, updated_by, created_at, applied_at, apply_error`
+
+func scanDeviceConfig(row interface{ Scan(...any) error }) (DeviceConfig, error) {
+	var cfg DeviceConfig
+	var settings []byte
+	err := row.Scan(&cfg.DeviceID, &cfg.Version, &settings, &cfg.UpdatedBy, &cfg.CreatedAt, &cfg.AppliedAt, &cfg.Error)
+	if err != nil {
+		return cfg, notFound(err)
+	}
+	return cfg, json.Unmarshal(settings, &cfg.Settings)
+}
+
+func (s *PostgresStore) CreateDeviceConfig(cfg *DeviceConfig) error {
+	settings, err := json.Marshal(cfg.Settings)
+	if err != nil {
+		return err
+	}
+	return s.db.QueryRow(`
+        INSERT INTO device_configs (device_id, version, config, updated_by)
+        SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3 FROM device_configs WHERE device_id = $1
+        RETURNING version, created_at`,
+		cfg.DeviceID, settings, cfg.UpdatedBy).Scan(&cfg.Version, &cfg.CreatedAt)
+}
+
+func (s *PostgresStore) LatestDeviceConfig(deviceID int) (DeviceConfig, error) {
+	return scanDeviceConfig(s.db.QueryRow(`
+        SELECT `+deviceConfigColumns+` FROM device_configs
+        WHERE device_id = $1 ORDER BY version DESC LIMIT 1`, deviceID))
+}
+
+func (s *PostgresStore) AppliedDeviceConfig(deviceID int) (DeviceConfig, error) {
+	return scanDeviceConfig(s.db.QueryRow(`
+        SELECT `+deviceConfigColumns+` FROM device_configs
+        WHERE device_id = $1 AND applied_at IS NOT NULL
+        ORDER BY applied_at DESC, version DESC LIMIT 1`, deviceID))
+}
+
+func (s *PostgresStore) RecordDeviceConfigResult(deviceID, version int, applyErr string, at time.Time) error {
+	query := `UPDATE device_configs SET applied_at = $3, apply_error = '' WHERE device_id = $1 AND version = $2`
+	args := []interface{}{deviceID, version, at}
+	if applyErr != "" {
+		query = `UPDATE device_configs SET apply_error = $3 WHERE device_id = $1 AND version = $2`
+		args[2] = applyErr
+	}
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	return rowsAffected(res)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStores runs fn against every Store implementation. The in-memory store
+// always runs; Postgres runs when TEST_DATABASE_URL points at a scratch
+// database, which is migrated and emptied before each test.
+func testStores(t *testing.T, fn func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryStore())
+	})
+	t.Run("postgres", func(t *testing.T) {
+		url := os.Getenv("TEST_DATABASE_URL")
+		if url == "" {
+			t.Skip("TEST_DATABASE_URL not set")
+		}
+		db, err := sql.Open("postgres", url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		resetTestDatabase(t, db)
+		fn(t, NewPostgresStore(db))
+	})
+}
+
+// resetTestDatabase brings the schema up to date and truncates every table
+func resetTestDatabase(t *testing.T, db *sql.DB) {
+	t.Helper()
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(`
+        SELECT quote_ident(tablename) FROM pg_tables
+        WHERE schemaname = current_schema() AND tablename <> 'schema_migrations'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`TRUNCATE ` + strings.Join(tables, ", ") + ` RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seedDevice creates a user owning one device
+func seedDevice(t *testing.T, store Store, login string) (User, Device) {
+	t.Helper()
+	user := User{Name: login, Login: login, Email: login + "@example.com", Pass: "hash"}
+	if err := store.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	device := Device{Name: login + " panel", UserID: user.ID}
+	if err := store.CreateDevice(&device); err != nil {
+		t.Fatal(err)
+	}
+	return user, device
+}
+
+func TestStoreUsers(t *testing.T) {
+	testStores(t, func(t *testing.T, store Store) {
+		user := User{Name: "Alice Smith", Login: "alice", Email: "alice@example.com", Pass: "hash", IsAdmin: true}
+		if err := store.CreateUser(&user); err != nil {
+			t.Fatal(err)
+		}
+		if user.ID == 0 {
+			t.Fatal("CreateUser did not assign an ID")
+		}
+
+		got, err := store.GetUserByLogin("alice")
+		if err != nil || got.ID != user.ID || got.Email != user.Email {
+			t.Fatalf("GetUserByLogin: got %+v, %v", got, err)
+		}
+		if got.IsAdmin {
+			t.Error("CreateUser stored the admin flag")
+		}
+		if _, err := store.GetUserByLogin("nobody"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUserByLogin of a missing login: got %v, want ErrNotFound", err)
+		}
+
+		found, err := store.SearchUsers("SMITH")
+		if err != nil || len(found) != 1 || found[0].ID != user.ID {
+			t.Errorf("SearchUsers: got %+v, %v", found, err)
+		}
+
+		if err := store.SetUserAdmin(user.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		user.Name, user.IsAdmin = "Alice Jones", false
+		if err := store.UpdateUser(user); err != nil {
+			t.Fatal(err)
+		}
+		got, err = store.GetUser(user.ID)
+		if err != nil || got.Name != "Alice Jones" || !got.IsAdmin {
+			t.Errorf("after UpdateUser got %+v, %v; want the new name and the admin flag kept", got, err)
+		}
+
+		if err := store.DeleteUser(user.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetUser(user.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUser after delete: got %v, want ErrNotFound", err)
+		}
+		if err := store.DeleteUser(user.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("second DeleteUser: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreDevicesAndBreakers(t *testing.T) {
+	testStores(t, func(t *testing.T, store Store) {
+		alice, device := seedDevice(t, store, "alice")
+		_, other := seedDevice(t, store, "bob")
+
+		devices, err := store.ListDevicesByUser(alice.ID)
+		if err != nil || len(devices) != 1 || devices[0].ID != device.ID {
+			t.Fatalf("ListDevicesByUser: got %+v, %v", devices, err)
+		}
+		if err := store.UpdateDeviceName(device.ID, "garage"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.GetDevice(device.ID); err != nil || got.Name != "garage" || got.UserID != alice.ID {
+			t.Errorf("GetDevice after rename: got %+v, %v", got, err)
+		}
+		if err := store.UpdateDeviceName(other.ID+100, "x"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("renaming a missing device: got %v, want ErrNotFound", err)
+		}
+
+		// MACs are only ever bound by redeeming a claim
+		if _, err := store.GetDeviceByMAC(""); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetDeviceByMAC of an unbound MAC: got %v, want ErrNotFound", err)
+		}
+		if err := store.CreateDeviceClaim(device.ID, "code", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.RedeemDeviceClaim("code", "AA:BB:CC:DD:EE:FF", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.GetDeviceByMAC("AA:BB:CC:DD:EE:FF"); err != nil || got.ID != device.ID {
+			t.Errorf("GetDeviceByMAC: got %+v, %v", got, err)
+		}
+
+		breaker := Breaker{DeviceID: device.ID, Name: "main", Breaker_Number: "1", Priority: 2}
+		if err := store.CreateBreaker(&breaker); err != nil {
+			t.Fatal(err)
+		}
+		if !breaker.Status {
+			t.Error("new breakers should start closed")
+		}
+		if err := store.SetBreakerStatus(breaker.ID, false); err != nil {
+			t.Fatal(err)
+		}
+		breakers, err := store.ListBreakersByDevice(device.ID)
+		if err != nil || len(breakers) != 1 || breakers[0].Status || breakers[0].Priority != 2 {
+			t.Fatalf("ListBreakersByDevice: got %+v, %v", breakers, err)
+		}
+
+		// Deleting the device takes its breakers with it
+		if err := store.DeleteDevice(device.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetBreaker(breaker.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetBreaker after device delete: got %v, want ErrNotFound", err)
+		}
+		if err := store.DeleteDevice(device.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("second DeleteDevice: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreFrequencyLogs(t *testing.T) {
+	testStores(t, func(t *testing.T, store Store) {
+		_, device := seedDevice(t, store, "alice")
+		_, other := seedDevice(t, store, "bob")
+
+		base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+		rocof := 0.25
+		// Inserted out of order; reads come back oldest first
+		for _, i := range []int{2, 0, 3, 1} {
+			entry := FrequencyLog{DeviceID: device.ID, Frequency: 60 + float64(i)/100, Timestamp: base.Add(time.Duration(i) * time.Minute)}
+			if i == 1 {
+				entry.Rocof = &rocof
+			}
+			if err := store.InsertFrequency(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.InsertFrequency(FrequencyLog{DeviceID: other.ID, Frequency: 59, Timestamp: base}); err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			r    FrequencyRange
+			want []int
+		}{
+			{FrequencyRange{}, []int{0, 1, 2, 3}},
+			{FrequencyRange{Start: base.Add(time.Minute)}, []int{1, 2, 3}},
+			{FrequencyRange{End: base.Add(2 * time.Minute)}, []int{0, 1, 2}},
+			{FrequencyRange{Start: base.Add(time.Minute), End: base.Add(2 * time.Minute)}, []int{1, 2}},
+			{FrequencyRange{Limit: 2}, []int{0, 1}},
+		}
+		for _, tc := range cases {
+			logs, err := store.ListFrequency(device.ID, tc.r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			for _, entry := range logs {
+				got = append(got, int(entry.Timestamp.Sub(base)/time.Minute))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("ListFrequency(%+v): got minutes %v, want %v", tc.r, got, tc.want)
+			}
+		}
+
+		logs, _ := store.ListFrequency(device.ID, FrequencyRange{Start: base.Add(time.Minute), Limit: 1})
+		if len(logs) != 1 || logs[0].Rocof == nil || *logs[0].Rocof != rocof || logs[0].Frequency != 60.01 {
+			t.Errorf("reading at +1m: got %+v", logs)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSummaryRange is how far back fetchFrequencySummary looks without ?start
+const defaultSummaryRange = 24 * time.Hour
+
+// deviceTarget names one of the caller's sites or groups instead of a single
+// device. It binds from ?site= / ?group= or from site_id / group_id in a body.
+type deviceTarget struct {
+	SiteID  *int `json:"site_id" form:"site"`
+	GroupID *int `json:"group_id" form:"group"`
+}
+
+func (t deviceTarget) empty() bool {
+	return t.SiteID == nil && t.GroupID == nil
+}
+
+// targetDevices resolves a site or group to the devices in it that the caller
+// holds at least role need on, with their role. Devices the caller has since
+// lost access to are left out. The location is the site's timezone, or UTC
+// for a group.
+func (s *Server) targetDevices(c *gin.Context, t deviceTarget, need string) ([]SharedDevice, *time.Location, bool) {
+	if (t.SiteID == nil) == (t.GroupID == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give either a site or a group"})
+		return nil, nil, false
+	}
+
+	var devices []Device
+	var err error
+	loc := time.UTC
+	if t.SiteID != nil {
+		auditTarget(c, "site", int64(*t.SiteID))
+		site, ok := s.ownSite(c, *t.SiteID)
+		if !ok {
+			return nil, nil, false
+		}
+		if loc, err = time.LoadLocation(site.Timezone); err != nil {
+			loc = time.UTC
+		}
+		devices, err = s.store.ListSiteDevices(site.ID)
+	} else {
+		auditTarget(c, "group", int64(*t.GroupID))
+		group, ok := s.ownDeviceGroup(c, *t.GroupID)
+		if !ok {
+			return nil, nil, false
+		}
+		devices, err = s.store.ListGroupDevices(group.ID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+		return nil, nil, false
+	}
+
+	userID := currentUserID(c)
+	targets := []SharedDevice{}
+	for _, device := range devices {
+		role, err := s.deviceRole(userID, device.ID)
+		if errors.Is(err, errForbidden) || errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+			return nil, nil, false
+		}
+		if roleRank[role] >= roleRank[need] {
+			targets = append(targets, SharedDevice{Device: device, Role: role})
+		}
+	}
+	return targets, loc, true
+}
+
+// bindTargetQuery reads ?site= and ?group=, writing a 400 on failure
+func bindTargetQuery(c *gin.Context) (deviceTarget, bool) {
+	var target deviceTarget
+	if err := c.ShouldBindQuery(&target); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid site or group"})
+		return target, false
+	}
+	return target, true
+}
+
+// fetchTargetDevices is fetchDevices narrowed to a site or group
+func (s *Server) fetchTargetDevices(c *gin.Context, target deviceTarget) {
+	shared, _, ok := s.targetDevices(c, target, RoleViewer)
+	if !ok {
+		return
+	}
+	devices := make([]Device, 0, len(shared))
+	for _, d := range shared {
+		devices = append(devices, d.Device)
+	}
+
+	statuses, err := s.devicePresence(devices)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+		return
+	}
+	for i := range statuses {
+		statuses[i].Role = shared[i].Role
+	}
+
+	c.JSON(http.StatusOK, statuses)
+}
+
+// frequencySummary folds frequency buckets into one count, min, max and avg
+type frequencySummary struct {
+	DeviceID int      `json:"device_id,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Count    int64    `json:"count"`
+	Min      *float64 `json:"min"`
+	Max      *float64 `json:"max"`
+	Avg      *float64 `json:"avg"`
+
+	sum float64
+}
+
+func (f *frequencySummary) add(count int64, min, max, sum float64) {
+	if count == 0 {
+		return
+	}
+	if f.Count == 0 || min < *f.Min {
+		f.Min = &min
+	}
+	if f.Count == 0 || max > *f.Max {
+		f.Max = &max
+	}
+	f.Count += count
+	f.sum += sum
+	avg := f.sum / float64(f.Count)
+	f.Avg = &avg
+}
+
+// fetchFrequencySummary reports the count, min, max and average frequency of
+// every device in ?site= or ?group= over ?start and ?end, and of all of them
+// together. The range defaults to the last day; ?tz= defaults to the site's
+// timezone and sets the bucket boundaries used underneath.
+func (s *Server) fetchFrequencySummary(c *gin.Context) {
+	target, ok := bindTargetQuery(c)
+	if !ok {
+		return
+	}
+	r, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	devices, loc, ok := s.targetDevices(c, target, RoleViewer)
+	if !ok {
+		return
+	}
+	if tz := c.Query("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tz"})
+			return
+		}
+	}
+
+	now := time.Now()
+	if r.End.IsZero() {
+		r.End = now
+	}
+	if r.Start.IsZero() {
+		r.Start = r.End.Add(-defaultSummaryRange)
+	}
+	name := s.autoBucket(r, loc, now)
+	var width time.Duration
+	for _, bucket := range frequencyBuckets {
+		if bucket.name == name {
+			width = bucket.width
+		}
+	}
+
+	overall := frequencySummary{}
+	summaries := make([]frequencySummary, 0, len(devices))
+	for _, device := range devices {
+		buckets, err := s.store.AggregateFrequency(device.ID, r, width, loc)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch data"})
+			return
+		}
+		summary := frequencySummary{DeviceID: device.ID, Name: device.Name}
+		for _, b := range buckets {
+			summary.add(b.Count, b.Min, b.Max, b.Avg*float64(b.Count))
+		}
+		if summary.Count > 0 {
+			overall.add(summary.Count, *summary.Min, *summary.Max, summary.sum)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"start":   r.Start.In(loc),
+		"end":     r.End.In(loc),
+		"bucket":  name,
+		"devices": summaries,
+		"overall": overall,
+	})
+}
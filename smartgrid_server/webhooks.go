@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// webhookPollInterval is how often the outbox is checked for due retries
+	webhookPollInterval = 5 * time.Second
+	// webhookBatch is how many deliveries are attempted at once
+	webhookBatch = 50
+	// maxWebhookDeliveryList caps fetchWebhookDeliveries
+	maxWebhookDeliveryList = 200
+	// webhookEventBuffer is how many published events may wait to be queued
+	webhookEventBuffer = 1024
+)
+
+// EventPing is sent by testWebhook and bypasses the event-type filter
+const EventPing = "ping"
+
+// webhookEventTypes are the events a webhook may subscribe to. Frequency
+// readings arrive every few seconds per device, so a webhook only gets them
+// when it asks for them by name.
+var webhookEventTypes = []string{EventFrequency, EventBreaker, EventPresence, EventExcursion, EventAlert, EventLoadShed, EventFirmware, EventConfig}
+
+// errWebhookAddress is returned when a receiver resolves to a non-public address
+var errWebhookAddress = errors.New("webhook address is not public")
+
+// cgnatPrefix is the carrier-grade NAT range, which netip does not count as private
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// Headers on every delivery. The signature is the hex HMAC-SHA256, keyed by
+// the webhook secret, of the timestamp, a ".", and the raw body.
+const (
+	headerWebhookEvent     = "X-Smartgrid-Event"
+	headerWebhookDelivery  = "X-Smartgrid-Delivery"
+	headerWebhookTimestamp = "X-Smartgrid-Timestamp"
+	headerWebhookSignature = "X-Smartgrid-Signature"
+)
+
+// webhookDispatcher delivers the outbox; wake nudges it when something is
+// queued. Published events wait in events so the device read path never
+// queries webhooks itself.
+type webhookDispatcher struct {
+	client       *http.Client
+	wake         chan struct{}
+	events       chan Event
+	allowPrivate bool
+}
+
+func newWebhookDispatcher(cfg Config) *webhookDispatcher {
+	d := &webhookDispatcher{
+		wake:         make(chan struct{}, 1),
+		events:       make(chan Event, webhookEventBuffer),
+		allowPrivate: cfg.WebhookAllowPrivate,
+	}
+	// The address is checked after the host resolves, on every connection, so
+	// a name cannot pass validation and later point somewhere internal. There
+	// is no proxy, since the check would then only see the proxy.
+	dialer := &net.Dialer{Timeout: cfg.WebhookTimeout, Control: d.checkAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client = &http.Client{
+		Timeout:   cfg.WebhookTimeout,
+		Transport: transport,
+		// A redirect is reported as the response it is rather than followed
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// checkAddress refuses connections to loopback, private, link-local (which
+// includes cloud metadata at 169.254.169.254) and other non-public addresses
+func (d *webhookDispatcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	if d.allowPrivate {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || cgnatPrefix.Contains(ip) {
+		return fmt.Errorf("%w: %s", errWebhookAddress, ip)
+	}
+	return nil
+}
+
+// newWebhookSecret returns a random signing secret
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// signWebhook returns the signature header value for body sent at timestamp
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// wants reports whether hook subscribes to eventType; no event types means
+// every type but frequency
+func (hook Webhook) wants(eventType string) bool {
+	if !hook.Enabled {
+		return false
+	}
+	if len(hook.EventTypes) == 0 {
+		return eventType != EventFrequency
+	}
+	return slices.Contains(hook.EventTypes, eventType)
+}
+
+// enqueueWebhookEvent hands e to queueWebhookEvents without waiting; when the
+// buffer is full the event is dropped for webhooks rather than stall the caller
+func (s *Server) enqueueWebhookEvent(e Event) {
+	select {
+	case s.webhooks.events <- e:
+	default:
+		log.Println("Webhook event buffer full, dropping", e.Type, "event")
+	}
+}
+
+// queueWebhookEvents writes published events to the outbox until ctx is cancelled
+func (s *Server) queueWebhookEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.webhooks.events:
+			s.queueWebhooks(e)
+		}
+	}
+}
+
+// queueWebhooks writes e to the outbox of each webhook of e's recipients that
+// subscribes to it
+func (s *Server) queueWebhooks(e Event) {
+	var payload []byte
+	for _, userID := range e.userIDs {
+		hooks, err := s.store.ListWebhooks(userID)
+		if err != nil {
+			log.Println("Failed to load webhooks:", err)
+			continue
+		}
+		for _, hook := range hooks {
+			if !hook.wants(e.Type) {
+				continue
+			}
+			if payload == nil {
+				if payload, err = json.Marshal(e); err != nil {
+					log.Println("Failed to encode webhook payload:", err)
+					return
+				}
+			}
+			s.queueWebhook(hook.ID, e.Type, payload)
+		}
+	}
+}
+
+// queueWebhook adds one delivery to the outbox and wakes the dispatcher
+func (s *Server) queueWebhook(webhookID int, eventType string, payload []byte) (WebhookDelivery, error) {
+	d := WebhookDelivery{WebhookID: webhookID, EventType: eventType, Payload: payload, Status: DeliveryPending, NextAttemptAt: time.Now()}
+	if err := s.store.EnqueueWebhookDelivery(&d); err != nil {
+		log.Println("Failed to queue webhook delivery:", err)
+		return d, err
+	}
+	select {
+	case s.webhooks.wake <- struct{}{}:
+	default:
+	}
+	return d, nil
+}
+
+// deliverWebhooks works through the outbox until ctx is cancelled
+func (s *Server) deliverWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.webhooks.wake:
+		}
+		for s.flushWebhooks(time.Now()) == webhookBatch {
+		}
+	}
+}
+
+// flushWebhooks attempts every delivery due by now and returns how many it tried
+func (s *Server) flushWebhooks(now time.Time) int {
+	// Claimed rows are leased past the longest attempt so that, if this process
+	// dies mid-delivery, they come due again rather than being lost
+	lease := now.Add(s.cfg.WebhookTimeout + time.Minute)
+	deliveries, err := s.store.ClaimWebhookDeliveries(now, lease, webhookBatch)
+	if err != nil {
+		log.Println("Failed to claim webhook deliveries:", err)
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d = s.attemptWebhook(d, now)
+			if err := s.store.RecordWebhookAttempt(d); err != nil {
+				log.Println("Failed to record webhook attempt:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+// attemptWebhook posts d once and returns it updated with the outcome
+func (s *Server) attemptWebhook(d WebhookDelivery, now time.Time) WebhookDelivery {
+	d.Attempts++
+	d.LastAttemptAt = &now
+	d.ResponseStatus = nil
+
+	hook, err := s.store.GetWebhook(d.WebhookID)
+	switch {
+	case err != nil:
+		d.LastError = "Failed to load webhook: " + err.Error()
+	case !hook.Enabled:
+		// Nothing more will be sent to a disabled webhook
+		d.Status, d.LastError = DeliveryFailed, "Webhook disabled"
+		return d
+	default:
+		d.LastError = s.postWebhook(hook, &d, now)
+	}
+
+	switch {
+	case d.LastError == "":
+		d.Status, d.DeliveredAt = DeliveryDelivered, &now
+	case d.Attempts >= s.cfg.WebhookMaxAttempts:
+		d.Status = DeliveryFailed
+	default:
+		d.NextAttemptAt = now.Add(s.webhookBackoff(d.Attempts))
+	}
+	return d
+}
+
+// postWebhook sends the signed payload, returning "" on a 2xx response and a
+// description of the failure otherwise. Only the status of a failed response
+// is kept, never its body.
+func (s *Server) postWebhook(hook Webhook, d *WebhookDelivery, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "smartgrid-webhooks/1")
+	req.Header.Set(headerWebhookEvent, d.EventType)
+	req.Header.Set(headerWebhookDelivery, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(headerWebhookTimestamp, timestamp)
+	req.Header.Set(headerWebhookSignature, signWebhook(hook.Secret, timestamp, d.Payload))
+
+	resp, err := s.webhooks.client.Do(req)
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+
+	d.ResponseStatus = &resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Sprintf("HTTP %d", resp.StatusCode)
+	}
+	return ""
+}
+
+// webhookBackoff is the wait after the given number of failed attempts
+func (s *Server) webhookBackoff(attempts int) time.Duration {
+	wait := s.cfg.WebhookRetryBase
+	for i := 1; i < attempts && wait < s.cfg.WebhookRetryMax; i++ {
+		wait *= 2
+	}
+	return min(wait, s.cfg.WebhookRetryMax)
+}
+
+// webhookInput is the body of createWebhook and updateWebhook
+type webhookInput struct {
+	URL        string   `json:"url" binding:"required"`
+	EventTypes []string `json:"event_types"`
+	Enabled    *bool    `json:"enabled"`
+}
+
+// bindWebhook validates the request body into hook
+func bindWebhook(c *gin.Context, hook *Webhook) bool {
+	var input webhookInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return false
+	}
+
+	u, err := url.Parse(input.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL"})
+		return false
+	}
+	for _, eventType := range input.EventTypes {
+		if !slices.Contains(webhookEventTypes, eventType) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event type " + strconv.Quote(eventType)})
+			return false
+		}
+	}
+
+	hook.URL = input.URL
+	hook.EventTypes = input.EventTypes
+	if hook.EventTypes == nil {
+		hook.EventTypes = []string{}
+	}
+	hook.Enabled = input.Enabled == nil || *input.Enabled
+	return true
+}
+
+// loadWebhook resolves :id to one of the caller's webhooks
+func (s *Server) loadWebhook(c *gin.Context) (Webhook, bool) {
+	id, ok := paramID(c, "id", "webhook")
+	if !ok {
+		return Webhook{}, false
+	}
+	auditTarget(c, "webhook", int64(id))
+	hook, err := s.store.GetWebhook(id)
+	if err := checkOwner(c, hook.UserID, err); err != nil {
+		abortAuthz(c, err, "Webhook")
+		return Webhook{}, false
+	}
+	return hook, true
+}
+
+// createWebhook registers a webhook; its signing secret is only shown here
+func (s *Server) createWebhook(c *gin.Context) {
+	hook := Webhook{UserID: currentUserID(c)}
+	if !bindWebhook(c, &hook) {
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create webhook"})
+		return
+	}
+	hook.Secret = secret
+	if err := s.store.CreateWebhook(&hook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create webhook"})
+		return
+	}
+	auditTarget(c, "webhook", int64(hook.ID))
+	auditChange(c, nil, hook)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook created successfully", "webhookID": hook.ID, "secret": secret})
+}
+
+func (s *Server) fetchWebhooks(c *gin.Context) {
+	hooks, err := s.store.ListWebhooks(currentUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		return
+	}
+	if hooks == nil {
+		hooks = []Webhook{}
+	}
+
+	c.JSON(http.StatusOK, hooks)
+}
+
+func (s *Server) readWebhook(c *gin.Context) {
+	hook, ok := s.loadWebhook(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, hook)
+}
+
+func (s *Server) updateWebhook(c *gin.Context) {
+	hook, ok := s.loadWebhook(c)
+	before := hook
+	if !ok || !bindWebhook(c, &hook) {
+		return
+	}
+
+	if err := s.store.UpdateWebhook(hook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update webhook"})
+		return
+	}
+	auditChange(c, before, hook)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook updated successfully"})
+}
+
+func (s *Server) deleteWebhook(c *gin.Context) {
+	hook, ok := s.loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteWebhook(hook.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete webhook"})
+		return
+	}
+	auditChange(c, hook, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// testWebhook queues a ping so a receiver can be checked end to end
+func (s *Server) testWebhook(c *gin.Context) {
+	hook, ok := s.loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	payload, _ := json.Marshal(Event{Type: EventPing, Time: time.Now(), Data: gin.H{"webhook_id": hook.ID}})
+	d, err := s.queueWebhook(hook.ID, EventPing, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not queue test delivery"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Test delivery queued", "deliveryId": d.ID})
+}
+
+// fetchWebhookDeliveries is a webhook's delivery log, newest first
+func (s *Server) fetchWebhookDeliveries(c *gin.Context) {
+	hook, ok := s.loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+	limit := maxWebhookDeliveryList
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxWebhookDeliveryList)
+	}
+
+	deliveries, err := s.store.ListWebhookDeliveries(hook.ID, status, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook deliveries"})
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// redeliverWebhookDelivery queues a fresh copy of a past delivery, e.g. one
+// that ran out of retries; the original stays in the log
+func (s *Server) redeliverWebhookDelivery(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return
+	}
+
+	auditTarget(c, "webhook_delivery", id)
+	d, err := s.store.GetWebhookDelivery(id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch delivery"})
+		return
+	}
+	hook, err := s.store.GetWebhook(d.WebhookID)
+	if err := checkOwner(c, hook.UserID, err); err != nil {
+		abortAuthz(c, err, "Webhook")
+		return
+	}
+
+	copied, err := s.queueWebhook(hook.ID, d.EventType, d.Payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not queue delivery"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Delivery queued", "deliveryId": copied.ID})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records deliveries, failing the first fail of them
+type webhookReceiver struct {
+	mu       sync.Mutex
+	fail     int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	if len(r.requests) <= r.fail {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	}
+}
+
+// queuePublished writes the events published so far to the outbox, as
+// queueWebhookEvents would
+func queuePublished(s *Server) {
+	for len(s.webhooks.events) > 0 {
+		s.queueWebhooks(<-s.webhooks.events)
+	}
+}
+
+// createTestWebhook registers url for bob and returns the webhook and its
+// secret; the receivers in these tests listen on loopback
+func createTestWebhook(t *testing.T, f *fixture, url, eventTypes string) (Webhook, string) {
+	t.Helper()
+	f.server.webhooks.allowPrivate = true
+	body := fmt.Sprintf(`{"url":%q,"event_types":%s}`, url, eventTypes)
+	w := f.do(t, f.users[1].ID, "POST", "/createWebhook", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("createWebhook: got %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		WebhookID int    `json:"webhookID"`
+		Secret    string `json:"secret"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	hook, err := f.server.store.GetWebhook(created.WebhookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook, created.Secret
+}
+
+func TestWebhookDeliveryRetriesAndSigns(t *testing.T) {
+	receiver := &webhookReceiver{fail: 1}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newFixture(t)
+	f.server.cfg.WebhookRetryBase = time.Minute
+	hook, secret := createTestWebhook(t, f, ts.URL, `["breaker"]`)
+
+	// Only the subscribed event type reaches the outbox
+	f.server.publish(EventFrequency, f.devices[1], map[string]float64{"frequency": 60})
+	f.server.publish(EventBreaker, f.devices[1], map[string]any{"breaker_id": f.breaker[1].ID, "status": true})
+	queuePublished(f.server)
+
+	now := time.Now()
+	if n := f.server.flushWebhooks(now); n != 1 {
+		t.Fatalf("first flush attempted %d deliveries, want 1", n)
+	}
+	deliveries, _ := f.server.store.ListWebhookDeliveries(hook.ID, "", 10)
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	d := deliveries[0]
+	if d.Status != DeliveryPending || d.Attempts != 1 || d.ResponseStatus == nil || *d.ResponseStatus != http.StatusServiceUnavailable {
+		t.Fatalf("after a failed attempt got %+v", d)
+	}
+	// The receiver's body is not kept
+	if d.LastError != "HTTP 503" {
+		t.Fatalf("last error %q, want only the status", d.LastError)
+	}
+	if want := now.Add(time.Minute); !d.NextAttemptAt.Equal(want) {
+		t.Fatalf("next attempt at %v, want %v", d.NextAttemptAt, want)
+	}
+
+	// Not due again until the backoff has passed
+	if n := f.server.flushWebhooks(now.Add(59 * time.Second)); n != 0 {
+		t.Fatalf("retried %d deliveries before backoff elapsed", n)
+	}
+	if n := f.server.flushWebhooks(now.Add(time.Minute)); n != 1 {
+		t.Fatalf("retry attempted %d deliveries, want 1", n)
+	}
+	if d, _ = f.server.store.GetWebhookDelivery(d.ID); d.Status != DeliveryDelivered || d.Attempts != 2 {
+		t.Fatalf("after a successful retry got %+v", d)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.requests) != 2 {
+		t.Fatalf("receiver saw %d requests, want 2", len(receiver.requests))
+	}
+	req, body := receiver.requests[1], receiver.bodies[1]
+	if got := req.Header.Get(headerWebhookEvent); got != EventBreaker {
+		t.Fatalf("event header %q, want %q", got, EventBreaker)
+	}
+	if got, want := req.Header.Get(headerWebhookSignature), signWebhook(secret, req.Header.Get(headerWebhookTimestamp), body); got != want {
+		t.Fatalf("signature %q, want %q", got, want)
+	}
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil || e.Type != EventBreaker || e.DeviceID != f.devices[1].ID {
+		t.Fatalf("unexpected payload %s (%v)", body, err)
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	receiver := &webhookReceiver{fail: 100}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newFixture(t)
+	f.server.cfg.WebhookMaxAttempts = 2
+	hook, _ := createTestWebhook(t, f, ts.URL, `[]`)
+
+	if w := f.do(t, f.users[1].ID, "POST", fmt.Sprintf("/testWebhook/%d", hook.ID), ""); w.Code != http.StatusAccepted {
+		t.Fatalf("testWebhook: got %d: %s", w.Code, w.Body)
+	}
+	now := time.Now()
+	f.server.flushWebhooks(now)
+	f.server.flushWebhooks(now.Add(f.server.cfg.WebhookRetryMax))
+
+	deliveries, _ := f.server.store.ListWebhookDeliveries(hook.ID, "", 10)
+	if len(deliveries) != 1 || deliveries[0].Status != DeliveryFailed || deliveries[0].Attempts != 2 {
+		t.Fatalf("got %+v, want one failed delivery after 2 attempts", deliveries)
+	}
+	if n := f.server.flushWebhooks(now.Add(24 * time.Hour)); n != 0 {
+		t.Fatalf("failed delivery was retried %d times", n)
+	}
+}
+
+func TestWebhookDefaultEventsLeaveOutFrequency(t *testing.T) {
+	f := newFixture(t)
+	hook, _ := createTestWebhook(t, f, "https://hooks.example.com/grid", `[]`)
+
+	f.server.publish(EventFrequency, f.devices[1], map[string]float64{"frequency": 60})
+	f.server.publish(EventPresence, f.devices[1], map[string]bool{"online": true})
+	queuePublished(f.server)
+
+	deliveries, _ := f.server.store.ListWebhookDeliveries(hook.ID, "", 10)
+	if len(deliveries) != 1 || deliveries[0].EventType != EventPresence {
+		t.Fatalf("got %+v, want only the presence event", deliveries)
+	}
+}
+
+func TestWebhookRefusesPrivateAddressesAndRedirects(t *testing.T) {
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(ts.URL, http.StatusFound))
+	defer redirect.Close()
+
+	f := newFixture(t)
+	local, _ := createTestWebhook(t, f, ts.URL, `[]`)
+	moved, _ := createTestWebhook(t, f, redirect.URL, `[]`)
+
+	// The redirect is reported, not followed
+	f.server.queueWebhook(moved.ID, EventPing, []byte(`{}`))
+	f.server.flushWebhooks(time.Now())
+	deliveries, _ := f.server.store.ListWebhookDeliveries(moved.ID, "", 10)
+	if len(deliveries) != 1 || deliveries[0].ResponseStatus == nil || *deliveries[0].ResponseStatus != http.StatusFound {
+		t.Fatalf("got %+v, want the 302 recorded", deliveries)
+	}
+
+	// Without the private-address override nothing reaches loopback
+	f.server.webhooks.allowPrivate = false
+	f.server.queueWebhook(local.ID, EventPing, []byte(`{}`))
+	f.server.flushWebhooks(time.Now())
+	deliveries, _ = f.server.store.ListWebhookDeliveries(local.ID, "", 10)
+	if len(deliveries) != 1 || deliveries[0].ResponseStatus != nil || !strings.Contains(deliveries[0].LastError, errWebhookAddress.Error()) {
+		t.Fatalf("got %+v, want the loopback address refused", deliveries)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.requests) != 0 {
+		t.Fatalf("receiver saw %d requests", len(receiver.requests))
+	}
+
+	for _, addr := range []string{"169.254.169.254:80", "10.0.0.1:443", "[::1]:80", "100.64.0.1:80", "0.0.0.0:80"} {
+		if err := f.server.webhooks.checkAddress("tcp", addr, nil); !errors.Is(err, errWebhookAddress) {
+			t.Errorf("%s: got %v, want it refused", addr, err)
+		}
+	}
+	if err := f.server.webhooks.checkAddress("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("public address refused: %v", err)
+	}
+}